@@ -0,0 +1,3 @@
+module inventory-microservices/pkg/httpx
+
+go 1.25.6
@@ -0,0 +1,95 @@
+// Package httpx holds HTTP middleware shared by the services.
+package httpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Counter is the part of a prometheus.Counter Recover uses, so this
+// package doesn't need the Prometheus client.
+type Counter interface {
+	Inc()
+}
+
+// RecoverOptions configures Recover.
+type RecoverOptions struct {
+	// RequestIDHeader names the response header a middleware further in
+	// sets to the request id. The id is logged with the panic, and the
+	// header is kept on the 500 and echoed in its body. Empty skips both.
+	RequestIDHeader string
+	// Panics, if set, counts the panics recovered.
+	Panics Counter
+}
+
+// recoverWriter notes whether the response has started, after which a
+// 500 can no longer be sent.
+type recoverWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *recoverWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoverWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Recover returns middleware that turns a panic in the handlers and
+// middleware inside it into a 500 JSON error, logging the stack with the
+// request id and counting it in opts.Panics. If the response had already
+// started, the connection is aborted instead, so the client doesn't take
+// a truncated response for a whole one. http.ErrAbortHandler, which
+// handlers panic with to abort a response on purpose, is passed on as is.
+func Recover(opts RecoverOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := &recoverWriter{ResponseWriter: w}
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				if opts.Panics != nil {
+					opts.Panics.Inc()
+				}
+				var id string
+				if opts.RequestIDHeader != "" {
+					id = w.Header().Get(opts.RequestIDHeader)
+				}
+				slog.Error("panic serving request", "request_id", id, "method", r.Method, "path", r.URL.Path,
+					"panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+				if rw.started {
+					panic(http.ErrAbortHandler)
+				}
+				// Drop whatever the failed handler meant to send.
+				for name := range w.Header() {
+					delete(w.Header(), name)
+				}
+				body := map[string]string{"error": "Internal Server Error"}
+				if id != "" {
+					w.Header().Set(opts.RequestIDHeader, id)
+					body["request_id"] = id
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(body)
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package httpx
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type countPanics int
+
+func (c *countPanics) Inc() { *c++ }
+
+func TestRecoverTurnsPanicsInto500s(t *testing.T) {
+	var panics countPanics
+	h := Recover(RecoverOptions{RequestIDHeader: "X-Request-ID", Panics: &panics})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "abc")
+		w.Header().Set("Content-Type", "text/csv")
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d content type %q, want a 500 JSON error", w.Code, w.Header().Get("Content-Type"))
+	}
+	var got map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %q isn't JSON: %v", w.Body.String(), err)
+	}
+	if got["error"] != "Internal Server Error" || got["request_id"] != "abc" || w.Header().Get("X-Request-ID") != "abc" {
+		t.Errorf("body %q header %q, want the error and the request id", w.Body.String(), w.Header().Get("X-Request-ID"))
+	}
+	if panics != 1 {
+		t.Errorf("counted %d panics, want 1", panics)
+	}
+}
+
+func TestRecoverAbortsStartedResponses(t *testing.T) {
+	var panics countPanics
+	srv := httptest.NewServer(Recover(RecoverOptions{Panics: &panics})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		panic("halfway")
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("a response that panicked part way read as whole")
+	}
+	if panics != 1 {
+		t.Errorf("counted %d panics, want 1", panics)
+	}
+}
+
+func TestRecoverPassesOnAbortHandler(t *testing.T) {
+	var panics countPanics
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", p)
+		}
+		if panics != 0 {
+			t.Errorf("counted %d panics, want none", panics)
+		}
+	}()
+	Recover(RecoverOptions{Panics: &panics})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
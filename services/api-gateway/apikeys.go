@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// apiKeyHeader carries partner keys. It isn't X-API-Key, which is
+	// inventory-service's own credential and is proxied untouched.
+	apiKeyHeader = "X-Partner-Key"
+	// apiKeyIDHeader tells upstreams which partner key a request used,
+	// and apiKeyScopesHeader what it was granted.
+	apiKeyIDHeader     = "X-API-Key-ID"
+	apiKeyScopesHeader = "X-API-Key-Scopes"
+)
+
+var apiKeyRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_api_key_requests_total",
+		Help: "Requests made with an API key, by key id and outcome",
+	},
+	[]string{"key_id", "outcome"},
+)
+
+// apiKeyConfig is one partner key as configured in API_KEYS. The key
+// itself may be given as its SHA-256 instead, so the plaintext needn't
+// be in the gateway's environment. A zero quota means unlimited. Scopes,
+// as in "write", are checked by access policies.
+type apiKeyConfig struct {
+	ID        string   `json:"id"`
+	Key       string   `json:"key"`
+	KeySHA256 string   `json:"key_sha256"`
+	Routes    []string `json:"routes"`
+	Scopes    []string `json:"scopes"`
+	PerMinute int      `json:"per_minute"`
+	PerDay    int      `json:"per_day"`
+}
+
+// apiKey is a partner key with the routes it may call and its usage in
+// the current minute and day.
+type apiKey struct {
+	id        string
+	routes    []pathRule
+	scopes    string
+	perMinute int
+	perDay    int
+
+	mu          sync.Mutex
+	minute, day time.Time
+	minuteUsed  int
+	dayUsed     int
+}
+
+// apiKeyStore holds partner keys by the SHA-256 of the key. Quotas are
+// counted by each gateway replica separately.
+type apiKeyStore struct {
+	keys map[string]*apiKey
+}
+
+// loadAPIKeys reads partner keys as a JSON array from API_KEYS, or from
+// the file named by API_KEYS_FILE. It returns nil if neither is set.
+func loadAPIKeys() (*apiKeyStore, error) {
+	raw := getEnv("API_KEYS", "")
+	if path := getEnv("API_KEYS_FILE", ""); path != "" {
+		if raw != "" {
+			return nil, errors.New("set only one of API_KEYS and API_KEYS_FILE")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(data)
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	var configs []apiKeyConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		return nil, fmt.Errorf("API keys must be a JSON array: %w", err)
+	}
+	return newAPIKeyStore(configs)
+}
+
+func newAPIKeyStore(configs []apiKeyConfig) (*apiKeyStore, error) {
+	store := &apiKeyStore{keys: map[string]*apiKey{}}
+	ids := map[string]bool{}
+	for _, c := range configs {
+		if c.ID == "" || ids[c.ID] {
+			return nil, fmt.Errorf("API key id %q is empty or repeated", c.ID)
+		}
+		ids[c.ID] = true
+
+		hash := c.KeySHA256
+		if (c.Key == "") == (hash == "") {
+			return nil, fmt.Errorf("API key %q: set exactly one of key and key_sha256", c.ID)
+		}
+		if c.Key != "" {
+			hash = hashAPIKey(c.Key)
+		} else if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("API key %q: key_sha256 must be a hex SHA-256", c.ID)
+		}
+		if c.PerMinute < 0 || c.PerDay < 0 {
+			return nil, fmt.Errorf("API key %q: quotas must not be negative", c.ID)
+		}
+		if len(c.Routes) == 0 {
+			return nil, fmt.Errorf("API key %q: no routes allowed", c.ID)
+		}
+
+		for _, scope := range c.Scopes {
+			if scope == "" || strings.ContainsAny(scope, ", ") {
+				return nil, fmt.Errorf("API key %q: scope %q must be one word", c.ID, scope)
+			}
+		}
+
+		key := &apiKey{id: c.ID, scopes: strings.Join(c.Scopes, ","), perMinute: c.PerMinute, perDay: c.PerDay}
+		for _, route := range c.Routes {
+			rules, err := parsePathRules(route)
+			if err != nil || len(rules) != 1 {
+				return nil, fmt.Errorf("API key %q: route %q must be [METHOD ]/prefix", c.ID, route)
+			}
+			key.routes = append(key.routes, rules[0])
+		}
+		store.keys[strings.ToLower(hash)] = key
+	}
+	return store, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// quotaWindow is how much of a quota is left and when it resets.
+type quotaWindow struct {
+	limit, remaining int
+	reset            time.Time
+}
+
+// take counts a request against k's quotas. If either is used up, it
+// returns false and the window that is. Otherwise it returns the window
+// with the least left, or nil if k is unlimited.
+func (k *apiKey) take(now time.Time) (bool, *quotaWindow) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	minute, day := now.Truncate(time.Minute), now.UTC().Truncate(24*time.Hour)
+	if !minute.Equal(k.minute) {
+		k.minute, k.minuteUsed = minute, 0
+	}
+	if !day.Equal(k.day) {
+		k.day, k.dayUsed = day, 0
+	}
+
+	var windows []quotaWindow
+	if k.perMinute > 0 {
+		windows = append(windows, quotaWindow{k.perMinute, k.perMinute - k.minuteUsed, minute.Add(time.Minute)})
+	}
+	if k.perDay > 0 {
+		windows = append(windows, quotaWindow{k.perDay, k.perDay - k.dayUsed, day.Add(24 * time.Hour)})
+	}
+	var tightest *quotaWindow
+	for i := range windows {
+		w := &windows[i]
+		if w.remaining <= 0 {
+			return false, w
+		}
+		if tightest == nil || w.remaining < tightest.remaining {
+			tightest = w
+		}
+	}
+
+	k.minuteUsed++
+	k.dayUsed++
+	if tightest != nil {
+		tightest.remaining--
+	}
+	return true, tightest
+}
+
+// serve lets a request with an X-Partner-Key through if the key is known,
+// may call the route and has quota left, forwarding the key's id in
+// X-API-Key-ID rather than the key itself, and its scopes in
+// X-API-Key-Scopes.
+func (s *apiKeyStore) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key, ok := s.keys[hashAPIKey(r.Header.Get(apiKeyHeader))]
+	if !ok {
+		apiKeyRequests.WithLabelValues("unknown", "unauthorized").Inc()
+		writeError(w, http.StatusUnauthorized, "Invalid API key")
+		return
+	}
+
+	allowed := false
+	for _, rule := range key.routes {
+		if rule.matches(r) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		apiKeyRequests.WithLabelValues(key.id, "forbidden").Inc()
+		writeError(w, http.StatusForbidden, "API key may not call this route")
+		return
+	}
+
+	now := time.Now()
+	ok, window := key.take(now)
+	if window != nil {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(window.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(window.remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(window.reset.Unix(), 10))
+	}
+	if !ok {
+		apiKeyRequests.WithLabelValues(key.id, "quota_exceeded").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(window.reset.Sub(now).Seconds())+1))
+		log.Printf("API key %s exhausted its quota of %d", key.id, window.limit)
+		writeError(w, http.StatusTooManyRequests, "API key quota exceeded")
+		return
+	}
+	apiKeyRequests.WithLabelValues(key.id, "allowed").Inc()
+
+	r.Header.Del(apiKeyHeader)
+	r.Header.Set(apiKeyIDHeader, key.id)
+	if key.scopes != "" {
+		r.Header.Set(apiKeyScopesHeader, key.scopes)
+	}
+	next.ServeHTTP(w, r)
+}
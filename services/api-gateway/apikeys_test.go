@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testAPIKeys(t *testing.T, configs ...apiKeyConfig) *apiKeyStore {
+	t.Helper()
+	store, err := newAPIKeyStore(configs)
+	if err != nil {
+		t.Fatalf("newAPIKeyStore: %s", err)
+	}
+	return store
+}
+
+func serveAPIKey(keys *apiKeyStore, next http.Handler, method, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(apiKeyHeader, key)
+	req.Header.Set(apiKeyIDHeader, "spoofed")
+	rec := httptest.NewRecorder()
+	authMiddleware(&authenticator{secret: testSecret}, keys)(next).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIKeyScopesAndForwardsID(t *testing.T) {
+	keys := testAPIKeys(t,
+		apiKeyConfig{ID: "acme", Key: "acme-secret", Routes: []string{"GET /api/products", "/api/orders"}},
+		apiKeyConfig{ID: "globex", KeySHA256: strings.ToUpper(hashAPIKey("globex-secret")), Routes: []string{"/api/payments"}},
+	)
+	var got http.Header
+
+	rec := serveAPIKey(keys, identityEcho(&got), http.MethodGet, "/api/products/1", "acme-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("in scope: status %d, want 200", rec.Code)
+	}
+	if got.Get(apiKeyIDHeader) != "acme" || got.Get(apiKeyHeader) != "" {
+		t.Errorf("forwarded %s=%q %s=%q, want the id and not the key",
+			apiKeyIDHeader, got.Get(apiKeyIDHeader), apiKeyHeader, got.Get(apiKeyHeader))
+	}
+	if rec := serveAPIKey(keys, identityEcho(&got), http.MethodGet, "/api/payments/1", "globex-secret"); rec.Code != http.StatusOK {
+		t.Errorf("hashed key: status %d, want 200", rec.Code)
+	}
+
+	before := testutil.ToFloat64(apiKeyRequests.WithLabelValues("acme", "forbidden"))
+	got = nil
+	if rec := serveAPIKey(keys, identityEcho(&got), http.MethodPost, "/api/products", "acme-secret"); rec.Code != http.StatusForbidden {
+		t.Errorf("out of scope: status %d, want 403", rec.Code)
+	}
+	if got != nil {
+		t.Error("out of scope request reached the upstream")
+	}
+	if n := testutil.ToFloat64(apiKeyRequests.WithLabelValues("acme", "forbidden")) - before; n != 1 {
+		t.Errorf("forbidden count rose by %v, want 1", n)
+	}
+
+	if rec := serveAPIKey(keys, identityEcho(&got), http.MethodGet, "/api/products", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key: status %d, want 401", rec.Code)
+	}
+}
+
+func TestAPIKeyLeavesInventoryKeyAlone(t *testing.T) {
+	keys := testAPIKeys(t, apiKeyConfig{ID: "acme", Key: "acme-secret", Routes: []string{"/api"}})
+	var got http.Header
+
+	req := httptest.NewRequest(http.MethodPost, "/api/products", nil)
+	req.Header.Set("X-API-Key", "inventory-key")
+	rec := httptest.NewRecorder()
+	authMiddleware(nil, keys)(identityEcho(&got)).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || got.Get("X-API-Key") != "inventory-key" {
+		t.Errorf("status %d, forwarded X-API-Key %q: want inventory's key proxied untouched", rec.Code, got.Get("X-API-Key"))
+	}
+}
+
+func TestAPIKeyQuota(t *testing.T) {
+	keys := testAPIKeys(t, apiKeyConfig{ID: "acme", Key: "acme-secret", Routes: []string{"/api"}, PerMinute: 2, PerDay: 100})
+	var got http.Header
+
+	for want := 1; want >= 0; want-- {
+		rec := serveAPIKey(keys, identityEcho(&got), http.MethodGet, "/api/orders", "acme-secret")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", rec.Code)
+		}
+		if r := rec.Header().Get("X-RateLimit-Remaining"); r != strconv.Itoa(want) {
+			t.Errorf("X-RateLimit-Remaining = %q, want %d", r, want)
+		}
+	}
+	rec := serveAPIKey(keys, identityEcho(&got), http.MethodGet, "/api/orders", "acme-secret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota: status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("X-RateLimit-Remaining") != "0" || rec.Header().Get("X-RateLimit-Limit") != "2" || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("over quota headers = %v", rec.Header())
+	}
+
+	// The minute's count resets, the day's carries on.
+	key := keys.keys[hashAPIKey("acme-secret")]
+	ok, window := key.take(time.Now().Add(time.Minute))
+	if !ok || window.limit != 2 || window.remaining != 1 {
+		t.Errorf("next minute: take = %t, %+v; want the minute window with 1 left", ok, window)
+	}
+	if key.dayUsed != 3 {
+		t.Errorf("day usage = %d, want 3", key.dayUsed)
+	}
+}
+
+func TestAPIKeyConfigRejectsMalformed(t *testing.T) {
+	tests := map[string][]apiKeyConfig{
+		"no id":        {{Key: "k", Routes: []string{"/api"}}},
+		"repeated id":  {{ID: "a", Key: "k1", Routes: []string{"/api"}}, {ID: "a", Key: "k2", Routes: []string{"/api"}}},
+		"no key":       {{ID: "a", Routes: []string{"/api"}}},
+		"both keys":    {{ID: "a", Key: "k", KeySHA256: hashAPIKey("k"), Routes: []string{"/api"}}},
+		"bad hash":     {{ID: "a", KeySHA256: "abc", Routes: []string{"/api"}}},
+		"no routes":    {{ID: "a", Key: "k"}},
+		"bad route":    {{ID: "a", Key: "k", Routes: []string{"api"}}},
+		"negative cap": {{ID: "a", Key: "k", Routes: []string{"/api"}, PerDay: -1}},
+	}
+	for name, configs := range tests {
+		if _, err := newAPIKeyStore(configs); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestAPIKeyBypassesTokenOnlyWhenPresent(t *testing.T) {
+	keys := testAPIKeys(t, apiKeyConfig{ID: "acme", Key: "acme-secret", Routes: []string{"/api"}})
+	var got http.Header
+	req := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+	req.Header.Set(apiKeyIDHeader, "acme")
+	rec := httptest.NewRecorder()
+	authMiddleware(&authenticator{secret: testSecret}, keys)(identityEcho(&got)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("spoofed %s without a key: status %d, want 401", apiKeyIDHeader, rec.Code)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Headers the gateway sets from a validated token. Upstreams may trust
+// them because the gateway always drops client-supplied copies.
+const (
+	userIDHeader    = "X-User-ID"
+	userRolesHeader = "X-User-Roles"
+)
+
+var authRejected = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_auth_rejected_total",
+		Help: "Requests rejected with 401 for a missing or invalid token, by reason",
+	},
+	[]string{"reason"},
+)
+
+// authenticator validates Bearer JWTs, signed either with an HS256
+// secret or with a key from a JWKS endpoint.
+type authenticator struct {
+	secret    []byte
+	jwks      *jwksCache
+	issuer    string
+	audience  string
+	allowlist []pathRule
+}
+
+// pathRule matches requests whose path is Prefix or below it and, if
+// Method is set, that use it. A rule for /api/orders also matches every
+// version of it, such as /api/v1/orders, but not /api/orders-internal.
+type pathRule struct {
+	Method string
+	Prefix string
+}
+
+func (p pathRule) matches(r *http.Request) bool {
+	if p.Method != "" && p.Method != r.Method {
+		return false
+	}
+	_, unversionedPath := splitVersion(r.URL.Path)
+	return underPath(r.URL.Path, p.Prefix) || underPath(unversionedPath, p.Prefix)
+}
+
+// underPath reports whether path is prefix or a path below it, matching
+// whole segments only.
+func underPath(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// loadAuthenticator configures token validation from JWT_SECRET or
+// JWKS_URL. It returns nil if neither is set.
+func loadAuthenticator() (*authenticator, error) {
+	secret, jwksURL := getEnv("JWT_SECRET", ""), getEnv("JWKS_URL", "")
+	if secret == "" && jwksURL == "" {
+		return nil, nil
+	}
+	if secret != "" && jwksURL != "" {
+		return nil, errors.New("set only one of JWT_SECRET and JWKS_URL")
+	}
+	allowlist, err := parsePathRules(getEnv("AUTH_ALLOWLIST", "/health,/readyz,/metrics,GET /api/docs"))
+	if err != nil {
+		return nil, fmt.Errorf("AUTH_ALLOWLIST: %w", err)
+	}
+	a := &authenticator{
+		issuer:    getEnv("JWT_ISSUER", ""),
+		audience:  getEnv("JWT_AUDIENCE", ""),
+		allowlist: allowlist,
+	}
+	if secret != "" {
+		a.secret = []byte(secret)
+	} else {
+		a.jwks = newJWKSCache(jwksURL, loadDuration("JWKS_REFRESH_INTERVAL", time.Hour))
+	}
+	return a, nil
+}
+
+// parsePathRules parses a comma-separated list of "[METHOD ]/prefix"
+// entries, as in "/health,GET /api/products".
+func parsePathRules(raw string) ([]pathRule, error) {
+	var rules []pathRule
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rule := pathRule{Prefix: entry}
+		if method, prefix, ok := strings.Cut(entry, " "); ok {
+			rule.Method, rule.Prefix = strings.ToUpper(method), strings.TrimSpace(prefix)
+		}
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return nil, fmt.Errorf("entry %q: prefix must start with /", entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// gatewayClaims are the claims read from a token: the user id is the
+// subject and roles a list of strings.
+type gatewayClaims struct {
+	Roles []string `json:"roles"`
+	jwt.RegisteredClaims
+}
+
+// authenticate validates r's Bearer token.
+func (a *authenticator) authenticate(r *http.Request) (*gatewayClaims, string, error) {
+	scheme, raw, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(raw) == "" {
+		return nil, "missing", errors.New("missing bearer token")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+	var keyFunc jwt.Keyfunc
+	if a.secret != nil {
+		opts = append(opts, jwt.WithValidMethods([]string{"HS256"}))
+		keyFunc = func(*jwt.Token) (interface{}, error) { return a.secret, nil }
+	} else {
+		opts = append(opts, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}))
+		keyFunc = func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return a.jwks.key(r.Context(), kid)
+		}
+	}
+
+	var claims gatewayClaims
+	if _, err := jwt.ParseWithClaims(strings.TrimSpace(raw), &claims, keyFunc, opts...); err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, "expired", err
+		}
+		return nil, "invalid", err
+	}
+	if claims.Subject == "" {
+		return nil, "invalid", errors.New("token has no subject")
+	}
+	return &claims, "", nil
+}
+
+// authMiddleware authenticates requests at the edge. Requests carrying
+// an X-Partner-Key are checked against keys; all others need a valid token
+// from a on every path not allowlisted. Either may be nil to turn that
+// scheme off. Identity headers a client sent itself are always dropped,
+// so upstreams never see them unvalidated.
+func authMiddleware(a *authenticator, keys *apiKeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del(userIDHeader)
+			r.Header.Del(userRolesHeader)
+			r.Header.Del(apiKeyIDHeader)
+			r.Header.Del(apiKeyScopesHeader)
+
+			if keys != nil && r.Header.Get(apiKeyHeader) != "" {
+				keys.serve(w, r, next)
+				return
+			}
+			if a == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			a.serve(w, r, next)
+		})
+	}
+}
+
+// serve requires a valid token unless r's path is allowlisted, and
+// forwards who it was issued to in X-User-ID and X-User-Roles.
+func (a *authenticator) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	for _, rule := range a.allowlist {
+		if rule.matches(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	claims, reason, err := a.authenticate(r)
+	if err != nil {
+		authRejected.WithLabelValues(reason).Inc()
+		if reason == "missing" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			loggerFrom(r.Context()).Info("rejected token", "method", r.Method, "path", r.URL.Path, "error", err)
+		}
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	r.Header.Set(userIDHeader, claims.Subject)
+	if len(claims.Roles) > 0 {
+		r.Header.Set(userRolesHeader, strings.Join(claims.Roles, ","))
+	}
+	next.ServeHTTP(w, r)
+}
+
+// jwksRefetchInterval is the least time between fetches of the JWKS, so
+// tokens with unknown key ids can't make the gateway hammer it.
+const jwksRefetchInterval = 30 * time.Second
+
+// jwksCache holds the signing keys published at a JWKS URL, fetching
+// them again once they are older than refresh or a token names a key id
+// it doesn't have, as happens after a key rotation. Fetches run without
+// the lock held, so tokens signed with a key already held are validated
+// while one is in flight.
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetching    chan struct{} // closed when the fetch in flight, if any, is done
+}
+
+func newJWKSCache(url string, refresh time.Duration) *jwksCache {
+	return &jwksCache{url: url, refresh: refresh, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// key returns the key with id kid. An empty kid is accepted if the set
+// holds exactly one key. A stale set is refreshed in the background; only
+// a kid the cache doesn't hold waits for the fetch.
+func (c *jwksCache) key(ctx context.Context, kid string) (interface{}, error) {
+	c.mu.Lock()
+	now := time.Now()
+	key := c.lookup(kid)
+	stale := now.Sub(c.fetchedAt) > c.refresh
+	if (stale || key == nil) && c.fetching == nil && now.Sub(c.attemptedAt) >= jwksRefetchInterval {
+		c.attemptedAt = now
+		c.fetching = make(chan struct{})
+		go c.refetch(c.fetching)
+	}
+	wait := c.fetching
+	c.mu.Unlock()
+
+	if key != nil {
+		return key, nil
+	}
+	if wait != nil {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+		key = c.lookup(kid)
+		c.mu.Unlock()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// lookup returns the held key for kid, or nil. c.mu must be held.
+func (c *jwksCache) lookup(kid string) interface{} {
+	if key, ok := c.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// refetch fetches the set and swaps it in, then closes done. It isn't
+// tied to the request that started it, so that request giving up doesn't
+// cancel the fetch others wait on.
+func (c *jwksCache) refetch(done chan struct{}) {
+	keys, err := c.fetch(context.Background())
+
+	c.mu.Lock()
+	if err != nil {
+		// Keep validating with the keys already held.
+		log.Printf("Failed to fetch JWKS from %s: %v", c.url, err)
+	} else {
+		c.keys, c.fetchedAt = keys, time.Now()
+	}
+	c.fetching = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// jwk is a JSON Web Key; only RSA and EC signing keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeKeyInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeKeyInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeKeyInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("malformed key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("test-secret")
+
+func signHS256(t *testing.T, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	return token
+}
+
+func validClaims() gatewayClaims {
+	return gatewayClaims{
+		Roles: []string{"customer", "admin"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "42",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+// identityEcho records the identity headers it was sent.
+func identityEcho(got *http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func serveAuth(a *authenticator, next http.Handler, method, path, token string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	authMiddleware(a, nil)(next).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthForwardsClaims(t *testing.T) {
+	a := &authenticator{secret: testSecret}
+	var got http.Header
+	spoofed := http.Header{userIDHeader: {"1"}, userRolesHeader: {"admin"}}
+
+	rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", signHS256(t, validClaims()), spoofed)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if got.Get(userIDHeader) != "42" || got.Get(userRolesHeader) != "customer,admin" {
+		t.Errorf("forwarded %s=%q %s=%q, want 42 and customer,admin",
+			userIDHeader, got.Get(userIDHeader), userRolesHeader, got.Get(userRolesHeader))
+	}
+	if n := len(got.Values(userIDHeader)); n != 1 {
+		t.Errorf("%d %s values forwarded, want 1", n, userIDHeader)
+	}
+
+	claims := validClaims()
+	claims.Roles = nil
+	serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", signHS256(t, claims), spoofed)
+	if roles := got.Values(userRolesHeader); len(roles) != 0 {
+		t.Errorf("client's roles forwarded: %q", roles)
+	}
+}
+
+func TestAuthRejectsBadTokens(t *testing.T) {
+	a := &authenticator{secret: testSecret, issuer: "auth-service"}
+
+	expired := validClaims()
+	expired.Issuer = "auth-service"
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := validClaims()
+	noExpiry.Issuer = "auth-service"
+	noExpiry.ExpiresAt = nil
+	noSubject := validClaims()
+	noSubject.Issuer = "auth-service"
+	noSubject.Subject = ""
+	wrongKey, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("other"))
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := map[string]string{
+		"missing":      "",
+		"garbage":      "not-a-jwt",
+		"expired":      signHS256(t, expired),
+		"no expiry":    signHS256(t, noExpiry),
+		"no subject":   signHS256(t, noSubject),
+		"wrong issuer": signHS256(t, validClaims()),
+		"wrong key":    wrongKey,
+		"alg none":     unsigned,
+	}
+	for name, token := range tests {
+		var got http.Header
+		rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", token, nil)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, rec.Code)
+		}
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", name)
+		}
+		if got != nil {
+			t.Errorf("%s: request reached the upstream", name)
+		}
+	}
+}
+
+func TestAuthAllowlist(t *testing.T) {
+	rules, err := parsePathRules("/health, GET /api/products")
+	if err != nil {
+		t.Fatalf("parsePathRules: %s", err)
+	}
+	a := &authenticator{secret: testSecret, allowlist: rules}
+	var got http.Header
+
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/products/3", "", http.Header{userIDHeader: {"1"}}); rec.Code != http.StatusOK {
+		t.Errorf("GET allowlisted: status %d, want 200", rec.Code)
+	}
+	if got.Get(userIDHeader) != "" {
+		t.Errorf("client's %s forwarded on allowlisted path", userIDHeader)
+	}
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/health", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("/health: status %d, want 200", rec.Code)
+	}
+	if rec := serveAuth(a, identityEcho(&got), http.MethodPost, "/api/products", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST not allowlisted: status %d, want 401", rec.Code)
+	}
+	// Prefixes match whole path segments only.
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/healthz-admin", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("/healthz-admin: status %d, want 401", rec.Code)
+	}
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/products-internal", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("/api/products-internal: status %d, want 401", rec.Code)
+	}
+
+	if _, err := parsePathRules("api/products"); err == nil {
+		t.Error("parsePathRules accepted a prefix without a leading /")
+	}
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func signRS256(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	return signed
+}
+
+func TestAuthJWKS(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var rotated atomic.Bool
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []map[string]string{rsaJWK("old", oldKey)}
+		if rotated.Load() {
+			keys = append(keys, rsaJWK("new", newKey))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	cache := newJWKSCache(jwks.URL, time.Hour)
+	a := &authenticator{jwks: cache}
+	var got http.Header
+
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", signRS256(t, "old", oldKey), nil); rec.Code != http.StatusOK {
+		t.Fatalf("old key: status %d, want 200", rec.Code)
+	}
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", signRS256(t, "old", oldKey), nil); rec.Code != http.StatusOK {
+		t.Fatalf("old key again: status %d, want 200", rec.Code)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1 while cached", n)
+	}
+
+	// After a rotation an unknown key id makes the cache refetch.
+	rotated.Store(true)
+	cache.attemptedAt = time.Time{}
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", signRS256(t, "new", newKey), nil); rec.Code != http.StatusOK {
+		t.Fatalf("rotated key: status %d, want 200", rec.Code)
+	}
+
+	// HS256 tokens signed with the public key must not be accepted.
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString(oldKey.N.Bytes())
+	if rec := serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", hs, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("HS256 against JWKS: status %d, want 401", rec.Code)
+	}
+
+	// Unknown key ids don't refetch more than once per interval.
+	before := fetches.Load()
+	for i := 0; i < 3; i++ {
+		serveAuth(a, identityEcho(&got), http.MethodGet, "/api/orders", signRS256(t, "unknown", newKey), nil)
+	}
+	if n := fetches.Load() - before; n != 0 {
+		t.Errorf("unknown key id fetched the JWKS %d times within the refetch interval", n)
+	}
+}
+
+func TestJWKSRefreshDoesNotBlockKnownKeys(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("k1", key)}})
+	}))
+	defer jwks.Close()
+	defer close(release)
+
+	cache := newJWKSCache(jwks.URL, time.Hour)
+	if _, err := cache.key(context.Background(), "k1"); err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+
+	// Make the set stale; the refresh it starts hangs until released.
+	cache.mu.Lock()
+	cache.fetchedAt, cache.attemptedAt = time.Time{}, time.Time{}
+	cache.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.key(context.Background(), "k1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("known key during refresh: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a known key waited for the JWKS refresh")
+	}
+
+	// A request for an unknown key waits, but gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cache.key(ctx, "k2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unknown key during refresh: got %v, want the context's deadline", err)
+	}
+}
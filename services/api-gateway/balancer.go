@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	instanceRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_instance_requests_total",
+			Help: "Requests sent to each upstream instance, by outcome",
+		},
+		[]string{"upstream", "instance", "outcome"},
+	)
+	upstreamRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_requests_total",
+			Help: "Calls to upstreams, by upstream and outcome class (2xx, 3xx, 4xx, throttled for 429, 5xx, timeout, network, canceled)",
+		},
+		[]string{"upstream", "class"},
+	)
+	upstreamDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gateway_upstream_request_duration_seconds",
+			Help:    "Time from sending a request to an upstream to its response headers, by upstream and outcome class",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"upstream", "class"},
+	)
+	instanceUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_upstream_instance_up",
+			Help: "Whether an upstream instance is in rotation (1) or pulled out after failing (0)",
+		},
+		[]string{"upstream", "instance"},
+	)
+)
+
+var (
+	// ejectAfterFailures is how many failures in a row pull an instance
+	// out of rotation; probeInterval is how often its /health is then
+	// checked to bring it back.
+	ejectAfterFailures = loadPositiveInt("LB_EJECT_AFTER_FAILURES", 3)
+	probeInterval      = loadDuration("LB_PROBE_INTERVAL", 5*time.Second)
+)
+
+// errNoInstances is a request with every instance of its upstream out of
+// rotation.
+var errNoInstances = errors.New("no upstream instance available")
+
+// splitTargets splits a comma-separated list of upstream URLs.
+func splitTargets(raw string) []string {
+	var targets []string
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// instance is one replica of an upstream, with its own circuit breaker
+// so a failing replica doesn't trip the breaker for healthy ones.
+type instance struct {
+	url         *url.URL
+	breaker     *upstreamBreaker
+	outstanding atomic.Int64
+
+	// Guarded by the balancer's mu.
+	failures int
+	ejected  bool
+}
+
+// balancer spreads an upstream's requests over its instances, sending
+// each to the one with the fewest requests in flight and rotating among
+// ties, so idle instances are taken in turn.
+type balancer struct {
+	upstream   string
+	instances  []*instance
+	transport  http.RoundTripper
+	ejectAfter int
+	probeEvery time.Duration
+	rotation   atomic.Uint32
+	// ejectLast lets every instance be pulled out of rotation.
+	ejectLast bool
+	canary    *canary
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+}
+
+// newBalancer balances over targets, a comma-separated list of absolute
+// URLs. Breakers are named after the upstream, or with more than one
+// instance after the upstream and each instance's host.
+func newBalancer(upstream, targets string, breakers breakerConfig) (*balancer, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = upstreamResponseTimeout
+
+	b := &balancer{
+		upstream: upstream, transport: tracingTransport(upstream, transport),
+		ejectAfter: ejectAfterFailures, probeEvery: probeInterval, closed: make(chan struct{}),
+	}
+	urls, err := parseTargets(targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range urls {
+		name := upstream
+		if len(urls) > 1 {
+			name = upstream + "@" + u.Host
+		}
+		b.instances = append(b.instances, &instance{url: u, breaker: newBreaker(name, breakers)})
+		instanceUp.WithLabelValues(upstream, u.Host).Set(1)
+	}
+	return b, nil
+}
+
+// parseTargets parses a comma-separated list of absolute upstream URLs.
+func parseTargets(targets string) ([]*url.URL, error) {
+	list := splitTargets(targets)
+	if len(list) == 0 {
+		return nil, errors.New("no upstream URL given")
+	}
+	var urls []*url.URL
+	for _, target := range list {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("upstream URL must be absolute: " + target)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// close stops b's probes of ejected instances, once b's config has been
+// replaced. Requests already in flight still complete.
+func (b *balancer) close() {
+	b.closeOnce.Do(func() { close(b.closed) })
+	if b.canary != nil {
+		b.canary.balancer.close()
+	}
+}
+
+// pick chooses the instance for the next request among those in
+// rotation with a breaker that isn't open. If every breaker is open, the
+// error says when the first one lets a probe through.
+func (b *balancer) pick() (*instance, error) {
+	return b.pickExcept(nil)
+}
+
+// pickExcept picks an instance other than skip, as pick does.
+func (b *balancer) pickExcept(skip *instance) (*instance, error) {
+	n := len(b.instances)
+	start := int(b.rotation.Add(1))
+	var best *instance
+	var open *circuitOpenError
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i < n; i++ {
+		inst := b.instances[(start+i)%n]
+		if inst.ejected || inst == skip {
+			continue
+		}
+		if inst.breaker.cb.State() == gobreaker.StateOpen {
+			wait := inst.breaker.retryAfter(time.Now())
+			if open == nil || wait < open.retryAfter {
+				open = &circuitOpenError{upstream: inst.breaker.upstream, retryAfter: wait}
+			}
+			continue
+		}
+		if best == nil || inst.outstanding.Load() < best.outstanding.Load() {
+			best = inst
+		}
+	}
+	switch {
+	case best != nil:
+		return best, nil
+	case open != nil:
+		return nil, open
+	}
+	return nil, errNoInstances
+}
+
+// RoundTrip sends req to an instance through that instance's breaker,
+// on the canary if b has one that selects req and is available, and
+// hedges it if its route is configured for that.
+func (b *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.canary == nil {
+		inst, err := b.pick()
+		if err != nil {
+			return nil, err
+		}
+		return b.sendHedged(inst, req)
+	}
+
+	target, variant := b, "stable"
+	if b.canary.selects(req) {
+		target, variant = b.canary.balancer, "canary"
+	}
+	inst, err := target.pick()
+	if err != nil && target != b {
+		target, variant = b, "stable"
+		inst, err = b.pick()
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := target.sendHedged(inst, req)
+	outcome := "success"
+	if requestFailed(resp, err) {
+		outcome = "error"
+	}
+	variantRequests.WithLabelValues(b.upstream, variant, outcome).Inc()
+	return resp, err
+}
+
+// send sends req to inst.
+func (b *balancer) send(inst *instance, req *http.Request) (*http.Response, error) {
+	out := req.WithContext(req.Context())
+	u := *req.URL
+	u.Scheme, u.Host = inst.url.Scheme, inst.url.Host
+	u.Path = strings.TrimRight(inst.url.Path, "/") + req.URL.Path
+	out.URL, out.Host = &u, inst.url.Host
+
+	inst.outstanding.Add(1)
+	result, err := inst.breaker.execute(func() (interface{}, error) {
+		// Timed here, around the upstream call alone, so a slow
+		// upstream can be told apart from a slow gateway.
+		start := time.Now()
+		resp, err := b.transport.RoundTrip(out)
+		class := outcomeClass(resp, err)
+		if class != "" {
+			exemplar := prometheus.Labels{"request_id": requestIDFrom(req.Context())}
+			upstreamDuration.WithLabelValues(b.upstream, class).(prometheus.ExemplarObserver).ObserveWithExemplar(time.Since(start).Seconds(), exemplar)
+			upstreamRequests.WithLabelValues(b.upstream, class).Inc()
+		}
+		return resp, err
+	})
+	inst.outstanding.Add(-1)
+
+	var resp *http.Response
+	if err == nil {
+		resp = result.(*http.Response)
+	}
+	b.record(inst, resp, err)
+	return resp, err
+}
+
+// record counts a request's outcome against inst, pulling inst out of
+// rotation after ejectAfter failures in a row. Cancelled requests, such
+// as the losers of hedged ones, aren't counted. The last instance in
+// rotation is only pulled from a canary, whose traffic the stable
+// instances then take; otherwise that would only turn its errors into
+// 503s, and its breaker already guards it.
+func (b *balancer) record(inst *instance, resp *http.Response, err error) {
+	var open *circuitOpenError
+	if errors.As(err, &open) || isBodyTooLarge(err) || errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := requestFailed(resp, err)
+	outcome := "success"
+	if failed {
+		outcome = "error"
+	}
+	instanceRequests.WithLabelValues(b.upstream, inst.url.Host, outcome).Inc()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		inst.failures = 0
+		return
+	}
+	inst.failures++
+	if inst.ejected || inst.failures < b.ejectAfter || (!b.ejectLast && b.inRotation() <= 1) {
+		return
+	}
+	inst.ejected = true
+	instanceUp.WithLabelValues(b.upstream, inst.url.Host).Set(0)
+	log.Printf("Pulled %s instance %s out of rotation after %d failures", b.upstream, inst.url.Host, inst.failures)
+	go b.probe(inst)
+}
+
+// outcomeClass classes an upstream call by its status, as in "5xx" or
+// "throttled" for a 429, or its error: "timeout", "canceled" when the
+// client went away, or "network". A request body over the limit is the
+// client's doing and gets no class.
+func outcomeClass(resp *http.Response, err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil && resp.StatusCode == http.StatusTooManyRequests:
+		return "throttled"
+	case err == nil:
+		return strconv.Itoa(resp.StatusCode/100) + "xx"
+	case isBodyTooLarge(err):
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "network"
+}
+
+// requestFailed reports whether a request to an instance failed, by
+// error or by a gateway error status.
+func requestFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// inRotation counts instances not pulled out. The caller holds mu.
+func (b *balancer) inRotation() int {
+	n := 0
+	for _, inst := range b.instances {
+		if !inst.ejected {
+			n++
+		}
+	}
+	return n
+}
+
+// probe checks an ejected instance's /health until it answers 200, then
+// puts it back in rotation, or until b is closed.
+func (b *balancer) probe(inst *instance) {
+	client := &http.Client{Timeout: upstreamHealthTimeout}
+	ticker := time.NewTicker(b.probeEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-ticker.C:
+		}
+		resp, err := client.Get(strings.TrimRight(inst.url.String(), "/") + "/health")
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		b.mu.Lock()
+		inst.ejected, inst.failures = false, 0
+		b.mu.Unlock()
+		instanceUp.WithLabelValues(b.upstream, inst.url.Host).Set(1)
+		log.Printf("Put %s instance %s back in rotation", b.upstream, inst.url.Host)
+		return
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+)
+
+// countingUpstream answers 200, or 503 while failing is set, counting
+// the API requests it gets.
+func countingUpstream(t *testing.T, calls *atomic.Int32, failing *atomic.Bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			calls.Add(1)
+		}
+		if failing != nil && failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	var a, b atomic.Int32
+	targets := countingUpstream(t, &a, nil).URL + ", " + countingUpstream(t, &b, nil).URL
+	gw := newTestGatewayWith(t, testProxy(t, "lb-rr", targets, "/api/orders", "/orders"))
+
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(gw.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if a.Load() != 5 || b.Load() != 5 {
+		t.Errorf("requests split %d/%d, want 5/5", a.Load(), b.Load())
+	}
+}
+
+func TestBalancerEjectsFailingInstance(t *testing.T) {
+	withRetries(t, 0)
+	var healthyCalls, failingCalls atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	healthy := countingUpstream(t, &healthyCalls, nil)
+	bad := countingUpstream(t, &failingCalls, &failing)
+
+	lb, err := newBalancer("lb-eject", healthy.URL+","+bad.URL, breakerConfig{
+		MinRequests: 100, FailureRatio: 1, Window: time.Minute, OpenTimeout: time.Minute, HalfOpenRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.ejectAfter, lb.probeEvery = 2, 20*time.Millisecond
+	gw := newTestGatewayWith(t, newProxy(lb, "/api/orders", "/orders"))
+	get := func() int {
+		resp, err := http.Get(gw.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if failingCalls.Load() != 2 {
+		t.Fatalf("failing instance got %d requests, want 2 before it was pulled", failingCalls.Load())
+	}
+	if got := testutil.ToFloat64(instanceUp.WithLabelValues("lb-eject", lb.instances[1].url.Host)); got != 0 {
+		t.Errorf("instance up gauge = %v, want 0", got)
+	}
+	for i := 0; i < 4; i++ {
+		if status := get(); status != http.StatusOK {
+			t.Errorf("with the failing instance out: status %d, want 200", status)
+		}
+	}
+	if failingCalls.Load() != 2 {
+		t.Errorf("pulled instance got %d requests, want none after it was pulled", failingCalls.Load()-2)
+	}
+
+	// Once its /health passes it is put back.
+	failing.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(instanceUp.WithLabelValues("lb-eject", lb.instances[1].url.Host)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("instance wasn't put back in rotation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if failingCalls.Load() == 2 {
+		t.Error("reinstated instance got no requests")
+	}
+}
+
+func TestBalancerBreakersPerInstance(t *testing.T) {
+	withRetries(t, 0)
+	var calls atomic.Int32
+	healthy := countingUpstream(t, &calls, nil)
+	lb, err := newBalancer("lb-breaker", healthy.URL+","+newClosedUpstream(), breakerConfig{
+		MinRequests: 1, FailureRatio: 1, Window: time.Minute, OpenTimeout: time.Minute, HalfOpenRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.ejectAfter = 100
+	gw := newTestGatewayWith(t, newProxy(lb, "/api/orders", "/orders"))
+
+	for i := 0; i < 6; i++ {
+		resp, err := http.Get(gw.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if state := lb.instances[1].breaker.cb.State(); state != gobreaker.StateOpen {
+		t.Errorf("down instance's breaker is %s, want open", state)
+	}
+	if state := lb.instances[0].breaker.cb.State(); state != gobreaker.StateClosed {
+		t.Errorf("healthy instance's breaker is %s, want closed", state)
+	}
+	if calls.Load() != 5 {
+		t.Errorf("healthy instance got %d requests, want all but the one that tripped the other's breaker", calls.Load())
+	}
+}
+
+func TestBalancerKeepsLastInstance(t *testing.T) {
+	withRetries(t, 0)
+	var calls atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	lb, err := newBalancer("lb-last", countingUpstream(t, &calls, &failing).URL, breakerConfig{
+		MinRequests: 100, FailureRatio: 1, Window: time.Minute, OpenTimeout: time.Minute, HalfOpenRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.ejectAfter = 1
+	gw := newTestGatewayWith(t, newProxy(lb, "/api/orders", "/orders"))
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(gw.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if calls.Load() != 3 || lb.instances[0].ejected {
+		t.Errorf("only instance got %d of 3 requests, ejected %t", calls.Load(), lb.instances[0].ejected)
+	}
+}
+
+func TestUpstreamMetricsByOutcomeClass(t *testing.T) {
+	withRetries(t, 0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/orders/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/orders/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+	oldTimeout := upstreamResponseTimeout
+	upstreamResponseTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { upstreamResponseTimeout = oldTimeout })
+
+	gw := newTestGatewayWith(t, testProxy(t, "metrics-classes", upstream.URL, "/api/orders", "/orders"))
+	for _, path := range []string{"/api/orders/1", "/api/orders/missing", "/api/orders/slow"} {
+		resp, err := http.Get(gw.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	closed := newTestGatewayWith(t, testProxy(t, "metrics-network", newClosedUpstream(), "/api/orders", "/orders"))
+	resp, err := http.Get(closed.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, tt := range []struct{ upstream, class string }{
+		{"metrics-classes", "2xx"}, {"metrics-classes", "4xx"}, {"metrics-classes", "timeout"}, {"metrics-network", "network"},
+	} {
+		if got := testutil.ToFloat64(upstreamRequests.WithLabelValues(tt.upstream, tt.class)); got != 1 {
+			t.Errorf("%s %s: expected 1 call counted, got %v", tt.upstream, tt.class, got)
+		}
+	}
+	if n := testutil.CollectAndCount(upstreamDuration, "gateway_upstream_request_duration_seconds"); n == 0 {
+		t.Error("expected upstream latency observed")
+	}
+}
+
+func TestOutcomeClass(t *testing.T) {
+	tests := []struct {
+		resp *http.Response
+		err  error
+		want string
+	}{
+		{&http.Response{StatusCode: http.StatusOK}, nil, "2xx"},
+		{&http.Response{StatusCode: http.StatusFound}, nil, "3xx"},
+		{&http.Response{StatusCode: http.StatusNotFound}, nil, "4xx"},
+		{&http.Response{StatusCode: http.StatusTooManyRequests}, nil, "throttled"},
+		{&http.Response{StatusCode: http.StatusBadGateway}, nil, "5xx"},
+		{nil, context.DeadlineExceeded, "timeout"},
+		{nil, context.Canceled, "canceled"},
+		{nil, errors.New("connection refused"), "network"},
+		{nil, &http.MaxBytesError{Limit: 1}, ""},
+	}
+	for _, tt := range tests {
+		if got := outcomeClass(tt.resp, tt.err); got != tt.want {
+			t.Errorf("outcomeClass(%v, %v) = %q, want %q", tt.resp, tt.err, got, tt.want)
+		}
+	}
+}
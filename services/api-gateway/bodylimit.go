@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var bodyTooLarge = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_request_body_too_large_total",
+		Help: "Requests rejected with 413 for a body over the route's limit, by route",
+	},
+	[]string{"route"},
+)
+
+// bodyLimitOverride gives requests matching a pathRule their own body
+// size limit.
+type bodyLimitOverride struct {
+	pathRule
+	Max int64
+}
+
+// bodyLimiter caps request body sizes before they are proxied.
+type bodyLimiter struct {
+	max       int64
+	overrides []bodyLimitOverride
+}
+
+// loadBodyLimiter reads MAX_REQUEST_BODY (1MB) and MAX_REQUEST_BODY_OVERRIDES,
+// which by default lets the bulk product import take 10MB.
+func loadBodyLimiter() (*bodyLimiter, error) {
+	max, err := parseByteSize(getEnv("MAX_REQUEST_BODY", "1MB"))
+	if err != nil {
+		return nil, fmt.Errorf("MAX_REQUEST_BODY: %w", err)
+	}
+	overrides, err := parseBodyLimitOverrides(getEnv("MAX_REQUEST_BODY_OVERRIDES", "POST /api/products/bulk=10MB"))
+	if err != nil {
+		return nil, fmt.Errorf("MAX_REQUEST_BODY_OVERRIDES: %w", err)
+	}
+	return &bodyLimiter{max: max, overrides: overrides}, nil
+}
+
+// parseByteSize parses a positive size in bytes, optionally suffixed
+// with KB, MB or GB (powers of 1024).
+func parseByteSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	unit := int64(1)
+	for suffix, size := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, suffix)), size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%q must be a positive size such as 512KB or 10MB", raw)
+	}
+	return n * unit, nil
+}
+
+// parseBodyLimitOverrides parses a comma-separated list of
+// "[METHOD ]/prefix=size" entries. The first matching entry applies.
+func parseBodyLimitOverrides(raw string) ([]bodyLimitOverride, error) {
+	var overrides []bodyLimitOverride
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, size, ok := strings.Cut(entry, "=")
+		rules, err := parsePathRules(route)
+		if !ok || err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("entry %q must be [METHOD ]/prefix=size", entry)
+		}
+		max, err := parseByteSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+		overrides = append(overrides, bodyLimitOverride{pathRule: rules[0], Max: max})
+	}
+	return overrides, nil
+}
+
+func (l *bodyLimiter) limit(r *http.Request) int64 {
+	for _, o := range l.overrides {
+		if o.matches(r) {
+			return o.Max
+		}
+	}
+	return l.max
+}
+
+// middleware rejects requests declaring a body over the limit outright
+// and cuts off chunked ones once they pass it, so an oversized upload is
+// never streamed through to the upstream in full. A body cut off mid-way
+// surfaces as a proxy error and is answered with 413 by proxyError.
+func (l *bodyLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := l.limit(r)
+		if r.ContentLength > max {
+			rejectBodyTooLarge(w, r, max)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func rejectBodyTooLarge(w http.ResponseWriter, r *http.Request, max int64) {
+	bodyTooLarge.WithLabelValues(routeFrom(r.Context())).Inc()
+	w.Header().Set("Connection", "close")
+	writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", max))
+}
+
+// isBodyTooLarge reports whether err came from a request body over its
+// limit. It is the client's fault, not the upstream's.
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// onlyReader hides strings.Reader's length so requests are sent chunked.
+type onlyReader struct{ io.Reader }
+
+func TestBodyLimit(t *testing.T) {
+	withRetries(t, 0)
+	var received atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+	}))
+	defer upstream.Close()
+
+	limits := &bodyLimiter{max: 1024}
+	limits.overrides, _ = parseBodyLimitOverrides("POST /api/products/bulk=4KB")
+	router := newRouter(
+		testProxy(t, "body-products", upstream.URL, "/api/products", "/products"),
+		testProxy(t, "body-orders", upstream.URL, "/api/orders", "/orders"),
+		http.NotFoundHandler(),
+	)
+	router.Use(limits.middleware)
+	gw := httptest.NewServer(router)
+	defer gw.Close()
+
+	post := func(path string, body io.Reader) (int, map[string]string) {
+		resp, err := http.Post(gw.URL+path, "application/json", body)
+		if err != nil {
+			t.Fatalf("POST %s: %s", path, err)
+		}
+		defer resp.Body.Close()
+		var envelope map[string]string
+		json.NewDecoder(resp.Body).Decode(&envelope)
+		return resp.StatusCode, envelope
+	}
+	before := testutil.ToFloat64(bodyTooLarge.WithLabelValues("/api/orders"))
+
+	if status, _ := post("/api/orders", strings.NewReader(strings.Repeat("a", 1024))); status != http.StatusOK {
+		t.Errorf("body at the limit: status %d, want 200", status)
+	}
+
+	received.Store(-1)
+	status, envelope := post("/api/orders", strings.NewReader(strings.Repeat("a", 2048)))
+	if status != http.StatusRequestEntityTooLarge || envelope["error"] == "" {
+		t.Errorf("declared length over the limit: %d %v, want 413 with an error", status, envelope)
+	}
+	if received.Load() != -1 {
+		t.Error("declared oversized body reached the upstream")
+	}
+
+	// Chunked bodies are cut off, and several don't open the breaker.
+	for i := 0; i < 5; i++ {
+		status, _ := post("/api/orders", onlyReader{strings.NewReader(strings.Repeat("a", 64<<10))})
+		if status != http.StatusRequestEntityTooLarge {
+			t.Fatalf("chunked body over the limit: status %d, want 413", status)
+		}
+	}
+	if status, _ := post("/api/orders", strings.NewReader("{}")); status != http.StatusOK {
+		t.Errorf("after oversized bodies: status %d, want 200 with the breaker closed", status)
+	}
+	if n := testutil.ToFloat64(bodyTooLarge.WithLabelValues("/api/orders")) - before; n != 6 {
+		t.Errorf("rejections counted %v, want 6", n)
+	}
+
+	if status, _ := post("/api/products/bulk", strings.NewReader(strings.Repeat("a", 3000))); status != http.StatusOK {
+		t.Errorf("override route: status %d, want 200", status)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	valid := map[string]int64{"512": 512, "1KB": 1024, "10mb": 10 << 20, " 2 GB ": 2 << 30}
+	for raw, want := range valid {
+		if got, err := parseByteSize(raw); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "0", "-1MB", "ten", "1TB"} {
+		if _, err := parseByteSize(raw); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded, want error", raw)
+		}
+	}
+}
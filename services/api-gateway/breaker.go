@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	breakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_circuit_breaker_state",
+			Help: "Circuit breaker state by upstream: 0 closed, 1 half-open, 2 open",
+		},
+		[]string{"upstream"},
+	)
+	breakerTrips = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_circuit_breaker_trips_total",
+			Help: "Times an upstream's circuit breaker opened",
+		},
+		[]string{"upstream"},
+	)
+)
+
+// breakerConfig is when an upstream's circuit breaker opens: once at
+// least MinRequests requests in a Window have failed at FailureRatio or
+// more. It stays open for OpenTimeout, then lets HalfOpenRequests probes
+// through before closing again.
+type breakerConfig struct {
+	MinRequests      uint32
+	FailureRatio     float64
+	Window           time.Duration
+	OpenTimeout      time.Duration
+	HalfOpenRequests uint32
+}
+
+func loadBreakerConfig() breakerConfig {
+	return breakerConfig{
+		MinRequests:      uint32(loadPositiveInt("BREAKER_MIN_REQUESTS", 3)),
+		FailureRatio:     loadRatio("BREAKER_FAILURE_RATIO", 0.6),
+		Window:           loadDuration("BREAKER_WINDOW", 60*time.Second),
+		OpenTimeout:      loadDuration("BREAKER_OPEN_TIMEOUT", 30*time.Second),
+		HalfOpenRequests: uint32(loadPositiveInt("BREAKER_HALF_OPEN_REQUESTS", 1)),
+	}
+}
+
+// upstreamBreaker is an upstream's circuit breaker, remembering when it
+// last opened so rejected requests can be told when to retry.
+type upstreamBreaker struct {
+	upstream    string
+	cb          *gobreaker.CircuitBreaker
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	openedAt time.Time
+}
+
+func newBreaker(upstream string, c breakerConfig) *upstreamBreaker {
+	b := &upstreamBreaker{upstream: upstream, openTimeout: c.OpenTimeout}
+	b.cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        upstream,
+		MaxRequests: c.HalfOpenRequests,
+		Interval:    c.Window,
+		Timeout:     c.OpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
+			return counts.Requests >= c.MinRequests && failureRatio >= c.FailureRatio
+		},
+		// A client's oversized body isn't the upstream failing, nor
+		// is a request cancelled by the client or a hedge.
+		IsSuccessful: func(err error) bool {
+			return err == nil || isBodyTooLarge(err) || errors.Is(err, context.Canceled)
+		},
+		OnStateChange: b.stateChanged,
+	})
+	breakerState.WithLabelValues(upstream).Set(float64(gobreaker.StateClosed))
+	return b
+}
+
+func (b *upstreamBreaker) stateChanged(name string, from, to gobreaker.State) {
+	log.Printf("Circuit Breaker %s changed state from %s to %s", name, from, to)
+	breakerState.WithLabelValues(b.upstream).Set(float64(to))
+	if to == gobreaker.StateOpen {
+		breakerTrips.WithLabelValues(b.upstream).Inc()
+		b.mu.Lock()
+		b.openedAt = time.Now()
+		b.mu.Unlock()
+	}
+}
+
+// retryAfter is how long until the open breaker next lets a probe
+// through, at least a second.
+func (b *upstreamBreaker) retryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait := b.openTimeout - now.Sub(b.openedAt); wait > time.Second {
+		return wait
+	}
+	return time.Second
+}
+
+// circuitOpenError is a request refused without reaching the upstream
+// because its breaker is open, or half-open with its probes in flight.
+type circuitOpenError struct {
+	upstream   string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.upstream)
+}
+
+// throttledError carries an upstream's 429 through its breaker, which
+// counts it as a failure: an upstream that keeps shedding load trips the
+// breaker and is spared the gateway's traffic until it recovers.
+type throttledError struct {
+	resp *http.Response
+}
+
+func (e *throttledError) Error() string { return "upstream throttled the request" }
+
+// execute runs fn through the breaker, turning a refusal into a
+// circuitOpenError. A 429 from fn counts as a failure but is returned as
+// the response.
+func (b *upstreamBreaker) execute(fn func() (interface{}, error)) (interface{}, error) {
+	result, err := b.cb.Execute(func() (interface{}, error) {
+		result, err := fn()
+		if resp, ok := result.(*http.Response); ok && err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &throttledError{resp: resp}
+		}
+		return result, err
+	})
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		return throttled.resp, nil
+	}
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return nil, &circuitOpenError{upstream: b.upstream, retryAfter: b.retryAfter(time.Now())}
+	}
+	return result, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+)
+
+func TestBreakerFailsFastWhenOpen(t *testing.T) {
+	withRetries(t, 0)
+	b, err := newBalancer("test-open", newClosedUpstream(), breakerConfig{
+		MinRequests: 2, FailureRatio: 0.5, Window: time.Minute, OpenTimeout: 30 * time.Second, HalfOpenRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := b.instances[0].breaker
+	gw := newTestGatewayWith(t, newProxy(b, "/api/orders", "/orders"))
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(gw.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Retry-After") != "" {
+			t.Errorf("request %d: unexpected Retry-After before the breaker opened", i)
+		}
+	}
+	if breaker.cb.State() != gobreaker.StateOpen {
+		t.Fatalf("expected the breaker open after 2 failures, got %s", breaker.cb.State())
+	}
+	if got := testutil.ToFloat64(breakerTrips.WithLabelValues("test-open")); got != 1 {
+		t.Errorf("expected 1 trip, got %v", got)
+	}
+	if got := testutil.ToFloat64(breakerState.WithLabelValues("test-open")); got != float64(gobreaker.StateOpen) {
+		t.Errorf("expected the state gauge at open, got %v", got)
+	}
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 30 {
+		t.Errorf("expected Retry-After within the open timeout, got %q", resp.Header.Get("Retry-After"))
+	}
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body["error"] != "Service unavailable (Circuit Breaker Open)" {
+		t.Errorf("unexpected body %v", body)
+	}
+}
+
+func TestBreakerRetryAfterAtLeastOneSecond(t *testing.T) {
+	b := &upstreamBreaker{openTimeout: 10 * time.Second, openedAt: time.Now().Add(-time.Minute)}
+	if got := b.retryAfter(time.Now()); got != time.Second {
+		t.Errorf("expected 1s once the open timeout has passed, got %s", got)
+	}
+}
+
+func TestBreakerOpensOnSustained429s(t *testing.T) {
+	withRetries(t, 0)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+	b, err := newBalancer("test-throttled", upstream.URL, breakerConfig{
+		MinRequests: 3, FailureRatio: 0.6, Window: time.Minute, OpenTimeout: 30 * time.Second, HalfOpenRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := newTestGatewayWith(t, newProxy(b, "/api/orders", "/orders"))
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(gw.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("request %d: got %d with Retry-After %q, want the upstream's 429", i, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+	if state := b.instances[0].breaker.cb.State(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker is %s after 3 429s, want open", state)
+	}
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 3 {
+		t.Errorf("got %d after %d upstream calls, want 503 without calling the upstream", resp.StatusCode, calls.Load())
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var cacheEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_cache_events_total",
+		Help: "Inventory events read to invalidate the response cache, by outcome (purged, ignored or invalid)",
+	},
+	[]string{"outcome"},
+)
+
+// invalidatingEvents are the inventory events after which a product's
+// cached responses may be stale.
+var invalidatingEvents = map[string]bool{
+	"product_created":    true,
+	"product_updated":    true,
+	"product_deleted":    true,
+	"product_archived":   true,
+	"product_restocked":  true,
+	"product_sale_ended": true,
+	"stock_changed":      true,
+	"variant_created":    true,
+	"variant_updated":    true,
+	"variant_deleted":    true,
+}
+
+// maxCacheEventsBackoff caps the wait between failed reads.
+const maxCacheEventsBackoff = 30 * time.Second
+
+// eventReader is the part of *kafka.Reader cacheInvalidator uses.
+type eventReader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	Close() error
+}
+
+// cacheInvalidator purges the response cache as inventory-service
+// reports changes to products on inventory-events. It is optional: a
+// read that fails is logged and retried with backoff, and meanwhile
+// entries still expire with the cache's TTL.
+type cacheInvalidator struct {
+	cache   *responseCache
+	reader  eventReader
+	backoff time.Duration
+}
+
+// newCacheInvalidator reads inventory-events from broker in the consumer
+// group given by CACHE_EVENTS_GROUP_ID, "api-gateway" by default. Each
+// gateway instance keeps its own cache, so when several run, each needs
+// a group of its own; in a shared one they would split the topic's
+// partitions and each miss the others' events. Only events published
+// from now on are read.
+func newCacheInvalidator(cache *responseCache, broker string) *cacheInvalidator {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     []string{broker},
+		Topic:       "inventory-events",
+		GroupID:     getEnv("CACHE_EVENTS_GROUP_ID", "api-gateway"),
+		StartOffset: kafka.LastOffset,
+	})
+	return &cacheInvalidator{cache: cache, reader: reader, backoff: time.Second}
+}
+
+// run reads events until ctx is done, then closes the reader.
+func (ci *cacheInvalidator) run(ctx context.Context) {
+	defer ci.reader.Close()
+	wait := ci.backoff
+	for {
+		msg, err := ci.reader.ReadMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Reading inventory events for the response cache, retrying in %s: %v", wait, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wait = min(2*wait, maxCacheEventsBackoff)
+			continue
+		}
+		wait = ci.backoff
+		ci.handle(msg.Value)
+	}
+}
+
+// handle purges the cache for one event. Inventory sends product ids as
+// numbers or numeric strings, depending on the event.
+func (ci *cacheInvalidator) handle(value []byte) {
+	var event struct {
+		EventType string      `json:"event_type"`
+		ProductID json.Number `json:"product_id"`
+	}
+	if err := json.Unmarshal(value, &event); err != nil {
+		cacheEvents.WithLabelValues("invalid").Inc()
+		return
+	}
+	if !invalidatingEvents[event.EventType] {
+		cacheEvents.WithLabelValues("ignored").Inc()
+		return
+	}
+	if event.ProductID == "" {
+		cacheEvents.WithLabelValues("invalid").Inc()
+		return
+	}
+	ci.cache.purge(event.ProductID.String())
+	responseCachePurges.WithLabelValues("event").Inc()
+	cacheEvents.WithLabelValues("purged").Inc()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeEventReader hands out its messages, or errors, in order, then
+// blocks until the context is done.
+type fakeEventReader struct {
+	results chan fakeRead
+	closed  atomic.Bool
+}
+
+type fakeRead struct {
+	value string
+	err   error
+}
+
+func newFakeEventReader(reads ...fakeRead) *fakeEventReader {
+	r := &fakeEventReader{results: make(chan fakeRead, len(reads))}
+	for _, read := range reads {
+		r.results <- read
+	}
+	return r
+}
+
+func (r *fakeEventReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case read := <-r.results:
+		return kafka.Message{Value: []byte(read.value)}, read.err
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeEventReader) Close() error {
+	r.closed.Store(true)
+	return nil
+}
+
+// cachedProducts fills c with product 1, product 2 and a listing.
+func cachedProducts(c *responseCache) {
+	for _, entry := range []*cachedResponse{{product: "1"}, {product: "2"}, {product: ""}} {
+		c.set("product "+entry.product, entry)
+	}
+}
+
+func TestCacheInvalidatorPurgesChangedProducts(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{"product_updated", `{"event_type":"product_updated","product_id":1}`, []string{"product 2"}},
+		{"string product id", `{"event_type":"stock_changed","product_id":"1"}`, []string{"product 2"}},
+		{"product_deleted", `{"event_type":"product_deleted","product_id":2}`, []string{"product 1"}},
+		{"unrelated event", `{"event_type":"low_stock_alert","product_id":1}`, []string{"product ", "product 1", "product 2"}},
+		{"no product id", `{"event_type":"product_updated"}`, []string{"product ", "product 1", "product 2"}},
+		{"invalid JSON", `{"event_type":`, []string{"product ", "product 1", "product 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newResponseCache(time.Minute, 100)
+			cachedProducts(c)
+			(&cacheInvalidator{cache: c}).handle([]byte(tt.event))
+
+			for _, key := range tt.want {
+				if c.get(key) == nil {
+					t.Errorf("%q purged", key)
+				}
+			}
+			if n := len(c.entries); n != len(tt.want) {
+				t.Errorf("%d entries left, want %d", n, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestCacheInvalidatorSurvivesReadErrors(t *testing.T) {
+	c := newResponseCache(time.Minute, 100)
+	cachedProducts(c)
+	reader := newFakeEventReader(
+		fakeRead{err: errors.New("broker unavailable")},
+		fakeRead{err: errors.New("broker unavailable")},
+		fakeRead{value: `not json`},
+		fakeRead{value: `{"event_type":"product_updated","product_id":2}`},
+	)
+	ci := &cacheInvalidator{cache: c, reader: reader, backoff: time.Millisecond}
+	purgesBefore := testutil.ToFloat64(responseCachePurges.WithLabelValues("event"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ci.run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for c.get("product 2") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the event after the failed reads wasn't applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.get("product 1") == nil {
+		t.Error("product 1 purged by an event for product 2")
+	}
+	if got := testutil.ToFloat64(responseCachePurges.WithLabelValues("event")) - purgesBefore; got != 1 {
+		t.Errorf("%g event purges counted, want 1", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run didn't return when its context was cancelled")
+	}
+	if !reader.closed.Load() {
+		t.Error("reader not closed")
+	}
+}
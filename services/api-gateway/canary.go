@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var variantRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_upstream_variant_requests_total",
+		Help: "Requests to upstreams with a canary, by variant (canary or stable) and outcome",
+	},
+	[]string{"upstream", "variant", "outcome"},
+)
+
+// canariesDisabled is the kill switch: with CANARY_DISABLED=true every
+// request goes to the stable instances whatever canaries are configured.
+func canariesDisabled() bool {
+	disabled, _ := strconv.ParseBool(getEnv("CANARY_DISABLED", "false"))
+	return disabled
+}
+
+// canaryURL is the canary instance URL configured for the upstream whose
+// settings are prefixed by prefix, as in ORDER_SERVICE_CANARY_URL, or ""
+// if it has none or canaries are switched off.
+func canaryURL(prefix string) string {
+	if canariesDisabled() {
+		return ""
+	}
+	return getEnv(prefix+"_CANARY_URL", "")
+}
+
+// canary is a second, separately balanced set of instances that gets a
+// share of an upstream's traffic.
+type canary struct {
+	balancer *balancer
+	percent  uint32
+	header   string
+}
+
+// selects reports whether req goes to the canary: always if it carries
+// the canary header set to true, otherwise for percent of request ids.
+// The choice depends only on the request, so retries make the same one.
+func (c *canary) selects(req *http.Request) bool {
+	if c.header != "" && strings.EqualFold(req.Header.Get(c.header), "true") {
+		return true
+	}
+	if c.percent == 0 {
+		return false
+	}
+	id := requestIDFrom(req.Context())
+	if id == "" {
+		return uint32(rand.Intn(100)) < c.percent
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32()%100 < c.percent
+}
+
+// loadCanary sets up b's canary from prefix_CANARY_URL, with
+// prefix_CANARY_PERCENT of requests (0 by default) and those with the
+// prefix_CANARY_HEADER header (X-Canary by default) set to true sent to
+// it. It leaves b alone if no canary is configured.
+func loadCanary(b *balancer, prefix string, breakers breakerConfig) error {
+	target := canaryURL(prefix)
+	if target == "" {
+		return nil
+	}
+	percent, err := strconv.Atoi(getEnv(prefix+"_CANARY_PERCENT", "0"))
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("%s_CANARY_PERCENT must be between 0 and 100", prefix)
+	}
+	cb, err := newBalancer(b.upstream+"-canary", target, breakers)
+	if err != nil {
+		return fmt.Errorf("%s_CANARY_URL: %w", prefix, err)
+	}
+	// A canary can be pulled out of rotation entirely, since the stable
+	// instances take its traffic meanwhile.
+	cb.ejectLast = true
+	b.canary = &canary{balancer: cb, percent: uint32(percent), header: getEnv(prefix+"_CANARY_HEADER", "X-Canary")}
+	log.Printf("Sending %d%% of %s traffic and requests with %s: true to canary %s", percent, b.upstream, b.canary.header, target)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// canaryGateway serves a gateway whose orders go to stable, with a
+// canary at canaryTarget taking percent of requests.
+func canaryGateway(t *testing.T, upstream, stable, canaryTarget, percent string) *balancer {
+	t.Helper()
+	t.Setenv("TEST_CANARY_URL", canaryTarget)
+	t.Setenv("TEST_CANARY_PERCENT", percent)
+	b, err := newBalancer(upstream, stable, testBreakers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCanary(b, "TEST", testBreakers); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func getWithRequestID(t *testing.T, url, id string, header http.Header) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set(requestIDHeader, id)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestCanaryPercentIsDeterministicPerRequestID(t *testing.T) {
+	var stableCalls, canaryCalls atomic.Int32
+	b := canaryGateway(t, "canary-pct",
+		countingUpstream(t, &stableCalls, nil).URL, countingUpstream(t, &canaryCalls, nil).URL, "20")
+	gw := newTestGatewayWith(t, newProxy(b, "/api/orders", "/orders"))
+
+	for i := 0; i < 200; i++ {
+		getWithRequestID(t, gw.URL+"/api/orders", fmt.Sprintf("req-%d", i), nil)
+	}
+	canary := canaryCalls.Load()
+	if canary < 20 || canary > 60 {
+		t.Errorf("expected about 20%% of 200 requests on the canary, got %d", canary)
+	}
+	if got := testutil.ToFloat64(variantRequests.WithLabelValues("canary-pct", "canary", "success")); got != float64(canary) {
+		t.Errorf("expected %d canary requests counted, got %v", canary, got)
+	}
+	if got := testutil.ToFloat64(variantRequests.WithLabelValues("canary-pct", "stable", "success")); got != float64(stableCalls.Load()) {
+		t.Errorf("expected %d stable requests counted, got %v", stableCalls.Load(), got)
+	}
+
+	// The same ids land on the same variant again.
+	before := canaryCalls.Load()
+	for i := 0; i < 200; i++ {
+		getWithRequestID(t, gw.URL+"/api/orders", fmt.Sprintf("req-%d", i), nil)
+	}
+	if again := canaryCalls.Load() - before; again != canary {
+		t.Errorf("expected the same %d ids on the canary, got %d", canary, again)
+	}
+}
+
+func TestCanaryHeaderAndRetriesStayOnCanary(t *testing.T) {
+	withRetries(t, 2)
+	var stableCalls, canaryCalls int32
+	b := canaryGateway(t, "canary-header",
+		flakyUpstream(t, 0, &stableCalls), flakyUpstream(t, 1, &canaryCalls), "0")
+	gw := newTestGatewayWith(t, newProxy(b, "/api/orders", "/orders"))
+
+	getWithRequestID(t, gw.URL+"/api/orders", "plain", nil)
+	getWithRequestID(t, gw.URL+"/api/orders", "opted-in", http.Header{"X-Canary": {"true"}})
+
+	if atomic.LoadInt32(&stableCalls) != 1 {
+		t.Errorf("expected the plain request on stable, got %d stable calls", stableCalls)
+	}
+	if atomic.LoadInt32(&canaryCalls) != 2 {
+		t.Errorf("expected the opted-in request and its retry on the canary, got %d canary calls", canaryCalls)
+	}
+}
+
+func TestCanaryFallsBackToStableWhenPulled(t *testing.T) {
+	withRetries(t, 0)
+	var stableCalls, canaryCalls atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	b := canaryGateway(t, "canary-eject",
+		countingUpstream(t, &stableCalls, nil).URL, countingUpstream(t, &canaryCalls, &failing).URL, "100")
+	b.canary.balancer.probeEvery = 10 * time.Millisecond
+	gw := newTestGatewayWith(t, newProxy(b, "/api/orders", "/orders"))
+
+	for i := 0; i < ejectAfterFailures+3; i++ {
+		getWithRequestID(t, gw.URL+"/api/orders", fmt.Sprintf("req-%d", i), nil)
+	}
+	if canaryCalls.Load() != int32(ejectAfterFailures) {
+		t.Errorf("expected the canary pulled after %d failures, got %d calls", ejectAfterFailures, canaryCalls.Load())
+	}
+	if stableCalls.Load() != 3 {
+		t.Errorf("expected stable to take the canary's traffic, got %d calls", stableCalls.Load())
+	}
+
+	failing.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if testutil.ToFloat64(instanceUp.WithLabelValues("canary-eject-canary", b.canary.balancer.instances[0].url.Host)) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("canary wasn't put back in rotation once healthy")
+}
+
+func TestCanaryKillSwitch(t *testing.T) {
+	t.Setenv("CANARY_DISABLED", "true")
+	b := canaryGateway(t, "canary-off", newClosedUpstream(), newClosedUpstream(), "100")
+	if b.canary != nil {
+		t.Error("expected no canary with CANARY_DISABLED set")
+	}
+	t.Setenv("ORDER_SERVICE_CANARY_URL", "http://canary:8082")
+	if _, ok := upstreams()["orders-canary"]; ok {
+		t.Error("expected no canary health check with CANARY_DISABLED set")
+	}
+}
+
+func TestCanaryIsHealthChecked(t *testing.T) {
+	t.Setenv("ORDER_SERVICE_CANARY_URL", "http://canary:8082")
+	if got := upstreams()["orders-canary"]; got != "http://canary:8082" {
+		t.Errorf("expected the canary in the health check, got %q", got)
+	}
+}
+
+func TestLoadCanaryRejectsBadPercent(t *testing.T) {
+	b, _ := newBalancer("canary-bad", "http://stable:8082", testBreakers)
+	t.Setenv("TEST_CANARY_URL", "http://canary:8082")
+	t.Setenv("TEST_CANARY_PERCENT", "150")
+	if err := loadCanary(b, "TEST", testBreakers); err == nil {
+		t.Error("expected an error for a percentage over 100")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest body worth compressing; below it gzip's
+// header and trailer eat most of the saving.
+const gzipMinSize = 1024
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return w
+}}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		if strings.HasPrefix(q, "q=") {
+			if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressible reports whether a response of contentType is worth
+// compressing; images, archives and the like already are. Server-sent
+// events are left alone: each event is too small to gain much, and some
+// clients and proxies hold compressed streams back.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/xml",
+		mediaType == "application/javascript",
+		mediaType == "application/x-ndjson",
+		mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// gzipMiddleware compresses responses for clients that accept gzip. The
+// decision waits for the response headers and, when the length isn't
+// declared, the first gzipMinSize bytes, so small bodies go out as they
+// are. Streamed responses are compressed as they are flushed rather
+// than buffered whole.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			// Responses that could be compressed still vary on the header.
+			next.ServeHTTP(&varyWriter{ResponseWriter: w}, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// addVary adds Accept-Encoding to h's Vary unless it's there already.
+func addVary(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if f := strings.TrimSpace(field); f == "*" || strings.EqualFold(f, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// varyWriter adds Vary: Accept-Encoding to compressible responses sent
+// uncompressed because the client didn't ask, so caches don't serve
+// them to clients that did.
+type varyWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (v *varyWriter) WriteHeader(status int) {
+	if !v.wroteHeader {
+		v.wroteHeader = true
+		if h := v.Header(); h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+			addVary(h)
+		}
+	}
+	v.ResponseWriter.WriteHeader(status)
+}
+
+func (v *varyWriter) Write(b []byte) (int, error) {
+	if !v.wroteHeader {
+		v.WriteHeader(http.StatusOK)
+	}
+	return v.ResponseWriter.Write(b)
+}
+
+func (v *varyWriter) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
+
+// gzipResponseWriter holds back the status and the start of the body
+// until it knows whether to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool // WriteHeader was called by the handler
+	decided     bool
+	gz          *gzip.Writer // nil when passing the body through
+	buf         []byte
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader || g.decided {
+		return
+	}
+	// Informational responses, such as 101 for an upgraded connection,
+	// go straight out.
+	if status >= 100 && status < 200 {
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	g.status, g.wroteHeader = status, true
+
+	h := g.Header()
+	if !g.eligible() {
+		g.decide(false)
+		return
+	}
+	addVary(h)
+	if cl := h.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		g.decide(err == nil && n >= gzipMinSize)
+	}
+}
+
+// eligible reports whether the response could be compressed at all.
+func (g *gzipResponseWriter) eligible() bool {
+	h := g.Header()
+	switch {
+	case g.status == http.StatusNoContent, g.status == http.StatusNotModified,
+		g.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	return compressible(h.Get("Content-Type"))
+}
+
+// decide sends the held-back header and body, compressed or not.
+func (g *gzipResponseWriter) decide(compress bool) error {
+	g.decided = true
+	if compress {
+		h := g.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// A strong ETag names the uncompressed bytes.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		g.gz = gzipWriters.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+
+	buf := g.buf
+	g.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := g.write(buf)
+	return err
+}
+
+func (g *gzipResponseWriter) write(b []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.decided {
+		return g.write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what has been written so far. A stream flushed before
+// reaching gzipMinSize is compressed anyway, since more is likely to
+// follow.
+func (g *gzipResponseWriter) Flush() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.decided {
+		g.decide(true)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Hijack hands over the connection for upgraded responses, which are
+// never compressed.
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if g.decided || g.wroteHeader {
+		return nil, nil, errors.New("gzip: response already started")
+	}
+	return http.NewResponseController(g.ResponseWriter).Hijack()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// close sends a body that never reached gzipMinSize as it is and ends
+// the gzip stream.
+func (g *gzipResponseWriter) close() {
+	if !g.decided {
+		if !g.wroteHeader {
+			// Nothing was written; leave the response to net/http.
+			return
+		}
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+		g.gz.Reset(io.Discard)
+		gzipWriters.Put(g.gz)
+		g.gz = nil
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getGzip(t *testing.T, url, acceptEncoding string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	// Setting Accept-Encoding ourselves stops the client decompressing.
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("gzip.NewReader: %s", err)
+		}
+		body = zr
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading body: %s", err)
+	}
+	return resp, string(b)
+}
+
+func TestGzipResponses(t *testing.T) {
+	large := `[` + strings.Repeat(`{"name":"widget","price":9.99},`, 100) + `{}]`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/products":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, large)
+		case "/products/1":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"widget"}`)
+		case "/products/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, 4096))
+		case "/products/compressed":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, large)
+			zw.Close()
+		}
+	}))
+	defer upstream.Close()
+	gw := newTestGateway(t, upstream.URL)
+
+	tests := []struct {
+		name, path, accept string
+		gzipped            bool
+		vary               bool
+	}{
+		{"large json", "/api/products", "gzip, deflate", true, true},
+		{"gzip refused", "/api/products", "gzip;q=0, deflate", false, true},
+		{"no accept-encoding", "/api/products", "", false, true},
+		{"small body", "/api/products/1", "gzip", false, true},
+		{"image", "/api/products/image", "gzip", false, false},
+		{"already compressed", "/api/products/compressed", "gzip", true, false},
+	}
+	for _, tt := range tests {
+		resp, body := getGzip(t, gw.URL+tt.path, tt.accept)
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+			t.Errorf("%s: gzipped = %t, want %t", tt.name, got, tt.gzipped)
+		}
+		if got := resp.Header.Get("Vary") == "Accept-Encoding"; got != tt.vary {
+			t.Errorf("%s: Vary = %q", tt.name, resp.Header.Values("Vary"))
+		}
+		if tt.path == "/api/products" && body != large {
+			t.Errorf("%s: body mismatch, got %d bytes", tt.name, len(body))
+		}
+	}
+
+	resp, _ := getGzip(t, gw.URL+"/api/products", "gzip")
+	if etag := resp.Header.Get("ETag"); etag != `W/"v1"` {
+		t.Errorf("compressed ETag = %q, want it weakened", etag)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl == strconv.Itoa(len(large)) {
+		t.Errorf("compressed response kept the uncompressed Content-Length %s", cl)
+	}
+}
+
+func TestGzipStreamsIncrementally(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"id":1}`+"\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, `{"id":2}`+"\n")
+	}))
+	defer upstream.Close()
+	defer close(release)
+	gw := newTestGateway(t, upstream.URL)
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/payments/export", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("stream not compressed: %v", resp.Header)
+	}
+
+	line := make(chan string, 1)
+	go func() {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		s, _ := bufio.NewReader(zr).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case got := <-line:
+		if got != `{"id":1}`+"\n" {
+			t.Errorf("unexpected first line %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first line wasn't flushed before the upstream finished")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, GZIP":        true,
+		"br;q=1.0, gzip;q=0.5": true,
+		"gzip;q=0":             false,
+		"*":                    true,
+		"identity":             false,
+	}
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var configReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_config_reloads_total",
+		Help: "Gateway config reloads, by outcome (applied, rejected or unchanged)",
+	},
+	[]string{"outcome"},
+)
+
+// gatewayConfig is the configuration the gateway can take on without a
+// restart: where each upstream is, how long it may take to respond, the
+// rate limits, the API version table, maintenance windows, response
+// transforms, hedged routes, client IP lists, mirrors, access policies
+// and WebSocket routes. Its defaults come from the environment, and
+// GATEWAY_CONFIG_FILE, in YAML or JSON, overrides them.
+type gatewayConfig struct {
+	// Upstreams are comma-separated instance URLs by upstream name
+	// (inventory, orders, payments).
+	Upstreams       map[string]string            `yaml:"upstreams"`
+	ResponseTimeout string                       `yaml:"response_timeout"`
+	RateLimits      rateLimitConfig              `yaml:"rate_limits"`
+	APIVersions     map[string]map[string]string `yaml:"api_versions"`
+	// Maintenance puts upstreams in maintenance mode, by name.
+	Maintenance map[string]maintenanceWindow `yaml:"maintenance"`
+	// Transforms remove or rename fields of JSON responses.
+	Transforms []transformConfig `yaml:"transforms"`
+	// Hedging lists the routes whose slow reads are hedged, in the form
+	// of HEDGE_ROUTES.
+	Hedging string `yaml:"hedging"`
+	// IPAccess allows and denies client IPs, for the whole API and per
+	// route.
+	IPAccess ipAccessConfig `yaml:"ip_access"`
+	// Mirrors copy requests to shadow upstreams.
+	Mirrors []mirrorConfig `yaml:"mirrors"`
+	// AccessPolicies name the roles or API key scopes routes require.
+	AccessPolicies []accessPolicyConfig `yaml:"access_policies"`
+	// Websockets tunnel WebSocket upgrades to upstreams, by route.
+	Websockets []websocketConfig `yaml:"websockets"`
+}
+
+// rateLimitConfig holds policies in the form of RATE_LIMIT_READ,
+// RATE_LIMIT_WRITE and RATE_LIMIT_OVERRIDES.
+type rateLimitConfig struct {
+	Read      string `yaml:"read"`
+	Write     string `yaml:"write"`
+	Overrides string `yaml:"overrides"`
+}
+
+// envConfig is the config given by environment variables.
+func envConfig() (*gatewayConfig, error) {
+	cfg := &gatewayConfig{
+		Upstreams: map[string]string{
+			"inventory": getEnv("INVENTORY_SERVICE_URL", "http://localhost:8081"),
+			"orders":    getEnv("ORDER_SERVICE_URL", "http://localhost:8082"),
+			"payments":  getEnv("PAYMENT_SERVICE_URL", "http://localhost:8084"),
+		},
+		ResponseTimeout: loadDuration("UPSTREAM_RESPONSE_TIMEOUT", 30*time.Second).String(),
+		RateLimits: rateLimitConfig{
+			Read:      getEnv("RATE_LIMIT_READ", "20:40"),
+			Write:     getEnv("RATE_LIMIT_WRITE", "5:10"),
+			Overrides: getEnv("RATE_LIMIT_OVERRIDES", ""),
+		},
+		APIVersions: map[string]map[string]string{aliasVersion: resourceUpstreams},
+		Hedging:     getEnv("HEDGE_ROUTES", ""),
+		IPAccess: ipAccessConfig{
+			Allow: getEnv("IP_ALLOWLIST", ""),
+			Deny:  getEnv("IP_DENYLIST", ""),
+		},
+	}
+	if raw := getEnv("API_VERSIONS", ""); raw != "" {
+		table, err := parseAPIVersions(raw)
+		if err != nil {
+			return nil, fmt.Errorf("API_VERSIONS: %w", err)
+		}
+		cfg.APIVersions = table
+	}
+	return cfg, nil
+}
+
+// loadGatewayConfig reads the config file at path over the environment's
+// config, or takes the environment's alone if path is "". The version
+// identifies the config in logs: a hash of the file, or "env".
+func loadGatewayConfig(path string) (*gatewayConfig, string, error) {
+	cfg, err := envConfig()
+	if err != nil || path == "" {
+		return cfg, "env", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:6])
+
+	// A table in the file replaces the environment's rather than adding
+	// to it.
+	cfg.APIVersions = nil
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, version, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if cfg.APIVersions == nil {
+		cfg.APIVersions = map[string]map[string]string{aliasVersion: resourceUpstreams}
+	}
+	return cfg, version, nil
+}
+
+// parsedConfig is a gatewayConfig checked and ready to apply.
+type parsedConfig struct {
+	*gatewayConfig
+	responseTimeout time.Duration
+	read, write     ratePolicy
+	overrides       []rateOverride
+	transforms      []responseTransform
+	hedges          []hedgeRoute
+	ipAccess        *ipAccess
+	mirrors         []mirror
+	policies        []accessPolicy
+	websockets      []websocketRoute
+}
+
+// validate checks every setting, so a config that would fail part way
+// through being applied is rejected up front.
+func (cfg *gatewayConfig) validate() (*parsedConfig, error) {
+	p := &parsedConfig{gatewayConfig: cfg}
+	for name := range upstreamEnvPrefixes {
+		if _, err := parseTargets(cfg.Upstreams[name]); err != nil {
+			return nil, fmt.Errorf("upstreams.%s: %w", name, err)
+		}
+	}
+	for name := range cfg.Upstreams {
+		if _, ok := upstreamEnvPrefixes[name]; !ok {
+			return nil, fmt.Errorf("upstreams: unknown upstream %q", name)
+		}
+	}
+	var err error
+	if p.responseTimeout, err = time.ParseDuration(cfg.ResponseTimeout); err != nil || p.responseTimeout <= 0 {
+		return nil, fmt.Errorf("response_timeout: %q must be a positive duration", cfg.ResponseTimeout)
+	}
+	if p.read, err = parseRatePolicy("read", cfg.RateLimits.Read); err != nil {
+		return nil, fmt.Errorf("rate_limits.read: %w", err)
+	}
+	if p.write, err = parseRatePolicy("write", cfg.RateLimits.Write); err != nil {
+		return nil, fmt.Errorf("rate_limits.write: %w", err)
+	}
+	if p.overrides, err = parseRateOverrides(cfg.RateLimits.Overrides); err != nil {
+		return nil, fmt.Errorf("rate_limits.overrides: %w", err)
+	}
+	for name := range cfg.Maintenance {
+		if _, ok := upstreamEnvPrefixes[name]; !ok {
+			return nil, fmt.Errorf("maintenance: unknown upstream %q", name)
+		}
+	}
+	if err := validateAPIVersions(cfg.APIVersions); err != nil {
+		return nil, fmt.Errorf("api_versions: %w", err)
+	}
+	if p.transforms, err = parseTransforms(cfg.Transforms); err != nil {
+		return nil, fmt.Errorf("transforms: %w", err)
+	}
+	if p.hedges, err = parseHedgeRoutes(cfg.Hedging); err != nil {
+		return nil, fmt.Errorf("hedging: %w", err)
+	}
+	if p.ipAccess, err = parseIPAccess(cfg.IPAccess); err != nil {
+		return nil, fmt.Errorf("ip_access: %w", err)
+	}
+	if p.mirrors, err = parseMirrors(cfg.Mirrors); err != nil {
+		return nil, fmt.Errorf("mirrors: %w", err)
+	}
+	if p.policies, err = parseAccessPolicies(cfg.AccessPolicies); err != nil {
+		return nil, fmt.Errorf("access_policies: %w", err)
+	}
+	if p.websockets, err = parseWebsockets(cfg.Websockets); err != nil {
+		return nil, fmt.Errorf("websockets: %w", err)
+	}
+	return p, nil
+}
+
+// routing is the router built from one config, with the balancers to
+// close once it is replaced.
+type routing struct {
+	router    *mux.Router
+	balancers []*balancer
+}
+
+// gateway serves requests with the routing built from the current
+// config, replacing it whole when the config is reloaded. Requests
+// already in flight finish on the routing they started on.
+type gateway struct {
+	path     string
+	breakers breakerConfig
+	limiter  *rateLimiter
+	// cache, if set, keeps product responses across reloads.
+	cache *responseCache
+	// middleware is added to each routing's router after the rate
+	// limiter, and lasts across reloads.
+	middleware []mux.MiddlewareFunc
+
+	reloadMu   sync.Mutex // serializes reloads
+	rateLimits rateLimitConfig
+	mu         sync.RWMutex
+	current    *routing
+	version    string
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.RLock()
+	current := g.current
+	g.mu.RUnlock()
+	current.router.ServeHTTP(w, r)
+}
+
+// reload loads the config and, if it is valid and has changed, switches
+// to routing built from it. An invalid config is rejected and the
+// current one stays in effect.
+func (g *gateway) reload() error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	cfg, version, err := loadGatewayConfig(g.path)
+	if err == nil && g.current != nil && version == g.version {
+		configReloads.WithLabelValues("unchanged").Inc()
+		return nil
+	}
+	var next *routing
+	if err == nil {
+		next, err = g.build(cfg)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("rejected").Inc()
+		if g.current != nil {
+			log.Printf("Rejected gateway config %s, keeping %s: %v", version, g.version, err)
+		}
+		return err
+	}
+
+	g.mu.Lock()
+	previous := g.current
+	g.current, g.version = next, version
+	g.mu.Unlock()
+	maintenance.setConfigured(cfg.Maintenance)
+	if previous != nil {
+		for _, b := range previous.balancers {
+			b.close()
+		}
+	}
+	configReloads.WithLabelValues("applied").Inc()
+	source := g.path
+	if source == "" {
+		source = "the environment"
+	}
+	log.Printf("Applied gateway config %s from %s: products -> %s, orders -> %s, payments -> %s",
+		version, source, cfg.Upstreams["inventory"], cfg.Upstreams["orders"], cfg.Upstreams["payments"])
+	return nil
+}
+
+// build validates cfg and builds its routing. The caller holds reloadMu.
+func (g *gateway) build(cfg *gatewayConfig) (*routing, error) {
+	p, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// These are read only while building routing, which reloadMu
+	// serializes.
+	upstreamResponseTimeout = p.responseTimeout
+	inventoryServiceURL = cfg.Upstreams["inventory"]
+	orderServiceURL = cfg.Upstreams["orders"]
+	paymentServiceURL = cfg.Upstreams["payments"]
+
+	r := &routing{}
+	proxies := map[string]http.Handler{}
+	for resource, name := range resourceUpstreams {
+		prefix := upstreamEnvPrefixes[name]
+		// Named after the service, as in order-service.
+		b, err := newBalancer(strings.ToLower(strings.ReplaceAll(prefix, "_", "-")), cfg.Upstreams[name], g.breakers)
+		if err != nil {
+			return nil, err
+		}
+		if err := loadCanary(b, prefix, g.breakers); err != nil {
+			return nil, err
+		}
+		r.balancers = append(r.balancers, b)
+		proxies[name] = newProxy(b, "/api/"+resource, "/"+resource)
+	}
+	if g.cache != nil {
+		proxies["inventory"] = g.cache.middleware(proxies["inventory"])
+	}
+	versioned, err := setAPIVersions(cfg.APIVersions, g.breakers)
+	if err != nil {
+		return nil, err
+	}
+	r.balancers = append(r.balancers, versioned...)
+	apiDocs = newAPIDocs(docSources(cfg.APIVersions, cfg.Upstreams))
+
+	r.router = newRouter(proxies["inventory"], proxies["orders"], proxies["payments"])
+	// Ahead of the rate limiter, so refused clients use up no budget.
+	r.router.Use(ipAccessMiddleware(p.ipAccess))
+	if g.limiter != nil {
+		// Unchanged limits keep their clients' buckets.
+		if cfg.RateLimits != g.rateLimits {
+			g.limiter.setPolicies(p.read, p.write, p.overrides)
+			g.rateLimits = cfg.RateLimits
+		}
+		r.router.Use(g.limiter.middleware)
+	}
+	r.router.Use(g.middleware...)
+	r.router.Use(accessPolicyMiddleware(p.policies))
+	// Ahead of hedging, mirroring and transforms, none of which apply
+	// to a tunnelled connection.
+	r.router.Use(websocketMiddleware(p.websockets))
+	r.router.Use(hedgeMiddleware(p.hedges))
+	r.router.Use(mirrorMiddleware(p.mirrors))
+	// Innermost, so the transforms see the caller's roles.
+	r.router.Use(transformMiddleware(p.transforms))
+	return r, nil
+}
+
+// watch reloads the config on SIGHUP and, with a config file, whenever
+// the file changes. The file's directory is watched rather than the
+// file, so edits that replace it, as editors and Kubernetes ConfigMaps
+// do, are seen too. If the file can't be watched, SIGHUP still works.
+// It returns when ctx is done.
+func (g *gateway) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if g.path != "" {
+		w, err := fsnotify.NewWatcher()
+		if err == nil {
+			if err = w.Add(filepath.Dir(g.path)); err != nil {
+				w.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Not watching %s for changes, reload with SIGHUP: %v", g.path, err)
+		} else {
+			defer w.Close()
+			events, errs = w.Events, w.Errors
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("Reloading gateway config on SIGHUP")
+		case e := <-events:
+			// Writes often come in bursts; reloading an unchanged file
+			// is skipped by its hash.
+			if e.Has(fsnotify.Chmod) && !e.Has(fsnotify.Write) {
+				continue
+			}
+		case err := <-errs:
+			log.Printf("Watching gateway config: %v", err)
+			continue
+		}
+		g.reload()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// writeConfig writes a gateway config routing every upstream to target.
+func writeConfig(t *testing.T, path, target, extra string) {
+	t.Helper()
+	data := "upstreams:\n  inventory: " + target + "\n  orders: " + target + "\n  payments: " + target + "\n" + extra
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// configGateway serves a gateway configured from the file at path.
+func configGateway(t *testing.T, path string) (*gateway, *httptest.Server) {
+	t.Helper()
+	return configGatewayWith(t, path)
+}
+
+// configGatewayWith is configGateway with middleware, such as auth, in
+// place of none.
+func configGatewayWith(t *testing.T, path string, middleware ...mux.MiddlewareFunc) (*gateway, *httptest.Server) {
+	t.Helper()
+	oldTable, oldUpstreams, oldTimeout := apiVersionTable, versionedUpstreams, upstreamResponseTimeout
+	t.Cleanup(func() {
+		apiVersionTable, versionedUpstreams, upstreamResponseTimeout = oldTable, oldUpstreams, oldTimeout
+	})
+	g := &gateway{path: path, breakers: testBreakers, middleware: append([]mux.MiddlewareFunc{}, middleware...)}
+	if err := g.reload(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+	return g, srv
+}
+
+func TestConfigReloadSwitchesUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, pathUpstream(t, "first"), "")
+	g, gw := configGateway(t, path)
+	firstVersion := g.version
+
+	if _, body := getBody(t, gw.URL+"/api/orders/1"); body != "first /orders/1" {
+		t.Fatalf("expected the first upstream, got %q", body)
+	}
+
+	writeConfig(t, path, pathUpstream(t, "second"), "response_timeout: 5s\n")
+	if err := g.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if g.version == firstVersion {
+		t.Error("expected a new config version")
+	}
+	if _, body := getBody(t, gw.URL+"/api/orders/1"); body != "second /orders/1" {
+		t.Errorf("expected the second upstream after reloading, got %q", body)
+	}
+	if upstreamResponseTimeout != 5*time.Second {
+		t.Errorf("expected the response timeout from the file, got %s", upstreamResponseTimeout)
+	}
+}
+
+func TestConfigReloadRejectsInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	writeConfig(t, path, pathUpstream(t, "good"), "")
+	g, gw := configGateway(t, path)
+	version := g.version
+
+	for _, extra := range []string{
+		"response_timeout: soon\n",
+		"rate_limits:\n  read: fast\n",
+		"api_versions:\n  v2:\n    orders: orders\n",
+		"upstreams:\n  search: http://search:8080\n",
+		"not: [valid\n",
+	} {
+		writeConfig(t, path, pathUpstream(t, "bad"), extra)
+		if err := g.reload(); err == nil {
+			t.Errorf("expected %q rejected", extra)
+		}
+	}
+	writeConfig(t, path, "relative/url", "")
+	if err := g.reload(); err == nil {
+		t.Error("expected a relative upstream URL rejected")
+	}
+
+	if g.version != version {
+		t.Errorf("expected version %s kept, got %s", version, g.version)
+	}
+	if _, body := getBody(t, gw.URL+"/api/orders/1"); body != "good /orders/1" {
+		t.Errorf("expected the previous config still routing, got %q", body)
+	}
+}
+
+func TestConfigReloadsJSONAndVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	stable, v2 := pathUpstream(t, "stable"), pathUpstream(t, "v2")
+	data := `{"upstreams": {"inventory": "` + stable + `", "orders": "` + stable + `", "payments": "` + stable + `"},
+		"api_versions": {"v1": {"products": "inventory", "orders": "orders", "payments": "payments"}, "v2": {"orders": "` + v2 + `"}}}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, gw := configGateway(t, path)
+
+	if _, body := getBody(t, gw.URL+"/api/v2/orders/3"); body != "v2 /orders/3" {
+		t.Errorf("expected v2 orders from the config file's table, got %q", body)
+	}
+}
+
+func TestConfigWatchReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, pathUpstream(t, "before"), "")
+	g, gw := configGateway(t, path)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		g.watch(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// Replace the file as editors do, by renaming a new one over it.
+	tmp := path + ".tmp"
+	writeConfig(t, tmp, pathUpstream(t, "after"), "")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, body := getBody(t, gw.URL+"/api/orders/1"); body == "after /orders/1" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("config change wasn't picked up")
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// docsSpecPath is where upstreams serve their OpenAPI document, and
+	// docsCacheTTL how long the merged document is reused.
+	docsSpecPath = getEnv("DOCS_SPEC_PATH", "/openapi.json")
+	docsCacheTTL = loadDuration("DOCS_CACHE_TTL", 5*time.Minute)
+)
+
+// maxSpecSize is the largest upstream OpenAPI document read.
+const maxSpecSize = 4 << 20
+
+// apiDocs is the API documentation of the current config. Set while
+// building routing.
+var apiDocs = newAPIDocs(nil)
+
+// docSource is an upstream whose OpenAPI document is merged into the
+// gateway's, with the gateway path prefix each of its paths is served
+// under, by the path's prefix upstream.
+type docSource struct {
+	name     string
+	urls     []*url.URL
+	prefixes map[string][]string
+}
+
+// docSources lists the upstreams table serves, each named upstream by
+// its URLs in upstreams. Sources are sorted by name so the merged
+// document is stable.
+func docSources(table map[string]map[string]string, upstreams map[string]string) []docSource {
+	byTarget := map[string]*docSource{}
+	for version, resources := range table {
+		for resource, target := range resources {
+			src, ok := byTarget[target]
+			if !ok {
+				targets, name := target, target
+				if _, named := upstreamEnvPrefixes[target]; named {
+					targets = upstreams[target]
+				} else {
+					name = resource + "-" + version
+				}
+				urls, err := parseTargets(targets)
+				if err != nil {
+					continue
+				}
+				src = &docSource{name: name, urls: urls, prefixes: map[string][]string{}}
+				byTarget[target] = src
+			}
+			src.prefixes["/"+resource] = append(src.prefixes["/"+resource], "/api/"+version+"/"+resource)
+		}
+	}
+	var sources []docSource
+	for _, src := range byTarget {
+		for _, prefixes := range src.prefixes {
+			sort.Strings(prefixes)
+		}
+		sources = append(sources, *src)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources
+}
+
+// docsAggregator serves one OpenAPI document for the whole API, merged
+// from its upstreams' documents with their paths rewritten to where the
+// gateway serves them, and a page to browse it. The merged document is
+// cached for docsCacheTTL. An upstream without a document is listed as
+// a tag saying so, rather than failing the rest.
+type docsAggregator struct {
+	sources []docSource
+	client  *http.Client
+
+	mu      sync.Mutex
+	spec    []byte
+	builtAt time.Time
+}
+
+func newAPIDocs(sources []docSource) *docsAggregator {
+	return &docsAggregator{sources: sources, client: &http.Client{Timeout: upstreamHealthTimeout}}
+}
+
+func (d *docsAggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/docs" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, docsPage)
+		return
+	}
+	spec, err := d.document(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to build API documentation")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(docsCacheTTL.Seconds())))
+	w.Write(spec)
+}
+
+// document returns the merged document, building it again once it is
+// older than docsCacheTTL.
+func (d *docsAggregator) document(ctx context.Context) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.spec != nil && time.Since(d.builtAt) < docsCacheTTL {
+		return d.spec, nil
+	}
+	specs := make([]map[string]interface{}, len(d.sources))
+	errs := make([]error, len(d.sources))
+	var wg sync.WaitGroup
+	for i, src := range d.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The document outlives the request that builds it, so a
+			// client going away mustn't leave it cached without upstreams.
+			specs[i], errs[i] = d.fetch(context.WithoutCancel(ctx), src)
+		}()
+	}
+	wg.Wait()
+
+	spec, err := json.Marshal(mergeSpecs(d.sources, specs, errs))
+	if err != nil {
+		return nil, err
+	}
+	d.spec, d.builtAt = spec, time.Now()
+	return spec, nil
+}
+
+// fetch gets src's document from the first of its instances to serve
+// one.
+func (d *docsAggregator) fetch(ctx context.Context, src docSource) (map[string]interface{}, error) {
+	var lastErr error
+	for _, u := range src.urls {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(u.String(), "/")+docsSpecPath, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var spec map[string]interface{}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxSpecSize)).Decode(&spec)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode != http.StatusOK:
+			lastErr = fmt.Errorf("%s returned %d", docsSpecPath, resp.StatusCode)
+		case err != nil:
+			lastErr = fmt.Errorf("%s isn't JSON: %w", docsSpecPath, err)
+		case spec["paths"] == nil:
+			lastErr = fmt.Errorf("%s has no paths", docsSpecPath)
+		default:
+			return spec, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// mergeSpecs merges the upstreams' documents, specs[i] being sources[i]'s
+// or nil with the reason in errs[i]. Each upstream is a tag, given to
+// its operations that have none. Its paths outside the prefixes the
+// gateway serves, such as /health, are left out. Components named the
+// same by two upstreams but differing are renamed after the second, as
+// in orders.Error, and its references to them rewritten.
+func mergeSpecs(sources []docSource, specs []map[string]interface{}, errs []error) map[string]interface{} {
+	paths := map[string]interface{}{}
+	components := map[string]map[string]interface{}{}
+	var tags []interface{}
+
+	for i, src := range sources {
+		spec := specs[i]
+		if spec == nil {
+			tags = append(tags, map[string]interface{}{
+				"name":                   src.name,
+				"description":            fmt.Sprintf("No API document available: %v", errs[i]),
+				"x-gateway-spec-missing": true,
+			})
+			continue
+		}
+		tag := map[string]interface{}{"name": src.name}
+		if info, ok := spec["info"].(map[string]interface{}); ok {
+			if title, ok := info["title"].(string); ok {
+				tag["description"] = title
+			}
+		}
+		tags = append(tags, tag)
+
+		renames := map[string]string{}
+		var added [][2]string
+		if comps, ok := spec["components"].(map[string]interface{}); ok {
+			for kind, entries := range comps {
+				entries, ok := entries.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if components[kind] == nil {
+					components[kind] = map[string]interface{}{}
+				}
+				for name, def := range entries {
+					merged := name
+					if existing, taken := components[kind][name]; taken {
+						if sameJSON(existing, def) {
+							continue
+						}
+						merged = src.name + "." + name
+						renames["#/components/"+kind+"/"+name] = "#/components/" + kind + "/" + merged
+					}
+					components[kind][merged] = def
+					added = append(added, [2]string{kind, merged})
+				}
+			}
+			for _, c := range added {
+				components[c[0]][c[1]] = rewriteRefs(components[c[0]][c[1]], renames)
+			}
+		}
+
+		upstreamPaths, _ := spec["paths"].(map[string]interface{})
+		for path, item := range upstreamPaths {
+			item = rewriteRefs(item, renames)
+			tagOperations(item, src.name)
+			for prefix, served := range src.prefixes {
+				if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+					continue
+				}
+				for _, to := range served {
+					paths[to+strings.TrimPrefix(path, prefix)] = item
+				}
+			}
+		}
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Inventory system API",
+			"version":     aliasVersion,
+			"description": "All endpoints served through the API gateway. Unversioned paths such as /api/products are deprecated aliases of /api/v1.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/"}},
+		"tags":    tags,
+		"paths":   paths,
+	}
+	if len(components) > 0 {
+		doc["components"] = components
+	}
+	return doc
+}
+
+// tagOperations gives the operations of a path item without tags the
+// upstream's.
+func tagOperations(item interface{}, tag string) {
+	ops, ok := item.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for method, op := range ops {
+		switch method {
+		case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+		default:
+			continue
+		}
+		if op, ok := op.(map[string]interface{}); ok && op["tags"] == nil {
+			op["tags"] = []interface{}{tag}
+		}
+	}
+}
+
+// rewriteRefs returns v with each $ref in renames replaced.
+func rewriteRefs(v interface{}, renames map[string]string) interface{} {
+	if len(renames) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				if to, ok := renames[ref]; ok {
+					v[k] = to
+				}
+				continue
+			}
+			v[k] = rewriteRefs(child, renames)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = rewriteRefs(child, renames)
+		}
+	}
+	return v
+}
+
+func sameJSON(a, b interface{}) bool {
+	x, err1 := json.Marshal(a)
+	y, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(x) == string(y)
+}
+
+// docsPage browses the merged document with Swagger UI.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Inventory system API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/docs/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// specUpstream serves spec at /openapi.json, counting requests for it.
+func specUpstream(t *testing.T, spec string, calls *atomic.Int32) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openapi.json" || spec == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if calls != nil {
+			calls.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(spec))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// withAPIDocs serves docs merged from the upstreams for the default
+// version table.
+func withAPIDocs(t *testing.T, upstreams map[string]string) {
+	t.Helper()
+	old := apiDocs
+	apiDocs = newAPIDocs(docSources(map[string]map[string]string{aliasVersion: resourceUpstreams}, upstreams))
+	t.Cleanup(func() { apiDocs = old })
+}
+
+const inventorySpec = `{
+  "openapi": "3.0.3",
+  "info": {"title": "Inventory service"},
+  "paths": {
+    "/products/{id}": {"get": {"responses": {"404": {"$ref": "#/components/responses/NotFound"}}}},
+    "/health": {"get": {}}
+  },
+  "components": {
+    "schemas": {"Error": {"type": "object", "properties": {"error": {"type": "string"}}}},
+    "responses": {"NotFound": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}}
+  }
+}`
+
+const ordersSpec = `{
+  "openapi": "3.0.3",
+  "info": {"title": "Order service"},
+  "paths": {
+    "/orders": {"post": {"tags": ["orders"], "responses": {"400": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}}}}
+  },
+  "components": {
+    "schemas": {"Error": {"type": "object", "properties": {"message": {"type": "string"}}}}
+  }
+}`
+
+func TestAPIDocsMergesUpstreams(t *testing.T) {
+	withAPIDocs(t, map[string]string{
+		"inventory": specUpstream(t, inventorySpec, nil),
+		"orders":    specUpstream(t, ordersSpec, nil),
+		"payments":  specUpstream(t, "", nil),
+	})
+	gw := newTestGatewayWith(t, http.NotFoundHandler())
+
+	resp, body := getBody(t, gw.URL+"/api/docs/openapi.json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var doc struct {
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Tags       []map[string]interface{}                     `json:"tags"`
+		Components map[string]map[string]interface{}            `json:"components"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := doc.Paths["/api/v1/products/{id}"]; !ok {
+		t.Errorf("paths %v: want /products/{id} served as /api/v1/products/{id}", keys(doc.Paths))
+	}
+	if _, ok := doc.Paths["/health"]; ok || len(doc.Paths) != 2 {
+		t.Errorf("paths %v: want only the two under the API", keys(doc.Paths))
+	}
+	if tags := doc.Paths["/api/v1/products/{id}"]["get"]["tags"]; tags == nil || tags.([]interface{})[0] != "inventory" {
+		t.Errorf("untagged operation got tags %v, want its upstream's", tags)
+	}
+
+	// The orders service's Error differs from inventory's, so it is
+	// renamed along with its references.
+	if _, ok := doc.Components["schemas"]["orders.Error"]; !ok {
+		t.Errorf("schemas %v: want orders.Error", keys(doc.Components["schemas"]))
+	}
+	if !strings.Contains(body, `"$ref":"#/components/schemas/orders.Error"`) {
+		t.Error("orders reference wasn't rewritten to orders.Error")
+	}
+	if !strings.Contains(body, `{"$ref":"#/components/schemas/Error"}`) {
+		t.Error("inventory's own reference to Error was changed")
+	}
+
+	var stub map[string]interface{}
+	for _, tag := range doc.Tags {
+		if tag["name"] == "payments" {
+			stub = tag
+		}
+	}
+	if stub == nil || stub["x-gateway-spec-missing"] != true {
+		t.Errorf("tags %v: want a stub for payments, which has no spec", doc.Tags)
+	}
+}
+
+func TestAPIDocsCachedAndPage(t *testing.T) {
+	var calls atomic.Int32
+	withAPIDocs(t, map[string]string{
+		"inventory": specUpstream(t, inventorySpec, &calls),
+		"orders":    newClosedUpstream(),
+		"payments":  newClosedUpstream(),
+	})
+	gw := newTestGatewayWith(t, http.NotFoundHandler())
+
+	for i := 0; i < 3; i++ {
+		if resp, body := getBody(t, gw.URL+"/api/docs/openapi.json"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstream spec fetched %d times, want once while cached", calls.Load())
+	}
+
+	resp, body := getBody(t, gw.URL+"/api/docs")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("docs page: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(body, "/api/docs/openapi.json") {
+		t.Error("docs page doesn't load the merged spec")
+	}
+}
+
+func keys[V any](m map[string]V) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxErrorMessage is the longest upstream error message passed on;
+// longer ones are cut short.
+const maxErrorMessage = 512
+
+// maxErrorBody is how much of a plain-text error body is read.
+const maxErrorBody = 64 << 10
+
+// internalErrorPatterns match error text that gives away internals, such
+// as SQL, database driver errors and stack traces. Messages matching
+// them are replaced by the status text.
+var internalErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bpq: `),
+	regexp.MustCompile(`(?i)\bsql: `),
+	regexp.MustCompile(`(?i)\b(select\s.+\sfrom|insert\s+into|update\s.+\sset|delete\s+from)\b`),
+	regexp.MustCompile(`(?i)\b(syntax error at or near|violates \w+ constraint|relation "[^"]+" does not exist)`),
+	regexp.MustCompile(`goroutine \d+ \[|panic: |runtime error: `),
+	regexp.MustCompile(`\.go:\d+`),
+	regexp.MustCompile(`\bat [\w.$]+\([\w.]+:\d+\)`),
+}
+
+// upstreamError is the JSON body an upstream's plain-text error is
+// turned into.
+type upstreamError struct {
+	Error struct {
+		Message  string `json:"message"`
+		Status   int    `json:"status"`
+		Upstream string `json:"upstream"`
+	} `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// normalizeError rewrites a non-2xx plain-text response from upstream,
+// such as one from http.Error, as a JSON upstreamError. JSON and other
+// bodies are passed through untouched.
+func normalizeError(resp *http.Response, upstream string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified ||
+		resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		return nil
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var body upstreamError
+	body.Error.Message = errorMessage(string(raw), resp.StatusCode)
+	body.Error.Status = resp.StatusCode
+	body.Error.Upstream = upstream
+	if resp.Request != nil {
+		body.RequestID = requestIDFrom(resp.Request.Context())
+		if body.Error.Message != strings.TrimSpace(string(raw)) {
+			loggerFrom(resp.Request.Context()).Warn("redacted upstream error",
+				"upstream", upstream, "status", resp.StatusCode, "message", truncate(strings.TrimSpace(string(raw)), maxErrorMessage))
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Header.Set("Content-Type", "application/json")
+	return nil
+}
+
+// errorMessage is the message passed on for an upstream's error text:
+// the text, trimmed and cut to maxErrorMessage, or the status text if it
+// is empty or gives away internals.
+func errorMessage(text string, status int) string {
+	generic := http.StatusText(status)
+	if generic == "" {
+		generic = "Upstream error"
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return generic
+	}
+	for _, p := range internalErrorPatterns {
+		if p.MatchString(text) {
+			return generic
+		}
+	}
+	return truncate(text, maxErrorMessage)
+}
+
+// truncate cuts s to at most n bytes, on a rune boundary, marking the cut
+// with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "…"
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizesPlainTextErrors(t *testing.T) {
+	withRetries(t, 0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/orders/stock":
+			http.Error(w, "Insufficient stock", http.StatusConflict)
+		case "/orders/sql":
+			http.Error(w, `pq: duplicate key value violates unique constraint "orders_pkey"`, http.StatusInternalServerError)
+		case "/orders/huge":
+			http.Error(w, strings.Repeat("x", 10000), http.StatusBadRequest)
+		case "/orders/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not_found"}`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer upstream.Close()
+	gw := newTestGatewayWith(t, testProxy(t, "orders", upstream.URL, "/api/orders", "/orders"))
+
+	tests := []struct {
+		path, message string
+		status        int
+	}{
+		{"/api/orders/stock", "Insufficient stock", http.StatusConflict},
+		{"/api/orders/sql", "Internal Server Error", http.StatusInternalServerError},
+		{"/api/orders/huge", strings.Repeat("x", maxErrorMessage) + "…", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, body := getBody(t, gw.URL+tt.path)
+		if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: status %d, content type %q", tt.path, resp.StatusCode, resp.Header.Get("Content-Type"))
+			continue
+		}
+		var got upstreamError
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Errorf("%s: body %q isn't JSON: %v", tt.path, body, err)
+			continue
+		}
+		if got.Error.Message != tt.message || got.Error.Status != tt.status || got.Error.Upstream != "orders" {
+			t.Errorf("%s: error %+v, want message %q", tt.path, got.Error, tt.message)
+		}
+		if got.RequestID == "" || got.RequestID != resp.Header.Get(requestIDHeader) {
+			t.Errorf("%s: request id %q, want the response's", tt.path, got.RequestID)
+		}
+	}
+
+	if resp, body := getBody(t, gw.URL+"/api/orders/json"); body != `{"code":"not_found"}` {
+		t.Errorf("JSON error: status %d body %q, want it passed through", resp.StatusCode, body)
+	}
+	if resp, body := getBody(t, gw.URL+"/api/orders/1"); body != "ok" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("plain-text success: body %q, want it passed through", body)
+	}
+}
+
+func TestErrorMessageHidesInternals(t *testing.T) {
+	leaks := []string{
+		"sql: no rows in result set",
+		`ERROR: relation "orders" does not exist`,
+		"failed: SELECT id, stock FROM products WHERE id = 4",
+		`pq: syntax error at or near "FROM"`,
+		"panic: runtime error: index out of range\n\ngoroutine 1 [running]:\nmain.main()\n\t/app/main.go:12 +0x1d",
+	}
+	for _, text := range leaks {
+		if got := errorMessage(text, http.StatusInternalServerError); got != "Internal Server Error" {
+			t.Errorf("errorMessage(%q) = %q, want it hidden", text, got)
+		}
+	}
+	for _, text := range []string{"Insufficient stock", "Product not found", "Invalid request: quantity must be positive"} {
+		if got := errorMessage(text+"\n", http.StatusBadRequest); got != text {
+			t.Errorf("errorMessage(%q) = %q, want it kept", text, got)
+		}
+	}
+	if got := errorMessage("", 599); got != "Upstream error" {
+		t.Errorf("empty message with an unknown status = %q", got)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the load balancers in front of the gateway, from
+// TRUSTED_PROXIES: a comma-separated list of addresses and CIDRs. Only
+// their X-Forwarded-* headers are believed.
+var trustedProxies proxyList
+
+// proxyList is a set of networks.
+type proxyList []*net.IPNet
+
+func (l proxyList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(raw string) (proxyList, error) {
+	var nets proxyList
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy reports whether req's connection comes from one of
+// trustedProxies.
+func fromTrustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && trustedProxies.contains(ip)
+}
+
+// setForwardedHeaders sets X-Forwarded-Host and X-Forwarded-Proto on an
+// outgoing request, and drops any X-Forwarded-* a client sent itself
+// unless it came through a trusted proxy, whose values are kept. The
+// ReverseProxy then appends the connecting address to X-Forwarded-For.
+// Hop-by-hop headers are removed by the ReverseProxy in both directions.
+func setForwardedHeaders(req *http.Request) {
+	if !fromTrustedProxy(req) {
+		for _, h := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"} {
+			req.Header.Del(h)
+		}
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+// clientIP is the address a request came from. X-Forwarded-For is only
+// believed when the connection is from one of trusted, and then read
+// from the right, skipping further trusted proxies, so a client can't
+// pick its own address by sending the header itself.
+func clientIP(r *http.Request, trusted proxyList) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted.contains(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted.contains(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
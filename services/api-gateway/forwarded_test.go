@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// headerGateway serves the gateway, auth middleware included, in front
+// of an upstream that records the headers it got and answers with
+// hop-by-hop headers of its own.
+func headerGateway(t *testing.T, got *http.Header) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r.Header.Clone()
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Kept", "1")
+	}))
+	t.Cleanup(upstream.Close)
+	router := newRouter(http.NotFoundHandler(), testProxy(t, "forwarded", upstream.URL, "/api/orders", "/orders"), http.NotFoundHandler())
+	router.Use(authMiddleware(nil, nil))
+	gw := httptest.NewServer(router)
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func withTrustedProxies(t *testing.T, raw string) {
+	t.Helper()
+	old := trustedProxies
+	nets, err := parseCIDRs(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = nets
+	t.Cleanup(func() { trustedProxies = old })
+}
+
+func spoofedRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/api/orders", nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	req.Header.Set(userIDHeader, "1")
+	req.Header.Set(userRolesHeader, "admin")
+	req.Header.Set("X-Custom", "kept")
+	return req
+}
+
+func TestProxyHeadersFromUntrustedClient(t *testing.T) {
+	withTrustedProxies(t, "")
+	var got http.Header
+	gw := headerGateway(t, &got)
+
+	resp, err := http.DefaultClient.Do(spoofedRequest(t, gw.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := map[string]string{
+		"X-Forwarded-For":   "127.0.0.1",
+		"X-Forwarded-Host":  strings.TrimPrefix(gw.URL, "http://"),
+		"X-Forwarded-Proto": "http",
+		"X-Custom":          "kept",
+	}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("upstream got %s %q, want %q", name, got.Values(name), value)
+		}
+	}
+	for _, name := range []string{"X-Client-Hop", "Proxy-Authorization", "Forwarded", userIDHeader, userRolesHeader} {
+		if v := got.Values(name); len(v) != 0 {
+			t.Errorf("upstream got %s %q, want it dropped", name, v)
+		}
+	}
+	if c := got.Get("Connection"); strings.Contains(c, "X-Client-Hop") {
+		t.Errorf("upstream got Connection %q", c)
+	}
+
+	if resp.Header.Get("X-Kept") != "1" {
+		t.Error("end-to-end response header dropped")
+	}
+	for _, name := range []string{"X-Upstream-Hop", "Proxy-Authenticate"} {
+		if v := resp.Header.Values(name); len(v) != 0 {
+			t.Errorf("client got %s %q, want it dropped", name, v)
+		}
+	}
+}
+
+func TestProxyHeadersFromTrustedProxy(t *testing.T) {
+	withTrustedProxies(t, "127.0.0.0/8")
+	var got http.Header
+	gw := headerGateway(t, &got)
+
+	resp, err := http.DefaultClient.Do(spoofedRequest(t, gw.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := map[string]string{
+		"X-Forwarded-For":   "1.2.3.4, 127.0.0.1",
+		"X-Forwarded-Host":  "evil.example",
+		"X-Forwarded-Proto": "https",
+	}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("upstream got %s %q, want %q", name, got.Values(name), value)
+		}
+	}
+	// Identity headers are the gateway's own even behind a proxy.
+	for _, name := range []string{userIDHeader, userRolesHeader, "X-Client-Hop"} {
+		if v := got.Values(name); len(v) != 0 {
+			t.Errorf("upstream got %s %q, want it dropped", name, v)
+		}
+	}
+}
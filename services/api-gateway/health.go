@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamHealthTimeout bounds each upstream's /health check.
+var upstreamHealthTimeout = loadDuration("UPSTREAM_HEALTH_TIMEOUT", 2*time.Second)
+
+// healthCacheTTL is how long an aggregated health result is reused, so
+// frequent probes of many gateway replicas don't multiply into a storm
+// of upstream checks.
+var healthCacheTTL = loadDuration("HEALTH_CACHE_TTL", 2*time.Second)
+
+// upstreams are the services the gateway routes to, by name, each with
+// its comma-separated instance URLs. Canaries are listed as the service
+// name suffixed with -canary.
+func upstreams() map[string]string {
+	all := map[string]string{
+		"inventory": inventoryServiceURL,
+		"orders":    orderServiceURL,
+		"payments":  paymentServiceURL,
+	}
+	for name, prefix := range upstreamEnvPrefixes {
+		if target := canaryURL(prefix); target != "" {
+			all[name+"-canary"] = target
+		}
+	}
+	return all
+}
+
+// criticalUpstreams are the upstreams the gateway isn't ready without,
+// from CRITICAL_UPSTREAMS; the rest are reported but don't fail the
+// check. All are critical by default.
+func criticalUpstreams() map[string]bool {
+	critical := map[string]bool{}
+	raw := getEnv("CRITICAL_UPSTREAMS", "inventory,orders,payments")
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			critical[name] = true
+		}
+	}
+	return critical
+}
+
+// upstreamHealth is an aggregated health result: each upstream "up" or
+// "down", and whether all critical ones are up.
+type upstreamHealth struct {
+	Status      string                       `json:"status"`
+	Services    map[string]string            `json:"services"`
+	Maintenance map[string]maintenanceWindow `json:"maintenance,omitempty"`
+	ready       bool
+}
+
+// healthChecker checks every upstream's /health concurrently, caching
+// the result for a short while.
+type healthChecker struct {
+	upstreams map[string]string
+	critical  map[string]bool
+	ttl       time.Duration
+	client    *http.Client
+
+	mu        sync.Mutex
+	last      *upstreamHealth
+	checkedAt time.Time
+}
+
+func newHealthChecker(upstreams map[string]string, critical map[string]bool, ttl, timeout time.Duration) *healthChecker {
+	return &healthChecker{upstreams: upstreams, critical: critical, ttl: ttl, client: &http.Client{Timeout: timeout}}
+}
+
+// check returns the cached result if it is fresh, otherwise checks the
+// upstreams. Concurrent callers wait for one check rather than each
+// starting their own.
+func (h *healthChecker) check() *upstreamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last != nil && time.Since(h.checkedAt) < h.ttl {
+		return h.last
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := &upstreamHealth{Services: map[string]string{}}
+	for name := range h.upstreams {
+		result.Services[name] = "down"
+	}
+	for name, targets := range h.upstreams {
+		// An upstream with several instances is up while any one is.
+		for _, baseURL := range splitTargets(targets) {
+			wg.Add(1)
+			go func(name, baseURL string) {
+				defer wg.Done()
+				resp, err := h.client.Get(strings.TrimRight(baseURL, "/") + "/health")
+				if err != nil {
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					mu.Lock()
+					result.Services[name] = "up"
+					mu.Unlock()
+				}
+			}(name, baseURL)
+		}
+	}
+	wg.Wait()
+
+	result.evaluate(h.critical)
+	h.last, h.checkedAt = result, time.Now()
+	return result
+}
+
+// ServeHTTP answers /health/ready (and /readyz) with each upstream's
+// state, and 503 if a critical one is down. An upstream in maintenance
+// is reported as such and doesn't count against readiness, since the
+// gateway answers for it. /health stays a liveness check of the gateway
+// process alone.
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := h.withMaintenance(h.check(), maintenance.all())
+	w.Header().Set("Content-Type", "application/json")
+	if !result.ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// withMaintenance returns result with the upstreams in windows marked as
+// in maintenance, leaving the cached result as it is.
+func (h *healthChecker) withMaintenance(result *upstreamHealth, windows map[string]maintenanceWindow) *upstreamHealth {
+	if len(windows) == 0 {
+		return result
+	}
+	marked := &upstreamHealth{Services: map[string]string{}, Maintenance: windows}
+	for name, state := range result.Services {
+		if _, ok := windows[name]; ok {
+			state = "maintenance"
+		}
+		marked.Services[name] = state
+	}
+	marked.evaluate(h.critical)
+	return marked
+}
+
+// evaluate sets the status from whether any critical upstream is down.
+func (u *upstreamHealth) evaluate(critical map[string]bool) {
+	u.ready = true
+	for name, state := range u.Services {
+		if state == "down" && critical[name] {
+			u.ready = false
+		}
+	}
+	u.Status = "ready"
+	if !u.ready {
+		u.Status = "not ready"
+	}
+}
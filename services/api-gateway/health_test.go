@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthReadyBreakdown(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "healthy"}`))
+	}))
+	defer up.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	targets := map[string]string{"inventory": newClosedUpstream() + "," + up.URL, "orders": failing.URL, "payments": newClosedUpstream()}
+
+	tests := []struct {
+		name     string
+		critical map[string]bool
+		want     int
+	}{
+		{"critical upstream down", map[string]bool{"inventory": true, "orders": true}, http.StatusServiceUnavailable},
+		{"only non-critical down", map[string]bool{"inventory": true}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		h := newHealthChecker(targets, tt.critical, time.Minute, time.Second)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		var body upstreamHealth
+		json.NewDecoder(rec.Body).Decode(&body)
+		want := map[string]string{"inventory": "up", "orders": "down", "payments": "down"}
+		for name, state := range want {
+			if body.Services[name] != state {
+				t.Errorf("%s: %s is %q, want %q", tt.name, name, body.Services[name], state)
+			}
+		}
+	}
+}
+
+func TestHealthReadyCachesResults(t *testing.T) {
+	var checks atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+	}))
+	defer up.Close()
+
+	h := newHealthChecker(map[string]string{"inventory": up.URL}, map[string]bool{"inventory": true}, time.Minute, time.Second)
+	for i := 0; i < 5; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	}
+	if n := checks.Load(); n != 1 {
+		t.Errorf("upstream checked %d times, want 1 within the cache TTL", n)
+	}
+
+	h.checkedAt = time.Now().Add(-2 * time.Minute)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	if n := checks.Load(); n != 2 {
+		t.Errorf("upstream checked %d times, want 2 after the cache expired", n)
+	}
+}
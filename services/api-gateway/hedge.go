@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	hedgedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_hedged_requests_total",
+			Help: "Second requests sent to another instance after the first was slower than the hedging delay, by upstream",
+		},
+		[]string{"upstream"},
+	)
+	hedgeWins = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_hedge_wins_total",
+			Help: "Hedged requests whose second request answered first, by upstream",
+		},
+		[]string{"upstream"},
+	)
+)
+
+// hedgeRoute hedges the GET and HEAD requests a pathRule matches once
+// their first attempt has gone without a response for delay.
+type hedgeRoute struct {
+	pathRule
+	delay time.Duration
+}
+
+// parseHedgeRoutes parses a comma-separated list of
+// "[METHOD ]/prefix=delay" entries, as in "GET /api/products=50ms". Only
+// GET and HEAD requests are hedged, so a rule without a method covers
+// both.
+func parseHedgeRoutes(raw string) ([]hedgeRoute, error) {
+	var routes []hedgeRoute
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be [METHOD ]/prefix=delay", entry)
+		}
+		rules, err := parsePathRules(route)
+		if err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("entry %q must be [METHOD ]/prefix=delay", entry)
+		}
+		if m := rules[0].Method; m != "" && m != http.MethodGet && m != http.MethodHead {
+			return nil, fmt.Errorf("entry %q: only GET and HEAD requests can be hedged", entry)
+		}
+		delay, err := time.ParseDuration(strings.TrimSpace(spec))
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("entry %q: delay must be a positive duration", entry)
+		}
+		routes = append(routes, hedgeRoute{pathRule: rules[0], delay: delay})
+	}
+	return routes, nil
+}
+
+// hedge is a client request's permission to be hedged. It is shared by
+// every attempt at the request, retries included, so at most one hedge
+// is sent for it.
+type hedge struct {
+	delay time.Duration
+	used  atomic.Bool
+}
+
+type hedgeKey struct{}
+
+func hedgeFrom(ctx context.Context) *hedge {
+	h, _ := ctx.Value(hedgeKey{}).(*hedge)
+	return h
+}
+
+// hedgeMiddleware marks the requests routes match as hedgeable.
+func hedgeMiddleware(routes []hedgeRoute) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(routes) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				for _, route := range routes {
+					if route.matches(r) {
+						r = r.WithContext(context.WithValue(r.Context(), hedgeKey{}, &hedge{delay: route.delay}))
+						break
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hedgeAttempt is the outcome of one of a hedged request's attempts.
+type hedgeAttempt struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+}
+
+// sendHedged sends req to inst and, if req may be hedged and inst
+// hasn't answered within the hedging delay, to a second instance as
+// well. The first good response is used and the other attempt
+// cancelled; a failure is only returned once both have failed.
+func (b *balancer) sendHedged(inst *instance, req *http.Request) (*http.Response, error) {
+	h := hedgeFrom(req.Context())
+	// Upgrades are left alone, as the proxy needs the upstream's
+	// connection itself.
+	if h == nil || len(b.instances) < 2 || h.used.Load() || req.Header.Get("Upgrade") != "" ||
+		(req.Body != nil && req.Body != http.NoBody) {
+		return b.send(inst, req)
+	}
+
+	results := make(chan hedgeAttempt, 2)
+	cancels := map[bool]context.CancelFunc{}
+	launch := func(inst *instance, hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[hedge] = cancel
+		go func() {
+			resp, err := b.send(inst, req.Clone(ctx))
+			results <- hedgeAttempt{resp: resp, err: err, hedge: hedge, cancel: cancel}
+		}()
+	}
+	launch(inst, false)
+	pending, hedged := 1, false
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			second, err := b.pickExcept(inst)
+			if err != nil || !h.used.CompareAndSwap(false, true) {
+				continue
+			}
+			hedged = true
+			hedgedRequests.WithLabelValues(b.upstream).Inc()
+			launch(second, true)
+			pending++
+		case a := <-results:
+			pending--
+			if hedged && pending > 0 && requestFailed(a.resp, a.err) {
+				// The other attempt may still succeed.
+				discard(a)
+				continue
+			}
+			if pending > 0 {
+				// Cancel the slower attempt, and clean up after it once
+				// it returns.
+				cancels[!a.hedge]()
+				go func() { discard(<-results) }()
+			}
+			if a.hedge && !requestFailed(a.resp, a.err) {
+				hedgeWins.WithLabelValues(b.upstream).Inc()
+			}
+			if a.err != nil {
+				a.cancel()
+				return nil, a.err
+			}
+			a.resp.Body = &cancelBody{ReadCloser: a.resp.Body, cancel: a.cancel}
+			return a.resp, nil
+		}
+	}
+}
+
+// discard closes a losing attempt's body and cancels it.
+func discard(a hedgeAttempt) {
+	a.cancel()
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+}
+
+// cancelBody cancels its attempt's context once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.cancel)
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowUpstream answers after delay, or notes in canceled that the
+// request was cancelled first.
+func slowUpstream(t *testing.T, delay time.Duration, status int, canceled *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.WriteHeader(status)
+			w.Write([]byte("slow"))
+		case <-r.Context().Done():
+			if canceled != nil {
+				canceled.Add(1)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// hedgedGateway serves lb's orders with routes hedged.
+func hedgedGateway(t *testing.T, lb *balancer, routes string) *httptest.Server {
+	t.Helper()
+	hedges, err := parseHedgeRoutes(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestGatewayWith(t, hedgeMiddleware(hedges)(newProxy(lb, "/api/orders", "/orders")))
+}
+
+func TestHedgeWinsOverSlowInstance(t *testing.T) {
+	withRetries(t, 0)
+	var canceled, fastCalls atomic.Int32
+	slow := slowUpstream(t, 2*time.Second, http.StatusOK, &canceled)
+	fast := countingUpstream(t, &fastCalls, nil)
+	lb, err := newBalancer("hedge-wins", slow.URL+","+fast.URL, testBreakers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := hedgedGateway(t, lb, "GET /api/orders=20ms")
+	hedgedBefore := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-wins"))
+	winsBefore := testutil.ToFloat64(hedgeWins.WithLabelValues("hedge-wins"))
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		resp, body := getBody(t, gw.URL+"/api/orders")
+		if resp.StatusCode != http.StatusOK || body == "slow" {
+			t.Fatalf("status %d body %q, want the fast instance's 200", resp.StatusCode, body)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("request took %s, want the hedge's answer", elapsed)
+		}
+	}
+	// Every request that went to the slow instance first was hedged,
+	// and the hedge won.
+	hedged := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-wins")) - hedgedBefore
+	if hedged == 0 {
+		t.Fatal("no request was hedged")
+	}
+	if got := testutil.ToFloat64(hedgeWins.WithLabelValues("hedge-wins")) - winsBefore; got != hedged {
+		t.Errorf("hedges won %v times, want all %v", got, hedged)
+	}
+	deadline := time.Now().Add(time.Second)
+	for float64(canceled.Load()) != hedged {
+		if time.Now().After(deadline) {
+			t.Fatalf("slow instance saw %d requests cancelled, want %v", canceled.Load(), hedged)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The cancelled losers don't count against the slow instance.
+	if lb.instances[0].failures != 0 || lb.instances[0].ejected {
+		t.Errorf("slow instance has %d failures, ejected %t", lb.instances[0].failures, lb.instances[0].ejected)
+	}
+}
+
+func TestHedgeOnlyOnConfiguredReads(t *testing.T) {
+	withRetries(t, 0)
+	slow := slowUpstream(t, 100*time.Millisecond, http.StatusOK, nil)
+	lb, err := newBalancer("hedge-scope", slow.URL+","+slowUpstream(t, 100*time.Millisecond, http.StatusOK, nil).URL, testBreakers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := hedgedGateway(t, lb, "/api/orders/recent=10ms")
+	before := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-scope"))
+
+	for _, path := range []string{"/api/orders", "/api/orders/1"} {
+		resp, _ := getBody(t, gw.URL+path)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", path, resp.StatusCode)
+		}
+	}
+	resp, err := http.Post(gw.URL+"/api/orders/recent", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-scope")) - before; got != 0 {
+		t.Errorf("hedged %v requests off the configured GET route", got)
+	}
+
+	getBody(t, gw.URL+"/api/orders/recent")
+	if got := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-scope")) - before; got != 1 {
+		t.Errorf("hedged %v requests on the configured route, want 1", got)
+	}
+}
+
+func TestHedgeOncePerRequest(t *testing.T) {
+	withRetries(t, 2)
+	var canceled atomic.Int32
+	a := slowUpstream(t, 50*time.Millisecond, http.StatusServiceUnavailable, &canceled)
+	b := slowUpstream(t, 50*time.Millisecond, http.StatusServiceUnavailable, &canceled)
+	lb, err := newBalancer("hedge-cap", a.URL+","+b.URL, testBreakers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.ejectAfter = 100
+	gw := hedgedGateway(t, lb, "GET /api/orders=10ms")
+	hedgedBefore := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-cap"))
+	winsBefore := testutil.ToFloat64(hedgeWins.WithLabelValues("hedge-cap"))
+
+	resp, _ := getBody(t, gw.URL+"/api/orders")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want the upstreams' 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Gateway-Retries"); got != "2" {
+		t.Errorf("retries = %q, want 2", got)
+	}
+	if got := testutil.ToFloat64(hedgedRequests.WithLabelValues("hedge-cap")) - hedgedBefore; got != 1 {
+		t.Errorf("hedged %v times across the retries, want 1", got)
+	}
+	if got := testutil.ToFloat64(hedgeWins.WithLabelValues("hedge-cap")) - winsBefore; got != 0 {
+		t.Errorf("failed hedge counted as a win")
+	}
+}
+
+func TestParseHedgeRoutes(t *testing.T) {
+	routes, err := parseHedgeRoutes("GET /api/products=50ms, /api/orders=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].Method != "GET" || routes[0].delay != 50*time.Millisecond ||
+		routes[1].Prefix != "/api/orders" || routes[1].delay != time.Second {
+		t.Errorf("parsed %+v", routes)
+	}
+	for _, raw := range []string{"POST /api/orders=50ms", "/api/products", "/api/products=0s", "api/products=50ms", "/api/products=soon"} {
+		if _, err := parseHedgeRoutes(raw); err == nil {
+			t.Errorf("%q: expected an error", raw)
+		}
+	}
+}
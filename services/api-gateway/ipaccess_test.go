@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIPAccessLists(t *testing.T) {
+	old := trustedProxies
+	trustedProxies, _ = parseCIDRs("127.0.0.1")
+	t.Cleanup(func() { trustedProxies = old })
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	lists := `ip_access:
+  deny: 203.0.113.0/24
+  routes:
+    - route: DELETE /api/products
+      allow: 198.51.100.0/24, 192.0.2.10
+`
+	target := pathUpstream(t, "up")
+	writeConfig(t, path, target, lists)
+	g, gw := configGateway(t, path)
+
+	send := func(method, path, client string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, gw.URL+path, nil)
+		req.Header.Set("X-Forwarded-For", client)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	denied := testutil.ToFloat64(ipBlocked.WithLabelValues("/api/orders/{id}", "denied"))
+	tests := []struct {
+		method, path, client string
+		want                 int
+	}{
+		{"GET", "/api/orders/1", "203.0.113.9", http.StatusForbidden},
+		{"GET", "/api/orders/1", "192.0.2.1", http.StatusOK},
+		{"GET", "/health", "203.0.113.9", http.StatusOK},
+		{"DELETE", "/api/products/1", "192.0.2.1", http.StatusForbidden},
+		{"DELETE", "/api/v1/products/1", "192.0.2.1", http.StatusForbidden},
+		{"DELETE", "/api/products/1", "198.51.100.7", http.StatusOK},
+		{"DELETE", "/api/products/1", "192.0.2.10", http.StatusOK},
+		{"GET", "/api/products/1", "192.0.2.1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		status, body := send(tt.method, tt.path, tt.client)
+		if status != tt.want {
+			t.Errorf("%s %s from %s: status %d, want %d", tt.method, tt.path, tt.client, status, tt.want)
+		}
+		if status == http.StatusForbidden && !strings.Contains(body, `"error":"Forbidden"`) {
+			t.Errorf("%s %s from %s: body %q, want a JSON error", tt.method, tt.path, tt.client, body)
+		}
+	}
+	if got := testutil.ToFloat64(ipBlocked.WithLabelValues("/api/orders/{id}", "denied")) - denied; got != 1 {
+		t.Errorf("counted %v denied requests, want 1", got)
+	}
+
+	// Lists go with the config they came in.
+	writeConfig(t, path, target, "")
+	if err := g.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := send("GET", "/api/orders/1", "203.0.113.9"); status != http.StatusOK {
+		t.Errorf("after removing the deny list: status %d, want 200", status)
+	}
+}
+
+func TestParseIPAccess(t *testing.T) {
+	if a, err := parseIPAccess(ipAccessConfig{}); a != nil || err != nil {
+		t.Errorf("no lists: got %v, %v, want nil", a, err)
+	}
+	for _, cfg := range []ipAccessConfig{
+		{Deny: "not-an-ip"},
+		{Allow: "10.0.0.0/33"},
+		{Routes: []ipRouteConfig{{Route: "api/products", Deny: "10.0.0.1"}}},
+		{Routes: []ipRouteConfig{{Route: "/api/products"}}},
+	} {
+		if _, err := parseIPAccess(cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// initLogger installs a JSON slog handler as the process-wide default.
+// The standard log package is routed through it too, so every line the
+// gateway writes is structured.
+func initLogger() {
+	var level slog.Level
+	switch strings.ToLower(getEnv("LOG_LEVEL", "info")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler).With("service", "api-gateway"))
+}
+
+// loggerFrom returns the default logger annotated with the request id
+// carried by ctx, if any.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// accessLogSkipPaths are paths not access logged, from
+// ACCESS_LOG_SKIP_PATHS, so probes and scrapes don't drown out traffic.
+func accessLogSkipPaths() map[string]bool {
+	skip := map[string]bool{}
+	for _, path := range strings.Split(getEnv("ACCESS_LOG_SKIP_PATHS", "/health,/health/ready,/readyz,/metrics"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			skip[path] = true
+		}
+	}
+	return skip
+}
+
+// accessLogWriter counts the status and bytes of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// accessLogMiddleware writes one access log line per request once it
+// completes, at warn for server errors. It runs inside metricsMiddleware
+// to log the route template rather than the raw path.
+func accessLogMiddleware(skip map[string]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			body := &countingBody{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+			wrapped := &accessLogWriter{ResponseWriter: w}
+
+			next.ServeHTTP(wrapped, r)
+
+			if wrapped.status == 0 {
+				wrapped.status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			if wrapped.status >= 500 {
+				level = slog.LevelWarn
+			}
+			loggerFrom(r.Context()).Log(r.Context(), level, "request completed",
+				"method", r.Method,
+				"route", routeFrom(r.Context()),
+				"status", wrapped.status,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000,
+				"request_bytes", body.n,
+				"response_bytes", wrapped.bytes,
+				"client_ip", clientIP(r, trustedProxies),
+				"user_agent", r.UserAgent(),
+			)
+		})
+	}
+}
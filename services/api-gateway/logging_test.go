@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger's output to a buffer.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+	orders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":7}`))
+	})
+	router := newRouter(http.NotFoundHandler(), orders, http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/orders/7", strings.NewReader(`{"quantity":2}`))
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set(requestIDHeader, "log-me")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines, want 1 with /health skipped: %s", len(lines), logs)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("log line isn't JSON: %s", lines[0])
+	}
+	want := map[string]interface{}{
+		"msg":            "request completed",
+		"method":         "POST",
+		"route":          "/api/orders/{id}",
+		"status":         float64(201),
+		"request_bytes":  float64(len(`{"quantity":2}`)),
+		"response_bytes": float64(len(`{"id":7}`)),
+		"client_ip":      "192.0.2.1",
+		"user_agent":     "test-agent",
+		"request_id":     "log-me",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing from %s", lines[0])
+	}
+}
+
+func TestAccessLogServerErrorsAtWarn(t *testing.T) {
+	logs := captureLogs(t)
+	router := newRouter(http.NotFoundHandler(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}), http.NotFoundHandler())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/orders", nil))
+
+	var entry map[string]interface{}
+	json.Unmarshal(logs.Bytes(), &entry)
+	if entry["level"] != "WARN" || entry["status"] != float64(502) {
+		t.Errorf("got %v, want a WARN line for the 502", entry)
+	}
+}
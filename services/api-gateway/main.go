@@ -1,19 +1,17 @@
 package main
 
 import (
-	"io"
+	"context"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
-	"os"
-
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sony/gobreaker"
 )
 
 // Prometheus metrics
@@ -23,7 +21,7 @@ var (
 			Name: "gateway_http_requests_total",
 			Help: "Total number of HTTP requests",
 		},
-		[]string{"method", "route", "status"},
+		[]string{"method", "route", "api_version", "status"},
 	)
 	httpRequestDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -31,7 +29,7 @@ var (
 			Help:    "HTTP request latency in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"method", "route"},
+		[]string{"method", "route", "api_version"},
 	)
 	errorRate = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -44,141 +42,172 @@ var (
 
 var inventoryServiceURL string
 var orderServiceURL string
-
-var inventoryCB *gobreaker.CircuitBreaker
-var orderCB *gobreaker.CircuitBreaker
+var paymentServiceURL string
+
+// upstreamEnvPrefixes are the prefixes of each upstream's settings, such
+// as ORDER_SERVICE_URL and ORDER_SERVICE_CANARY_URL.
+var upstreamEnvPrefixes = map[string]string{
+	"inventory": "INVENTORY_SERVICE",
+	"orders":    "ORDER_SERVICE",
+	"payments":  "PAYMENT_SERVICE",
+}
 
 func main() {
-	inventoryServiceURL = getEnv("INVENTORY_SERVICE_URL", "http://localhost:8081")
-	orderServiceURL = getEnv("ORDER_SERVICE_URL", "http://localhost:8082")
-
-	var st gobreaker.Settings
-	st.Name = "InventoryService"
-	st.ReadyToTrip = func(counts gobreaker.Counts) bool {
-		failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
-		return counts.Requests >= 3 && failureRatio >= 0.6
-	}
-	st.Timeout = 30 * time.Second
-	st.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
-		log.Printf("Circuit Breaker %s changed state from %s to %s", name, from, to)
+	initLogger()
+	if err := initTracing(context.Background()); err != nil {
+		log.Fatal("Failed to set up tracing: ", err)
 	}
-	inventoryCB = gobreaker.NewCircuitBreaker(st)
-
-	st.Name = "OrderService"
-	orderCB = gobreaker.NewCircuitBreaker(st)
-
-	router := mux.NewRouter()
-	router.Use(loggingMiddleware)
-	router.Use(metricsMiddleware)
-
-	// Route to inventory service
-	router.PathPrefix("/api/products").HandlerFunc(proxyToInventory)
-
-	// Route to order service
-	router.PathPrefix("/api/orders").HandlerFunc(proxyToOrders)
-
-	// Health check
-	router.HandleFunc("/health", healthCheck).Methods("GET")
-
-	// Metrics
-	router.Handle("/metrics", promhttp.Handler())
-
-	port := getEnv("PORT", "8080")
-	log.Printf("API Gateway starting on port %s", port)
-	log.Printf("Routing /api/products -> %s", inventoryServiceURL)
-	log.Printf("Routing /api/orders -> %s", orderServiceURL)
 
-	log.Fatal(http.ListenAndServe(":"+port, router))
-}
-
-func proxyToInventory(w http.ResponseWriter, r *http.Request) {
-	proxyRequest(w, r, inventoryServiceURL, "/api/products", "/products", inventoryCB)
-}
-
-func proxyToOrders(w http.ResponseWriter, r *http.Request) {
-	proxyRequest(w, r, orderServiceURL, "/api/orders", "/orders", orderCB)
-}
-
-func proxyRequest(w http.ResponseWriter, r *http.Request, targetURL, stripPrefix, newPrefix string, cb *gobreaker.CircuitBreaker) {
-	// Build target URL
-	path := r.URL.Path
-	if stripPrefix != "" {
-		path = newPrefix + path[len(stripPrefix):]
+	breakers := loadBreakerConfig()
+	if canariesDisabled() {
+		log.Println("Canaries disabled by CANARY_DISABLED")
 	}
 
-	targetURL = targetURL + path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+	var err error
+	trustedProxies, err = parseCIDRs(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	limiter, err := loadRateLimiter()
+	if err != nil {
+		log.Fatal("Invalid rate limit configuration: ", err)
 	}
 
-	// Create new request
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	auth, err := loadAuthenticator()
 	if err != nil {
-		errorRate.WithLabelValues(r.URL.Path, "request_creation").Inc()
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
+		log.Fatal("Invalid authentication configuration: ", err)
+	}
+	apiKeys, err := loadAPIKeys()
+	if err != nil {
+		log.Fatal("Invalid API key configuration: ", err)
+	}
+	bodyLimits, err := loadBodyLimiter()
+	if err != nil {
+		log.Fatal("Invalid request body limit configuration: ", err)
+	}
+	cache, err := loadResponseCache()
+	if err != nil {
+		log.Fatal("Invalid response cache configuration: ", err)
 	}
 
-	// Copy headers
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
+	if limiter != nil {
+		go limiter.evictLoop(time.Minute)
+	} else {
+		log.Println("Rate limiting disabled")
+	}
+	if auth == nil {
+		log.Println("Token authentication disabled: set JWT_SECRET or JWKS_URL to require tokens")
+	}
+	if apiKeys != nil {
+		log.Printf("Accepting %d partner API keys", len(apiKeys.keys))
+	}
+	if cache != nil {
+		log.Printf("Caching product responses for %s", cache.ttl)
+		// With KAFKA_BROKER set, inventory's events purge changed
+		// products without waiting for the TTL.
+		if broker := getEnv("KAFKA_BROKER", ""); broker != "" {
+			go newCacheInvalidator(cache, broker).run(context.Background())
 		}
 	}
 
-	// Execute request
-	client := &http.Client{Timeout: 30 * time.Second}
-	result, err := cb.Execute(func() (interface{}, error) {
-		return client.Do(proxyReq)
-	})
+	// Upstreams, timeouts, rate limits and API versions can be changed
+	// in GATEWAY_CONFIG_FILE without a restart.
+	gw := &gateway{
+		path:       getEnv("GATEWAY_CONFIG_FILE", ""),
+		breakers:   breakers,
+		limiter:    limiter,
+		cache:      cache,
+		middleware: []mux.MiddlewareFunc{authMiddleware(auth, apiKeys), bodyLimits.middleware},
+	}
+	if err := gw.reload(); err != nil {
+		log.Fatal("Invalid gateway configuration: ", err)
+	}
+	go gw.watch(context.Background())
 
+	tlsConfig, err := loadTLSConfig()
 	if err != nil {
-		errorRate.WithLabelValues(r.URL.Path, "request_execution").Inc()
-		log.Printf("Error proxying request to %s: %v", targetURL, err)
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-		}
-		return
+		log.Fatal("Invalid TLS configuration: ", err)
 	}
 
-	resp := result.(*http.Response)
-	defer resp.Body.Close()
-
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	port := getEnv("PORT", "8080")
+	if tlsConfig == nil {
+		log.Printf("API Gateway starting on port %s", port)
+		log.Fatal(http.ListenAndServe(":"+port, gw))
 	}
 
-	// Write status code
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy response body
-	io.Copy(w, resp.Body)
+	// TLS_REDIRECT_PORT serves a plain HTTP listener that only redirects
+	// to HTTPS.
+	if redirectPort := getEnv("TLS_REDIRECT_PORT", ""); redirectPort != "" {
+		go func() {
+			log.Printf("Redirecting HTTP on port %s to HTTPS", redirectPort)
+			log.Fatal(http.ListenAndServe(":"+redirectPort, httpsRedirect(port)))
+		}()
+	}
+	server := &http.Server{Addr: ":" + port, Handler: gw, TLSConfig: tlsConfig}
+	log.Printf("API Gateway starting on port %s with TLS", port)
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("%s %s", r.Method, r.URL.Path)
-		next.ServeHTTP(w, r)
-		log.Printf("Completed in %v", time.Since(start))
+// newRouter routes the API prefixes to their upstreams' proxies.
+func newRouter(inventory, orders, payments http.Handler) *mux.Router {
+	router := mux.NewRouter()
+	// Outermost, so a panic anywhere inside becomes a 500.
+	router.Use(recoverMiddleware)
+	router.Use(tracingMiddleware)
+	router.Use(requestIDMiddleware)
+	router.Use(metricsMiddleware)
+	router.Use(accessLogMiddleware(accessLogSkipPaths()))
+	router.Use(gzipMiddleware)
+
+	// Versioned routes, /api/v1/products and so on, and the deprecated
+	// unversioned ones served as v1.
+	versions := newAPIVersions(map[string]http.Handler{
+		"inventory": inMaintenance("inventory", inventory),
+		"orders":    inMaintenance("orders", orders),
+		"payments":  inMaintenance("payments", payments),
 	})
+	for resource, h := range versions.routes[aliasVersion] {
+		router.PathPrefix("/api/" + resource).Handler(deprecated(h))
+	}
+	// The upstreams' API documentation, merged.
+	router.Handle("/api/docs", apiDocs).Methods("GET")
+	router.Handle("/api/docs/openapi.json", apiDocs).Methods("GET")
+	router.PathPrefix("/api/").Handler(versions)
+
+	// Health check
+	router.HandleFunc("/health", healthCheck).Methods("GET")
+	ready := newHealthChecker(upstreams(), criticalUpstreams(), healthCacheTTL, upstreamHealthTimeout)
+	router.Handle("/health/ready", ready).Methods("GET")
+	router.Handle("/readyz", ready).Methods("GET")
+
+	// Maintenance mode, switched on and off without a restart. Without
+	// ADMIN_TOKEN it can only be set in the gateway config.
+	if token := getEnv("ADMIN_TOKEN", ""); token != "" {
+		router.Handle("/admin/maintenance/{service}", maintenanceAdmin{token: token}).Methods("POST", "DELETE")
+	}
+
+	// Metrics
+	// OpenMetrics carries the request id exemplars.
+	router.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+
+	return router
 }
 
 func metricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		route := routeTemplate(r.URL.Path)
+		version := apiVersion(r.URL.Path)
 
-		next.ServeHTTP(wrapped, r)
+		next.ServeHTTP(wrapped, r.WithContext(withRoute(r.Context(), route)))
 
+		// The request id is attached as an exemplar, linking a latency
+		// spike on a dashboard to the logs of a request that caused it.
+		exemplar := prometheus.Labels{"request_id": requestIDFrom(r.Context())}
 		duration := time.Since(start).Seconds()
-		httpRequestDuration.WithLabelValues(r.Method, r.URL.Path).Observe(duration)
-		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(wrapped.statusCode)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route, version).(prometheus.ExemplarObserver).ObserveWithExemplar(duration, exemplar)
+		httpRequestsTotal.WithLabelValues(r.Method, route, version, strconv.Itoa(wrapped.statusCode)).(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
 	})
 }
 
@@ -192,6 +221,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// proxied responses can be flushed and connections upgraded.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"status": "healthy"}`))
@@ -204,3 +239,50 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+func loadPositiveInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil || n < 1 {
+		log.Printf("Invalid %s, using %d", key, def)
+		return def
+	}
+	return n
+}
+
+func loadNonNegativeInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s, using %d", key, def)
+		return def
+	}
+	return n
+}
+
+func loadDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, def.String()))
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s, using %s", key, def)
+		return def
+	}
+	return d
+}
+
+// loadDate reads a YYYY-MM-DD date, taken as midnight UTC.
+func loadDate(key, def string) time.Time {
+	t, err := time.Parse(time.DateOnly, getEnv(key, def))
+	if err != nil {
+		log.Printf("Invalid %s, using %s", key, def)
+		t, _ = time.Parse(time.DateOnly, def)
+	}
+	return t
+}
+
+// loadRatio reads a fraction in (0, 1].
+func loadRatio(key string, def float64) float64 {
+	f, err := strconv.ParseFloat(getEnv(key, strconv.FormatFloat(def, 'f', -1, 64)), 64)
+	if err != nil || f <= 0 || f > 1 {
+		log.Printf("Invalid %s, using %g", key, def)
+		return def
+	}
+	return f
+}
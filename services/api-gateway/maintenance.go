@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var maintenanceMode = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gateway_upstream_maintenance",
+		Help: "Whether an upstream is in maintenance mode (1) or proxied normally (0)",
+	},
+	[]string{"upstream"},
+)
+
+// maintenanceRetryAfter is the Retry-After sent during a maintenance
+// window with no end given.
+const maintenanceRetryAfter = time.Minute
+
+// maintenanceWindow describes why an upstream is in maintenance and,
+// if known, until when.
+type maintenanceWindow struct {
+	Reason string    `json:"reason,omitempty" yaml:"reason"`
+	Until  time.Time `json:"until,omitempty" yaml:"until"`
+}
+
+// maintenanceState is which upstreams are in maintenance, by name. A
+// window can come from the gateway config or be set through the admin
+// endpoint; one set through the endpoint takes precedence and lasts
+// until cleared there, across config reloads.
+type maintenanceState struct {
+	mu         sync.RWMutex
+	configured map[string]maintenanceWindow
+	manual     map[string]maintenanceWindow
+}
+
+// maintenance is the gateway's maintenance state.
+var maintenance = &maintenanceState{configured: map[string]maintenanceWindow{}, manual: map[string]maintenanceWindow{}}
+
+// window returns the maintenance window upstream is in, if any.
+func (m *maintenanceState) window(upstream string) (maintenanceWindow, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if w, ok := m.manual[upstream]; ok {
+		return w, true
+	}
+	w, ok := m.configured[upstream]
+	return w, ok
+}
+
+// setConfigured replaces the windows from the gateway config.
+func (m *maintenanceState) setConfigured(windows map[string]maintenanceWindow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configured = windows
+	m.updateGauges()
+}
+
+// set puts upstream in maintenance until cleared, or takes it out.
+func (m *maintenanceState) set(upstream string, w *maintenanceWindow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w == nil {
+		delete(m.manual, upstream)
+	} else {
+		m.manual[upstream] = *w
+	}
+	m.updateGauges()
+}
+
+// updateGauges sets the maintenance gauge of every upstream. The caller
+// holds mu.
+func (m *maintenanceState) updateGauges() {
+	for name := range upstreamEnvPrefixes {
+		_, manual := m.manual[name]
+		_, configured := m.configured[name]
+		if manual || configured {
+			maintenanceMode.WithLabelValues(name).Set(1)
+		} else {
+			maintenanceMode.WithLabelValues(name).Set(0)
+		}
+	}
+}
+
+// all returns every upstream's current window.
+func (m *maintenanceState) all() map[string]maintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	all := map[string]maintenanceWindow{}
+	for name, w := range m.configured {
+		all[name] = w
+	}
+	for name, w := range m.manual {
+		all[name] = w
+	}
+	return all
+}
+
+// inMaintenance answers requests for upstream with 503 while it is in
+// maintenance, rather than proxying them, and says when to retry.
+func inMaintenance(upstream string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window, ok := maintenance.window(upstream)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		errorRate.WithLabelValues(routeFrom(r.Context()), "maintenance").Inc()
+
+		retryAfter := maintenanceRetryAfter
+		if !window.Until.IsZero() {
+			retryAfter = max(time.Until(window.Until), time.Second)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		body := map[string]string{
+			"error":   fmt.Sprintf("The %s service is down for maintenance", upstream),
+			"service": upstream,
+		}
+		if window.Reason != "" {
+			body["reason"] = window.Reason
+		}
+		if !window.Until.IsZero() {
+			body["until"] = window.Until.UTC().Format(time.RFC3339)
+		}
+		if id := w.Header().Get(requestIDHeader); id != "" {
+			body["request_id"] = id
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// maintenanceAdmin serves POST /admin/maintenance/{service}, with an
+// optional {"reason", "until"} body, to put a service in maintenance
+// and DELETE to take it out. Requests must carry the admin token in
+// X-Admin-Token.
+type maintenanceAdmin struct {
+	token string
+}
+
+func (a maintenanceAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(a.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "Invalid admin token")
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if _, ok := upstreamEnvPrefixes[service]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown service %q", service))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		maintenance.set(service, nil)
+		log.Printf("Took %s out of maintenance", service)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var window maintenanceWindow
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&window); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "Body must be {\"reason\", \"until\"} with until in RFC 3339")
+		return
+	}
+	maintenance.set(service, &window)
+	log.Printf("Put %s in maintenance: %s", service, window.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(window)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetMaintenance takes every upstream out of maintenance after the
+// test.
+func resetMaintenance(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		maintenance.setConfigured(nil)
+		for name := range upstreamEnvPrefixes {
+			maintenance.set(name, nil)
+		}
+	})
+}
+
+func adminRequest(t *testing.T, method, url, token, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("X-Admin-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestMaintenanceThroughAdminEndpoint(t *testing.T) {
+	resetMaintenance(t)
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	gw := newTestGateway(t, pathUpstream(t, "orders"))
+
+	until := time.Now().Add(10 * time.Minute).UTC().Truncate(time.Second)
+	body := `{"reason": "database migration", "until": "` + until.Format(time.RFC3339) + `"}`
+	if resp := adminRequest(t, http.MethodPost, gw.URL+"/admin/maintenance/orders", "s3cret", body); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 putting orders in maintenance, got %d", resp.StatusCode)
+	}
+
+	resp, raw := getBody(t, gw.URL+"/api/orders/1")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 in maintenance, got %d", resp.StatusCode)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 590 || secs > 600 {
+		t.Errorf("expected Retry-After until the window ends, got %q", resp.Header.Get("Retry-After"))
+	}
+	var got map[string]string
+	json.Unmarshal([]byte(raw), &got)
+	if got["service"] != "orders" || got["reason"] != "database migration" || got["until"] != until.Format(time.RFC3339) {
+		t.Errorf("expected the maintenance window explained, got %v", got)
+	}
+	if _, body := getBody(t, gw.URL+"/api/products/1"); body != "orders /products/1" {
+		t.Errorf("expected other upstreams still proxied, got %q", body)
+	}
+
+	if resp := adminRequest(t, http.MethodDelete, gw.URL+"/admin/maintenance/orders", "s3cret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 clearing maintenance, got %d", resp.StatusCode)
+	}
+	if _, body := getBody(t, gw.URL+"/api/orders/1"); body != "orders /orders/1" {
+		t.Errorf("expected proxying to resume, got %q", body)
+	}
+}
+
+func TestMaintenanceAdminRejectsBadRequests(t *testing.T) {
+	resetMaintenance(t)
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	gw := newTestGateway(t, pathUpstream(t, "orders"))
+
+	if resp := adminRequest(t, http.MethodPost, gw.URL+"/admin/maintenance/orders", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the wrong token, got %d", resp.StatusCode)
+	}
+	if resp := adminRequest(t, http.MethodPost, gw.URL+"/admin/maintenance/search", "s3cret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown service, got %d", resp.StatusCode)
+	}
+	if resp := adminRequest(t, http.MethodPost, gw.URL+"/admin/maintenance/orders", "s3cret", `{"until": "tomorrow"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad window, got %d", resp.StatusCode)
+	}
+	if _, ok := maintenance.window("orders"); ok {
+		t.Error("expected orders not in maintenance after rejected requests")
+	}
+}
+
+func TestMaintenanceAdminDisabledWithoutToken(t *testing.T) {
+	gw := newTestGateway(t, pathUpstream(t, "orders"))
+	if resp := adminRequest(t, http.MethodPost, gw.URL+"/admin/maintenance/orders", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no admin endpoint without ADMIN_TOKEN, got %d", resp.StatusCode)
+	}
+}
+
+func TestMaintenanceFromConfigReportedByHealth(t *testing.T) {
+	resetMaintenance(t)
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	upstream := pathUpstream(t, "payments")
+	writeConfig(t, path, upstream, "maintenance:\n  payments:\n    reason: ledger migration\n")
+	g, gw := configGateway(t, path)
+
+	resp, _ := getBody(t, gw.URL+"/api/payments/1")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("expected 503 with the default Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	resp, raw := getBody(t, gw.URL+"/health/ready")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the gateway ready during maintenance, got %d", resp.StatusCode)
+	}
+	var health upstreamHealth
+	json.Unmarshal([]byte(raw), &health)
+	if health.Services["payments"] != "maintenance" || health.Maintenance["payments"].Reason != "ledger migration" {
+		t.Errorf("expected payments reported in maintenance, got %s", raw)
+	}
+
+	writeConfig(t, path, upstream, "")
+	if err := g.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := getBody(t, gw.URL+"/api/payments/1"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected proxying to resume once the config clears maintenance, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var mirroredRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_mirrored_requests_total",
+		Help: "Requests copied to a shadow upstream, by mirrored route and outcome (success, error or dropped)",
+	},
+	[]string{"route", "outcome"},
+)
+
+var (
+	// mirrorTimeout bounds each mirrored request; mirrorSlots how many
+	// may be in flight, beyond which copies are dropped.
+	mirrorTimeout = loadDuration("MIRROR_TIMEOUT", 5*time.Second)
+	mirrorSlots   = make(chan struct{}, loadPositiveInt("MIRROR_MAX_IN_FLIGHT", 100))
+)
+
+// maxMirrorBody is the largest request body copied; requests with bigger
+// bodies aren't mirrored.
+const maxMirrorBody = 1 << 20
+
+// mirrorConfig copies Percent of the requests Route matches to the
+// shadow upstream at URL.
+type mirrorConfig struct {
+	Route   string  `yaml:"route"`
+	URL     string  `yaml:"url"`
+	Percent float64 `yaml:"percent"`
+}
+
+type mirror struct {
+	pathRule
+	route   string
+	target  *url.URL
+	percent float64
+}
+
+var mirrorClient = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	// A shadow's redirects aren't followed; its response is discarded
+	// anyway.
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// parseMirrors checks the configured mirrors.
+func parseMirrors(configs []mirrorConfig) ([]mirror, error) {
+	var mirrors []mirror
+	for _, c := range configs {
+		rules, err := parsePathRules(c.Route)
+		if err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("route %q must be [METHOD ]/prefix", c.Route)
+		}
+		targets, err := parseTargets(c.URL)
+		if err != nil || len(targets) != 1 {
+			return nil, fmt.Errorf("route %q: url %q must be one absolute URL", c.Route, c.URL)
+		}
+		if c.Percent <= 0 || c.Percent > 100 {
+			return nil, fmt.Errorf("route %q: percent must be in (0, 100]", c.Route)
+		}
+		mirrors = append(mirrors, mirror{pathRule: rules[0], route: c.Route, target: targets[0], percent: c.Percent})
+	}
+	return mirrors, nil
+}
+
+// mirrorMiddleware copies a share of the requests each mirror matches,
+// body included, to its shadow upstream, marked with X-Shadow: true.
+// Copies are sent in the background and their responses discarded: the
+// client is always answered by the primary, which never waits on the
+// shadow. A shadow failing is only logged and counted. The shadow sees
+// the path the primary upstream does, as in /products/1 for
+// /api/v1/products/1.
+func mirrorMiddleware(mirrors []mirror) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(mirrors) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, m := range mirrors {
+				if m.matches(r) && r.Header.Get("Upgrade") == "" && rand.Float64()*100 < m.percent {
+					m.send(r)
+					break
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// send starts copying r to m's shadow. It buffers r's body so both the
+// primary and the copy can read it.
+func (m mirror) send(r *http.Request) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxMirrorBody+1))
+		if err != nil || len(data) > maxMirrorBody {
+			// Give the primary what was read and the rest, unmirrored.
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+			mirroredRequests.WithLabelValues(m.route, "dropped").Inc()
+			return
+		}
+		r.Body = readCloser{bytes.NewReader(data), r.Body}
+		body = data
+	}
+
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		mirroredRequests.WithLabelValues(m.route, "dropped").Inc()
+		return
+	}
+
+	// Detached from the client's request, so the copy isn't cancelled
+	// when the primary's response is sent.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mirrorTimeout)
+	shadow := r.Clone(ctx)
+	_, unversioned := splitVersion(r.URL.Path)
+	shadow.URL.Scheme, shadow.URL.Host = m.target.Scheme, m.target.Host
+	shadow.URL.Path = strings.TrimRight(m.target.Path, "/") + strings.TrimPrefix(unversioned, "/api")
+	shadow.URL.RawPath = ""
+	shadow.Host, shadow.RequestURI = m.target.Host, ""
+	shadow.Body, shadow.ContentLength = http.NoBody, int64(len(body))
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	setForwardedHeaders(shadow)
+	shadow.Header.Set("X-Shadow", "true")
+	logger := loggerFrom(r.Context())
+
+	go func() {
+		defer func() { <-mirrorSlots }()
+		defer cancel()
+		outcome := "success"
+		resp, err := mirrorClient.Do(shadow)
+		if err != nil {
+			outcome = "error"
+			logger.Warn("mirrored request failed", "route", m.route, "shadow", m.target.Host, "error", err)
+		} else {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			if resp.StatusCode >= http.StatusInternalServerError {
+				outcome = "error"
+				logger.Warn("mirrored request failed", "route", m.route, "shadow", m.target.Host, "status", resp.StatusCode)
+			}
+		}
+		mirroredRequests.WithLabelValues(m.route, outcome).Inc()
+	}()
+}
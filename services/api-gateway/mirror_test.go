@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// shadowRequest is a request a shadow upstream got.
+type shadowRequest struct {
+	method, path, body, shadow string
+}
+
+// shadowUpstream reports each request it gets on seen, after delay.
+func shadowUpstream(t *testing.T, delay time.Duration) (string, chan shadowRequest) {
+	t.Helper()
+	seen := make(chan shadowRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- shadowRequest{r.Method, r.URL.Path, string(body), r.Header.Get("X-Shadow")}
+		time.Sleep(delay)
+		w.Write([]byte("shadow"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, seen
+}
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	shadowURL, seen := shadowUpstream(t, 2*time.Second)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("primary " + string(body)))
+	}))
+	defer primary.Close()
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, primary.URL, "mirrors:\n  - route: /api/products\n    url: "+shadowURL+"\n    percent: 100\n")
+	_, gw := configGateway(t, path)
+
+	start := time.Now()
+	resp, err := http.Post(gw.URL+"/api/v1/products", "application/json", strings.NewReader(`{"name":"Widget"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `primary {"name":"Widget"}` {
+		t.Errorf("client got %q, want the primary's response to the full body", body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, waiting on the slow shadow", elapsed)
+	}
+
+	select {
+	case got := <-seen:
+		want := shadowRequest{"POST", "/products", `{"name":"Widget"}`, "true"}
+		if got != want {
+			t.Errorf("shadow got %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shadow got no copy")
+	}
+
+	// Routes without a mirror aren't copied.
+	getBody(t, gw.URL+"/api/orders/1")
+	select {
+	case got := <-seen:
+		t.Errorf("shadow got a copy of %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorFailureDoesntAffectPrimary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, pathUpstream(t, "primary"), "mirrors:\n  - route: GET /api/orders\n    url: "+newClosedUpstream()+"\n    percent: 100\n")
+	_, gw := configGateway(t, path)
+	before := testutil.ToFloat64(mirroredRequests.WithLabelValues("GET /api/orders", "error"))
+
+	if resp, body := getBody(t, gw.URL+"/api/orders/1"); resp.StatusCode != http.StatusOK || body != "primary /orders/1" {
+		t.Fatalf("status %d body %q, want the primary's", resp.StatusCode, body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(mirroredRequests.WithLabelValues("GET /api/orders", "error"))-before != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed mirror wasn't counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseMirrorsRejectsBadConfig(t *testing.T) {
+	for _, c := range []mirrorConfig{
+		{Route: "products", URL: "http://shadow", Percent: 10},
+		{Route: "/api/products", URL: "shadow:8081", Percent: 10},
+		{Route: "/api/products", URL: "http://a,http://b", Percent: 10},
+		{Route: "/api/products", URL: "http://shadow", Percent: 0},
+		{Route: "/api/products", URL: "http://shadow", Percent: 150},
+	} {
+		if _, err := parseMirrors([]mirrorConfig{c}); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
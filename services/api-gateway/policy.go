@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var policyDenied = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_access_policy_denied_total",
+		Help: "Requests refused with 403 by an access policy, by policy route",
+	},
+	[]string{"policy"},
+)
+
+// accessPolicyConfig lets the requests Route, as in "POST /api/products",
+// matches through only for callers with one of Roles in their token or
+// an API key with one of Scopes.
+type accessPolicyConfig struct {
+	Route  string   `yaml:"route"`
+	Roles  []string `yaml:"roles"`
+	Scopes []string `yaml:"scopes"`
+}
+
+type accessPolicy struct {
+	pathRule
+	route         string
+	roles, scopes []string
+}
+
+// parseAccessPolicies checks the configured policies.
+func parseAccessPolicies(configs []accessPolicyConfig) ([]accessPolicy, error) {
+	var policies []accessPolicy
+	for _, c := range configs {
+		rules, err := parsePathRules(c.Route)
+		if err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("route %q must be [METHOD ]/prefix", c.Route)
+		}
+		if len(c.Roles) == 0 && len(c.Scopes) == 0 {
+			return nil, fmt.Errorf("route %q: no roles or scopes required", c.Route)
+		}
+		for _, name := range append(append([]string{}, c.Roles...), c.Scopes...) {
+			if name == "" || strings.ContainsAny(name, ", ") {
+				return nil, fmt.Errorf("route %q: role or scope %q must be one word", c.Route, name)
+			}
+		}
+		policies = append(policies, accessPolicy{pathRule: rules[0], route: c.Route, roles: c.Roles, scopes: c.Scopes})
+	}
+	return policies, nil
+}
+
+// allows reports whether a caller with roles and scopes may make the
+// requests p matches.
+func (p accessPolicy) allows(roles, scopes map[string]bool) bool {
+	for _, role := range p.roles {
+		if roles[role] {
+			return true
+		}
+	}
+	for _, scope := range p.scopes {
+		if scopes[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// requirement names what p requires, as in `role "admin" or scope "write"`.
+func (p accessPolicy) requirement() string {
+	var names []string
+	for _, role := range p.roles {
+		names = append(names, fmt.Sprintf("role %q", role))
+	}
+	for _, scope := range p.scopes {
+		names = append(names, fmt.Sprintf("scope %q", scope))
+	}
+	return strings.Join(names, " or ")
+}
+
+// headerSet is the set of a comma-separated header's values.
+func headerSet(r *http.Request, name string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range strings.Split(r.Header.Get(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// accessPolicyMiddleware refuses with 403 requests from callers that
+// don't meet every policy matching them, naming what is missing. It runs
+// after authentication, judging callers by the X-User-Roles and
+// X-API-Key-Scopes the auth middlewares set; requests no policy matches
+// are let through.
+func accessPolicyMiddleware(policies []accessPolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(policies) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			roles, scopes := headerSet(r, userRolesHeader), headerSet(r, apiKeyScopesHeader)
+			for _, p := range policies {
+				if p.matches(r) && !p.allows(roles, scopes) {
+					policyDenied.WithLabelValues(p.route).Inc()
+					writeError(w, http.StatusForbidden, "Forbidden: requires "+p.requirement())
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
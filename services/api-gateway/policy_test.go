@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const productPolicies = `access_policies:
+  - route: POST /api/products
+    roles: [admin]
+    scopes: [write]
+  - route: PUT /api/products
+    roles: [admin]
+    scopes: [write]
+  - route: DELETE /api/products
+    roles: [admin]
+`
+
+func TestAccessPolicies(t *testing.T) {
+	keys := testAPIKeys(t,
+		apiKeyConfig{ID: "writer", Key: "writer-secret", Routes: []string{"/api/products"}, Scopes: []string{"write"}},
+		apiKeyConfig{ID: "reader", Key: "reader-secret", Routes: []string{"/api/products"}, Scopes: []string{"read"}},
+	)
+	auth := &authenticator{secret: testSecret}
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	target := pathUpstream(t, "up")
+	writeConfig(t, path, target, productPolicies)
+	g, gw := configGatewayWith(t, path, authMiddleware(auth, keys))
+
+	tokenWith := func(roles ...string) string {
+		claims := validClaims()
+		claims.Roles = roles
+		return signHS256(t, claims)
+	}
+	send := func(method, path, token, key string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, gw.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		// Spoofed, and dropped by the auth middleware.
+		req.Header.Set(apiKeyScopesHeader, "write")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	admin, customer := tokenWith("customer", "admin"), tokenWith("customer")
+	callers := []struct {
+		name, token, key string
+		// want is the status for GET, POST, PUT and DELETE.
+		want [4]int
+	}{
+		{"admin", admin, "", [4]int{200, 200, 200, 200}},
+		{"customer", customer, "", [4]int{200, 403, 403, 403}},
+		{"no roles", tokenWith(), "", [4]int{200, 403, 403, 403}},
+		{"write key", "", "writer-secret", [4]int{200, 200, 200, 403}},
+		{"read key", "", "reader-secret", [4]int{200, 403, 403, 403}},
+	}
+	for _, c := range callers {
+		for i, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+			for _, p := range []string{"/api/products/1", "/api/v1/products/1"} {
+				status, body := send(method, p, c.token, c.key)
+				if status != c.want[i] {
+					t.Errorf("%s: %s %s: status %d, want %d", c.name, method, p, status, c.want[i])
+				}
+				if status == http.StatusForbidden && !strings.Contains(body, `role \"admin\"`) {
+					t.Errorf("%s: %s %s: body %q doesn't name what's missing", c.name, method, p, body)
+				}
+			}
+		}
+	}
+	if _, body := send("POST", "/api/products", customer, ""); !strings.Contains(body, `requires role \"admin\" or scope \"write\"`) {
+		t.Errorf("POST body %q, want the role and scope named", body)
+	}
+	if status, _ := send("DELETE", "/api/orders/1", customer, ""); status != http.StatusOK {
+		t.Errorf("unpoliced route: status %d, want 200", status)
+	}
+
+	denied := testutil.ToFloat64(policyDenied.WithLabelValues("DELETE /api/products"))
+	send("DELETE", "/api/products/1", customer, "")
+	if got := testutil.ToFloat64(policyDenied.WithLabelValues("DELETE /api/products")) - denied; got != 1 {
+		t.Errorf("counted %v denials, want 1", got)
+	}
+
+	// Policies go with the config they came in.
+	writeConfig(t, path, target, "")
+	if err := g.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := send("DELETE", "/api/products/1", customer, ""); status != http.StatusOK {
+		t.Errorf("after removing the policies: status %d, want 200", status)
+	}
+}
+
+func TestParseAccessPoliciesRejectsBadConfig(t *testing.T) {
+	for _, c := range []accessPolicyConfig{
+		{Route: "api/products", Roles: []string{"admin"}},
+		{Route: "POST /api/products"},
+		{Route: "POST /api/products", Roles: []string{""}},
+		{Route: "POST /api/products", Scopes: []string{"read,write"}},
+	} {
+		if _, err := parseAccessPolicies([]accessPolicyConfig{c}); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
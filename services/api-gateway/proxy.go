@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamResponseTimeout bounds how long an upstream may take to start
+// responding; a timeout counts as a failure for its circuit breaker.
+// Bodies aren't limited, so long exports and event streams can run.
+var upstreamResponseTimeout = loadDuration("UPSTREAM_RESPONSE_TIMEOUT", 30*time.Second)
+
+// upstreamIdleTimeout bounds how long the gateway waits for the next
+// bytes of a response body, so an upstream stalled mid-stream is cut off
+// without limiting how long a stream that keeps sending may last. Event
+// streams should send heartbeats more often than this.
+var upstreamIdleTimeout = loadDuration("UPSTREAM_IDLE_TIMEOUT", 60*time.Second)
+
+// newProxy returns a reverse proxy to b's instances that rewrites the
+// path prefix stripPrefix to newPrefix, as in /api/products/1 →
+// /products/1. Idempotent requests are retried, each attempt picking an
+// instance afresh, and responses are flushed as they arrive so streamed
+// ones such as CSV and NDJSON exports and server-sent events aren't held
+// back. A client hanging up cancels the upstream request.
+func newProxy(b *balancer, stripPrefix, newPrefix string) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			setForwardedHeaders(req)
+			req.URL.Path = newPrefix + strings.TrimPrefix(req.URL.Path, stripPrefix)
+			req.URL.RawPath = ""
+		},
+		Transport: retryTransport{
+			upstream:   b.upstream,
+			next:       b,
+			maxRetries: maxRetries,
+			backoff:    retryBackoff,
+			budget:     upstreamResponseTimeout,
+		},
+		// The gateway already set the response's X-Request-ID; drop the
+		// upstream's echo of it so it isn't sent twice. Plain-text errors
+		// are turned into JSON, as the rest of the API is.
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Del(requestIDHeader)
+			resp.Body = newIdleTimeoutBody(resp.Body, upstreamIdleTimeout)
+			return normalizeError(resp, b.upstream)
+		},
+		FlushInterval: -1,
+		ErrorHandler:  proxyError,
+	}
+}
+
+// idleTimeoutBody closes a response body, failing the read in progress,
+// when a single read waits longer than the timeout. Only time spent
+// waiting on the upstream counts, not time spent writing to a slow
+// client.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() { body.Close() })
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// proxyError answers a request the upstream couldn't take with 503.
+// While the upstream's breaker is open it says when to retry.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var retried *retriedError
+	if errors.As(err, &retried) {
+		w.Header().Set("X-Gateway-Retries", strconv.Itoa(retried.retries))
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectBodyTooLarge(w, r, tooLarge.Limit)
+		return
+	}
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		errorRate.WithLabelValues(routeFrom(r.Context()), "circuit_open").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(open.retryAfter.Seconds()))))
+		writeError(w, http.StatusServiceUnavailable, "Service unavailable (Circuit Breaker Open)")
+		return
+	}
+	errorRate.WithLabelValues(routeFrom(r.Context()), "request_execution").Inc()
+	loggerFrom(r.Context()).Error("proxying request failed", "url", r.URL.String(), "error", err)
+	writeError(w, http.StatusServiceUnavailable, "Service unavailable")
+}
+
+// writeError writes a JSON {"error": message} response, with the
+// request's id so a client can quote it when reporting the failure.
+func writeError(w http.ResponseWriter, status int, message string) {
+	body := map[string]string{"error": message}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBreakers = breakerConfig{MinRequests: 3, FailureRatio: 0.6, Window: time.Minute, OpenTimeout: time.Minute, HalfOpenRequests: 1}
+
+// testProxy proxies stripPrefix to newPrefix on targets, balanced as
+// upstream.
+func testProxy(t *testing.T, upstream, targets, stripPrefix, newPrefix string) http.Handler {
+	t.Helper()
+	b, err := newBalancer(upstream, targets, testBreakers)
+	if err != nil {
+		t.Fatalf("newBalancer: %s", err)
+	}
+	return newProxy(b, stripPrefix, newPrefix)
+}
+
+// newTestGateway serves the gateway router with every prefix proxied to
+// upstream.
+func newTestGateway(t *testing.T, upstream string) *httptest.Server {
+	t.Helper()
+	gw := httptest.NewServer(newRouter(
+		testProxy(t, "/products", upstream, "/api/products", "/products"),
+		testProxy(t, "/orders", upstream, "/api/orders", "/orders"),
+		testProxy(t, "/payments", upstream, "/api/payments", "/payments"),
+	))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+// newTestGatewayWith serves the gateway router with orders proxied by
+// orders.
+func newTestGatewayWith(t *testing.T, orders http.Handler) *httptest.Server {
+	t.Helper()
+	gw := httptest.NewServer(newRouter(http.NotFoundHandler(), orders, http.NotFoundHandler()))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+// newClosedUpstream returns the URL of a server that is no longer
+// listening.
+func newClosedUpstream() string {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	return upstream.URL
+}
+
+func TestProxyRewritesPrefix(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"method": r.Method, "path": r.URL.Path, "query": r.URL.RawQuery,
+			"auth": r.Header.Get("Authorization"), "body": string(body),
+		})
+	}))
+	defer upstream.Close()
+	gw := newTestGateway(t, upstream.URL)
+
+	tests := []struct{ path, want string }{
+		{"/api/products/7", "/products/7"},
+		{"/api/orders", "/orders"},
+		{"/api/orders/user/3", "/orders/user/3"},
+		{"/api/payments/9/refund", "/payments/9/refund"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", gw.URL+tt.path+"?limit=5", strings.NewReader(`{"a":1}`))
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.path, err)
+		}
+		var got map[string]string
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Upstream") != "yes" {
+			t.Errorf("%s: expected the upstream's 201 and headers, got %d %v", tt.path, resp.StatusCode, resp.Header)
+		}
+		if got["path"] != tt.want || got["query"] != "limit=5" || got["method"] != "POST" {
+			t.Errorf("%s: upstream saw %v", tt.path, got)
+		}
+		if got["auth"] != "Bearer token" || got["body"] != `{"a":1}` {
+			t.Errorf("%s: headers or body not forwarded, upstream saw %v", tt.path, got)
+		}
+	}
+}
+
+func TestProxyStreamsResponses(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"id":1}`+"\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, `{"id":2}`+"\n")
+	}))
+	defer upstream.Close()
+	defer close(release)
+	gw := newTestGateway(t, upstream.URL)
+
+	resp, err := http.Get(gw.URL + "/api/payments/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case got := <-line:
+		if got != `{"id":1}`+"\n" {
+			t.Errorf("unexpected first line %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first line wasn't flushed before the upstream finished")
+	}
+}
+
+func TestProxyStreamsServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer upstream.Close()
+	gw := newTestGateway(t, upstream.URL)
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/orders/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("expected the event stream uncompressed, got %q", enc)
+	}
+
+	events := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			if strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimSpace(line)
+			}
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		select {
+		case got := <-events:
+			if want := fmt.Sprintf("data: event %d", i); got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %d didn't arrive before the upstream sent the next", i)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestProxyCancelsUpstreamWhenClientHangsUp(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer upstream.Close()
+	gw := newTestGateway(t, upstream.URL)
+
+	resp, err := http.Get(gw.URL + "/api/orders/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(resp.Body).ReadString('\n')
+	resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request wasn't cancelled after the client hung up")
+	}
+}
+
+func TestIdleTimeoutBodyCutsOffStalledUpstream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	resp, err := http.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := newIdleTimeoutBody(resp.Body, 50*time.Millisecond)
+	defer body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the stalled read to fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled body wasn't cut off after the idle timeout")
+	}
+}
+
+func TestProxyUnavailableUpstream(t *testing.T) {
+	gw := newTestGateway(t, newClosedUpstream())
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body["error"] != "Service unavailable" {
+		t.Errorf("expected a JSON error, got %v (%v)", body, err)
+	}
+}
+
+func TestNewBalancerRejectsRelativeURL(t *testing.T) {
+	if _, err := newBalancer("bad", "localhost:8081", testBreakers); err == nil {
+		t.Error("expected an error for a URL without a scheme")
+	}
+}
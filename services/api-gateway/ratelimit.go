@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+var rateLimited = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_rate_limited_total",
+		Help: "Requests rejected with 429 by the per-client rate limiter, by route",
+	},
+	[]string{"route"},
+)
+
+// ratePolicy is a token bucket: Rate requests per second with bursts of
+// up to Burst.
+type ratePolicy struct {
+	Name  string
+	Rate  rate.Limit
+	Burst int
+}
+
+// rateOverride applies a policy to requests matching a pathRule.
+type rateOverride struct {
+	pathRule
+	Policy ratePolicy
+}
+
+// rateLimiter limits each client, by IP, with one bucket per policy.
+// Reads and writes have separate policies so writes can be held to a
+// stricter rate, and overrides can single out routes.
+type rateLimiter struct {
+	trusted proxyList
+	idleTTL time.Duration
+	store   rateStore
+
+	mu          sync.Mutex
+	read, write ratePolicy
+	overrides   []rateOverride
+}
+
+// rateStore holds the clients' buckets, by a key naming the client and
+// policy.
+type rateStore interface {
+	// allow takes a token from key's bucket, or returns how long until
+	// one is available.
+	allow(key string, policy ratePolicy, now time.Time) (bool, time.Duration)
+	// evictIdle forgets buckets unused for longer than ttl.
+	evictIdle(now time.Time, ttl time.Duration) int
+	// reset forgets every bucket.
+	reset()
+}
+
+// memoryRateStore keeps buckets in the gateway's memory, so with more
+// than one replica each gives a client its own budget.
+type memoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*clientBucket
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// loadRateLimiter configures the limiter from RATE_LIMIT_*, trusting
+// X-Forwarded-For from trustedProxies. RATE_LIMIT_BACKEND picks where
+// buckets are kept: "memory", per replica, or "redis", shared by every
+// replica. It returns nil if RATE_LIMIT_ENABLED is false.
+func loadRateLimiter() (*rateLimiter, error) {
+	if enabled, err := strconv.ParseBool(getEnv("RATE_LIMIT_ENABLED", "true")); err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_ENABLED: %w", err)
+	} else if !enabled {
+		return nil, nil
+	}
+	read, err := parseRatePolicy("read", getEnv("RATE_LIMIT_READ", "20:40"))
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_READ: %w", err)
+	}
+	write, err := parseRatePolicy("write", getEnv("RATE_LIMIT_WRITE", "5:10"))
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_WRITE: %w", err)
+	}
+	overrides, err := parseRateOverrides(getEnv("RATE_LIMIT_OVERRIDES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_OVERRIDES: %w", err)
+	}
+	l := newRateLimiter(read, write, overrides, trustedProxies, loadDuration("RATE_LIMIT_IDLE_TTL", 10*time.Minute))
+	switch backend := getEnv("RATE_LIMIT_BACKEND", "memory"); backend {
+	case "memory":
+	case "redis":
+		failOpen, err := strconv.ParseBool(getEnv("RATE_LIMIT_FAIL_OPEN", "true"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_FAIL_OPEN: %w", err)
+		}
+		addr := getEnv("REDIS_ADDR", "localhost:6379")
+		client := redis.NewClient(&redis.Options{
+			Addr:         addr,
+			DialTimeout:  250 * time.Millisecond,
+			ReadTimeout:  250 * time.Millisecond,
+			WriteTimeout: 250 * time.Millisecond,
+		})
+		store := newRedisRateStore(client, failOpen)
+		go store.syncLoop(loadDuration("RATE_LIMIT_SYNC_INTERVAL", 100*time.Millisecond))
+		l.store = store
+		log.Printf("Rate limits shared through redis at %s (fail open: %t)", addr, failOpen)
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q, want memory or redis", backend)
+	}
+	return l, nil
+}
+
+func newRateLimiter(read, write ratePolicy, overrides []rateOverride, trusted proxyList, idleTTL time.Duration) *rateLimiter {
+	return &rateLimiter{
+		read: read, write: write, overrides: overrides, trusted: trusted, idleTTL: idleTTL,
+		store: &memoryRateStore{buckets: map[string]*clientBucket{}},
+	}
+}
+
+// parseRatePolicy parses "rate:burst", as in "20:40".
+func parseRatePolicy(name, raw string) (ratePolicy, error) {
+	r, b, ok := strings.Cut(strings.TrimSpace(raw), ":")
+	perSecond, err1 := strconv.ParseFloat(r, 64)
+	burst, err2 := strconv.Atoi(b)
+	if !ok || err1 != nil || err2 != nil || perSecond <= 0 || burst < 1 {
+		return ratePolicy{}, fmt.Errorf("%q must be rate:burst with a positive rate and burst", raw)
+	}
+	return ratePolicy{Name: name, Rate: rate.Limit(perSecond), Burst: burst}, nil
+}
+
+// parseRateOverrides parses a comma-separated list of
+// "[METHOD ]/prefix=rate:burst" entries, as in
+// "POST /api/orders=1:3,/api/payments=5:10". The first matching entry
+// applies.
+func parseRateOverrides(raw string) ([]rateOverride, error) {
+	var overrides []rateOverride
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be [METHOD ]/prefix=rate:burst", entry)
+		}
+		rules, err := parsePathRules(route)
+		if err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("entry %q must be [METHOD ]/prefix=rate:burst", entry)
+		}
+		policy, err := parseRatePolicy(strings.TrimSpace(route), spec)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+		overrides = append(overrides, rateOverride{pathRule: rules[0], Policy: policy})
+	}
+	return overrides, nil
+}
+
+// setPolicies replaces the limiter's policies. Clients start over with
+// full buckets under the new ones.
+func (l *rateLimiter) setPolicies(read, write ratePolicy, overrides []rateOverride) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.read, l.write, l.overrides = read, write, overrides
+	l.store.reset()
+}
+
+// policy picks the bucket that applies to r.
+func (l *rateLimiter) policy(r *http.Request) ratePolicy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, o := range l.overrides {
+		if o.matches(r) {
+			return o.Policy
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return l.read
+	}
+	return l.write
+}
+
+// allow takes a token from client's bucket for policy, or returns how
+// long until one is available.
+func (l *rateLimiter) allow(client string, policy ratePolicy, now time.Time) (bool, time.Duration) {
+	return l.store.allow(policy.Name+"|"+client, policy, now)
+}
+
+// evictIdle forgets buckets unused for longer than the idle TTL. A
+// client coming back starts with a full bucket, as it would have had by
+// then anyway.
+func (l *rateLimiter) evictIdle(now time.Time) int {
+	return l.store.evictIdle(now, l.idleTTL)
+}
+
+func (s *memoryRateStore) allow(key string, policy ratePolicy, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(policy.Rate, policy.Burst)}
+		s.buckets[key] = b
+	}
+	b.lastSeen = now
+	s.mu.Unlock()
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (s *memoryRateStore) evictIdle(now time.Time, ttl time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := 0
+	for key, b := range s.buckets {
+		if now.Sub(b.lastSeen) > ttl {
+			delete(s.buckets, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+func (s *memoryRateStore) reset() {
+	s.mu.Lock()
+	s.buckets = map[string]*clientBucket{}
+	s.mu.Unlock()
+}
+
+// evictLoop runs evictIdle every interval.
+func (l *rateLimiter) evictLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := l.evictIdle(time.Now()); n > 0 {
+			log.Printf("Evicted %d idle rate limit buckets", n)
+		}
+	}
+}
+
+// middleware rejects API requests over their client's rate with 429 and
+// a Retry-After. Health checks and metrics aren't limited.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(clientIP(r, l.trusted), l.policy(r), time.Now())
+		if !ok {
+			rateLimited.WithLabelValues(routeFrom(r.Context())).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
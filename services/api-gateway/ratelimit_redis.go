@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	rateBackendErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_rate_limit_backend_errors_total",
+		Help: "Failed syncs of rate limit buckets with redis",
+	})
+	rateFailedOpen = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_rate_limit_failed_open_total",
+		Help: "Requests let through unlimited while redis was unavailable",
+	})
+)
+
+// rateScript takes ARGV[4] tokens from the token bucket at KEYS[1],
+// refilled at ARGV[1] per second up to ARGV[2] as of ARGV[3] in
+// milliseconds, and returns the tokens left. The count may go below
+// zero, so tokens replicas took between syncs over the limit are paid
+// back before any more are given out. A bucket expires once it would
+// have refilled.
+var rateScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local taken = tonumber(ARGV[4])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens, ts = burst, now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+	ts = now
+end
+tokens = tokens - taken
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return tostring(tokens)
+`)
+
+// redisRateStore shares buckets between gateway replicas through redis,
+// without a round trip per request: each replica decides from the
+// bucket's tokens as of its last sync, refilled since, less the tokens
+// it has taken itself. A sync loop sends those tokens to redis and
+// brings back what every replica has left. Between syncs the replicas
+// can together exceed a client's burst, by what they refill, which the
+// shared bucket then takes back.
+//
+// While redis can't be reached, requests are let through unlimited if
+// failOpen is set, and refused otherwise.
+type redisRateStore struct {
+	client   *redis.Client
+	prefix   string
+	failOpen bool
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*syncedBucket
+	down    bool
+	loaded  bool // whether redis has rateScript cached
+}
+
+// syncedBucket is this replica's view of a shared bucket.
+type syncedBucket struct {
+	policy   ratePolicy
+	tokens   float64 // left in the shared bucket at syncedAt
+	syncedAt time.Time
+	taken    int // by this replica since syncedAt
+	lastSeen time.Time
+}
+
+func newRedisRateStore(client *redis.Client, failOpen bool) *redisRateStore {
+	return &redisRateStore{
+		client: client, prefix: "gateway:ratelimit:", failOpen: failOpen, timeout: time.Second,
+		buckets: map[string]*syncedBucket{},
+	}
+}
+
+func (s *redisRateStore) allow(key string, policy ratePolicy, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		if s.failOpen {
+			rateFailedOpen.Inc()
+			return true, 0
+		}
+		return false, time.Second
+	}
+
+	b, ok := s.buckets[key]
+	if !ok || b.policy != policy {
+		b = &syncedBucket{policy: policy, tokens: float64(policy.Burst), syncedAt: now}
+		s.buckets[key] = b
+	}
+	b.lastSeen = now
+	refilled := b.tokens + math.Max(0, now.Sub(b.syncedAt).Seconds())*float64(policy.Rate)
+	tokens := math.Min(float64(policy.Burst), refilled) - float64(b.taken)
+	if tokens < 1 {
+		return false, time.Duration((1 - tokens) / float64(policy.Rate) * float64(time.Second))
+	}
+	b.taken++
+	return true, 0
+}
+
+func (s *redisRateStore) evictIdle(now time.Time, ttl time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := 0
+	for key, b := range s.buckets {
+		if b.taken == 0 && now.Sub(b.lastSeen) > ttl {
+			delete(s.buckets, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// reset forgets this replica's views; the shared buckets stay.
+func (s *redisRateStore) reset() {
+	s.mu.Lock()
+	s.buckets = map[string]*syncedBucket{}
+	s.mu.Unlock()
+}
+
+// syncLoop runs sync every interval.
+func (s *redisRateStore) syncLoop(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.sync(context.Background(), now)
+	}
+}
+
+// sync sends the tokens taken from each bucket used since its last sync
+// to redis, and takes on the tokens the shared bucket has left. While
+// redis is down it only checks whether it is back.
+func (s *redisRateStore) sync(ctx context.Context, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	type syncing struct {
+		key   string
+		b     *syncedBucket
+		taken int
+		cmd   *redis.Cmd
+	}
+	var batch []*syncing
+	s.mu.Lock()
+	down, loaded := s.down, s.loaded
+	for key, b := range s.buckets {
+		if b.taken > 0 || b.lastSeen.After(b.syncedAt) {
+			batch = append(batch, &syncing{key: key, b: b, taken: b.taken})
+		}
+	}
+	s.mu.Unlock()
+
+	var err error
+	switch {
+	case !loaded:
+		err = rateScript.Load(ctx, s.client).Err()
+	case down:
+		err = s.client.Ping(ctx).Err()
+	}
+	if err == nil && len(batch) > 0 {
+		_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, e := range batch {
+				p := e.b.policy
+				e.cmd = rateScript.EvalSha(ctx, pipe, []string{s.prefix + e.key},
+					float64(p.Rate), p.Burst, now.UnixMilli(), e.taken)
+			}
+			return nil
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		rateBackendErrors.Inc()
+		if redis.HasErrorPrefix(err, "NOSCRIPT") {
+			// Redis restarted or was flushed; load the script again.
+			s.loaded = false
+		} else if !s.down {
+			log.Printf("Rate limit redis unavailable, failing open: %t: %v", s.failOpen, err)
+			s.down = true
+		}
+		return err
+	}
+	s.loaded = true
+	if s.down {
+		log.Println("Rate limit redis available again")
+		s.down = false
+	}
+	for _, e := range batch {
+		e.b.taken -= e.taken
+		text, _ := e.cmd.Text()
+		if tokens, err := strconv.ParseFloat(text, 64); err == nil {
+			e.b.tokens, e.b.syncedAt = tokens, now
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisStore returns a store on mr, as one gateway replica.
+func newTestRedisStore(t *testing.T, mr *miniredis.Miniredis, failOpen bool) *redisRateStore {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), DialTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	return newRedisRateStore(client, failOpen)
+}
+
+func TestRedisRateStoreSharesBudget(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := newTestRedisStore(t, mr, true), newTestRedisStore(t, mr, true)
+	policy := ratePolicy{Name: "read", Rate: 1, Burst: 4}
+	now := time.Now()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		if ok, _ := a.allow("read|1.2.3.4", policy, now); !ok {
+			t.Fatalf("request %d refused within the burst", i+1)
+		}
+	}
+	if ok, _ := a.allow("read|1.2.3.4", policy, now); ok {
+		t.Fatal("request over the burst allowed")
+	}
+	if err := a.sync(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other replica learns of the spent budget at its next sync.
+	b.allow("read|1.2.3.4", policy, now)
+	if err := b.sync(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet("gateway:ratelimit:read|1.2.3.4", "tokens"); got != "-1" {
+		t.Errorf("shared bucket has %s tokens, want -1", got)
+	}
+	ok, wait := b.allow("read|1.2.3.4", policy, now)
+	if ok {
+		t.Fatal("second replica allowed a request past the shared budget")
+	}
+	if wait != 2*time.Second {
+		t.Errorf("wait = %s, want 2s to pay back the overdraft", wait)
+	}
+
+	// Both see the refill.
+	later := now.Add(3 * time.Second)
+	a.sync(ctx, later)
+	if ok, _ := a.allow("read|1.2.3.4", policy, later); !ok {
+		t.Error("request refused after the bucket refilled")
+	}
+	if ttl := mr.TTL("gateway:ratelimit:read|1.2.3.4"); ttl <= 0 {
+		t.Errorf("shared bucket has no expiry")
+	}
+}
+
+func TestRedisRateStoreOutage(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		mr := miniredis.RunT(t)
+		s := newTestRedisStore(t, mr, failOpen)
+		policy := ratePolicy{Name: "write", Rate: 1, Burst: 1}
+		now := time.Now()
+		s.allow("write|1.2.3.4", policy, now)
+
+		mr.Close()
+		errorsBefore := testutil.ToFloat64(rateBackendErrors)
+		openBefore := testutil.ToFloat64(rateFailedOpen)
+		if err := s.sync(context.Background(), now); err == nil {
+			t.Fatal("sync succeeded with redis down")
+		}
+		if got := testutil.ToFloat64(rateBackendErrors) - errorsBefore; got != 1 {
+			t.Errorf("counted %v backend errors, want 1", got)
+		}
+		for i := 0; i < 3; i++ {
+			if ok, _ := s.allow("write|1.2.3.4", policy, now); ok != failOpen {
+				t.Errorf("fail open %t: request allowed %t with redis down", failOpen, ok)
+			}
+		}
+		if got := testutil.ToFloat64(rateFailedOpen) - openBefore; failOpen && got != 3 {
+			t.Errorf("counted %v requests failed open, want 3", got)
+		}
+
+		// Limits apply again once redis is back.
+		if err := mr.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.sync(context.Background(), now); err != nil {
+			t.Fatalf("sync after redis came back: %v", err)
+		}
+		if ok, _ := s.allow("write|1.2.3.4", policy, now); ok {
+			t.Errorf("fail open %t: request over the limit allowed after redis came back", failOpen)
+		}
+	}
+}
+
+func TestRedisRateStoreReloadsScript(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestRedisStore(t, mr, true)
+	policy := ratePolicy{Name: "read", Rate: 1, Burst: 5}
+	now := time.Now()
+	s.allow("read|1.2.3.4", policy, now)
+	if err := s.sync(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FlushAll()
+	if err := s.client.ScriptFlush(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	s.allow("read|1.2.3.4", policy, now)
+	if err := s.sync(context.Background(), now); err == nil {
+		t.Fatal("expected NOSCRIPT after the script cache was flushed")
+	}
+	if err := s.sync(context.Background(), now); err != nil {
+		t.Fatalf("sync after reloading the script: %v", err)
+	}
+	if got := mr.HGet("gateway:ratelimit:read|1.2.3.4", "tokens"); got != "4" {
+		t.Errorf("shared bucket has %s tokens, want 4", got)
+	}
+}
+
+func TestLoadRateLimiterBackend(t *testing.T) {
+	t.Setenv("RATE_LIMIT_BACKEND", "memcached")
+	if _, err := loadRateLimiter(); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+	t.Setenv("RATE_LIMIT_BACKEND", "memory")
+	l, err := loadRateLimiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.store.(*memoryRateStore); !ok {
+		t.Errorf("store is %T, want the in-memory one", l.store)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testRateLimiter(t *testing.T, overrides string, trusted string) *rateLimiter {
+	t.Helper()
+	read, _ := parseRatePolicy("read", "1:2")
+	write, _ := parseRatePolicy("write", "1:1")
+	o, err := parseRateOverrides(overrides)
+	if err != nil {
+		t.Fatalf("parseRateOverrides: %s", err)
+	}
+	nets, err := parseCIDRs(trusted)
+	if err != nil {
+		t.Fatalf("parseCIDRs: %s", err)
+	}
+	return newRateLimiter(read, write, o, nets, time.Minute)
+}
+
+func TestRateLimitRejectsOverBurst(t *testing.T) {
+	limiter := testRateLimiter(t, "", "")
+	router := newRouter(http.NotFoundHandler(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), http.NotFoundHandler())
+	router.Use(limiter.middleware)
+	before := testutil.ToFloat64(rateLimited.WithLabelValues("/api/orders/{id}"))
+
+	do := func(method, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/orders/7", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := do(http.MethodGet, "10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("read %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	rec := do(http.MethodGet, "10.0.0.1:1234")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("read over burst: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if got := testutil.ToFloat64(rateLimited.WithLabelValues("/api/orders/{id}")) - before; got != 1 {
+		t.Errorf("throttled count rose by %v, want 1", got)
+	}
+
+	// Writes have their own, smaller bucket.
+	if rec := do(http.MethodPut, "10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Fatalf("first write: status %d, want 200", rec.Code)
+	}
+	if rec := do(http.MethodPut, "10.0.0.1:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second write: status %d, want 429", rec.Code)
+	}
+
+	// Other clients and non-API paths aren't affected.
+	if rec := do(http.MethodGet, "10.0.0.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("other client: status %d, want 200", rec.Code)
+	}
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("health: status %d, want 200", rec.Code)
+		}
+	}
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	limiter := testRateLimiter(t, "POST /api/orders=0.5:3, /api/payments=10:20", "")
+	tests := []struct {
+		method, path, want string
+	}{
+		{http.MethodGet, "/api/products", "read"},
+		{http.MethodDelete, "/api/products/1", "write"},
+		{http.MethodPost, "/api/orders", "POST /api/orders"},
+		{http.MethodGet, "/api/orders", "read"},
+		{http.MethodGet, "/api/payments/3", "/api/payments"},
+	}
+	for _, tt := range tests {
+		got := limiter.policy(httptest.NewRequest(tt.method, tt.path, nil))
+		if got.Name != tt.want {
+			t.Errorf("policy(%s %s) = %q, want %q", tt.method, tt.path, got.Name, tt.want)
+		}
+	}
+}
+
+func TestParseRateOverridesRejectsMalformed(t *testing.T) {
+	for _, raw := range []string{"/api/orders", "api/orders=1:1", "/api/orders=1", "/api/orders=0:1", "/api/orders=1:0"} {
+		if _, err := parseRateOverrides(raw); err == nil {
+			t.Errorf("parseRateOverrides(%q) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	limiter := testRateLimiter(t, "", "10.0.0.0/8, 192.168.1.1")
+	tests := []struct {
+		name, remote, xff, want string
+	}{
+		{"direct", "203.0.113.5:4000", "", "203.0.113.5"},
+		{"untrusted peer's header ignored", "203.0.113.5:4000", "198.51.100.1", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"spoofed hop left of the real client", "10.1.2.3:4000", "1.1.1.1, 198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"only proxies", "10.1.2.3:4000", "10.9.9.9", "10.9.9.9"},
+		{"garbage header", "10.1.2.3:4000", "not-an-ip", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/products", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(req, limiter.trusted); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitEvictsIdleBuckets(t *testing.T) {
+	limiter := testRateLimiter(t, "", "")
+	now := time.Now()
+	limiter.allow("a", limiter.read, now.Add(-2*time.Minute))
+	limiter.allow("b", limiter.read, now)
+
+	if n := limiter.evictIdle(now); n != 1 {
+		t.Fatalf("evictIdle = %d, want 1", n)
+	}
+	buckets := limiter.store.(*memoryRateStore).buckets
+	if _, ok := buckets["read|b"]; !ok || len(buckets) != 1 {
+		t.Errorf("buckets = %v, want only b's", buckets)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"inventory-microservices/pkg/httpx"
+)
+
+var panicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gateway_panics_total",
+	Help: "Panics recovered while serving requests",
+})
+
+// recoverMiddleware turns panics into 500s, counting them in
+// gateway_panics_total. The request id it logs is set by
+// requestIDMiddleware, further in.
+var recoverMiddleware = httpx.Recover(httpx.RecoverOptions{
+	RequestIDHeader: requestIDHeader,
+	Panics:          panicsTotal,
+})
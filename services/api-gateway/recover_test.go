@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoverTurnsPanicsInto500s(t *testing.T) {
+	gw := httptest.NewServer(newRouter(http.NotFoundHandler(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		var m map[string]int
+		m["boom"]++
+	}), http.NotFoundHandler()))
+	defer gw.Close()
+	before := testutil.ToFloat64(panicsTotal)
+
+	resp, body := getBody(t, gw.URL+"/api/orders/1")
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d content type %q, want a 500 JSON error", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var got map[string]string
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("body %q isn't JSON: %v", body, err)
+	}
+	if got["error"] != "Internal Server Error" || got["request_id"] == "" || got["request_id"] != resp.Header.Get(requestIDHeader) {
+		t.Errorf("body %q, want the error and the response's request id", body)
+	}
+	if n := testutil.ToFloat64(panicsTotal) - before; n != 1 {
+		t.Errorf("counted %v panics, want 1", n)
+	}
+
+	// The gateway goes on serving.
+	if resp, _ := getBody(t, gw.URL+"/health"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after a panic: health status %d", resp.StatusCode)
+	}
+}
+
+func TestRecoverAbortsStartedResponses(t *testing.T) {
+	gw := httptest.NewServer(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		panic("halfway")
+	})))
+	defer gw.Close()
+	before := testutil.ToFloat64(panicsTotal)
+
+	resp, err := http.Get(gw.URL)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("a response that panicked part way read as whole")
+	}
+	if n := testutil.ToFloat64(panicsTotal) - before; n != 1 {
+		t.Errorf("counted %v panics, want 1", n)
+	}
+}
+
+func TestRecoverPassesOnAbortHandler(t *testing.T) {
+	before := testutil.ToFloat64(panicsTotal)
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", p)
+		}
+		if n := testutil.ToFloat64(panicsTotal) - before; n != 0 {
+			t.Errorf("counted %v panics, want none", n)
+		}
+	}()
+	recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDPropagated(t *testing.T) {
+	var upstreamSaw string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamSaw = r.Header.Get(requestIDHeader)
+		w.Header().Set(requestIDHeader, upstreamSaw)
+	}))
+	defer upstream.Close()
+	gw := newTestGateway(t, upstream.URL)
+
+	tests := []struct {
+		name, sent string
+		reused     bool
+	}{
+		{"client id", "client-abc.123", true},
+		{"no id", "", false},
+		{"invalid id", "bad id\twith spaces", false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/products/1", nil)
+		if tt.sent != "" {
+			req.Header.Set(requestIDHeader, tt.sent)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		resp.Body.Close()
+
+		ids := resp.Header.Values(requestIDHeader)
+		if len(ids) != 1 {
+			t.Fatalf("%s: response has %d request ids, want 1", tt.name, len(ids))
+		}
+		if ids[0] != upstreamSaw {
+			t.Errorf("%s: upstream saw %q, client got %q", tt.name, upstreamSaw, ids[0])
+		}
+		if tt.reused != (ids[0] == tt.sent) {
+			t.Errorf("%s: request id %q, sent %q", tt.name, ids[0], tt.sent)
+		}
+		if !validRequestID.MatchString(ids[0]) {
+			t.Errorf("%s: request id %q isn't valid", tt.name, ids[0])
+		}
+	}
+}
+
+func TestRequestIDInProxyErrors(t *testing.T) {
+	gw := newTestGateway(t, newClosedUpstream())
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/orders/1", nil)
+	req.Header.Set(requestIDHeader, "trace-me")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusServiceUnavailable || body["request_id"] != "trace-me" {
+		t.Errorf("got %d %v, want 503 with request_id trace-me", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	responseCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_response_cache_requests_total",
+			Help: "Product reads looked up in the response cache, by result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+	responseCachePurges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_response_cache_purges_total",
+			Help: "Response cache purges, by source (write or event)",
+		},
+		[]string{"source"},
+	)
+)
+
+// productsPath is the prefix of the product routes, once any API version
+// has been taken off.
+const productsPath = "/api/products"
+
+// maxCachedBody is the largest response body the cache keeps. Bigger
+// responses, such as exports, are passed on without being stored.
+const maxCachedBody = 1 << 20
+
+// responseCache keeps inventory's answers to GET requests for products
+// for a TTL. A product's entries, and every listing's, are purged when
+// the gateway passes on a write to it, and when inventory reports a
+// change to it on inventory-events (see cacheInvalidator). The TTL
+// bounds how stale an entry can get when a change arrives some other way.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+// cachedResponse is an upstream's 200 response to a product read.
+type cachedResponse struct {
+	// product is the id of the product the response is about, or "" for
+	// listings and searches, which any product's change may affect.
+	product string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{ttl: ttl, maxEntries: maxEntries, now: time.Now, entries: map[string]*cachedResponse{}}
+}
+
+// loadResponseCache returns the product response cache configured by
+// RESPONSE_CACHE_TTL and RESPONSE_CACHE_MAX_ENTRIES, or nil when
+// RESPONSE_CACHE_TTL isn't set.
+func loadResponseCache() (*responseCache, error) {
+	raw := getEnv("RESPONSE_CACHE_TTL", "")
+	if raw == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("RESPONSE_CACHE_TTL: %q must be a positive duration", raw)
+	}
+	return newResponseCache(ttl, loadPositiveInt("RESPONSE_CACHE_MAX_ENTRIES", 10000)), nil
+}
+
+// productOf reports whether path is a product route and, if it names a
+// product, as /api/products/5/variants does, that product's id.
+func productOf(path string) (string, bool) {
+	if !underPath(path, productsPath) {
+		return "", false
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(path, productsPath), "/"), "/")
+	if id == "" || strings.Trim(id, "0123456789") != "" {
+		return "", true
+	}
+	return id, true
+}
+
+// cacheKey identifies a product read. Responses are shared only between
+// callers sending the same inventory key, since it can decide what they
+// may read, and asking for the same representation.
+func cacheKey(r *http.Request) string {
+	key := r.URL.Path + "?" + r.URL.RawQuery + "\x00" + r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Encoding")
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		sum := sha256.Sum256([]byte(apiKey))
+		key += "\x00" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// middleware serves product reads from the cache, storing the upstream's
+// response on a miss, and purges the cache after a successful write to a
+// product.
+func (c *responseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		product, ok := productOf(r.URL.Path)
+		if !ok || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(wrapped, r)
+			if wrapped.statusCode < http.StatusBadRequest {
+				c.purge(product)
+				responseCachePurges.WithLabelValues("write").Inc()
+			}
+			return
+		}
+
+		key := cacheKey(r)
+		if entry := c.get(key); entry != nil {
+			responseCacheRequests.WithLabelValues("hit").Inc()
+			for k, v := range entry.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(http.StatusOK)
+			w.Write(entry.body)
+			return
+		}
+		responseCacheRequests.WithLabelValues("miss").Inc()
+		w.Header().Set("X-Cache", "MISS")
+		capture := &captureWriter{ResponseWriter: w, header: http.Header{}}
+		next.ServeHTTP(capture, r)
+		if capture.cacheable() {
+			c.set(key, &cachedResponse{product: product, header: capture.header, body: capture.body.Bytes()})
+		}
+	})
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// set stores entry under key. When the cache is full, expired entries
+// are dropped first and, failing that, an arbitrary one.
+func (c *responseCache) set(key string, entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entry.expires = now.Add(c.ttl)
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// purge drops the entries about product, and every listing's. An empty
+// product drops the listings alone, as after a bulk create.
+func (c *responseCache) purge(product string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.product == "" || e.product == product {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// captureWriter passes a response on while keeping a copy of it. The
+// handler's headers are kept apart from those the gateway's own
+// middleware set, so only the upstream's are stored.
+type captureWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	tooLarge    bool
+	wroteHeader bool
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	for k, v := range cw.header {
+		cw.ResponseWriter.Header()[k] = v
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.tooLarge {
+		if cw.body.Len()+len(p) > maxCachedBody {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *captureWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// cacheable reports whether the captured response may be stored: a
+// complete 200 that isn't a stream, sets no cookie and doesn't forbid it.
+func (cw *captureWriter) cacheable() bool {
+	if cw.status != http.StatusOK || cw.tooLarge {
+		return false
+	}
+	if cw.header.Get("Set-Cookie") != "" || strings.HasPrefix(cw.header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	cc := strings.ToLower(cw.header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
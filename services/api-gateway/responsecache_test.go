@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProducts answers each request with its path and how many
+// requests it has had.
+func countingProducts(calls *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s #%d", r.URL.RequestURI(), n)
+	})
+}
+
+// cacheGet sends a request through h and returns the response.
+func cacheGet(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(""))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestResponseCacheServesRepeatReads(t *testing.T) {
+	var calls atomic.Int32
+	h := newResponseCache(time.Minute, 100).middleware(countingProducts(&calls))
+
+	first := cacheGet(h, "GET", "/api/products/1", nil)
+	second := cacheGet(h, "GET", "/api/products/1", nil)
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("X-Cache %q then %q, want MISS then HIT", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("cached response %q (%s), want %q", second.Body, second.Header().Get("Content-Type"), first.Body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+
+	// A different query or inventory key is a different entry.
+	cacheGet(h, "GET", "/api/products/1?fields=name", nil)
+	cacheGet(h, "GET", "/api/products/1", http.Header{"X-Api-Key": {"k1"}})
+	if rec := cacheGet(h, "GET", "/api/products/1", http.Header{"X-Api-Key": {"k2"}}); rec.Header().Get("X-Cache") != "MISS" {
+		t.Error("a response fetched with one inventory key was served to another")
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("upstream called %d times, want 4", n)
+	}
+
+	// Other routes pass straight through.
+	cacheGet(h, "GET", "/api/orders/1", nil)
+	if rec := cacheGet(h, "GET", "/api/orders/1", nil); rec.Header().Get("X-Cache") != "" {
+		t.Errorf("orders response has X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestResponseCacheSkipsUncacheableResponses(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/api/products/404":
+			http.Error(w, "Product not found", http.StatusNotFound)
+		case "/api/products/private":
+			w.Header().Set("Cache-Control", "private")
+		case "/api/products/export":
+			w.Write(make([]byte, maxCachedBody+1))
+		}
+	})
+	h := newResponseCache(time.Minute, 100).middleware(upstream)
+
+	for _, path := range []string{"/api/products/404", "/api/products/private", "/api/products/export"} {
+		cacheGet(h, "GET", path, nil)
+		if rec := cacheGet(h, "GET", path, nil); rec.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("%s: second read X-Cache %q, want MISS", path, rec.Header().Get("X-Cache"))
+		}
+	}
+	if n := calls.Load(); n != 6 {
+		t.Errorf("upstream called %d times, want 6", n)
+	}
+}
+
+func TestResponseCacheExpires(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(time.Minute, 100)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	h := c.middleware(countingProducts(&calls))
+
+	cacheGet(h, "GET", "/api/products", nil)
+	now = now.Add(59 * time.Second)
+	cacheGet(h, "GET", "/api/products", nil)
+	now = now.Add(time.Second)
+	cacheGet(h, "GET", "/api/products", nil)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+}
+
+func TestResponseCacheKeepsToMaxEntries(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(time.Minute, 2)
+	h := c.middleware(countingProducts(&calls))
+	for i := 1; i <= 5; i++ {
+		cacheGet(h, "GET", fmt.Sprintf("/api/products/%d", i), nil)
+	}
+	if n := len(c.entries); n != 2 {
+		t.Errorf("%d entries cached, want 2", n)
+	}
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(time.Minute, 100)
+	h := c.middleware(countingProducts(&calls))
+	paths := []string{"/api/products/1", "/api/products/1/variants", "/api/products/2", "/api/products?page=2", "/api/products/low-stock"}
+	for _, path := range paths {
+		cacheGet(h, "GET", path, nil)
+	}
+
+	c.purge("1")
+	want := map[string]string{
+		"/api/products/1":          "MISS",
+		"/api/products/1/variants": "MISS",
+		"/api/products/2":          "HIT",
+		"/api/products?page=2":     "MISS",
+		"/api/products/low-stock":  "MISS",
+	}
+	for _, path := range paths {
+		if got := cacheGet(h, "GET", path, nil).Header().Get("X-Cache"); got != want[path] {
+			t.Errorf("%s after purging product 1: X-Cache %q, want %q", path, got, want[path])
+		}
+	}
+}
+
+func TestResponseCacheWritesPurge(t *testing.T) {
+	var calls atomic.Int32
+	h := newResponseCache(time.Minute, 100).middleware(countingProducts(&calls))
+	cacheGet(h, "GET", "/api/products/1", nil)
+	cacheGet(h, "GET", "/api/products/2", nil)
+
+	cacheGet(h, "PUT", "/api/products/1", nil)
+	if rec := cacheGet(h, "GET", "/api/products/1", nil); rec.Header().Get("X-Cache") != "MISS" {
+		t.Error("product 1 still cached after a write to it")
+	}
+	if rec := cacheGet(h, "GET", "/api/products/2", nil); rec.Header().Get("X-Cache") != "HIT" {
+		t.Error("product 2 purged by a write to product 1")
+	}
+}
+
+func TestGatewayCachesProductReads(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(countingProducts(&calls))
+	defer upstream.Close()
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, upstream.URL, "")
+
+	oldTable, oldUpstreams, oldTimeout := apiVersionTable, versionedUpstreams, upstreamResponseTimeout
+	t.Cleanup(func() {
+		apiVersionTable, versionedUpstreams, upstreamResponseTimeout = oldTable, oldUpstreams, oldTimeout
+	})
+	g := &gateway{path: path, breakers: testBreakers, cache: newResponseCache(time.Minute, 100)}
+	if err := g.reload(); err != nil {
+		t.Fatal(err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	// Versioned and unversioned paths share entries.
+	for _, p := range []string{"/api/v1/products/1", "/api/products/1", "/api/v1/products/1"} {
+		if _, body := getBody(t, gw.URL+p); body != "/products/1 #1" {
+			t.Errorf("%s: got %q, want the first response", p, body)
+		}
+	}
+	getBody(t, gw.URL+"/api/v1/orders/1")
+	getBody(t, gw.URL+"/api/v1/orders/1")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("upstream called %d times, want 3", n)
+	}
+}
+
+func TestLoadResponseCache(t *testing.T) {
+	t.Setenv("RESPONSE_CACHE_TTL", "")
+	if c, err := loadResponseCache(); c != nil || err != nil {
+		t.Errorf("unset: got %v, %v; want no cache", c, err)
+	}
+	t.Setenv("RESPONSE_CACHE_TTL", "30s")
+	if c, err := loadResponseCache(); err != nil || c.ttl != 30*time.Second {
+		t.Errorf("30s: got %v, %v", c, err)
+	}
+	for _, raw := range []string{"soon", "0s", "-1m"} {
+		t.Setenv("RESPONSE_CACHE_TTL", raw)
+		if _, err := loadResponseCache(); err == nil {
+			t.Errorf("%q accepted", raw)
+		}
+	}
+}
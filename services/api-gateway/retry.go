@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var upstreamRetries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_upstream_retries_total",
+		Help: "Requests retried against an upstream after a network error or 502/503/504",
+	},
+	[]string{"upstream"},
+)
+
+var (
+	// maxRetries is how many times an idempotent request is retried.
+	// Set GATEWAY_MAX_RETRIES=0 to turn retries off.
+	maxRetries   = loadNonNegativeInt("GATEWAY_MAX_RETRIES", 2)
+	retryBackoff = loadDuration("GATEWAY_RETRY_BACKOFF", 100*time.Millisecond)
+)
+
+// maxRetryBody is the largest request body buffered so it can be sent
+// again; requests with bigger bodies are sent once.
+const maxRetryBody = 1 << 20
+
+// retryTransport retries GET and HEAD requests, and others carrying an
+// Idempotency-Key, when the upstream can't be reached or answers 502,
+// 503 or 504. Backoff is jittered and doubles per attempt, but a retry
+// never comes sooner than a 503's Retry-After, and no retry starts after
+// the request's deadline: its context's, or the response timeout
+// counted from the first attempt. A 429 isn't retried; it goes back to
+// the client with its Retry-After, so a throttling upstream isn't sent
+// more. The response carries the number of retries in
+// X-Gateway-Retries.
+type retryTransport struct {
+	upstream   string
+	next       http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+	budget     time.Duration
+}
+
+// retriedError is a request that failed after retries attempts.
+type retriedError struct {
+	err     error
+	retries int
+}
+
+func (e *retriedError) Error() string { return e.err.Error() }
+func (e *retriedError) Unwrap() error { return e.err }
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += t.maxRetries
+	}
+
+	var body []byte
+	if attempts > 1 && req.Body != nil && req.Body != http.NoBody {
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		if len(data) > maxRetryBody {
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+			attempts = 1
+		} else {
+			req.Body.Close()
+			body = data
+		}
+	}
+
+	deadline := time.Now().Add(t.budget)
+	if d, ok := req.Context().Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	backoff := t.backoff
+	for retries := 0; ; retries++ {
+		attempt := req
+		if body != nil {
+			attempt = req.Clone(req.Context())
+			attempt.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.next.RoundTrip(attempt)
+
+		wait := time.Duration(rand.Int63n(int64(backoff))) + backoff/2
+		if resp != nil {
+			if after := retryAfter(resp); after > wait {
+				wait = after
+			}
+		}
+		if retries+1 >= attempts || !shouldRetry(resp, err) || time.Now().Add(wait).After(deadline) {
+			trace.SpanFromContext(req.Context()).SetAttributes(
+				attribute.String("gateway.upstream", t.upstream),
+				attribute.Int("gateway.retries", retries),
+			)
+			if err != nil {
+				return nil, &retriedError{err: err, retries: retries}
+			}
+			resp.Header.Set("X-Gateway-Retries", strconv.Itoa(retries))
+			return resp, nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		upstreamRetries.WithLabelValues(t.upstream).Inc()
+
+		select {
+		case <-req.Context().Done():
+			trace.SpanFromContext(req.Context()).SetAttributes(
+				attribute.String("gateway.upstream", t.upstream),
+				attribute.Int("gateway.retries", retries),
+			)
+			return nil, &retriedError{err: req.Context().Err(), retries: retries}
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// isIdempotent reports whether req may safely be sent more than once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// shouldRetry reports whether an attempt failed in a way another might
+// not: a network error, or an upstream that is restarting or overloaded.
+// Requests refused by an open circuit breaker aren't retried.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		var open *circuitOpenError
+		return !errors.As(err, &open) && !isBodyTooLarge(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter is how long resp's Retry-After, in seconds or as a date,
+// asks to wait, or 0 without one.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// readCloser reads from r and closes c.
+type readCloser struct {
+	io.Reader
+	c io.Closer
+}
+
+func (rc readCloser) Close() error { return rc.c.Close() }
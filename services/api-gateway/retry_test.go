@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withRetries makes proxies built afterwards retry up to n times with a
+// short backoff.
+func withRetries(t *testing.T, n int) {
+	t.Helper()
+	oldRetries, oldBackoff := maxRetries, retryBackoff
+	maxRetries, retryBackoff = n, time.Millisecond
+	t.Cleanup(func() { maxRetries, retryBackoff = oldRetries, oldBackoff })
+}
+
+// flakyUpstream answers 503 to the first failures requests and 200 with
+// the request body after that, counting requests in calls.
+func flakyUpstream(t *testing.T, failures int32, calls *int32) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= failures {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestRetryIdempotentRequests(t *testing.T) {
+	withRetries(t, 2)
+	var calls int32
+	proxy := testProxy(t, "retry-get", flakyUpstream(t, 2, &calls), "/api/orders", "/orders")
+	gw := newTestGatewayWith(t, proxy)
+	before := testutil.ToFloat64(upstreamRetries.WithLabelValues("retry-get"))
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Gateway-Retries") != "2" {
+		t.Errorf("expected 200 after 2 retries, got %d with X-Gateway-Retries %q", resp.StatusCode, resp.Header.Get("X-Gateway-Retries"))
+	}
+	if got := testutil.ToFloat64(upstreamRetries.WithLabelValues("retry-get")) - before; got != 2 {
+		t.Errorf("expected 2 retries counted, got %v", got)
+	}
+}
+
+func TestRetryGivesUpAfterMaxRetries(t *testing.T) {
+	withRetries(t, 1)
+	var calls int32
+	proxy := testProxy(t, "retry-max", flakyUpstream(t, 5, &calls), "/api/orders", "/orders")
+	gw := newTestGatewayWith(t, proxy)
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls != 2 {
+		t.Errorf("expected the upstream's 503 after 2 attempts, got %d after %d", resp.StatusCode, calls)
+	}
+	if resp.Header.Get("X-Gateway-Retries") != "1" {
+		t.Errorf("expected X-Gateway-Retries 1, got %q", resp.Header.Get("X-Gateway-Retries"))
+	}
+}
+
+func TestRetryNonIdempotentRequests(t *testing.T) {
+	withRetries(t, 2)
+
+	t.Run("without an idempotency key", func(t *testing.T) {
+		var calls int32
+		proxy := testProxy(t, "retry-post", flakyUpstream(t, 1, &calls), "/api/orders", "/orders")
+		gw := newTestGatewayWith(t, proxy)
+
+		resp, err := http.Post(gw.URL+"/api/orders", "application/json", strings.NewReader(`{"quantity":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || calls != 1 {
+			t.Errorf("expected a single attempt, got %d after %d", resp.StatusCode, calls)
+		}
+	})
+
+	t.Run("with an idempotency key", func(t *testing.T) {
+		var calls int32
+		proxy := testProxy(t, "retry-key", flakyUpstream(t, 1, &calls), "/api/orders", "/orders")
+		gw := newTestGatewayWith(t, proxy)
+
+		req, _ := http.NewRequest("POST", gw.URL+"/api/orders", strings.NewReader(`{"quantity":1}`))
+		req.Header.Set("Idempotency-Key", "order-abc")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != `{"quantity":1}` {
+			t.Errorf("expected the body replayed on retry, got %d %q", resp.StatusCode, body)
+		}
+	})
+}
+
+func TestRetryNetworkErrorsReportRetries(t *testing.T) {
+	withRetries(t, 2)
+	proxy := testProxy(t, "retry-down", newClosedUpstream(), "/api/orders", "/orders")
+	gw := newTestGatewayWith(t, proxy)
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+	// testBreakers open after 3 failures, so all three attempts reach it.
+	if resp.Header.Get("X-Gateway-Retries") != "2" {
+		t.Errorf("expected X-Gateway-Retries 2, got %q", resp.Header.Get("X-Gateway-Retries"))
+	}
+}
+
+func TestRetryPassesUpstream429sBack(t *testing.T) {
+	withRetries(t, 2)
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+	gw := newTestGatewayWith(t, testProxy(t, "retry-429", upstream.URL, "/api/orders", "/orders"))
+	before := testutil.ToFloat64(upstreamRequests.WithLabelValues("retry-429", "throttled"))
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("got %d with Retry-After %q, want the upstream's 429 and Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if calls != 1 {
+		t.Errorf("upstream got %d requests, want 1", calls)
+	}
+	if got := testutil.ToFloat64(upstreamRequests.WithLabelValues("retry-429", "throttled")) - before; got != 1 {
+		t.Errorf("counted %v throttled calls, want 1", got)
+	}
+	if got := testutil.ToFloat64(upstreamRequests.WithLabelValues("retry-429", "4xx")); got != 0 {
+		t.Errorf("counted %v throttled calls as 4xx", got)
+	}
+}
+
+func TestRetryWaitsForRetryAfter(t *testing.T) {
+	withRetries(t, 2)
+	var calls int32
+	var first time.Time
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		if waited := time.Since(first); waited < time.Second {
+			t.Errorf("retried after %s, before the Retry-After", waited)
+		}
+	}))
+	defer upstream.Close()
+	gw := newTestGatewayWith(t, testProxy(t, "retry-after", upstream.URL, "/api/orders", "/orders"))
+
+	resp, err := http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("got %d after %d calls, want 200 after 2", resp.StatusCode, calls)
+	}
+
+	// A Retry-After past the deadline leaves the 503 to the client.
+	calls = 0
+	later := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "restarting", http.StatusServiceUnavailable)
+	}))
+	defer later.Close()
+	gw = newTestGatewayWith(t, testProxy(t, "retry-after-late", later.URL, "/api/orders", "/orders"))
+	resp, err = http.Get(gw.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "3600" || calls != 1 {
+		t.Errorf("got %d with Retry-After %q after %d calls, want the 503 passed back at once",
+			resp.StatusCode, resp.Header.Get("Retry-After"), calls)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// maxRouteTemplates caps the distinct route labels, so unusual paths
+// can't create unbounded metric series; later ones are counted as
+// routeOther.
+const maxRouteTemplates = 200
+
+const routeOther = "other"
+
+// routeSegmentNames names the id that follows a path segment, as in
+// /api/orders/user/{userId}; other ids are {id}.
+var routeSegmentNames = map[string]string{
+	"user":  "{userId}",
+	"order": "{orderId}",
+}
+
+var routeTemplates = struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+type routeKey struct{}
+
+// routeTemplate maps a request path to the metric label for its route:
+// numeric segments become placeholders, so /api/products/42 and
+// /api/products/43 are both /api/products/{id}, and /api/v1/products/42
+// is /api/v1/products/{id}. Paths outside the API,
+// or with segments that aren't plain words, are routeOther.
+func routeTemplate(path string) string {
+	switch path {
+	case "/health", "/health/ready", "/readyz", "/metrics", "/api/docs", "/api/docs/openapi.json":
+		return path
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "api" || len(segments) > 6 {
+		return routeOther
+	}
+	resource := 1
+	if versionPattern.MatchString(segments[1]) && len(segments) > 2 {
+		resource = 2
+	}
+	switch segments[resource] {
+	case "products", "orders", "payments":
+	default:
+		return routeOther
+	}
+
+	for i, s := range segments {
+		switch {
+		case i == 1 && resource == 2:
+			// The version, kept as it is.
+		case isNumber(s):
+			name, ok := routeSegmentNames[segments[i-1]]
+			if !ok {
+				name = "{id}"
+			}
+			segments[i] = name
+		case !isWord(s):
+			return routeOther
+		}
+	}
+	template := "/" + strings.Join(segments, "/")
+
+	routeTemplates.mu.Lock()
+	defer routeTemplates.mu.Unlock()
+	if !routeTemplates.seen[template] {
+		if len(routeTemplates.seen) >= maxRouteTemplates {
+			return routeOther
+		}
+		routeTemplates.seen[template] = true
+	}
+	return template
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isWord reports whether s looks like a fixed route segment, such as
+// "export" or "low-stock".
+func isWord(s string) bool {
+	if s == "" || len(s) > 32 {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRoute records a request's route label in its context, where the
+// proxy's error handler finds it after the path has been rewritten.
+func withRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+func routeFrom(ctx context.Context) string {
+	if route, ok := ctx.Value(routeKey{}).(string); ok {
+		return route
+	}
+	return routeOther
+}
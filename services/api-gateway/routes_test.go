@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	tests := map[string]string{
+		"/api/products":            "/api/products",
+		"/api/products/42":         "/api/products/{id}",
+		"/api/products/42/":        "/api/products/{id}",
+		"/api/products/low-stock":  "/api/products/low-stock",
+		"/api/orders/17":           "/api/orders/{id}",
+		"/api/orders/user/3":       "/api/orders/user/{userId}",
+		"/api/payments/order/9":    "/api/payments/order/{orderId}",
+		"/api/payments/9/refund":   "/api/payments/{id}/refund",
+		"/api/v1/products/42":      "/api/v1/products/{id}",
+		"/api/v2/orders/user/3":    "/api/v2/orders/user/{userId}",
+		"/api/v1/users/1":          routeOther,
+		"/health":                  "/health",
+		"/api/products/abc%20def":  routeOther,
+		"/api/products/Robert'); ": routeOther,
+		"/api/users/1":             routeOther,
+		"/wp-admin":                routeOther,
+		"/":                        routeOther,
+	}
+	for path, want := range tests {
+		if got := routeTemplate(path); got != want {
+			t.Errorf("routeTemplate(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRouteTemplateCapsDistinctRoutes(t *testing.T) {
+	old := routeTemplates.seen
+	routeTemplates.seen = map[string]bool{}
+	t.Cleanup(func() { routeTemplates.seen = old })
+
+	for i := 0; i < maxRouteTemplates; i++ {
+		routeTemplate("/api/products/" + strconv.Itoa(i) + "/x" + string(rune('a'+i%26)) + string(rune('a'+i/26)))
+	}
+	if got := routeTemplate("/api/products/brand-new"); got != routeOther {
+		t.Errorf("expected %q once the cap is reached, got %q", routeOther, got)
+	}
+	if got := routeTemplate("/api/products/1/xaa"); got != "/api/products/{id}/xaa" {
+		t.Errorf("expected routes seen before the cap to keep their label, got %q", got)
+	}
+}
+
+func TestProxyErrorsLabelledByRoute(t *testing.T) {
+	upstream := newClosedUpstream()
+	gw := newTestGateway(t, upstream)
+	counter := errorRate.WithLabelValues("/api/orders/{id}", "request_execution")
+	before := testutil.ToFloat64(counter)
+
+	resp, err := http.Get(gw.URL + "/api/orders/123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("expected the error counted under /api/orders/{id}, got %v", got)
+	}
+}
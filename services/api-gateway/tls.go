@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most, as handshakes come in.
+const certCheckInterval = 5 * time.Second
+
+// certReloader serves the certificate in certFile and keyFile, loading
+// it again when either file changes, so a renewed certificate is picked
+// up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+	checkEvery        time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	stamp     string
+	checkedAt time.Time
+}
+
+// newCertReloader loads the certificate, failing if it can't be.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, checkEvery: certCheckInterval}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fileStamp identifies the current contents of both files by their size
+// and modification time.
+func (c *certReloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, path := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d:%d;", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// load reads the certificate and key. The caller holds mu, or has the
+// only reference to c.
+func (c *certReloader) load() error {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.stamp, c.checkedAt = &cert, stamp, time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, first reloading it if
+// the files have changed since they were last checked. A certificate
+// that fails to load, as when the key has been written but not yet the
+// certificate, is retried at the next check and the old one kept
+// meanwhile.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) < c.checkEvery {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+	if stamp, err := c.fileStamp(); err == nil && stamp == c.stamp {
+		return c.cert, nil
+	}
+	if err := c.load(); err != nil {
+		log.Printf("Keeping the current TLS certificate: %v", err)
+		return c.cert, nil
+	}
+	log.Printf("Reloaded TLS certificate from %s", c.certFile)
+	return c.cert, nil
+}
+
+// parseTLSVersion parses a minimum TLS version, "1.2" or "1.3".
+func parseTLSVersion(raw string) (uint16, error) {
+	switch raw {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("TLS version %q must be 1.2 or 1.3", raw)
+}
+
+// loadTLSConfig configures HTTPS from TLS_CERT_FILE and TLS_KEY_FILE,
+// with TLS_MIN_VERSION (1.2 by default). It returns nil if neither file
+// is set, for plain HTTP.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := getEnv("TLS_CERT_FILE", ""), getEnv("TLS_KEY_FILE", "")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("set both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	minVersion, err := parseTLSVersion(getEnv("TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		return nil, fmt.Errorf("TLS_MIN_VERSION: %w", err)
+	}
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{MinVersion: minVersion, GetCertificate: certs.GetCertificate}, nil
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL over
+// HTTPS on httpsPort.
+func httpsRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with the given serial
+// number and its key to certFile and keyFile.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedSerial connects to srv and returns the serial number of the
+// certificate it presents. The server name makes httptest's server ask
+// GetCertificate rather than use its own certificate.
+func servedSerial(t *testing.T, srv *httptest.Server) int64 {
+	t.Helper()
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReloaderPicksUpRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.checkEvery = 0
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{GetCertificate: certs.GetCertificate}
+	srv.StartTLS()
+	defer srv.Close()
+
+	if got := servedSerial(t, srv); got != 1 {
+		t.Fatalf("expected certificate 1, got %d", got)
+	}
+
+	// A half-written renewal keeps the current certificate.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(t, srv); got != 1 {
+		t.Errorf("expected certificate 1 kept, got %d", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	if got := servedSerial(t, srv); got != 2 {
+		t.Errorf("expected the renewed certificate 2, got %d", got)
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	if cfg, err := loadTLSConfig(); cfg != nil || err != nil {
+		t.Errorf("expected plain HTTP without TLS files, got %v, %v", cfg, err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	if _, err := loadTLSConfig(); err == nil {
+		t.Error("expected an error with only the certificate set")
+	}
+
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	cfg, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 minimum, got %x", cfg.MinVersion)
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "1.0")
+	if _, err := loadTLSConfig(); err == nil {
+		t.Error("expected TLS 1.0 rejected")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		port, host, want string
+	}{
+		{"8443", "gateway.example.com:8080", "https://gateway.example.com:8443/api/orders?page=2"},
+		{"443", "gateway.example.com", "https://gateway.example.com/api/orders?page=2"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/orders?page=2", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		httpsRedirect(tt.port).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.want {
+			t.Errorf("port %s: got %d to %q, want %q", tt.port, rec.Code, rec.Header().Get("Location"), tt.want)
+		}
+	}
+}
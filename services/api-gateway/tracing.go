@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// initTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set; the exporter, sampler
+// and service name take the rest of their settings from the standard
+// OTEL_* variables. Unset, the gateway records no spans but still passes
+// W3C trace context from clients through to the upstreams.
+func initTracing(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "") == "" && getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") == "" {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "api-gateway")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	return nil
+}
+
+// untracedPaths are probes and scrapes, which would only add noise.
+var untracedPaths = map[string]bool{"/health": true, "/health/ready": true, "/readyz": true, "/metrics": true}
+
+// tracingMiddleware starts a server span per request, continuing the
+// client's trace if it sent a traceparent, named after the route
+// template.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "api-gateway",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeTemplate(r.URL.Path)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !untracedPaths[r.URL.Path]
+		}),
+	)
+}
+
+// tracingTransport starts a client span per attempt at upstream and
+// injects its trace context into the request.
+func tracingTransport(upstream string, next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + upstream
+		}),
+		otelhttp.WithSpanOptions(trace.WithAttributes(attribute.String("gateway.upstream", upstream))),
+	)
+}
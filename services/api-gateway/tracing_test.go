@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a global tracer provider that keeps ended spans.
+// The global provider can only be set once, so tests share it and tell
+// their spans apart by trace id.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	if err := initTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// spansInTrace returns the ended spans of the trace with id traceID.
+func spansInTrace(rec *tracetest.SpanRecorder, traceID string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key string) (attribute.Value, bool) {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// TestTracingPropagatesWithoutExporter comes first so that, run in file
+// order, it sees the no-op provider the gateway has with OTLP unset.
+func TestTracingPropagatesWithoutExporter(t *testing.T) {
+	if err := initTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Traceparent")
+	}))
+	t.Cleanup(upstream.Close)
+	proxy := tracingMiddleware(testProxy(t, "/orders", upstream.URL, "/api/orders", "/orders"))
+	gw := httptest.NewServer(proxy)
+	t.Cleanup(gw.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/orders", nil)
+	req.Header.Set("Traceparent", testTraceparent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got == "" || got[3:35] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the client's trace id passed upstream, got %q", got)
+	}
+}
+
+func TestTracingContinuesClientTrace(t *testing.T) {
+	rec := recordSpans(t)
+	withRetries(t, 2)
+	var calls int32
+	var upstreamTraceparent string
+	flaky := flakyUpstream(t, 1, &calls)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("Traceparent")
+		resp, err := http.Get(flaky + r.URL.Path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+	}))
+	t.Cleanup(upstream.Close)
+	gw := newTestGatewayWith(t, testProxy(t, "/orders", upstream.URL, "/api/orders", "/orders"))
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/orders/42", nil)
+	req.Header.Set("Traceparent", testTraceparent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after a retry, got %d", resp.StatusCode)
+	}
+
+	var server sdktrace.ReadOnlySpan
+	var clients []sdktrace.ReadOnlySpan
+	for _, s := range spansInTrace(rec, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		switch s.SpanKind() {
+		case trace.SpanKindServer:
+			server = s
+		case trace.SpanKindClient:
+			clients = append(clients, s)
+		}
+	}
+	if server == nil {
+		t.Fatal("no server span in the client's trace")
+	}
+	if server.Name() != "GET /api/orders/{id}" {
+		t.Errorf("expected the server span named after the route, got %q", server.Name())
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the server span parented by the client's span, got %s", server.Parent().SpanID())
+	}
+	if v, ok := spanAttr(server, "gateway.upstream"); !ok || v.AsString() != "/orders" {
+		t.Errorf("expected gateway.upstream /orders, got %v", v.Emit())
+	}
+	if v, ok := spanAttr(server, "gateway.retries"); !ok || v.AsInt64() != 1 {
+		t.Errorf("expected gateway.retries 1, got %v", v.Emit())
+	}
+
+	if len(clients) != 2 {
+		t.Fatalf("expected a client span per attempt, got %d", len(clients))
+	}
+	last := clients[len(clients)-1]
+	if last.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("expected client spans parented by the server span")
+	}
+	if v, ok := spanAttr(last, "gateway.upstream"); !ok || v.AsString() != "/orders" {
+		t.Errorf("expected gateway.upstream on the client span, got %v", v.Emit())
+	}
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + last.SpanContext().SpanID().String() + "-01"
+	if upstreamTraceparent != want {
+		t.Errorf("expected upstream traceparent %q, got %q", want, upstreamTraceparent)
+	}
+}
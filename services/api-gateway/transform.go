@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxTransformBody is the largest response body transformed; bigger
+// ones are passed through as they are.
+const maxTransformBody = 4 << 20
+
+var transformFailures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_response_transform_failures_total",
+		Help: "Responses passed through untransformed because a transform couldn't be applied, by route",
+	},
+	[]string{"route"},
+)
+
+// transformConfig is a response transform as given in the gateway
+// config: fields to remove from and rename in responses to Route,
+// except for callers with one of SkipRoles.
+type transformConfig struct {
+	Route     string            `yaml:"route"`
+	Remove    []string          `yaml:"remove"`
+	Rename    map[string]string `yaml:"rename"`
+	SkipRoles []string          `yaml:"skip_roles"`
+}
+
+// responseTransform removes and renames top-level fields of JSON
+// responses to the requests a pathRule matches. For an array, the
+// fields of each object in it, at any depth of nested arrays, are.
+type responseTransform struct {
+	rule      pathRule
+	remove    []string
+	rename    map[string]string
+	skipRoles map[string]bool
+}
+
+// parseTransforms checks the configured transforms.
+func parseTransforms(configs []transformConfig) ([]responseTransform, error) {
+	var transforms []responseTransform
+	for _, c := range configs {
+		rules, err := parsePathRules(c.Route)
+		if err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("route %q must be [METHOD ]/prefix", c.Route)
+		}
+		if len(c.Remove) == 0 && len(c.Rename) == 0 {
+			return nil, fmt.Errorf("route %q: nothing to remove or rename", c.Route)
+		}
+		removed, targets := map[string]bool{}, map[string]bool{}
+		for _, field := range c.Remove {
+			removed[field] = true
+		}
+		for from, to := range c.Rename {
+			if to == "" || removed[from] || targets[to] {
+				return nil, fmt.Errorf("route %q: can't rename %q to %q", c.Route, from, to)
+			}
+			targets[to] = true
+		}
+		t := responseTransform{rule: rules[0], remove: c.Remove, rename: c.Rename, skipRoles: map[string]bool{}}
+		for _, role := range c.SkipRoles {
+			t.skipRoles[role] = true
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// applies reports whether t applies to r, given the caller's roles in
+// X-User-Roles.
+func (t responseTransform) applies(r *http.Request) bool {
+	if !t.rule.matches(r) {
+		return false
+	}
+	for _, role := range strings.Split(r.Header.Get(userRolesHeader), ",") {
+		if t.skipRoles[strings.TrimSpace(role)] {
+			return false
+		}
+	}
+	return true
+}
+
+// errTransform is a body a transform can't be applied to.
+var errTransform = errors.New("response can't be transformed")
+
+// apply transforms v, an object or an array of them.
+func (t responseTransform) apply(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, field := range t.remove {
+			delete(v, field)
+		}
+		renamed := map[string]interface{}{}
+		for from, to := range t.rename {
+			if value, ok := v[from]; ok {
+				renamed[to] = value
+				delete(v, from)
+			}
+		}
+		for to, value := range renamed {
+			if _, taken := v[to]; taken {
+				return fmt.Errorf("%w: field %q already present", errTransform, to)
+			}
+			v[to] = value
+		}
+		return nil
+	case []interface{}:
+		for _, elem := range v {
+			if err := t.apply(elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: not an object or array", errTransform)
+}
+
+// transformBody applies transforms to a JSON body.
+func transformBody(body []byte, transforms []responseTransform) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: more than one JSON value", errTransform)
+	}
+	for _, t := range transforms {
+		if err := t.apply(v); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// transformMiddleware applies the transforms matching each request to
+// its response, if that is JSON. Anything else, streams and bodies too
+// big to hold included, passes through, as does a body a transform
+// fails on: transforms fail safe.
+func transformMiddleware(transforms []responseTransform) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var matching []responseTransform
+			for _, t := range transforms {
+				if t.applies(r) {
+					matching = append(matching, t)
+				}
+			}
+			if len(matching) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Ask for an uncompressed body; the gateway compresses the
+			// transformed one.
+			r.Header.Del("Accept-Encoding")
+			tw := &transformWriter{ResponseWriter: w, r: r, transforms: matching, status: http.StatusOK}
+			defer tw.close()
+			next.ServeHTTP(tw, r)
+		})
+	}
+}
+
+// transformWriter holds back a JSON response until it is complete, to
+// transform it.
+type transformWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	transforms  []responseTransform
+	status      int
+	wroteHeader bool
+	buffering   bool
+	buf         []byte
+}
+
+func (t *transformWriter) WriteHeader(status int) {
+	if t.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 {
+		t.ResponseWriter.WriteHeader(status)
+		return
+	}
+	t.status, t.wroteHeader = status, true
+	mediaType, _, _ := mime.ParseMediaType(t.Header().Get("Content-Type"))
+	t.buffering = mediaType == "application/json" && t.Header().Get("Content-Encoding") == "" &&
+		t.r.Method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified
+	if !t.buffering {
+		t.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (t *transformWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	if !t.buffering {
+		return t.ResponseWriter.Write(b)
+	}
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > maxTransformBody {
+		if err := t.passThrough(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// passThrough stops buffering, sending what was held back unchanged.
+func (t *transformWriter) passThrough() error {
+	t.buffering = false
+	t.ResponseWriter.WriteHeader(t.status)
+	buf := t.buf
+	t.buf = nil
+	_, err := t.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush passes through unless the response is being held back.
+func (t *transformWriter) Flush() {
+	if !t.buffering {
+		http.NewResponseController(t.ResponseWriter).Flush()
+	}
+}
+
+func (t *transformWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if t.wroteHeader {
+		return nil, nil, errors.New("transform: response already started")
+	}
+	return http.NewResponseController(t.ResponseWriter).Hijack()
+}
+
+func (t *transformWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// close transforms and sends a held-back response, or sends it as it
+// was if it can't be transformed.
+func (t *transformWriter) close() {
+	if !t.buffering {
+		return
+	}
+	if len(t.buf) == 0 {
+		t.passThrough()
+		return
+	}
+	body, err := transformBody(t.buf, t.transforms)
+	if err != nil {
+		route := routeFrom(t.r.Context())
+		transformFailures.WithLabelValues(route).Inc()
+		loggerFrom(t.r.Context()).Warn("passing response through untransformed", "route", route, "error", err)
+		t.passThrough()
+		return
+	}
+	t.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	t.ResponseWriter.WriteHeader(t.status)
+	t.ResponseWriter.Write(body)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testTransform = responseTransform{
+	remove:    []string{"cost"},
+	rename:    map[string]string{"stock_quantity": "stock"},
+	skipRoles: map[string]bool{},
+}
+
+func TestTransformBody(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"object",
+			`{"id": 1, "cost": 2.5, "stock_quantity": 7}`,
+			`{"id": 1, "stock": 7}`},
+		{"array of objects",
+			`[{"id": 1, "cost": 2.5}, {"id": 2, "stock_quantity": 0}]`,
+			`[{"id": 1}, {"id": 2, "stock": 0}]`},
+		{"nested arrays of objects",
+			`[[{"id": 1, "cost": 1}], [], [{"id": 2, "cost": 2}, {"id": 3}]]`,
+			`[[{"id": 1}], [], [{"id": 2}, {"id": 3}]]`},
+		{"only top-level fields",
+			`{"id": 1, "cost": 3, "items": [{"sku": "a", "cost": 1}]}`,
+			`{"id": 1, "items": [{"sku": "a", "cost": 1}]}`},
+		{"large numbers kept exact",
+			`{"id": 12345678901234567890, "cost": 1}`,
+			`{"id": 12345678901234567890}`},
+	}
+	for _, tt := range tests {
+		got, err := transformBody([]byte(tt.in), []responseTransform{testTransform})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var gotV, wantV interface{}
+		dec := json.NewDecoder(bytes.NewReader(got))
+		dec.UseNumber()
+		dec.Decode(&gotV)
+		dec = json.NewDecoder(bytes.NewReader([]byte(tt.want)))
+		dec.UseNumber()
+		dec.Decode(&wantV)
+		if !reflect.DeepEqual(gotV, wantV) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransformBodyFailures(t *testing.T) {
+	for _, in := range []string{
+		`{"stock_quantity": 1, "stock": 2}`,
+		`[{"id": 1}, "not an object"]`,
+		`"just a string"`,
+		`{"id": 1} {"id": 2}`,
+		`{"id": `,
+	} {
+		if _, err := transformBody([]byte(in), []responseTransform{testTransform}); err == nil {
+			t.Errorf("expected %s not transformed", in)
+		}
+	}
+	_, err := transformBody([]byte(`[1, 2]`), []responseTransform{testTransform})
+	if !errors.Is(err, errTransform) {
+		t.Errorf("expected errTransform for an array of numbers, got %v", err)
+	}
+}
+
+func TestParseTransformsRejectsBadConfig(t *testing.T) {
+	for _, c := range []transformConfig{
+		{Route: "products", Remove: []string{"cost"}},
+		{Route: "/api/products"},
+		{Route: "/api/products", Rename: map[string]string{"a": ""}},
+		{Route: "/api/products", Remove: []string{"a"}, Rename: map[string]string{"a": "b"}},
+		{Route: "/api/products", Rename: map[string]string{"a": "c", "b": "c"}},
+	} {
+		if _, err := parseTransforms([]transformConfig{c}); err == nil {
+			t.Errorf("expected %+v rejected", c)
+		}
+	}
+}
+
+// contentUpstream answers every request with body as contentType.
+func contentUpstream(t *testing.T, contentType, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+const transformsConfig = `transforms:
+  - route: GET /api/products
+    remove: [cost]
+    rename: {stock_quantity: stock}
+    skip_roles: [admin]
+`
+
+func TestTransformMiddleware(t *testing.T) {
+	products := `[{"id": 1, "cost": 4, "stock_quantity": 9}]`
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, contentUpstream(t, "application/json; charset=utf-8", products), transformsConfig)
+	_, gw := configGateway(t, path)
+
+	if _, body := getBody(t, gw.URL+"/api/v1/products"); body != `[{"id":1,"stock":9}]`+"\n" {
+		t.Errorf("expected cost removed and stock renamed, got %q", body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/api/products", nil)
+	req.Header.Set(userRolesHeader, "viewer,admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if len(got) != 1 || got[0]["cost"] == nil {
+		t.Errorf("expected admins to get the untransformed body, got %v", got)
+	}
+}
+
+func TestTransformMiddlewarePassesThrough(t *testing.T) {
+	tests := []struct {
+		name, contentType, body string
+	}{
+		{"invalid JSON", "application/json", `{"id": 1, "cost": `},
+		{"field collision", "application/json", `{"stock_quantity": 1, "stock": 2}`},
+		{"event stream", "text/event-stream", "data: {\"cost\": 1}\n\n"},
+		{"NDJSON stream", "application/x-ndjson", `{"cost": 1}` + "\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "gateway.yaml")
+		writeConfig(t, path, contentUpstream(t, tt.contentType, tt.body), transformsConfig)
+		_, gw := configGateway(t, path)
+
+		resp, body := getBody(t, gw.URL+"/api/products")
+		if resp.StatusCode != http.StatusOK || body != tt.body {
+			t.Errorf("%s: expected the body passed through, got %d %q", tt.name, resp.StatusCode, body)
+		}
+	}
+}
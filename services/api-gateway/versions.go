@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// unversioned is the version label of requests to /api/products and the
+// like, which are served as aliasVersion.
+const (
+	unversioned  = "unversioned"
+	aliasVersion = "v1"
+)
+
+var versionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
+// resourceUpstreams names the upstream serving each API resource unless
+// API_VERSIONS says otherwise.
+var resourceUpstreams = map[string]string{
+	"products": "inventory",
+	"orders":   "orders",
+	"payments": "payments",
+}
+
+// apiVersionTable maps each API version to the upstream serving each of
+// its resources, by name as in resourceUpstreams or, for versions served
+// elsewhere, by URL. Set from the gateway config.
+var apiVersionTable = map[string]map[string]string{aliasVersion: resourceUpstreams}
+
+// versionedUpstreams are the proxies for upstreams that apiVersionTable
+// gives by URL, by version and resource.
+var versionedUpstreams = map[string]http.Handler{}
+
+// parseAPIVersions parses a version table given as a JSON object, such
+// as {"v1": {"orders": "orders"}, "v2": {"orders":
+// "http://order-service-v2:8082"}}.
+func parseAPIVersions(raw string) (map[string]map[string]string, error) {
+	var table map[string]map[string]string
+	if err := json.Unmarshal([]byte(raw), &table); err != nil {
+		return nil, fmt.Errorf("must be a JSON object: %w", err)
+	}
+	return table, validateAPIVersions(table)
+}
+
+// validateAPIVersions checks that table serves v1, which unversioned
+// paths are served as, and that each version's resources are known and
+// mapped to an upstream name or absolute URLs.
+func validateAPIVersions(table map[string]map[string]string) error {
+	if _, ok := table[aliasVersion]; !ok {
+		return fmt.Errorf("must include %s, which unversioned paths are served as", aliasVersion)
+	}
+	for version, resources := range table {
+		if !versionPattern.MatchString(version) {
+			return fmt.Errorf("version %q must look like v2", version)
+		}
+		for resource, target := range resources {
+			if _, ok := resourceUpstreams[resource]; !ok {
+				return fmt.Errorf("unknown resource %q in %s", resource, version)
+			}
+			if _, ok := upstreamEnvPrefixes[target]; ok {
+				continue
+			}
+			if _, err := parseTargets(target); err != nil {
+				return fmt.Errorf("%s %s must be an upstream name or URL: %w", version, resource, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setAPIVersions serves a validated table, with a proxy for each
+// upstream it gives by URL. It returns their balancers.
+func setAPIVersions(table map[string]map[string]string, breakers breakerConfig) ([]*balancer, error) {
+	var balancers []*balancer
+	proxies := map[string]http.Handler{}
+	for version, resources := range table {
+		for resource, target := range resources {
+			if _, ok := upstreamEnvPrefixes[target]; ok {
+				continue
+			}
+			b, err := newBalancer(resource+"-"+version, target, breakers)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", version, resource, err)
+			}
+			balancers = append(balancers, b)
+			proxies[version+"/"+resource] = newProxy(b, "/api/"+resource, "/"+resource)
+		}
+	}
+	apiVersionTable, versionedUpstreams = table, proxies
+	return balancers, nil
+}
+
+// splitVersion splits the version off an API path, returning "v1" and
+// "/api/orders/5" for /api/v1/orders/5. Paths without one are returned
+// as they are.
+func splitVersion(path string) (string, string) {
+	rest, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return "", path
+	}
+	version, tail, _ := strings.Cut(rest, "/")
+	if !versionPattern.MatchString(version) {
+		return "", path
+	}
+	return version, "/api/" + tail
+}
+
+// apiVersion is the metric label for a path's API version: its version,
+// unversioned for other API paths, or "" outside the API.
+func apiVersion(path string) string {
+	if version, _ := splitVersion(path); version != "" {
+		return version
+	}
+	if strings.HasPrefix(path, "/api/") {
+		return unversioned
+	}
+	return ""
+}
+
+// apiVersions routes /api/{version}/{resource} to the resource's
+// upstream for that version, with the path the upstream sees the same
+// as for /api/{resource}.
+type apiVersions struct {
+	routes map[string]map[string]http.Handler
+}
+
+// newAPIVersions resolves apiVersionTable against the proxies for the
+// named upstreams.
+func newAPIVersions(named map[string]http.Handler) *apiVersions {
+	v := &apiVersions{routes: map[string]map[string]http.Handler{}}
+	for version, resources := range apiVersionTable {
+		v.routes[version] = map[string]http.Handler{}
+		for resource, target := range resources {
+			if h, ok := named[target]; ok {
+				v.routes[version][resource] = h
+			} else if h, ok := versionedUpstreams[version+"/"+resource]; ok {
+				v.routes[version][resource] = h
+			}
+		}
+	}
+	return v
+}
+
+// supported lists the versions served, in order.
+func (v *apiVersions) supported() []string {
+	var versions []string
+	for version := range v.routes {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func (v *apiVersions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version, path := splitVersion(r.URL.Path)
+	resources, ok := v.routes[version]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown API version %q; supported versions are %s, as in /api/%s/products",
+			version, strings.Join(v.supported(), ", "), aliasVersion))
+		return
+	}
+	resource, _, _ := strings.Cut(strings.TrimPrefix(path, "/api/"), "/")
+	h, ok := resources[resource]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown resource %q in API %s", resource, version))
+		return
+	}
+	r.URL.Path, r.URL.RawPath = path, ""
+	h.ServeHTTP(w, r)
+}
+
+// Unversioned paths are deprecated as of unversionedDeprecated and go
+// away at unversionedSunset.
+var (
+	unversionedDeprecated = loadDate("API_UNVERSIONED_DEPRECATED", "2026-10-17")
+	unversionedSunset     = loadDate("API_UNVERSIONED_SUNSET", "2027-04-30")
+)
+
+// deprecated marks responses to unversioned paths with Deprecation and
+// Sunset headers and links the versioned path that replaces them.
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Deprecation", fmt.Sprintf("@%d", unversionedDeprecated.Unix()))
+		h.Set("Sunset", unversionedSunset.Format(http.TimeFormat))
+		successor := "/api/" + aliasVersion + strings.TrimPrefix(r.URL.Path, "/api")
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withAPIVersions serves the version table raw for the test.
+func withAPIVersions(t *testing.T, raw string) {
+	t.Helper()
+	oldTable, oldUpstreams := apiVersionTable, versionedUpstreams
+	t.Cleanup(func() { apiVersionTable, versionedUpstreams = oldTable, oldUpstreams })
+	table, err := parseAPIVersions(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setAPIVersions(table, testBreakers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pathUpstream answers with the path it was asked for.
+func pathUpstream(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func getBody(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestVersionedAndUnversionedPathsReachSameUpstreamPath(t *testing.T) {
+	gw := newTestGateway(t, pathUpstream(t, "stable"))
+
+	resp, body := getBody(t, gw.URL+"/api/v1/orders/5")
+	if body != "stable /orders/5" {
+		t.Errorf("expected /api/v1/orders/5 proxied to /orders/5, got %q", body)
+	}
+	if resp.Header.Get("Deprecation") != "" || resp.Header.Get("Sunset") != "" {
+		t.Errorf("expected no deprecation headers on a versioned path, got %v", resp.Header)
+	}
+
+	resp, body = getBody(t, gw.URL+"/api/orders/5")
+	if body != "stable /orders/5" {
+		t.Errorf("expected /api/orders/5 proxied to /orders/5, got %q", body)
+	}
+	if got := resp.Header.Get("Deprecation"); got != "@1792195200" {
+		t.Errorf("expected a Deprecation date, got %q", got)
+	}
+	if got := resp.Header.Get("Sunset"); got != "Fri, 30 Apr 2027 00:00:00 GMT" {
+		t.Errorf("expected a Sunset date, got %q", got)
+	}
+	if got := resp.Header.Get("Link"); got != `</api/v1/orders/5>; rel="successor-version"` {
+		t.Errorf("expected a link to the v1 path, got %q", got)
+	}
+}
+
+func TestMetricsLabelledByAPIVersion(t *testing.T) {
+	v1 := httpRequestsTotal.WithLabelValues("GET", "/api/v1/payments/{id}", "v1", "200")
+	plain := httpRequestsTotal.WithLabelValues("GET", "/api/payments/{id}", unversioned, "200")
+	v1Before, plainBefore := testutil.ToFloat64(v1), testutil.ToFloat64(plain)
+	gw := newTestGateway(t, pathUpstream(t, "stable"))
+	getBody(t, gw.URL+"/api/v1/payments/77")
+	getBody(t, gw.URL+"/api/payments/77")
+
+	if got := testutil.ToFloat64(v1) - v1Before; got != 1 {
+		t.Errorf("expected 1 v1 request counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(plain) - plainBefore; got != 1 {
+		t.Errorf("expected 1 unversioned request counted, got %v", got)
+	}
+}
+
+func TestUnknownAPIVersion(t *testing.T) {
+	gw := newTestGateway(t, pathUpstream(t, "stable"))
+
+	resp, body := getBody(t, gw.URL+"/api/v9/orders")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+	var got map[string]string
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("expected a JSON error, got %q", body)
+	}
+	if !strings.Contains(got["error"], `"v9"`) || !strings.Contains(got["error"], "v1") {
+		t.Errorf("expected the error to name the version and the supported ones, got %q", got["error"])
+	}
+
+	resp, _ = getBody(t, gw.URL+"/api/v1/users")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown resource, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIVersionPointsElsewhere(t *testing.T) {
+	withAPIVersions(t, `{"v1": {"products": "inventory", "orders": "orders", "payments": "payments"}, "v2": {"orders": "`+pathUpstream(t, "v2")+`"}}`)
+	gw := newTestGateway(t, pathUpstream(t, "stable"))
+
+	if _, body := getBody(t, gw.URL+"/api/v2/orders/5"); body != "v2 /orders/5" {
+		t.Errorf("expected v2 orders on their own upstream, got %q", body)
+	}
+	if _, body := getBody(t, gw.URL+"/api/v1/orders/5"); body != "stable /orders/5" {
+		t.Errorf("expected v1 orders unchanged, got %q", body)
+	}
+	if resp, _ := getBody(t, gw.URL+"/api/v2/products"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a resource v2 doesn't have, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoadAPIVersionsRejectsBadTables(t *testing.T) {
+	for _, raw := range []string{
+		`[]`,
+		`{"v2": {"orders": "orders"}}`,
+		`{"v1": {"orders": "orders"}, "latest": {"orders": "orders"}}`,
+		`{"v1": {"users": "orders"}}`,
+		`{"v1": {"orders": "order-service-v2"}}`,
+	} {
+		if _, err := parseAPIVersions(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestPathRulesMatchEveryVersion(t *testing.T) {
+	rule := pathRule{Method: http.MethodPost, Prefix: "/api/products/bulk"}
+	for _, path := range []string{"/api/products/bulk", "/api/v1/products/bulk", "/api/v2/products/bulk"} {
+		if !rule.matches(httptest.NewRequest(http.MethodPost, path, nil)) {
+			t.Errorf("expected %s matched", path)
+		}
+	}
+	if rule.matches(httptest.NewRequest(http.MethodPost, "/api/v1/orders", nil)) {
+		t.Error("expected /api/v1/orders not matched")
+	}
+}
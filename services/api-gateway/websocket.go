@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	websocketConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_websocket_connections_total",
+			Help: "WebSocket upgrade requests, by route and outcome (upgraded, refused by the upstream, rejected over the limit or failed)",
+		},
+		[]string{"route", "outcome"},
+	)
+	websocketActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_websocket_connections_active",
+			Help: "WebSocket connections open through the gateway, by route",
+		},
+		[]string{"route"},
+	)
+)
+
+var (
+	// websocketSlots is how many WebSocket connections may be open at
+	// once, beyond which upgrades are refused with 503.
+	websocketSlots       = make(chan struct{}, loadPositiveInt("WEBSOCKET_MAX_CONNECTIONS", 1000))
+	websocketDialTimeout = loadDuration("WEBSOCKET_DIAL_TIMEOUT", 5*time.Second)
+)
+
+// websocketConfig sends WebSocket upgrades on the requests Route matches
+// to the upstream at URL.
+type websocketConfig struct {
+	Route string `yaml:"route"`
+	URL   string `yaml:"url"`
+}
+
+type websocketRoute struct {
+	pathRule
+	route  string
+	target *url.URL
+}
+
+// parseWebsockets checks the configured WebSocket routes. Like the
+// rest of the API they must be under /api/.
+func parseWebsockets(configs []websocketConfig) ([]websocketRoute, error) {
+	var routes []websocketRoute
+	for _, c := range configs {
+		rules, err := parsePathRules(c.Route)
+		if err != nil || len(rules) != 1 || !strings.HasPrefix(rules[0].Prefix, "/api/") {
+			return nil, fmt.Errorf("route %q must be [METHOD ]/api/prefix", c.Route)
+		}
+		targets, err := parseTargets(c.URL)
+		if err != nil || len(targets) != 1 {
+			return nil, fmt.Errorf("route %q: url %q must be one absolute URL", c.Route, c.URL)
+		}
+		routes = append(routes, websocketRoute{pathRule: rules[0], route: c.Route, target: targets[0]})
+	}
+	return routes, nil
+}
+
+// isWebsocketUpgrade reports whether r asks to switch to WebSocket.
+func isWebsocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketMiddleware tunnels WebSocket upgrades on the configured routes
+// to their upstreams. Other requests on those routes, and every request
+// elsewhere, go on to the normal proxy.
+func websocketMiddleware(routes []websocketRoute) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(routes) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isWebsocketUpgrade(r) {
+				for _, route := range routes {
+					if route.matches(r) {
+						route.serve(w, r)
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// serve passes the upgrade request on to the upstream, at the path the
+// proxy would use, as in /notifications/ws for /api/notifications/ws.
+// If the upstream switches protocols, the client's connection is
+// hijacked and bytes copied both ways until either side closes it;
+// otherwise the upstream's answer is passed back as it is.
+func (ws websocketRoute) serve(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	select {
+	case websocketSlots <- struct{}{}:
+	default:
+		websocketConnections.WithLabelValues(ws.route, "rejected").Inc()
+		writeError(w, http.StatusServiceUnavailable, "Too many WebSocket connections")
+		return
+	}
+	defer func() { <-websocketSlots }()
+
+	upstream, err := ws.dial(r.Context())
+	if err != nil {
+		websocketConnections.WithLabelValues(ws.route, "failed").Inc()
+		logger.Warn("websocket upstream unreachable", "route", ws.route, "upstream", ws.target.Host, "error", err)
+		writeError(w, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+	defer upstream.Close()
+
+	out := r.Clone(r.Context())
+	setForwardedHeaders(out)
+	// Appended as the proxy does for other requests.
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	_, unversioned := splitVersion(r.URL.Path)
+	out.URL.Scheme, out.URL.Host = ws.target.Scheme, ws.target.Host
+	out.URL.Path = strings.TrimRight(ws.target.Path, "/") + strings.TrimPrefix(unversioned, "/api")
+	out.URL.RawPath = ""
+	out.Host, out.RequestURI = ws.target.Host, ""
+
+	upstream.SetDeadline(time.Now().Add(upstreamResponseTimeout))
+	upstreamReader := bufio.NewReader(upstream)
+	var resp *http.Response
+	if err = out.Write(upstream); err == nil {
+		resp, err = http.ReadResponse(upstreamReader, out)
+	}
+	if err != nil {
+		websocketConnections.WithLabelValues(ws.route, "failed").Inc()
+		logger.Warn("websocket handshake failed", "route", ws.route, "upstream", ws.target.Host, "error", err)
+		writeError(w, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		websocketConnections.WithLabelValues(ws.route, "refused").Inc()
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		websocketConnections.WithLabelValues(ws.route, "failed").Inc()
+		logger.Error("websocket hijack failed", "route", ws.route, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer client.Close()
+	upstream.SetDeadline(time.Time{})
+	client.SetDeadline(time.Time{})
+
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		websocketConnections.WithLabelValues(ws.route, "failed").Inc()
+		return
+	}
+
+	websocketConnections.WithLabelValues(ws.route, "upgraded").Inc()
+	websocketActive.WithLabelValues(ws.route).Inc()
+	defer websocketActive.WithLabelValues(ws.route).Dec()
+
+	// Whatever either side sent ahead of the switch is in its reader's
+	// buffer, so the copies read through those. When one direction
+	// ends, both connections are closed to end the other.
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			client.Close()
+			upstream.Close()
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, buffered.Reader)
+		closeBoth()
+		close(done)
+	}()
+	io.Copy(client, upstreamReader)
+	closeBoth()
+	<-done
+}
+
+// dial connects to ws's upstream, over TLS for https and wss URLs.
+func (ws websocketRoute) dial(ctx context.Context) (net.Conn, error) {
+	host := ws.target.Host
+	secure := ws.target.Scheme == "https" || ws.target.Scheme == "wss"
+	if ws.target.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(ws.target.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: websocketDialTimeout}
+	if secure {
+		return (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: ws.target.Hostname()}}).DialContext(ctx, "tcp", host)
+	}
+	return dialer.DialContext(ctx, "tcp", host)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// echoUpstream switches upgrade requests to a protocol that echoes each
+// line back prefixed with the request's path, and answers other
+// requests with "plain" and the path.
+func echoUpstream(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocketUpgrade(r) {
+			w.Write([]byte("plain " + r.URL.Path))
+			return
+		}
+		if r.URL.Query().Get("refuse") != "" {
+			http.Error(w, "not today", http.StatusForbidden)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "bye\n" {
+				return
+			}
+			rw.WriteString(r.URL.Path + " " + line)
+			rw.Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// dialWebsocket sends an upgrade request for path to the gateway at
+// gwURL, returning the connection and the response to it.
+func dialWebsocket(t *testing.T, gwURL, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gwURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func TestWebsocketPassthrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, pathUpstream(t, "orders"), "websockets:\n  - route: /api/orders/live\n    url: "+echoUpstream(t)+"\n")
+	_, gw := configGateway(t, path)
+	route := "/api/orders/live"
+	upgraded := testutil.ToFloat64(websocketConnections.WithLabelValues(route, "upgraded"))
+
+	conn, reader, resp := dialWebsocket(t, gw.URL, "/api/v1/orders/live")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want 101", resp.StatusCode)
+	}
+	for _, msg := range []string{"hello\n", "again\n"} {
+		io.WriteString(conn, msg)
+		got, err := reader.ReadString('\n')
+		if err != nil || got != "/orders/live "+msg {
+			t.Fatalf("echo %q, %v, want %q", got, err, "/orders/live "+msg)
+		}
+	}
+	if got := testutil.ToFloat64(websocketActive.WithLabelValues(route)); got != 1 {
+		t.Errorf("%v connections active, want 1", got)
+	}
+	if got := testutil.ToFloat64(websocketConnections.WithLabelValues(route, "upgraded")) - upgraded; got != 1 {
+		t.Errorf("counted %v upgrades, want 1", got)
+	}
+
+	// The upstream closing ends the client's connection too.
+	io.WriteString(conn, "bye\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("after the upstream closed: read error %v, want EOF", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(websocketActive.WithLabelValues(route)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection still counted active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Plain requests on the route, and upgrades elsewhere, go to the
+	// route's upstream through the proxy.
+	if _, body := getBody(t, gw.URL+"/api/orders/live"); body != "orders /orders/live" {
+		t.Errorf("plain request got %q, want the orders upstream", body)
+	}
+	if _, _, resp := dialWebsocket(t, gw.URL, "/api/orders/1"); resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Error("upgrade outside the configured routes was tunnelled")
+	}
+
+	// An upstream refusing the upgrade is passed back.
+	if _, _, resp := dialWebsocket(t, gw.URL, "/api/orders/live?refuse=1"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("refused upgrade: status %d, want the upstream's 403", resp.StatusCode)
+	}
+}
+
+func TestWebsocketConnectionLimit(t *testing.T) {
+	old := websocketSlots
+	websocketSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { websocketSlots = old })
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, pathUpstream(t, "orders"), "websockets:\n  - route: /api/orders/live\n    url: "+echoUpstream(t)+"\n")
+	_, gw := configGateway(t, path)
+
+	conn, _, resp := dialWebsocket(t, gw.URL, "/api/orders/live")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("first connection: status %d, want 101", resp.StatusCode)
+	}
+	if _, _, resp := dialWebsocket(t, gw.URL, "/api/orders/live"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("over the limit: status %d, want 503", resp.StatusCode)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, _, resp := dialWebsocket(t, gw.URL, "/api/orders/live"); resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot not freed after the first connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseWebsocketsRejectsBadConfig(t *testing.T) {
+	for _, c := range []websocketConfig{
+		{Route: "/live", URL: "http://notification-service:8083"},
+		{Route: "/api/live", URL: "notification-service:8083"},
+		{Route: "/api/live", URL: "http://a,http://b"},
+	} {
+		if _, err := parseWebsockets([]websocketConfig{c}); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
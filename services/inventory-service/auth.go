@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// apiScope orders the permissions an API key can carry; each scope
+// includes the ones below it.
+type apiScope int
+
+const (
+	scopeRead apiScope = iota + 1
+	scopeWrite
+	scopeAdmin
+)
+
+var scopeNames = map[string]apiScope{"read": scopeRead, "write": scopeWrite, "admin": scopeAdmin}
+
+type apiKey struct {
+	ID    string
+	Key   string
+	Scope apiScope
+}
+
+var apiKeyRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "inventory_api_key_requests_total",
+		Help: "Requests authenticated with an API key, by key id and outcome",
+	},
+	[]string{"key_id", "outcome"},
+)
+
+// authConfig controls authMiddleware. Authentication is only skipped
+// when Disabled; with no keys configured protected requests are refused.
+type authConfig struct {
+	Keys         []apiKey
+	OpenPaths    map[string]bool
+	ProtectReads bool
+	Disabled     bool
+}
+
+// parseAPIKeys parses API_KEYS, a comma-separated list of id:key:scope
+// entries.
+func parseAPIKeys(raw string) ([]apiKey, error) {
+	var keys []apiKey
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("API_KEYS entry %q must be id:key:scope", entry)
+		}
+		scope, ok := scopeNames[parts[2]]
+		if !ok {
+			return nil, fmt.Errorf("API_KEYS entry %q: unknown scope %q", parts[0], parts[2])
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("API_KEYS: duplicate key id %q", parts[0])
+		}
+		seen[parts[0]] = true
+		keys = append(keys, apiKey{ID: parts[0], Key: parts[1], Scope: scope})
+	}
+	return keys, nil
+}
+
+func loadAuthConfig() authConfig {
+	keys, err := parseAPIKeys(getEnv("API_KEYS", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	protectReads, _ := strconv.ParseBool(getEnv("AUTH_PROTECT_READS", "false"))
+	disabled, _ := strconv.ParseBool(getEnv("AUTH_DISABLED", "false"))
+
+	open := map[string]bool{}
+	for _, p := range strings.Split(getEnv("AUTH_OPEN_PATHS", "/health,/readyz,/metrics"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			open[p] = true
+		}
+	}
+	// Fail closed: running without keys has to be asked for.
+	switch {
+	case disabled:
+		log.Println("WARNING: AUTH_DISABLED is set, inventory endpoints are unauthenticated")
+	case len(keys) == 0:
+		log.Fatal("API_KEYS is empty: set it, or AUTH_DISABLED=true to run without authentication")
+	}
+	return authConfig{Keys: keys, OpenPaths: open, ProtectReads: protectReads, Disabled: disabled}
+}
+
+// requiredScope is the scope a request needs: read for GETs (only when
+// reads are protected), write for other mutations and admin for deletes.
+func (c authConfig) requiredScope(r *http.Request) (apiScope, bool) {
+	if c.OpenPaths[r.URL.Path] {
+		return 0, false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead, c.ProtectReads
+	case http.MethodDelete:
+		return scopeAdmin, true
+	default:
+		return scopeWrite, true
+	}
+}
+
+func (c authConfig) lookup(key string) (apiKey, bool) {
+	var found apiKey
+	ok := false
+	for _, k := range c.Keys {
+		// Compare against every key so timing doesn't reveal which matched.
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// apiKeyIDFrom returns the id of the API key that authenticated the
+// request, or "" when auth is disabled or the request wasn't protected.
+func apiKeyIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyIDKey).(string)
+	return id
+}
+
+// authMiddleware requires an X-API-Key with a sufficient scope on
+// protected requests: 401 when the key is missing or unknown, 403 when
+// its scope is too narrow.
+func authMiddleware(c authConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			need, protected := c.requiredScope(r)
+			if c.Disabled || !protected {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			raw := r.Header.Get("X-API-Key")
+			if raw == "" {
+				w.Header().Set("WWW-Authenticate", "ApiKey")
+				http.Error(w, "Missing X-API-Key", http.StatusUnauthorized)
+				return
+			}
+			key, ok := c.lookup(raw)
+			if !ok {
+				apiKeyRequests.WithLabelValues("unknown", "unauthorized").Inc()
+				w.Header().Set("WWW-Authenticate", "ApiKey")
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			if key.Scope < need {
+				apiKeyRequests.WithLabelValues(key.ID, "forbidden").Inc()
+				loggerFrom(r.Context()).Warn("api key scope too narrow",
+					"api_key_id", key.ID, "method", r.Method, "path", r.URL.Path)
+				http.Error(w, "API key lacks the required scope", http.StatusForbidden)
+				return
+			}
+
+			apiKeyRequests.WithLabelValues(key.ID, "allowed").Inc()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyIDKey, key.ID)))
+		})
+	}
+}
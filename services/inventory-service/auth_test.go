@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys("ci:abc:write, ops:def:admin ,")
+	if err != nil {
+		t.Fatalf("parseAPIKeys: %s", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "ci" || keys[0].Scope != scopeWrite || keys[1].Scope != scopeAdmin {
+		t.Errorf("unexpected keys: %+v", keys)
+	}
+
+	for _, raw := range []string{"ci:abc", "ci:abc:root", "ci::read", "a:x:read,a:y:read"} {
+		if _, err := parseAPIKeys(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keys, _ := parseAPIKeys("reader:r-key:read,writer:w-key:write,admin:a-key:admin")
+	cfg := authConfig{Keys: keys, OpenPaths: map[string]bool{"/health": true, "/metrics": true}}
+	handler := authMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"reads open by default", "GET", "/products", "", http.StatusOK},
+		{"health open", "GET", "/health", "", http.StatusOK},
+		{"missing key", "POST", "/products", "", http.StatusUnauthorized},
+		{"unknown key", "POST", "/products", "nope", http.StatusUnauthorized},
+		{"read key cannot write", "PUT", "/products/1", "r-key", http.StatusForbidden},
+		{"write key can write", "POST", "/products/1/stock", "w-key", http.StatusOK},
+		{"write key cannot delete", "DELETE", "/products/1", "w-key", http.StatusForbidden},
+		{"admin key can delete", "DELETE", "/products/1", "a-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+
+	if v := testutil.ToFloat64(apiKeyRequests.WithLabelValues("writer", "forbidden")); v != 1 {
+		t.Errorf("expected one forbidden request for key id writer, got %v", v)
+	}
+	if v := testutil.ToFloat64(apiKeyRequests.WithLabelValues("admin", "allowed")); v != 1 {
+		t.Errorf("expected one allowed request for key id admin, got %v", v)
+	}
+}
+
+func TestAuthMiddlewareProtectReads(t *testing.T) {
+	keys, _ := parseAPIKeys("reader:r-key:read")
+	cfg := authConfig{Keys: keys, OpenPaths: map[string]bool{"/health": true}, ProtectReads: true}
+	handler := authMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/products", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unauthenticated read, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/products", nil)
+	req.Header.Set("X-API-Key", "r-key")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 with read key, got %d", w.Code)
+	}
+}
+
+func TestAuthMiddlewareFailsClosed(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		cfg  authConfig
+		want int
+	}{
+		{"no keys", authConfig{}, http.StatusUnauthorized},
+		{"disabled", authConfig{Disabled: true}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		authMiddleware(tt.cfg)(ok).ServeHTTP(w, httptest.NewRequest("DELETE", "/products/1", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// validateBarcode accepts EAN-8, UPC-A (12 digits) and EAN-13 codes whose
+// last digit is the GS1 check digit over the others.
+func validateBarcode(code string) error {
+	switch len(code) {
+	case 8, 12, 13:
+	default:
+		return errors.New("barcode must be 8, 12 or 13 digits")
+	}
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		c := code[i]
+		if c < '0' || c > '9' {
+			return errors.New("barcode must contain only digits")
+		}
+		if i == len(code)-1 {
+			continue
+		}
+		// Weights alternate 3, 1, 3, ... leftwards from the digit next to
+		// the check digit.
+		d := int(c - '0')
+		if (len(code)-1-i)%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	if want := (10 - sum%10) % 10; int(code[len(code)-1]-'0') != want {
+		return errors.New("barcode check digit is invalid")
+	}
+	return nil
+}
+
+// normalizeBarcode trims surrounding whitespace, which scanners and
+// spreadsheets like to add.
+func normalizeBarcode(p *Product) {
+	if p.Barcode != nil {
+		code := strings.TrimSpace(*p.Barcode)
+		p.Barcode = &code
+	}
+}
+
+// barcodeValue is the column value for a barcode: NULL when there is none.
+func barcodeValue(barcode *string) interface{} {
+	if barcode == nil || *barcode == "" {
+		return nil
+	}
+	return *barcode
+}
+
+// getProductByBarcode resolves a scanned UPC/EAN to its product.
+func getProductByBarcode(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	code := mux.Vars(r)["code"]
+	if err := validateBarcode(code); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var p Product
+	err := scanProduct(db.QueryRowContext(r.Context(), "SELECT "+productColumns+" FROM products WHERE barcode = $1", code), &p)
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.Variants, err = loadVariants(r.Context(), db, strconv.Itoa(p.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
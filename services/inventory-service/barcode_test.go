@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+func TestValidateBarcode(t *testing.T) {
+	tests := []struct {
+		code    string
+		wantErr bool
+	}{
+		{"96385074", false},      // EAN-8
+		{"036000291452", false},  // UPC-A
+		{"4006381333931", false}, // EAN-13
+		{"4006381333932", true},  // wrong check digit
+		{"036000291453", true},
+		{"1234567", true},
+		{"40063813339310", true},
+		{"40063813339a1", true},
+	}
+	for _, tt := range tests {
+		if err := validateBarcode(tt.code); (err != nil) != tt.wantErr {
+			t.Errorf("validateBarcode(%q) = %v, wantErr %v", tt.code, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGetProductByBarcode(t *testing.T) {
+	withBarcode := productRow(3, "Widget", "d", 9.99, 5)
+	withBarcode[9] = "4006381333931"
+
+	tests := []struct {
+		name       string
+		code       string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+	}{
+		{
+			name: "found",
+			code: "4006381333931",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE barcode = \\$1").
+					WithArgs("4006381333931").
+					WillReturnRows(newProductRows().AddRow(withBarcode...))
+				mock.ExpectQuery("SELECT (.+) FROM product_variants WHERE product_id = \\$1").
+					WithArgs("3").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "unknown",
+			code: "96385074",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE barcode = \\$1").
+					WillReturnRows(newProductRows())
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "malformed",
+			code:       "12345",
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			oldDB := db
+			db = mockDB
+			defer func() { db = oldDB }()
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/products/barcode/"+tt.code, nil), map[string]string{"code": tt.code})
+			w := httptest.NewRecorder()
+			getProductByBarcode(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK {
+				var p Product
+				json.NewDecoder(w.Body).Decode(&p)
+				if p.ID != 3 || p.Barcode == nil || *p.Barcode != tt.code {
+					t.Errorf("unexpected product %+v", p)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestProductBarcodeWrites(t *testing.T) {
+	stored := productRow(1, "Widget", "d", 9.99, 5)
+	stored[9] = "96385074"
+
+	runHandlerCases(t, (*productHandlers).createProduct, []handlerCase{
+		{
+			name:       "invalid barcode",
+			method:     "POST",
+			body:       `{"name":"Widget","price":1,"barcode":"96385075"}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "duplicate barcode",
+			method: "POST",
+			body:   `{"name":"Widget","price":1,"barcode":" 96385074 "}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO products \\(name, description, price, currency, stock, images, barcode,").
+					WithArgs("Widget", "", "1.00", "USD", 0, "[]", "96385074", "{}", nil, 0, "", "").
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			wantStatus: http.StatusConflict,
+		},
+	})
+
+	runHandlerCases(t, (*productHandlers).updateProduct, []handlerCase{
+		{
+			name:   "omitted barcode is kept",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(stored...))
+				mock.ExpectQuery("UPDATE products SET (.+) barcode = \\$12").
+					WithArgs("Widget", "d", "9.99", 5, nil, "1", "USD", nil, nil, nil, nil, "96385074", "{}").
+					WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 5)...))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"product_updated"},
+		},
+		{
+			name:   "empty barcode clears it",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":5,"barcode":""}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(stored...))
+				mock.ExpectQuery("UPDATE products SET (.+) barcode = \\$12").
+					WithArgs("Widget", "d", "9.99", 5, nil, "1", "USD", nil, nil, nil, nil, nil, "{}").
+					WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 5)...))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"product_updated"},
+		},
+		{
+			name:   "duplicate barcode",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":5,"barcode":"4006381333931"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(stored...))
+				mock.ExpectQuery("UPDATE products SET").WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusConflict,
+		},
+	})
+}
+
+func TestExportIncludesBarcode(t *testing.T) {
+	barcode := "96385074"
+	var sb strings.Builder
+	p := Product{ID: 1, Barcode: &barcode}
+	p.setReorderPolicy(reorderPolicy{})
+	enc := csvProductEncoder{w: csv.NewWriter(&sb)}
+	if err := enc.Encode(&p); err != nil {
+		t.Fatal(err)
+	}
+	enc.Flush()
+	if !strings.Contains(sb.String(), ",96385074,") {
+		t.Errorf("expected barcode in the CSV row, got %q", sb.String())
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxBulkProducts caps the size of a POST /products/bulk request. At twelve
+// parameters per row it keeps the INSERT well under Postgres' 65535
+// parameter limit.
+const maxBulkProducts = 1000
+
+// backgroundEvents tracks events published off the request path so
+// shutdown can wait for them before closing the Kafka writer.
+var backgroundEvents sync.WaitGroup
+
+// bulkItemError reports why one element of a bulk request was rejected.
+type bulkItemError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// BulkCreateResponse is returned by POST /products/bulk. Products are in
+// input order; with allow_partial, Errors lists the skipped indexes.
+type BulkCreateResponse struct {
+	Products []Product       `json:"products"`
+	Errors   []bulkItemError `json:"errors,omitempty"`
+}
+
+// createProductsBulk creates up to maxBulkProducts products in a single
+// multi-row INSERT. Every item is validated first; by default any invalid
+// item rejects the whole request, while ?allow_partial=true skips invalid
+// items and reports them by index.
+func (h *productHandlers) createProductsBulk(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	allowPartial, _ := strconv.ParseBool(r.URL.Query().Get("allow_partial"))
+
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(raw) == 0 {
+		http.Error(w, "request must contain at least one product", http.StatusBadRequest)
+		return
+	}
+	if len(raw) > maxBulkProducts {
+		http.Error(w, fmt.Sprintf("too many products: %d (max %d)", len(raw), maxBulkProducts), http.StatusBadRequest)
+		return
+	}
+
+	products := make([]Product, 0, len(raw))
+	var itemErrors []bulkItemError
+	for i, item := range raw {
+		var p Product
+		if err := json.Unmarshal(item, &p); err != nil {
+			itemErrors = append(itemErrors, bulkItemError{Index: i, Error: err.Error()})
+			continue
+		}
+		if p.Images == nil {
+			p.Images = []string{}
+		}
+		p.Tags = nonNilTags(normalizeTags(p.Tags))
+		normalizePrice(&p)
+		dropSaleFields(&p)
+		normalizeBarcode(&p)
+		if err := validateProduct(&p); err != nil {
+			itemErrors = append(itemErrors, bulkItemError{Index: i, Error: err.Error()})
+			continue
+		}
+		products = append(products, p)
+	}
+
+	if len(itemErrors) > 0 && (!allowPartial || len(products) == 0) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(BulkCreateResponse{Products: []Product{}, Errors: itemErrors})
+		return
+	}
+
+	err := h.insertProducts(r, products)
+	if isUniqueViolation(err) {
+		http.Error(w, "Barcode already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	for i := range products {
+		setProductGauges(strconv.Itoa(products[i].ID), &products[i])
+	}
+	loggerFrom(r.Context()).Info("products bulk created",
+		"created", len(products), "skipped", len(itemErrors))
+	h.publishProductsCreated(products)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(BulkCreateResponse{Products: products, Errors: itemErrors})
+}
+
+// insertProducts inserts products in one transaction and fills in their
+// ids and creation times. Serial ids are assigned in VALUES order, so
+// sorting the returned ids maps them back to the input regardless of the
+// order RETURNING emits them in.
+func (h *productHandlers) insertProducts(r *http.Request, products []Product) error {
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO products (name, description, price, currency, stock, images, barcode, tags, " + reorderColumns + ") VALUES ")
+	args := make([]interface{}, 0, len(products)*12)
+	for i := range products {
+		p := &products[i]
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(")
+		rp := p.reorderPolicy()
+		p.setReorderPolicy(rp)
+		for j, v := range []interface{}{
+			p.Name, p.Description, centsColumn(p.PriceCents), p.Currency, p.Stock, imageList(p.Images), barcodeValue(p.Barcode), pq.Array(p.Tags),
+			rp.ReorderPoint, rp.ReorderQuantity, rp.SupplierName, rp.SupplierContact,
+		} {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			args = append(args, v)
+			sb.WriteString("$" + strconv.Itoa(len(args)))
+		}
+		sb.WriteString(")")
+	}
+	sb.WriteString(" RETURNING id, created_at, stock")
+	query := withDefaultWarehouseStock(sb.String())
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		return err
+	}
+	type inserted struct {
+		id        int
+		createdAt time.Time
+	}
+	var got []inserted
+	for rows.Next() {
+		var row inserted
+		if err := rows.Scan(&row.id, &row.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		got = append(got, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(got) != len(products) {
+		return fmt.Errorf("inserted %d products, expected %d", len(got), len(products))
+	}
+
+	sort.Slice(got, func(i, j int) bool { return got[i].id < got[j].id })
+	for i := range products {
+		products[i].ID = got[i].id
+		products[i].CreatedAt = got[i].createdAt
+	}
+	return tx.Commit()
+}
+
+// publishProductsCreated emits one product_created event per product in
+// the background so a large import doesn't wait on the broker.
+func (h *productHandlers) publishProductsCreated(products []Product) {
+	events := make([]map[string]interface{}, 0, len(products))
+	now := time.Now().Unix()
+	for _, p := range products {
+		events = append(events, map[string]interface{}{
+			"event_type":    "product_created",
+			"product_id":    p.ID,
+			"name":          p.Name,
+			"stock":         p.Stock,
+			"primary_image": primaryImage(p.Images),
+			"tags":          p.Tags,
+			"timestamp":     now,
+		})
+	}
+
+	backgroundEvents.Add(1)
+	go func() {
+		defer backgroundEvents.Done()
+		for _, event := range events {
+			h.events.Publish(event)
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateProductsBulk(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	now := time.Now()
+	mock.ExpectBegin()
+	// RETURNING order is not guaranteed; ids must still map back to input order.
+	mock.ExpectQuery("INSERT INTO products \\(name, description, price, currency, stock, images, barcode, tags, " + reorderColumns + "\\) VALUES \\(\\$1, .+, \\$12\\), \\(\\$13, .+, \\$24\\) RETURNING id, created_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, now).AddRow(7, now))
+	mock.ExpectCommit()
+
+	body := `[{"name":"A","price_cents":100,"stock":1},{"name":"B","price_cents":200,"stock":2}]`
+	w := httptest.NewRecorder()
+	handlers.createProductsBulk(w, httptest.NewRequest("POST", "/products/bulk", strings.NewReader(body)))
+	backgroundEvents.Wait()
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp BulkCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if len(resp.Products) != 2 || resp.Products[0].ID != 7 || resp.Products[0].Name != "A" || resp.Products[1].ID != 8 {
+		t.Errorf("expected products in input order with ids 7, 8, got %+v", resp.Products)
+	}
+	if len(*events) != 2 || (*events)[0]["product_id"] != 7 {
+		t.Errorf("expected two product_created events, got %v", *events)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateProductsBulkValidation(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, _ := newTestProducts(mockDB)
+
+	body := `[{"name":"A","price_cents":100},{"name":"B","price_cents":-1},{"name":"C","stock":"x"}]`
+
+	t.Run("strict rejects the whole batch", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handlers.createProductsBulk(w, httptest.NewRequest("POST", "/products/bulk", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", w.Code)
+		}
+		var resp BulkCreateResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Errors) != 2 || resp.Errors[0].Index != 1 || resp.Errors[1].Index != 2 {
+			t.Errorf("expected errors for indexes 1 and 2, got %+v", resp.Errors)
+		}
+	})
+
+	t.Run("partial inserts the valid items", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO products").
+			WithArgs("A", "", "1.00", "USD", 0, "[]", nil, "{}", nil, 0, "", "").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+		mock.ExpectCommit()
+
+		w := httptest.NewRecorder()
+		handlers.createProductsBulk(w, httptest.NewRequest("POST", "/products/bulk?allow_partial=true", strings.NewReader(body)))
+		backgroundEvents.Wait()
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp BulkCreateResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Products) != 1 || len(resp.Errors) != 2 {
+			t.Errorf("expected 1 product and 2 errors, got %+v", resp)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateProductsBulkTooLarge(t *testing.T) {
+	handlers, _ := newTestProducts(nil)
+	items := make([]string, maxBulkProducts+1)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"name":"P%d"}`, i)
+	}
+	w := httptest.NewRecorder()
+	handlers.createProductsBulk(w, httptest.NewRequest("POST", "/products/bulk", strings.NewReader("["+strings.Join(items, ",")+"]")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// productCache caches single-product reads keyed by product id.
+// Implementations must treat backend failures as cache misses so that
+// reads always fall back to Postgres.
+type productCache interface {
+	Get(ctx context.Context, id string) (*Product, bool)
+	Set(ctx context.Context, id string, p *Product)
+	Invalidate(ctx context.Context, id string)
+}
+
+// newProductCache selects the cache backend from CACHE_BACKEND
+// ("none", "memory" or "redis").
+func newProductCache() productCache {
+	ttl, err := time.ParseDuration(getEnv("CACHE_TTL", "30s"))
+	if err != nil {
+		log.Printf("Invalid CACHE_TTL, using 30s: %v", err)
+		ttl = 30 * time.Second
+	}
+
+	switch backend := getEnv("CACHE_BACKEND", "none"); backend {
+	case "memory":
+		log.Printf("Product cache: in-memory (ttl %s)", ttl)
+		return newMemoryCache(ttl)
+	case "redis":
+		addr := getEnv("REDIS_ADDR", "localhost:6379")
+		log.Printf("Product cache: redis at %s (ttl %s)", addr, ttl)
+		client := redis.NewClient(&redis.Options{
+			Addr:         addr,
+			DialTimeout:  250 * time.Millisecond,
+			ReadTimeout:  250 * time.Millisecond,
+			WriteTimeout: 250 * time.Millisecond,
+		})
+		return newRedisCache(client, ttl)
+	case "none":
+		return noopCache{}
+	default:
+		log.Printf("Unknown CACHE_BACKEND %q, caching disabled", backend)
+		return noopCache{}
+	}
+}
+
+type noopCache struct{}
+
+func (noopCache) Get(context.Context, string) (*Product, bool) { return nil, false }
+func (noopCache) Set(context.Context, string, *Product)        {}
+func (noopCache) Invalidate(context.Context, string)           {}
+
+type memoryEntry struct {
+	product   Product
+	expiresAt time.Time
+}
+
+// memoryCache is a process-local cache. It is only consistent when a
+// single replica serves writes; use the redis backend otherwise.
+type memoryCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]memoryEntry
+}
+
+func newMemoryCache(ttl time.Duration) *memoryCache {
+	return &memoryCache{ttl: ttl, entries: make(map[string]memoryEntry)}
+}
+
+func (c *memoryCache) Get(_ context.Context, id string) (*Product, bool) {
+	c.mu.RLock()
+	e, ok := c.entries[id]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(e.expiresAt) {
+		return nil, false
+	}
+	p := e.product
+	return &p, true
+}
+
+func (c *memoryCache) Set(_ context.Context, id string, p *Product) {
+	c.mu.Lock()
+	c.entries[id] = memoryEntry{product: *p, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+}
+
+func (c *memoryCache) Invalidate(_ context.Context, id string) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
+
+// redisCache shares cached products between replicas. Mutations DEL the
+// key so every replica sees the change on its next read.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisCache(client *redis.Client, ttl time.Duration) *redisCache {
+	return &redisCache{client: client, ttl: ttl}
+}
+
+func redisProductKey(id string) string {
+	return "inventory:product:" + id
+}
+
+func (c *redisCache) Get(ctx context.Context, id string) (*Product, bool) {
+	data, err := c.client.Get(ctx, redisProductKey(id)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			loggerFrom(ctx).Warn("redis cache read failed, falling back to database", "product_id", id, "error", err)
+		}
+		return nil, false
+	}
+
+	var p Product
+	if err := json.Unmarshal(data, &p); err != nil {
+		loggerFrom(ctx).Warn("discarding corrupt cache entry", "product_id", id, "error", err)
+		return nil, false
+	}
+	return &p, true
+}
+
+func (c *redisCache) Set(ctx context.Context, id string, p *Product) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	if err := c.client.Set(ctx, redisProductKey(id), data, c.ttl).Err(); err != nil {
+		loggerFrom(ctx).Warn("redis cache write failed", "product_id", id, "error", err)
+	}
+}
+
+func (c *redisCache) Invalidate(ctx context.Context, id string) {
+	if err := c.client.Del(ctx, redisProductKey(id)).Err(); err != nil {
+		loggerFrom(ctx).Warn("redis cache invalidation failed", "product_id", id, "error", err)
+	}
+}
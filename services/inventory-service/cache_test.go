@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisCache(t *testing.T) (*redisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	return newRedisCache(client, time.Minute), mr
+}
+
+func TestRedisCacheSetGetInvalidate(t *testing.T) {
+	c, mr := newTestRedisCache(t)
+	ctx := context.Background()
+
+	if _, ok := c.Get(ctx, "1"); ok {
+		t.Fatal("expected miss on empty cache")
+	}
+
+	c.Set(ctx, "1", &Product{ID: 1, Name: "Widget", Stock: 5})
+	p, ok := c.Get(ctx, "1")
+	if !ok || p.Name != "Widget" || p.Stock != 5 {
+		t.Fatalf("expected cached product, got %+v (hit=%v)", p, ok)
+	}
+	if ttl := mr.TTL(redisProductKey("1")); ttl != time.Minute {
+		t.Errorf("expected ttl 1m, got %s", ttl)
+	}
+
+	c.Invalidate(ctx, "1")
+	if mr.Exists(redisProductKey("1")) {
+		t.Error("expected key to be deleted on invalidation")
+	}
+	if _, ok := c.Get(ctx, "1"); ok {
+		t.Error("expected miss after invalidation")
+	}
+}
+
+func TestRedisCacheOutageFallsBackToDatabase(t *testing.T) {
+	c, mr := newTestRedisCache(t)
+	mr.Close()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers := newProductHandlers(sqlStore{mockDB}, &recordedEvents{}, c)
+
+	rows := newProductRows().
+		AddRow(productRow(1, "Widget", "", 10.0, 5)...)
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").
+		WithArgs("1").
+		WillReturnRows(rows)
+	mock.ExpectQuery("SELECT (.+) FROM product_variants WHERE product_id = \\$1").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/products/1", nil), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	handlers.getProduct(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with redis down, got %d: %s", w.Code, w.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetProductServedFromCache(t *testing.T) {
+	c, _ := newTestRedisCache(t)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers := newProductHandlers(sqlStore{mockDB}, &recordedEvents{}, c)
+
+	rows := newProductRows().
+		AddRow(productRow(1, "Widget", "", 10.0, 5)...)
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").
+		WithArgs("1").
+		WillReturnRows(rows)
+	mock.ExpectQuery("SELECT (.+) FROM product_variants WHERE product_id = \\$1").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	for i := 0; i < 2; i++ {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/products/1", nil), map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		handlers.getProduct(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+
+	// Only one query was expected; a second would fail the mock.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
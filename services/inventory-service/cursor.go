@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+const defaultCursorLimit = 50
+
+// productCursor is the decoded form of the opaque ?cursor= value: the
+// sort key the page was ordered by and the last value of it returned.
+type productCursor struct {
+	Sort    string `json:"s"`
+	AfterID int64  `json:"id"`
+}
+
+// productPage is the response of GET /products in cursor mode.
+type productPage struct {
+	Products   []Product `json:"products"`
+	NextCursor *string   `json:"next_cursor"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(c productCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor value. An empty value starts from the
+// first page.
+func decodeCursor(raw string) (productCursor, error) {
+	c := productCursor{Sort: "id"}
+	if raw == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != "id" || c.AfterID < 0 {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
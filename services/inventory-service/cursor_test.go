@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	raw := encodeCursor(productCursor{Sort: "id", AfterID: 42})
+	c, err := decodeCursor(raw)
+	if err != nil || c.AfterID != 42 {
+		t.Fatalf("decodeCursor(%q) = %+v, %v", raw, c, err)
+	}
+	for _, bad := range []string{"!!!", encodeCursor(productCursor{Sort: "rank", AfterID: 1}), encodeCursor(productCursor{Sort: "id", AfterID: -1})} {
+		if _, err := decodeCursor(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestProductFilterCursor(t *testing.T) {
+	values, _ := url.ParseQuery("in_stock=true&limit=2&cursor=" + encodeCursor(productCursor{Sort: "id", AfterID: 10}))
+	f, err := parseProductFilter(values)
+	if err != nil {
+		t.Fatalf("parseProductFilter: %s", err)
+	}
+	query, args := f.sql()
+	want := "SELECT " + productColumns + " FROM products WHERE archived_at IS NULL AND stock > 0 AND id > $1 ORDER BY id LIMIT $2"
+	if query != want || len(args) != 2 {
+		t.Errorf("sql()\n got: %s %v\nwant: %s", query, args, want)
+	}
+
+	for _, q := range []string{"cursor=&offset=5", "cursor=&ids=1,2", "cursor=&q=mouse", "cursor=garbage"} {
+		values, _ := url.ParseQuery(q)
+		if _, err := parseProductFilter(values); err == nil {
+			t.Errorf("expected %q to be rejected", q)
+		}
+	}
+}
+
+func TestGetProductsCursorPages(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+	handlers, _ := newTestProducts(mockDB)
+
+	// First page: limit 2 fetches 3 rows, so there is a next page.
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE archived_at IS NULL ORDER BY id LIMIT \\$1").
+		WithArgs(3).
+		WillReturnRows(newProductRows().
+			AddRow(productRow(1, "A", "", 1, 1)...).
+			AddRow(productRow(2, "B", "", 1, 1)...).
+			AddRow(productRow(3, "C", "", 1, 1)...))
+	// Last page: fewer rows than the limit.
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE archived_at IS NULL AND id > \\$1 ORDER BY id LIMIT \\$2").
+		WithArgs(2, 3).
+		WillReturnRows(newProductRows().
+			AddRow(productRow(3, "C", "", 1, 1)...))
+
+	w := httptest.NewRecorder()
+	handlers.getProducts(w, httptest.NewRequest("GET", "/products?cursor=&limit=2", nil))
+	var page productPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode: %s (%s)", err, w.Body.String())
+	}
+	if len(page.Products) != 2 || page.NextCursor == nil {
+		t.Fatalf("expected 2 products and a next cursor, got %+v", page)
+	}
+
+	w = httptest.NewRecorder()
+	handlers.getProducts(w, httptest.NewRequest("GET", "/products?limit=2&cursor="+*page.NextCursor, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	page = productPage{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Products) != 1 || page.Products[0].ID != 3 || page.NextCursor != nil {
+		t.Errorf("expected final page with product 3 and no cursor, got %+v", page)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const exportFlushEvery = 500
+
+var (
+	exportTimeout = loadExportTimeout()
+	// exportSlots bounds concurrent exports; each holds a connection and
+	// streams for a long time.
+	exportSlots = make(chan struct{}, loadExportConcurrency())
+)
+
+func loadExportTimeout() time.Duration {
+	d, err := time.ParseDuration(getEnv("EXPORT_TIMEOUT", "10m"))
+	if err != nil || d <= 0 {
+		log.Printf("Invalid EXPORT_TIMEOUT, using 10m")
+		return 10 * time.Minute
+	}
+	return d
+}
+
+func loadExportConcurrency() int {
+	n, err := strconv.Atoi(getEnv("EXPORT_MAX_CONCURRENT", "2"))
+	if err != nil || n < 1 {
+		log.Printf("Invalid EXPORT_MAX_CONCURRENT, using 2")
+		return 2
+	}
+	return n
+}
+
+var exportCSVHeader = []string{
+	"id", "name", "description", "price", "price_cents", "currency", "stock", "images",
+	"supplier_name", "supplier_contact", "reorder_point", "reorder_quantity", "created_at", "barcode", "tags",
+}
+
+// productEncoder writes one product in the export format.
+type productEncoder interface {
+	Encode(p *Product) error
+	Flush() error
+}
+
+type csvProductEncoder struct{ w *csv.Writer }
+
+func (e csvProductEncoder) Encode(p *Product) error {
+	reorderPoint := ""
+	if p.ReorderPoint != nil {
+		reorderPoint = strconv.Itoa(*p.ReorderPoint)
+	}
+	return e.w.Write([]string{
+		strconv.Itoa(p.ID), p.Name, p.Description,
+		strconv.FormatFloat(p.Price, 'f', 2, 64), strconv.FormatInt(p.PriceCents, 10), p.Currency,
+		strconv.Itoa(p.Stock), strings.Join(p.Images, " "),
+		*p.SupplierName, *p.SupplierContact, reorderPoint, strconv.Itoa(*p.ReorderQuantity),
+		p.CreatedAt.UTC().Format(time.RFC3339), derefString(p.Barcode), strings.Join(p.Tags, " "),
+	})
+}
+
+func (e csvProductEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonProductEncoder struct{ enc *json.Encoder }
+
+func (e ndjsonProductEncoder) Encode(p *Product) error { return e.enc.Encode(p) }
+func (e ndjsonProductEncoder) Flush() error            { return nil }
+
+// exportProducts streams the catalog as CSV or NDJSON straight from the
+// database rows, flushing as it goes, so memory use doesn't grow with the
+// table. It accepts the listing filters and stops as soon as the client
+// disconnects.
+func (h *productHandlers) exportProducts(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("limit") == "" {
+		filter.Limit = 0 // exports are complete unless asked otherwise
+	}
+
+	select {
+	case exportSlots <- struct{}{}:
+		defer func() { <-exportSlots }()
+	default:
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many concurrent exports", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+
+	// Rows are read off the connection as the loop consumes them. The
+	// session statement_timeout is lifted for this transaction since a
+	// slow client legitimately keeps the statement open.
+	tx, err := h.store.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query, args := filter.sql()
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var enc productEncoder
+	contentType := "application/x-ndjson"
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write(exportCSVHeader)
+		enc = csvProductEncoder{cw}
+		contentType = "text/csv; charset=utf-8"
+	} else {
+		enc = ndjsonProductEncoder{json.NewEncoder(w)}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products-%s.%s"`,
+		time.Now().UTC().Format("20060102T150405Z"), format))
+
+	rc := http.NewResponseController(w)
+	logger := loggerFrom(r.Context())
+	count := 0
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			logger.Warn("export aborted", "error", err, "rows", count)
+			return
+		}
+		var p Product
+		if err := scanProduct(rows, &p); err != nil {
+			logger.Error("export aborted", "error", err, "rows", count)
+			return
+		}
+		if err := enc.Encode(&p); err != nil {
+			logger.Warn("export aborted, client write failed", "error", err, "rows", count)
+			return
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			if err := flushExport(enc, rc); err != nil {
+				logger.Warn("export aborted, client write failed", "error", err, "rows", count)
+				return
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger.Warn("export aborted", "error", err, "rows", count)
+		return
+	}
+	if err := flushExport(enc, rc); err != nil {
+		logger.Warn("export final flush failed", "error", err, "rows", count)
+		return
+	}
+	logger.Info("products exported", "format", format, "rows", count,
+		"duration_ms", time.Since(start).Milliseconds())
+}
+
+func flushExport(enc productEncoder, rc *http.ResponseController) error {
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
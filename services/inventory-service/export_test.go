@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectExportQuery(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE archived_at IS NULL AND stock > 0 ORDER BY id$").
+		WillReturnRows(rows)
+	mock.ExpectRollback()
+}
+
+func TestExportProductsCSV(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+	handlers, _ := newTestProducts(mockDB)
+
+	expectExportQuery(mock, newProductRows().
+		AddRow(productRow(1, "Widget", "Blue, large", 9.99, 5)...).
+		AddRow(productRow(2, "Gadget", "", 1.5, 3)...))
+
+	w := httptest.NewRecorder()
+	handlers.exportProducts(w, httptest.NewRequest("GET", "/products/export?in_stock=true", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="products-`) || !strings.HasSuffix(cd, `.csv"`) {
+		t.Errorf("unexpected Content-Disposition %q", cd)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid csv: %s", err)
+	}
+	if len(records) != 3 || records[0][0] != "id" || records[1][2] != "Blue, large" || records[2][4] != "150" {
+		t.Errorf("unexpected csv records: %v", records)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExportProductsNDJSON(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+	handlers, _ := newTestProducts(mockDB)
+
+	expectExportQuery(mock, newProductRows().
+		AddRow(productRow(1, "Widget", "", 9.99, 5)...).
+		AddRow(productRow(2, "Gadget", "", 1.5, 3)...))
+
+	w := httptest.NewRecorder()
+	handlers.exportProducts(w, httptest.NewRequest("GET", "/products/export?format=ndjson&in_stock=true", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	var names []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var p Product
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			t.Fatalf("invalid ndjson line %q: %s", scanner.Text(), err)
+		}
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, ",") != "Widget,Gadget" {
+		t.Errorf("unexpected products %v", names)
+	}
+}
+
+// cancellingWriter simulates a client that disconnects after the first
+// product is written.
+type cancellingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancellingWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestExportProductsStopsOnDisconnect(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+	handlers, _ := newTestProducts(mockDB)
+
+	rows := newProductRows()
+	for i := 1; i <= 100; i++ {
+		rows.AddRow(productRow(i, "P", "", 1, 1)...)
+	}
+	expectExportQuery(mock, rows)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := cancellingWriter{httptest.NewRecorder(), cancel}
+	req := httptest.NewRequest("GET", "/products/export?format=ndjson&in_stock=true", nil).WithContext(ctx)
+	handlers.exportProducts(w, req)
+
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 1 {
+		t.Errorf("expected export to stop after 1 product, wrote %d", lines)
+	}
+}
+
+func TestExportProductsConcurrencyLimit(t *testing.T) {
+	handlers, _ := newTestProducts(nil)
+	for i := 0; i < cap(exportSlots); i++ {
+		exportSlots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(exportSlots); i++ {
+			<-exportSlots
+		}
+	}()
+
+	w := httptest.NewRecorder()
+	handlers.exportProducts(w, httptest.NewRequest("GET", "/products/export", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d", w.Code)
+	}
+}
+
+func TestExportProductsRejectsUnknownFormat(t *testing.T) {
+	handlers, _ := newTestProducts(nil)
+	w := httptest.NewRecorder()
+	handlers.exportProducts(w, httptest.NewRequest("GET", "/products/export?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
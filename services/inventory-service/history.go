@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const defaultHistoryLimit = 50
+
+// historyFilter holds the query options shared by the history endpoints:
+// a changed-at window [From, To) and limit/offset paging.
+type historyFilter struct {
+	From, To *time.Time
+	Limit    int
+	Offset   int
+}
+
+// parseHistoryTime accepts RFC 3339 timestamps or plain dates. With
+// endOfDay a plain date means the end of that day, so ?to=2024-05-31
+// includes changes made on the 31st.
+func parseHistoryTime(name, raw string, endOfDay bool) (*time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp or YYYY-MM-DD date", name)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// parseHistoryFilter reads ?from=, ?to=, ?limit= and ?offset=.
+func parseHistoryFilter(query url.Values) (historyFilter, error) {
+	f := historyFilter{Limit: defaultHistoryLimit}
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		if f.From, err = parseHistoryTime("from", raw, false); err != nil {
+			return f, err
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		if f.To, err = parseHistoryTime("to", raw, true); err != nil {
+			return f, err
+		}
+	}
+	if f.From != nil && f.To != nil && f.To.Before(*f.From) {
+		return f, errors.New("to must not be before from")
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		f.Limit = limit
+	}
+	if raw := query.Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return f, errors.New("offset must be a non-negative integer")
+		}
+		f.Offset = offset
+	}
+	return f, nil
+}
+
+// addArg appends v to args and returns its placeholder.
+func addArg(args *[]interface{}, v interface{}) string {
+	*args = append(*args, v)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// conditions returns the WHERE conditions bounding column to the window.
+func (f historyFilter) conditions(column string, args *[]interface{}) []string {
+	var where []string
+	if f.From != nil {
+		where = append(where, column+" >= "+addArg(args, *f.From))
+	}
+	if f.To != nil {
+		where = append(where, column+" < "+addArg(args, *f.To))
+	}
+	return where
+}
+
+// page returns the LIMIT/OFFSET clause.
+func (f historyFilter) page(args *[]interface{}) string {
+	clause := " LIMIT " + addArg(args, f.Limit)
+	if f.Offset > 0 {
+		clause += " OFFSET " + addArg(args, f.Offset)
+	}
+	return clause
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxProductImages caps how many image URLs a product may carry.
+var maxProductImages = loadMaxProductImages()
+
+func loadMaxProductImages() int {
+	n, err := strconv.Atoi(getEnv("MAX_PRODUCT_IMAGES", "10"))
+	if err != nil || n < 1 {
+		log.Printf("Invalid MAX_PRODUCT_IMAGES, using 10")
+		return 10
+	}
+	return n
+}
+
+// imageList stores an ordered list of image URLs in a JSONB column. The
+// first entry is the primary image.
+type imageList []string
+
+func (l imageList) Value() (driver.Value, error) {
+	if l == nil {
+		l = imageList{}
+	}
+	data, err := json.Marshal([]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (l *imageList) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*l = imageList{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported images column type %T", src)
+	}
+	var images []string
+	if err := json.Unmarshal(data, &images); err != nil {
+		return err
+	}
+	if images == nil {
+		images = []string{}
+	}
+	*l = images
+	return nil
+}
+
+func validateImages(images []string) error {
+	if len(images) > maxProductImages {
+		return fmt.Errorf("too many images: %d (max %d)", len(images), maxProductImages)
+	}
+	for i, raw := range images {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("images[%d]: %q is not a valid http(s) URL", i, raw)
+		}
+	}
+	return nil
+}
+
+func primaryImage(images []string) string {
+	if len(images) == 0 {
+		return ""
+	}
+	return images[0]
+}
+
+// patchProductImages replaces or appends to a product's image list:
+//
+//	{"images": ["https://..."], "mode": "replace"|"append"}
+func (h *productHandlers) patchProductImages(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Images []string `json:"images"`
+		Mode   string   `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "replace"
+	}
+	if req.Mode != "replace" && req.Mode != "append" {
+		http.Error(w, `mode must be "replace" or "append"`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var name string
+	var stock int
+	var current []string
+	err = tx.QueryRowContext(r.Context(), "SELECT name, stock, images FROM products WHERE id = $1 FOR UPDATE", id).
+		Scan(&name, &stock, (*imageList)(&current))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	images := req.Images
+	if req.Mode == "append" {
+		images = append(current, req.Images...)
+	}
+	if images == nil {
+		images = []string{}
+	}
+	if err := validateImages(images); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), "UPDATE products SET images = $1 WHERE id = $2", imageList(images), id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.cache.Invalidate(r.Context(), id)
+
+	h.events.Publish(map[string]interface{}{
+		"event_type":    "product_updated",
+		"product_id":    id,
+		"name":          name,
+		"stock":         stock,
+		"primary_image": primaryImage(images),
+		"timestamp":     time.Now().Unix(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"images": images})
+}
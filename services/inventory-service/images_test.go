@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestValidateImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		images  []string
+		wantErr bool
+	}{
+		{"empty", []string{}, false},
+		{"valid", []string{"https://cdn.example.com/a.jpg", "http://example.com/b.png"}, false},
+		{"relative path", []string{"/a.jpg"}, true},
+		{"unsupported scheme", []string{"ftp://example.com/a.jpg"}, true},
+		{"too many", make([]string, maxProductImages+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateImages(tt.images); (err != nil) != tt.wantErr {
+				t.Errorf("validateImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPatchProductImagesAppend(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT name, stock, images FROM products WHERE id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "stock", "images"}).
+			AddRow("Widget", 5, `["https://cdn.example.com/a.jpg"]`))
+	mock.ExpectExec("UPDATE products SET images = \\$1 WHERE id = \\$2").
+		WithArgs(`["https://cdn.example.com/a.jpg","https://cdn.example.com/b.jpg"]`, "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := `{"images":["https://cdn.example.com/b.jpg"],"mode":"append"}`
+	req := mux.SetURLVars(httptest.NewRequest("PATCH", "/products/1/images", strings.NewReader(body)), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	handlers.patchProductImages(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(*events) != 1 || (*events)[0]["primary_image"] != "https://cdn.example.com/a.jpg" {
+		t.Errorf("unexpected events: %v", *events)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
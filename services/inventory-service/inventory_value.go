@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	inventoryTotalValue = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "inventory_total_value",
+			Help: "Total value of stock on hand (price * stock) across active products, by currency",
+		},
+		[]string{"currency"},
+	)
+	inventoryProductCount = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inventory_product_count",
+			Help: "Number of active (non-archived) products",
+		},
+	)
+)
+
+type valuedProduct struct {
+	PriceCents int64
+	Currency   string
+	Stock      int
+}
+
+func (v valuedProduct) cents() int64 { return v.PriceCents * int64(v.Stock) }
+
+// inventoryValuation keeps per-product values so the totals can be
+// adjusted incrementally between scans. seq orders every change; replace
+// keeps changes made after its scan started, so a slow scan can't roll
+// back a newer incremental update.
+type inventoryValuation struct {
+	mu       sync.Mutex
+	seq      uint64
+	products map[string]valuedProduct
+	changed  map[string]uint64 // id -> seq of the last incremental change, including removals
+	totals   map[string]int64  // currency -> cents
+}
+
+var valuation = newInventoryValuation()
+
+func newInventoryValuation() *inventoryValuation {
+	return &inventoryValuation{
+		products: map[string]valuedProduct{},
+		changed:  map[string]uint64{},
+		totals:   map[string]int64{},
+	}
+}
+
+// set records the full price and stock of a product.
+func (v *inventoryValuation) set(id string, p valuedProduct) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.put(id, p)
+	v.seq++
+	v.changed[id] = v.seq
+	v.publish()
+}
+
+// setStock updates only the stock of a product already known; unknown
+// products are picked up by the next scan.
+func (v *inventoryValuation) setStock(id string, stock int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	p, ok := v.products[id]
+	if !ok {
+		return
+	}
+	p.Stock = stock
+	v.put(id, p)
+	v.seq++
+	v.changed[id] = v.seq
+	v.publish()
+}
+
+func (v *inventoryValuation) remove(id string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.drop(id)
+	v.seq++
+	v.changed[id] = v.seq
+	v.publish()
+}
+
+// scanStarted returns a token to pass to replace once the scan finishes.
+func (v *inventoryValuation) scanStarted() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.seq
+}
+
+// replace makes a full scan authoritative, except for products changed
+// incrementally since the scan identified by token started.
+func (v *inventoryValuation) replace(token uint64, scanned map[string]valuedProduct) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for id := range v.products {
+		if _, ok := scanned[id]; !ok && v.changed[id] <= token {
+			v.drop(id)
+		}
+	}
+	for id, p := range scanned {
+		if v.changed[id] <= token {
+			v.put(id, p)
+		}
+	}
+	for id, s := range v.changed {
+		if s <= token {
+			delete(v.changed, id)
+		}
+	}
+	v.publish()
+}
+
+func (v *inventoryValuation) put(id string, p valuedProduct) {
+	v.drop(id)
+	v.products[id] = p
+	v.totals[p.Currency] += p.cents()
+}
+
+func (v *inventoryValuation) drop(id string) {
+	if old, ok := v.products[id]; ok {
+		v.totals[old.Currency] -= old.cents()
+		delete(v.products, id)
+	}
+}
+
+func (v *inventoryValuation) publish() {
+	for currency, cents := range v.totals {
+		inventoryTotalValue.WithLabelValues(currency).Set(centsToFloat(cents))
+	}
+	inventoryProductCount.Set(float64(len(v.products)))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInventoryValuationIncremental(t *testing.T) {
+	v := newInventoryValuation()
+	inventoryTotalValue.Reset()
+	defer inventoryTotalValue.Reset()
+
+	v.set("1", valuedProduct{PriceCents: 250, Currency: "USD", Stock: 4}) // 10.00
+	v.set("2", valuedProduct{PriceCents: 100, Currency: "EUR", Stock: 3}) // 3.00
+	v.setStock("1", 2)                                                    // 5.00
+	v.setStock("99", 10)                                                  // unknown, ignored
+
+	if got := testutil.ToFloat64(inventoryTotalValue.WithLabelValues("USD")); got != 5 {
+		t.Errorf("expected USD value 5, got %v", got)
+	}
+	if got := testutil.ToFloat64(inventoryProductCount); got != 2 {
+		t.Errorf("expected 2 products, got %v", got)
+	}
+
+	v.remove("2")
+	if got := testutil.ToFloat64(inventoryTotalValue.WithLabelValues("EUR")); got != 0 {
+		t.Errorf("expected EUR value 0 after removal, got %v", got)
+	}
+	if got := testutil.ToFloat64(inventoryProductCount); got != 1 {
+		t.Errorf("expected 1 product, got %v", got)
+	}
+}
+
+func TestInventoryValuationScanKeepsNewerUpdates(t *testing.T) {
+	v := newInventoryValuation()
+	inventoryTotalValue.Reset()
+	defer inventoryTotalValue.Reset()
+
+	v.set("1", valuedProduct{PriceCents: 100, Currency: "USD", Stock: 1})
+	v.set("3", valuedProduct{PriceCents: 100, Currency: "USD", Stock: 1})
+
+	token := v.scanStarted()
+	// While the scan runs, product 1 is restocked and product 2 created.
+	v.setStock("1", 50)
+	v.set("2", valuedProduct{PriceCents: 100, Currency: "USD", Stock: 5})
+
+	// The scan saw the old stock of 1, missed 2, and no longer sees 3.
+	v.replace(token, map[string]valuedProduct{
+		"1": {PriceCents: 100, Currency: "USD", Stock: 1},
+	})
+
+	if got := testutil.ToFloat64(inventoryTotalValue.WithLabelValues("USD")); got != 55 {
+		t.Errorf("expected USD value 55 (50 + 5), got %v", got)
+	}
+	if got := testutil.ToFloat64(inventoryProductCount); got != 2 {
+		t.Errorf("expected 2 products, got %v", got)
+	}
+
+	// A later scan is authoritative again.
+	v.replace(v.scanStarted(), map[string]valuedProduct{})
+	if got := testutil.ToFloat64(inventoryProductCount); got != 0 {
+		t.Errorf("expected 0 products after empty scan, got %v", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	kafkaPublishFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inventory_kafka_publish_failures_total",
+			Help: "Events that could not be published to Kafka after all retries, by event type",
+		},
+		[]string{"event_type"},
+	)
+	kafkaPublishDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "inventory_kafka_publish_duration_seconds",
+			Help:    "Time to publish an event to Kafka, including retries",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"event_type", "outcome"},
+	)
+	outboxPending = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inventory_event_outbox_pending",
+			Help: "Undelivered events waiting in the outbox after the last replay",
+		},
+	)
+)
+
+// messageWriter is the part of *kafka.Writer used for publishing, so tests
+// can substitute a fake broker.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+var (
+	eventWriter          messageWriter
+	publishMaxAttempts   = loadPositiveInt("KAFKA_PUBLISH_ATTEMPTS", 3)
+	publishRetryBackoff  = loadDuration("KAFKA_PUBLISH_BACKOFF", 100*time.Millisecond)
+	publishWriteTimeout  = loadDuration("KAFKA_PUBLISH_TIMEOUT", 2*time.Second)
+	outboxReplayInterval = loadDuration("OUTBOX_REPLAY_INTERVAL", 30*time.Second)
+)
+
+const outboxReplayBatch = 100
+
+func loadPositiveInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil || n < 1 {
+		log.Printf("Invalid %s, using %d", key, def)
+		return def
+	}
+	return n
+}
+
+func loadDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, def.String()))
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s, using %s", key, def)
+		return def
+	}
+	return d
+}
+
+// writeWithRetry publishes one message, retrying with exponential backoff
+// up to publishMaxAttempts times.
+func writeWithRetry(data []byte) error {
+	backoff := publishRetryBackoff
+	var err error
+	for attempt := 1; attempt <= publishMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), publishWriteTimeout)
+		err = eventWriter.WriteMessages(ctx, kafka.Message{Value: data})
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < publishMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// deliverEvent publishes an encoded event, falling back to the outbox
+// when Kafka stays unavailable so the event is replayed rather than lost.
+func deliverEvent(eventType string, productID interface{}, data []byte) {
+	start := time.Now()
+	err := writeWithRetry(data)
+	if err == nil {
+		kafkaPublishDuration.WithLabelValues(eventType, "published").Observe(time.Since(start).Seconds())
+		slog.Info("published event",
+			"event_type", eventType, "product_id", productID, "payload", json.RawMessage(data))
+		return
+	}
+
+	kafkaPublishDuration.WithLabelValues(eventType, "failed").Observe(time.Since(start).Seconds())
+	kafkaPublishFailures.WithLabelValues(eventType).Inc()
+	slog.Error("failed to publish event to Kafka, writing to outbox",
+		"event_type", eventType, "product_id", productID, "attempts", publishMaxAttempts, "error", err)
+
+	if _, oerr := db.Exec(
+		"INSERT INTO event_outbox (event_type, payload, last_error, attempts) VALUES ($1, $2, $3, $4)",
+		eventType, data, err.Error(), publishMaxAttempts,
+	); oerr != nil {
+		slog.Error("failed to write event to outbox, event lost",
+			"event_type", eventType, "product_id", productID, "error", oerr, "payload", json.RawMessage(data))
+	}
+}
+
+// replayOutbox republishes pending outbox events in order, stopping at the
+// first failure so ordering is preserved. SKIP LOCKED lets replicas run it
+// concurrently without double-publishing.
+func replayOutbox(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, event_type, payload FROM event_outbox WHERE published_at IS NULL
+		ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, outboxReplayBatch)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id        int64
+		eventType string
+		payload   []byte
+	}
+	var events []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.eventType, &p.payload); err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	published := 0
+	for _, e := range events {
+		wctx, cancel := context.WithTimeout(ctx, publishWriteTimeout)
+		werr := eventWriter.WriteMessages(wctx, kafka.Message{Value: e.payload})
+		cancel()
+		if werr != nil {
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE event_outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2", werr.Error(), e.id,
+			); err != nil {
+				return err
+			}
+			break
+		}
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE event_outbox SET published_at = CURRENT_TIMESTAMP WHERE id = $1", e.id,
+		); err != nil {
+			return err
+		}
+		published++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	outboxPending.Set(float64(len(events) - published))
+	if published > 0 {
+		slog.Info("replayed outbox events", "published", published, "remaining_in_batch", len(events)-published)
+	}
+	return nil
+}
+
+func replayOutboxLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := replayOutbox(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("outbox replay failed", "error", err)
+		}
+	}
+}
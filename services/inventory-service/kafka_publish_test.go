@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeWriter fails the first failures writes and records the rest.
+type fakeWriter struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	written  [][]byte
+}
+
+func (f *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("broker unavailable")
+	}
+	for _, m := range msgs {
+		f.written = append(f.written, m.Value)
+	}
+	return nil
+}
+
+func withFakeWriter(t *testing.T, failures int) *fakeWriter {
+	t.Helper()
+	fw := &fakeWriter{failures: failures}
+	oldWriter, oldBackoff := eventWriter, publishRetryBackoff
+	eventWriter, publishRetryBackoff = fw, time.Millisecond
+	t.Cleanup(func() { eventWriter, publishRetryBackoff = oldWriter, oldBackoff })
+	return fw
+}
+
+func TestDeliverEventRetriesTransientFailures(t *testing.T) {
+	fw := withFakeWriter(t, publishMaxAttempts-1)
+
+	deliverEvent("product_created", 1, []byte(`{"event_type":"product_created"}`))
+
+	if fw.calls != publishMaxAttempts || len(fw.written) != 1 {
+		t.Errorf("expected success on attempt %d, got %d calls and %d writes", publishMaxAttempts, fw.calls, len(fw.written))
+	}
+}
+
+func TestDeliverEventFallsBackToOutbox(t *testing.T) {
+	fw := withFakeWriter(t, 100)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	payload := []byte(`{"event_type":"product_updated"}`)
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs("product_updated", payload, "broker unavailable", publishMaxAttempts).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	before := testutil.ToFloat64(kafkaPublishFailures.WithLabelValues("product_updated"))
+	deliverEvent("product_updated", "1", payload)
+
+	if fw.calls != publishMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", publishMaxAttempts, fw.calls)
+	}
+	if got := testutil.ToFloat64(kafkaPublishFailures.WithLabelValues("product_updated")) - before; got != 1 {
+		t.Errorf("expected failure counter to increase by 1, got %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReplayOutboxStopsAtFirstFailure(t *testing.T) {
+	// The first replayed event goes through, the second fails.
+	var written [][]byte
+	calls := 0
+	oldWriter := eventWriter
+	eventWriter = writerFunc(func(ctx context.Context, msgs ...kafka.Message) error {
+		calls++
+		if calls == 2 {
+			return errors.New("broker unavailable")
+		}
+		written = append(written, msgs[0].Value)
+		return nil
+	})
+	defer func() { eventWriter = oldWriter }()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, event_type, payload FROM event_outbox WHERE published_at IS NULL").
+		WithArgs(outboxReplayBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "payload"}).
+			AddRow(1, "product_created", []byte(`{"n":1}`)).
+			AddRow(2, "product_updated", []byte(`{"n":2}`)).
+			AddRow(3, "product_updated", []byte(`{"n":3}`)))
+	mock.ExpectExec("UPDATE event_outbox SET published_at = CURRENT_TIMESTAMP WHERE id = \\$1").
+		WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE event_outbox SET attempts = attempts \\+ 1").
+		WithArgs("broker unavailable", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := replayOutbox(context.Background()); err != nil {
+		t.Fatalf("replayOutbox: %s", err)
+	}
+	if len(written) != 1 || string(written[0]) != `{"n":1}` {
+		t.Errorf("expected only the first event republished, got %q", written)
+	}
+	if got := testutil.ToFloat64(outboxPending); got != 2 {
+		t.Errorf("expected 2 pending events, got %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+type writerFunc func(ctx context.Context, msgs ...kafka.Message) error
+
+func (f writerFunc) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return f(ctx, msgs...)
+}
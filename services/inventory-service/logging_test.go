@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestLoggingMiddlewareRequestID(t *testing.T) {
+	var seen string
+	handler := requestLoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/products", nil)
+	req.Header.Set("X-Request-ID", "order-svc-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen != "order-svc-123" || w.Header().Get("X-Request-ID") != "order-svc-123" {
+		t.Errorf("expected caller's request id to be used and echoed, got ctx=%q header=%q", seen, w.Header().Get("X-Request-ID"))
+	}
+
+	for _, incoming := range []string{"", "bad id with spaces"} {
+		req = httptest.NewRequest("GET", "/products", nil)
+		req.Header.Set("X-Request-ID", incoming)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if len(seen) != 36 || seen == incoming || w.Header().Get("X-Request-ID") != seen {
+			t.Errorf("expected a generated uuid for %q, got ctx=%q header=%q", incoming, seen, w.Header().Get("X-Request-ID"))
+		}
+	}
+}
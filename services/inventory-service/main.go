@@ -6,27 +6,118 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+
+	"inventory-microservices/pkg/httpx"
 )
 
 // Product represents an inventory item
 type Product struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price"`
-	Stock       int       `json:"stock"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Price       float64    `json:"price"` // Deprecated: derived from PriceCents, use price_cents.
+	PriceCents  int64      `json:"price_cents"`
+	Currency    string     `json:"currency"`
+	Stock       int        `json:"stock"`
+	Images      []string   `json:"images"`
+	Variants    []Variant  `json:"variants,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+
+	// Barcode is the product's UPC/EAN. Omitting it on PUT keeps the stored
+	// value; sending "" clears it.
+	Barcode *string `json:"barcode"`
+
+	// Tags are freeform merchandising labels. Omitting them on PUT keeps
+	// the stored tags; sending [] clears them.
+	Tags []string `json:"tags"`
+
+	// Sale pricing, scheduled through /products/{id}/sale and ignored on
+	// the product endpoints. EffectivePrice is what a customer pays right
+	// now: the sale price while the sale runs, the regular price otherwise.
+	SalePriceCents      *int64     `json:"sale_price_cents"`
+	SaleStartsAt        *time.Time `json:"sale_starts_at"`
+	SaleEndsAt          *time.Time `json:"sale_ends_at"`
+	EffectivePrice      float64    `json:"effective_price"`
+	EffectivePriceCents int64      `json:"effective_price_cents"`
+
+	// Purchasing data. Omitting a field on PUT keeps its stored value.
+	SupplierName    *string `json:"supplier_name"`
+	SupplierContact *string `json:"supplier_contact"`
+	ReorderPoint    *int    `json:"reorder_point"`
+	ReorderQuantity *int    `json:"reorder_quantity"`
+}
+
+// productColumns is the column list scanProduct expects, in order.
+const productColumns = "id, name, description, price, currency, stock, images, created_at, archived_at, barcode, tags, " +
+	"sale_price, sale_starts_at, sale_ends_at, " + reorderColumns
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx.
+type dbExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func scanProduct(row rowScanner, p *Product) error {
+	var rp reorderPolicy
+	var barcode sql.NullString
+	var salePrice nullCentsColumn
+	err := row.Scan(append([]interface{}{&p.ID, &p.Name, &p.Description, (*centsColumn)(&p.PriceCents), &p.Currency,
+		&p.Stock, (*imageList)(&p.Images), &p.CreatedAt, &p.ArchivedAt, &barcode, pq.Array(&p.Tags),
+		&salePrice, &p.SaleStartsAt, &p.SaleEndsAt}, rp.dest()...)...)
+	p.Tags = nonNilTags(p.Tags)
+	p.Price = centsToFloat(p.PriceCents)
+	p.SalePriceCents = nil
+	if salePrice.Valid {
+		p.SalePriceCents = &salePrice.Cents
+	}
+	p.setEffectivePrice(time.Now())
+	p.Barcode = nil
+	if barcode.Valid {
+		p.Barcode = &barcode.String
+	}
+	p.setReorderPolicy(rp)
+	return err
+}
+
+// validateProduct checks the client-supplied fields of a product after
+// normalizePrice has run.
+func validateProduct(p *Product) error {
+	if err := validatePrice(p.PriceCents, p.Currency); err != nil {
+		return err
+	}
+	if err := validateReorderPolicy(p); err != nil {
+		return err
+	}
+	if p.Barcode != nil && *p.Barcode != "" {
+		if err := validateBarcode(*p.Barcode); err != nil {
+			return err
+		}
+	}
+	if err := validateTags(p.Tags); err != nil {
+		return err
+	}
+	return validateImages(p.Images)
 }
 
 // Prometheus metrics
@@ -53,6 +144,12 @@ var (
 			Buckets: prometheus.DefBuckets,
 		},
 	)
+	panicsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "inventory_panics_total",
+			Help: "Panics recovered while serving requests",
+		},
+	)
 	stockLevels = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "inventory_stock_levels",
@@ -64,8 +161,66 @@ var (
 
 var db *sql.DB
 var kafkaWriter *kafka.Writer
+var cache productCache = noopCache{}
+
+// productStore is the database the product handlers run against.
+// sqlStore adapts a *sql.DB to it; tests wrap a sqlmock one or fake it.
+type productStore interface {
+	dbExecutor
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (storeTx, error)
+}
+
+// storeTx is a transaction begun on a productStore. *sql.Tx satisfies it.
+type storeTx interface {
+	dbExecutor
+	Commit() error
+	Rollback() error
+}
+
+// sqlStore is the productStore backed by a *sql.DB.
+type sqlStore struct {
+	*sql.DB
+}
+
+func (s sqlStore) BeginTx(ctx context.Context, opts *sql.TxOptions) (storeTx, error) {
+	tx, err := s.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// eventPublisher publishes inventory events to Kafka, falling back to the
+// outbox.
+type eventPublisher interface {
+	Publish(event map[string]interface{})
+}
+
+// defaultPublisher publishes through publishEvent.
+type defaultPublisher struct{}
+
+func (defaultPublisher) Publish(event map[string]interface{}) { publishEvent(event) }
+
+// productHandlers serves the /products endpoints, their stock, variants
+// and images, from store, with reads through cache and changes published
+// to events.
+type productHandlers struct {
+	store  productStore
+	events eventPublisher
+	cache  productCache
+}
+
+func newProductHandlers(store productStore, events eventPublisher, cache productCache) *productHandlers {
+	return &productHandlers{store: store, events: events, cache: cache}
+}
+
+// shuttingDown flips at the start of shutdown so load balancers stop
+// routing new traffic while in-flight requests drain.
+var shuttingDown atomic.Bool
 
 func main() {
+	initLogger()
+
 	// Database connection
 	dbHost := getEnv("DB_HOST", "localhost")
 	dbPort := getEnv("DB_PORT", "5432")
@@ -73,15 +228,18 @@ func main() {
 	dbPassword := getEnv("DB_PASSWORD", "postgres")
 	dbName := getEnv("DB_NAME", "inventory_db")
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPassword, dbName)
+	// statement_timeout bounds every query server-side, even if the client
+	// side context is never cancelled.
+	statementTimeout := getEnv("DB_STATEMENT_TIMEOUT_MS", "5000")
+
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable statement_timeout=%s",
+		dbHost, dbPort, dbUser, dbPassword, dbName, statementTimeout)
 
 	var err error
 	db, err = sql.Open("postgres", connStr)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
-	defer db.Close()
 
 	// Wait for database to be ready
 	for i := 0; i < 30; i++ {
@@ -99,46 +257,146 @@ func main() {
 	// Initialize database schema
 	initDB()
 
+	// Product read cache
+	cache = newProductCache()
+
+	// Periodically rebuild stock gauges from the database
+	gaugeInterval, err := time.ParseDuration(getEnv("STOCK_GAUGE_REFRESH_INTERVAL", "5m"))
+	if err != nil {
+		log.Fatal("Invalid STOCK_GAUGE_REFRESH_INTERVAL:", err)
+	}
+	// Handle graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		log.Println("Shutting down gracefully...")
+		shuttingDown.Store(true)
+		cancel()
+	}()
+
+	go refreshStockGaugesLoop(ctx, gaugeInterval)
+	go publishSaleTransitionsLoop(ctx, saleCheckInterval)
+	go snapshotLoop(ctx, snapshotInterval)
+
 	// Kafka producer
 	kafkaBroker := getEnv("KAFKA_BROKER", "localhost:9092")
 	kafkaWriter = &kafka.Writer{
 		Addr:     kafka.TCP(kafkaBroker),
 		Topic:    "inventory-events",
 		Balancer: &kafka.LeastBytes{},
+		// Retries are handled by writeWithRetry so failures can be
+		// counted and sent to the outbox.
+		MaxAttempts: 1,
+	}
+	eventWriter = kafkaWriter
+	go replayOutboxLoop(ctx, outboxReplayInterval)
+	readinessChecks = []readinessCheck{
+		{Name: "database", Hard: true, Check: pingDatabase},
+		{Name: "kafka", Hard: true, Check: kafkaBrokerCheck(kafkaBroker)},
 	}
-	defer kafkaWriter.Close()
 
 	// HTTP router
+	requestTimeout, err := time.ParseDuration(getEnv("REQUEST_TIMEOUT", "10s"))
+	if err != nil {
+		log.Fatal("Invalid REQUEST_TIMEOUT:", err)
+	}
+
+	products := newProductHandlers(sqlStore{db}, defaultPublisher{}, cache)
+
 	router := mux.NewRouter()
+	// Outermost, so a panic anywhere below still gets a 500 carrying the
+	// request id requestLoggingMiddleware sets.
+	router.Use(httpx.Recover(httpx.RecoverOptions{RequestIDHeader: "X-Request-ID", Panics: panicsTotal}))
+	router.Use(requestLoggingMiddleware)
 	router.Use(metricsMiddleware)
-
-	router.HandleFunc("/products", getProducts).Methods("GET")
-	router.HandleFunc("/products/{id}", getProduct).Methods("GET")
-	router.HandleFunc("/products", createProduct).Methods("POST")
-	router.HandleFunc("/products/{id}", updateProduct).Methods("PUT")
-	router.HandleFunc("/products/{id}", deleteProduct).Methods("DELETE")
+	router.Use(authMiddleware(loadAuthConfig()))
+	router.Use(timeoutMiddleware(requestTimeout))
+
+	router.HandleFunc("/products", products.getProducts).Methods("GET")
+	router.HandleFunc("/products/reorder-suggestions", products.getReorderSuggestions).Methods("GET")
+	router.HandleFunc("/products/export", products.exportProducts).Methods("GET")
+	router.HandleFunc("/products/barcode/{code}", getProductByBarcode).Methods("GET")
+	router.HandleFunc("/products/{id}", products.getProduct).Methods("GET")
+	router.HandleFunc("/products", products.createProduct).Methods("POST")
+	router.HandleFunc("/products/bulk", products.createProductsBulk).Methods("POST")
+	router.HandleFunc("/products/{id}", products.updateProduct).Methods("PUT")
+	router.HandleFunc("/products/{id}", products.deleteProduct).Methods("DELETE")
+	router.HandleFunc("/products/{id}/images", products.patchProductImages).Methods("PATCH")
+	router.HandleFunc("/products/{id}/stock", getProductStock).Methods("GET")
+	router.HandleFunc("/products/{id}/stock", products.adjustStock).Methods("POST")
+	router.HandleFunc("/products/{id}/stock", products.setStock).Methods("PUT")
+	router.HandleFunc("/products/{id}/restock", products.restockProduct).Methods("POST")
+	router.HandleFunc("/products/{id}/sale", setSale).Methods("PUT")
+	router.HandleFunc("/products/{id}/sale", deleteSale).Methods("DELETE")
+	router.HandleFunc("/products/{id}/price-history", getPriceHistory).Methods("GET")
+	router.HandleFunc("/products/{id}/stock-history", getStockHistory).Methods("GET")
+	router.HandleFunc("/products/{id}/variants", products.getVariants).Methods("GET")
+	router.HandleFunc("/products/{id}/variants", products.createVariant).Methods("POST")
+	router.HandleFunc("/products/{id}/variants/{variantId}", products.getVariant).Methods("GET")
+	router.HandleFunc("/products/{id}/variants/{variantId}", products.updateVariant).Methods("PUT")
+	router.HandleFunc("/products/{id}/variants/{variantId}", products.deleteVariant).Methods("DELETE")
+	router.HandleFunc("/snapshots", getSnapshots).Methods("GET")
+	router.HandleFunc("/snapshots", createSnapshot).Methods("POST")
+	router.HandleFunc("/snapshots/{date}", getSnapshot).Methods("GET")
+	router.HandleFunc("/warehouses", getWarehouses).Methods("GET")
+	router.HandleFunc("/warehouses", createWarehouse).Methods("POST")
 	router.HandleFunc("/health", healthCheck).Methods("GET")
+	router.HandleFunc("/readyz", readinessCheckHandler).Methods("GET")
 	router.Handle("/metrics", promhttp.Handler())
 
 	port := getEnv("PORT", "8081")
 	log.Printf("Inventory Service starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	// Give load balancers a moment to observe the failing readiness check
+	// before the listener closes.
+	if delay, err := time.ParseDuration(getEnv("SHUTDOWN_DELAY", "2s")); err == nil {
+		time.Sleep(delay)
+	}
+	log.Println("Stopping HTTP server...")
+
+	// Let in-flight requests (and the events they publish) finish.
+	drainTimeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "15s"))
+	if err != nil {
+		drainTimeout = 15 * time.Second
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+
+	// Flush buffered Kafka writes before the database goes away.
+	backgroundEvents.Wait()
+	if err := kafkaWriter.Close(); err != nil {
+		log.Printf("Failed to close Kafka writer: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	log.Println("Inventory Service stopped")
 }
 
 func initDB() {
-	schema := `
-	CREATE TABLE IF NOT EXISTS products (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(255) NOT NULL,
-		description TEXT,
-		price DECIMAL(10, 2) NOT NULL,
-		stock INTEGER NOT NULL DEFAULT 0,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	_, err := db.Exec(schema)
-	if err != nil {
-		log.Fatal("Failed to create schema:", err)
+	if err := runMigrations(context.Background(), db, migrationFiles); err != nil {
+		log.Fatal("Failed to apply database migrations: ", err)
 	}
 	log.Println("Database schema initialized")
 }
@@ -158,6 +416,25 @@ func metricsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// streamingPaths set their own deadline instead of REQUEST_TIMEOUT.
+var streamingPaths = map[string]bool{"/products/export": true}
+
+// timeoutMiddleware bounds the request context so database calls made with
+// r.Context() are cancelled once the deadline passes or the client leaves.
+func timeoutMiddleware(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if streamingPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -168,10 +445,29 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-func getProducts(w http.ResponseWriter, r *http.Request) {
+// Unwrap lets http.ResponseController reach the underlying writer, e.g.
+// to flush a streamed export.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (h *productHandlers) getProducts(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	rows, err := db.Query("SELECT id, name, description, price, stock, created_at FROM products ORDER BY id")
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// In cursor mode fetch one extra row to learn whether there is a next
+	// page.
+	queryFilter := filter
+	if filter.Cursor != nil {
+		queryFilter.Limit++
+	}
+	query, args := queryFilter.sql()
+	rows, err := h.store.QueryContext(r.Context(), query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -183,7 +479,7 @@ func getProducts(w http.ResponseWriter, r *http.Request) {
 	products := []Product{}
 	for rows.Next() {
 		var p Product
-		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.CreatedAt)
+		err := scanProduct(rows, &p)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -191,18 +487,38 @@ func getProducts(w http.ResponseWriter, r *http.Request) {
 		products = append(products, p)
 	}
 
+	if filter.IDs != nil {
+		products = orderProductsByIDs(products, filter.IDs)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	if filter.Cursor != nil {
+		page := productPage{Products: products}
+		if len(products) > filter.Limit {
+			page.Products = products[:filter.Limit]
+			next := encodeCursor(productCursor{Sort: "id", AfterID: int64(page.Products[filter.Limit-1].ID)})
+			page.NextCursor = &next
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
 	json.NewEncoder(w).Encode(products)
 }
 
-func getProduct(w http.ResponseWriter, r *http.Request) {
+func (h *productHandlers) getProduct(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	if cached, ok := h.cache.Get(r.Context(), id); ok {
+		cached.setEffectivePrice(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cached)
+		return
+	}
+
 	var p Product
-	err := db.QueryRow("SELECT id, name, description, price, stock, created_at FROM products WHERE id = $1", id).
-		Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.CreatedAt)
+	err := scanProduct(h.store.QueryRowContext(r.Context(), "SELECT "+productColumns+" FROM products WHERE id = $1", id), &p)
 
 	dbQueryDuration.Observe(time.Since(start).Seconds())
 
@@ -215,13 +531,20 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stockLevels.WithLabelValues(strconv.Itoa(p.ID), p.Name).Set(float64(p.Stock))
+	p.Variants, err = loadVariants(r.Context(), h.store, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setProductGauges(id, &p)
+	h.cache.Set(r.Context(), id, &p)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(p)
 }
 
-func createProduct(w http.ResponseWriter, r *http.Request) {
+func (h *productHandlers) createProduct(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	var p Product
 
@@ -229,14 +552,33 @@ func createProduct(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if p.Images == nil {
+		p.Images = []string{}
+	}
+	p.Tags = nonNilTags(normalizeTags(p.Tags))
+	normalizePrice(&p)
+	dropSaleFields(&p)
+	normalizeBarcode(&p)
+	if err := validateProduct(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err := db.QueryRow(
-		"INSERT INTO products (name, description, price, stock) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
-		p.Name, p.Description, p.Price, p.Stock,
+	rp := p.reorderPolicy()
+	p.setReorderPolicy(rp)
+	err := h.store.QueryRowContext(r.Context(), withDefaultWarehouseStock(
+		`INSERT INTO products (name, description, price, currency, stock, images, barcode, tags, `+reorderColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id, created_at, stock`),
+		p.Name, p.Description, centsColumn(p.PriceCents), p.Currency, p.Stock, imageList(p.Images), barcodeValue(p.Barcode), pq.Array(p.Tags),
+		rp.ReorderPoint, rp.ReorderQuantity, rp.SupplierName, rp.SupplierContact,
 	).Scan(&p.ID, &p.CreatedAt)
 
 	dbQueryDuration.Observe(time.Since(start).Seconds())
 
+	if isUniqueViolation(err) {
+		http.Error(w, "Barcode already exists", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -244,22 +586,25 @@ func createProduct(w http.ResponseWriter, r *http.Request) {
 
 	// Publish event to Kafka
 	event := map[string]interface{}{
-		"event_type": "product_created",
-		"product_id": p.ID,
-		"name":       p.Name,
-		"stock":      p.Stock,
-		"timestamp":  time.Now().Unix(),
+		"event_type":    "product_created",
+		"product_id":    p.ID,
+		"name":          p.Name,
+		"stock":         p.Stock,
+		"primary_image": primaryImage(p.Images),
+		"tags":          p.Tags,
+		"timestamp":     time.Now().Unix(),
 	}
-	publishEvent(event)
+	h.events.Publish(event)
 
-	stockLevels.WithLabelValues(strconv.Itoa(p.ID), p.Name).Set(float64(p.Stock))
+	setProductGauges(strconv.Itoa(p.ID), &p)
+	loggerFrom(r.Context()).Info("product created", "product_id", p.ID, "stock", p.Stock)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(p)
 }
 
-func updateProduct(w http.ResponseWriter, r *http.Request) {
+func (h *productHandlers) updateProduct(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -269,59 +614,169 @@ func updateProduct(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	p.Tags = normalizeTags(p.Tags)
+	normalizePrice(&p)
+	dropSaleFields(&p)
+	normalizeBarcode(&p)
+	if err := validateProduct(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	result, err := db.Exec(
-		"UPDATE products SET name = $1, description = $2, price = $3, stock = $4 WHERE id = $5",
-		p.Name, p.Description, p.Price, p.Stock, id,
-	)
-
-	dbQueryDuration.Observe(time.Since(start).Seconds())
+	// Omitting images keeps the stored list; sending [] clears it.
+	var images interface{}
+	if p.Images != nil {
+		images = imageList(p.Images)
+	}
 
+	tx, err := h.store.BeginTx(r.Context(), nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	// Lock the row so the previous values we compare against can't change
+	// underneath us before the update lands.
+	var before Product
+	err = scanProduct(tx.QueryRowContext(r.Context(), "SELECT "+productColumns+" FROM products WHERE id = $1 FOR UPDATE", id), &before)
+	if err == sql.ErrNoRows {
 		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Barcode == nil {
+		p.Barcode = before.Barcode
+	} else if *p.Barcode == "" {
+		p.Barcode = nil
+	}
+	if p.Tags == nil {
+		p.Tags = before.Tags
+	}
+	if before.SalePriceCents != nil && p.PriceCents <= *before.SalePriceCents {
+		http.Error(w, "price must stay above the sale price; remove the sale first", http.StatusBadRequest)
+		return
+	}
 
-	// Publish event to Kafka
+	// Products with variants keep stock as the sum over their variants, so
+	// the requested stock only applies to products without any.
+	var rp reorderPolicy
+	err = tx.QueryRowContext(r.Context(),
+		`UPDATE products SET name = $1, description = $2, price = $3, currency = $7, images = COALESCE($5, images),
+			stock = CASE WHEN EXISTS (SELECT 1 FROM product_variants WHERE product_id = $6)
+				THEN (SELECT SUM(stock) FROM product_variants WHERE product_id = $6)
+				ELSE $4 END,
+			reorder_point = COALESCE($8, reorder_point), reorder_quantity = COALESCE($9, reorder_quantity),
+			supplier_name = COALESCE($10, supplier_name), supplier_contact = COALESCE($11, supplier_contact),
+			barcode = $12, tags = $13
+		WHERE id = $6 RETURNING images, stock, `+reorderColumns,
+		p.Name, p.Description, centsColumn(p.PriceCents), p.Stock, images, id, p.Currency,
+		p.ReorderPoint, p.ReorderQuantity, p.SupplierName, p.SupplierContact, barcodeValue(p.Barcode), pq.Array(p.Tags),
+	).Scan(append([]interface{}{(*imageList)(&p.Images), &p.Stock}, rp.dest()...)...)
+
+	// A changed stock level lands in the default warehouse, so products
+	// stocked in a single location behave as before.
+	var warehouse warehouseLevel
+	if err == nil && p.Stock != before.Stock {
+		warehouse, err = adjustWarehouseStock(r.Context(), tx, id, defaultWarehouseID, p.Stock-before.Stock)
+		if err == errStockRejected {
+			http.Error(w, "Stock is held in other warehouses; use PUT /products/{id}/stock with a warehouse_id", http.StatusConflict)
+			return
+		}
+	}
+	if err == nil {
+		err = recordPriceChange(r.Context(), tx, id, &before, &p)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	if isUniqueViolation(err) {
+		http.Error(w, "Barcode already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.cache.Invalidate(r.Context(), id)
+	p.setReorderPolicy(rp)
+	previousStock := before.Stock
+	changedFields, changes := productChanges(&before, &p)
+
+	// Publish event to Kafka. name, stock and primary_image are the
+	// pre-changes flat fields, kept for consumers that haven't moved to
+	// changes yet.
 	event := map[string]interface{}{
-		"event_type": "product_updated",
-		"product_id": id,
-		"name":       p.Name,
-		"stock":      p.Stock,
-		"timestamp":  time.Now().Unix(),
+		"event_type":     "product_updated",
+		"product_id":     id,
+		"name":           p.Name,
+		"stock":          p.Stock,
+		"primary_image":  primaryImage(p.Images),
+		"tags":           p.Tags,
+		"changed_fields": changedFields,
+		"changes":        changes,
+		"timestamp":      time.Now().Unix(),
+	}
+	if p.PriceCents != before.PriceCents {
+		event["price_delta_cents"] = p.PriceCents - before.PriceCents
 	}
-	publishEvent(event)
+	h.events.Publish(event)
 
-	// Check for low stock
-	if p.Stock < 10 {
-		lowStockEvent := map[string]interface{}{
-			"event_type": "low_stock_alert",
-			"product_id": id,
-			"name":       p.Name,
-			"stock":      p.Stock,
-			"timestamp":  time.Now().Unix(),
-		}
-		publishEvent(lowStockEvent)
+	loggerFrom(r.Context()).Info("product updated",
+		"product_id", id, "changed_fields", changedFields, "previous_stock", previousStock, "stock", p.Stock)
+	change := stockChange{
+		ProductID: id, Name: p.Name, Previous: previousStock, Current: p.Stock,
+		Reorder: &rp, ParentPrevious: previousStock, ParentCurrent: p.Stock,
 	}
+	if lowStockScope == "warehouse" && p.Stock != previousStock {
+		change.WarehouseID, change.Threshold = defaultWarehouseID, warehouse.Threshold
+		change.Previous, change.Current = warehouse.Stock-(p.Stock-previousStock), warehouse.Stock
+	}
+	publishStockThresholdEvents(h.events, change)
 
-	stockLevels.WithLabelValues(id, p.Name).Set(float64(p.Stock))
+	setProductGauges(id, &p)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Product updated successfully"})
 }
 
-func deleteProduct(w http.ResponseWriter, r *http.Request) {
+// deleteProduct removes a product unless order-service still has open
+// orders for it, in which case it answers 409 with the count. With
+// ?force=true such a product is archived instead: hidden from listings
+// but still readable by id so existing orders keep resolving.
+func (h *productHandlers) deleteProduct(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	vars := mux.Vars(r)
 	id := vars["id"]
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
 
-	result, err := db.Exec("DELETE FROM products WHERE id = $1", id)
+	openOrders, err := countOpenOrders(r.Context(), id)
+	if err != nil {
+		loggerFrom(r.Context()).Error("open order check failed", "product_id", id, "error", err)
+		http.Error(w, "Unable to verify open orders: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if openOrders > 0 {
+		if !force {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       "Product is referenced by open orders; use ?force=true to archive it",
+				"open_orders": openOrders,
+			})
+			return
+		}
+		h.archiveProduct(w, r, id, openOrders)
+		return
+	}
+
+	result, err := h.store.ExecContext(r.Context(), "DELETE FROM products WHERE id = $1", id)
 	dbQueryDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
@@ -334,6 +789,9 @@ func deleteProduct(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
+	h.cache.Invalidate(r.Context(), id)
+	clearStockGauge(id)
+	loggerFrom(r.Context()).Info("product deleted", "product_id", id)
 
 	// Publish event to Kafka
 	event := map[string]interface{}{
@@ -341,14 +799,55 @@ func deleteProduct(w http.ResponseWriter, r *http.Request) {
 		"product_id": id,
 		"timestamp":  time.Now().Unix(),
 	}
-	publishEvent(event)
+	h.events.Publish(event)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Product deleted successfully"})
 }
 
+func (h *productHandlers) archiveProduct(w http.ResponseWriter, r *http.Request, id string, openOrders int) {
+	start := time.Now()
+	result, err := h.store.ExecContext(r.Context(),
+		"UPDATE products SET archived_at = COALESCE(archived_at, CURRENT_TIMESTAMP) WHERE id = $1", id)
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	h.cache.Invalidate(r.Context(), id)
+	clearStockGauge(id)
+	loggerFrom(r.Context()).Info("product archived", "product_id", id, "open_orders", openOrders)
+
+	h.events.Publish(map[string]interface{}{
+		"event_type":  "product_archived",
+		"product_id":  id,
+		"open_orders": openOrders,
+		"timestamp":   time.Now().Unix(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Product archived",
+		"open_orders": openOrders,
+	})
+}
+
+// healthCheck is the liveness probe. It deliberately ignores Kafka; see
+// readinessCheckHandler for the full dependency check.
 func healthCheck(w http.ResponseWriter, r *http.Request) {
-	err := db.Ping()
+	if shuttingDown.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "shutting_down"})
+		return
+	}
+
+	err := db.PingContext(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{"status": "unhealthy", "error": err.Error()})
@@ -359,21 +858,14 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
-func publishEvent(event map[string]interface{}) {
+var publishEvent = func(event map[string]interface{}) {
 	data, err := json.Marshal(event)
 	if err != nil {
-		log.Printf("Failed to marshal event: %v", err)
+		slog.Error("failed to marshal event", "event_type", event["event_type"], "error", err)
 		return
 	}
-
-	err = kafkaWriter.WriteMessages(context.Background(), kafka.Message{
-		Value: data,
-	})
-	if err != nil {
-		log.Printf("Failed to publish event to Kafka: %v", err)
-	} else {
-		log.Printf("Published event: %s", string(data))
-	}
+	eventType, _ := event["event_type"].(string)
+	deliverEvent(eventType, event["product_id"], data)
 }
 
 func getEnv(key, defaultValue string) string {
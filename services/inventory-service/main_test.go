@@ -1,15 +1,60 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
 )
 
+// newProductRows returns mock rows with the columns scanProduct expects.
+func newProductRows() *sqlmock.Rows {
+	return sqlmock.NewRows(strings.Split(productColumns, ", "))
+}
+
+// reorderRows returns rows for a RETURNING clause that ends in
+// reorderColumns; pair with noReorder for the values.
+func reorderRows(columns ...string) *sqlmock.Rows {
+	return sqlmock.NewRows(append(columns, strings.Split(reorderColumns, ", ")...))
+}
+
+// noReorder appends the values of a product without purchasing data.
+func noReorder(values ...driver.Value) []driver.Value {
+	return append(values, nil, 0, "", "")
+}
+
+// productRow returns values for one product in productColumns order.
+func productRow(id int, name, description string, price float64, stock int) []driver.Value {
+	return []driver.Value{id, name, description, price, "USD", stock, `[]`, time.Now(), nil, nil, "{}", nil, nil, nil, nil, 0, "", ""}
+}
+
+// recordedEvents is an eventPublisher that keeps what it is given.
+type recordedEvents []map[string]interface{}
+
+func (e *recordedEvents) Publish(event map[string]interface{}) { *e = append(*e, event) }
+
+// discardEvents is an eventPublisher that drops what it is given, for
+// tests that publish from many goroutines.
+type discardEvents struct{}
+
+func (discardEvents) Publish(map[string]interface{}) {}
+
+// newTestProducts returns product handlers over q, without a cache, and
+// the events they publish.
+func newTestProducts(q *sql.DB) (*productHandlers, *recordedEvents) {
+	events := &recordedEvents{}
+	return newProductHandlers(sqlStore{q}, events, noopCache{}), events
+}
+
 func BenchmarkGetProducts(b *testing.B) {
 	// Create a new mock database
 	mockDB, mock, err := sqlmock.New()
@@ -17,11 +62,7 @@ func BenchmarkGetProducts(b *testing.B) {
 		b.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	defer mockDB.Close()
-
-	// Replace the global db variable with the mock
-	oldDB := db
-	db = mockDB
-	defer func() { db = oldDB }()
+	handlers, _ := newTestProducts(mockDB)
 
 	// Prepare the request
 	req, _ := http.NewRequest("GET", "/products", nil)
@@ -31,17 +72,17 @@ func BenchmarkGetProducts(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
 		// Create rows for the mock - we need fresh rows for each iteration as they are consumed
-		rows := sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "created_at"})
+		rows := newProductRows()
 		for j := 0; j < 1000; j++ {
-			rows.AddRow(j, fmt.Sprintf("Product %d", j), "Description", 10.0, 100, time.Now())
+			rows.AddRow(productRow(j, fmt.Sprintf("Product %d", j), "Description", 10.0, 100)...)
 		}
 
-		mock.ExpectQuery("SELECT id, name, description, price, stock, created_at FROM products ORDER BY id").
+		mock.ExpectQuery("SELECT (.+) FROM products WHERE archived_at IS NULL ORDER BY id").
 			WillReturnRows(rows)
 		b.StartTimer()
 
 		w := httptest.NewRecorder()
-		getProducts(w, req)
+		handlers.getProducts(w, req)
 
 		// Verify expectations were met (optional, but good sanity check)
 		// if err := mock.ExpectationsWereMet(); err != nil {
@@ -57,22 +98,18 @@ func TestGetProducts(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	defer mockDB.Close()
+	handlers, _ := newTestProducts(mockDB)
 
-	// Replace the global db variable with the mock
-	oldDB := db
-	db = mockDB
-	defer func() { db = oldDB }()
-
-	rows := sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "created_at"}).
-		AddRow(1, "Test Product", "Test Description", 10.0, 100, time.Now())
+	rows := newProductRows().
+		AddRow(productRow(1, "Test Product", "Test Description", 10.0, 100)...)
 
-	mock.ExpectQuery("SELECT id, name, description, price, stock, created_at FROM products ORDER BY id").
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE archived_at IS NULL ORDER BY id").
 		WillReturnRows(rows)
 
 	req, _ := http.NewRequest("GET", "/products", nil)
 	w := httptest.NewRecorder()
 
-	getProducts(w, req)
+	handlers.getProducts(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status OK, got %v", w.Code)
@@ -82,3 +119,273 @@ func TestGetProducts(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestGetProductsAbortsOnCancelledContext(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+	handlers, _ := newTestProducts(mockDB)
+
+	rows := newProductRows().
+		AddRow(productRow(1, "Test Product", "Test Description", 10.0, 100)...)
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE archived_at IS NULL ORDER BY id").
+		WillDelayFor(time.Second).
+		WillReturnRows(rows)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/products", nil)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	handlers.getProducts(w, req)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected query to be aborted by the context, took %v", elapsed)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500 for an aborted query, got %v", w.Code)
+	}
+}
+
+// handlerCase is one request against a product handler with the database
+// calls it is expected to make.
+type handlerCase struct {
+	name       string
+	method     string
+	body       string
+	setup      func(mock sqlmock.Sqlmock)
+	wantStatus int
+	wantEvents []string
+}
+
+// runHandlerCases runs each case against handler for product 1 (and
+// variant 2) with a fresh sqlmock database and recorded events.
+func runHandlerCases(t *testing.T, handler func(*productHandlers, http.ResponseWriter, *http.Request), cases []handlerCase) {
+	t.Helper()
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			handlers, events := newTestProducts(mockDB)
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest(tt.method, "/products/1", strings.NewReader(tt.body)), map[string]string{"id": "1", "variantId": "2"})
+			w := httptest.NewRecorder()
+			handler(handlers, w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got, want := strings.Join(eventTypes(*events), ","), strings.Join(tt.wantEvents, ","); got != want {
+				t.Errorf("expected events %q, got %q", want, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+var errDBDown = errors.New("connection refused")
+
+func TestGetProductsDatabaseFailure(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).getProducts, []handlerCase{
+		{
+			name:   "query fails",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products").WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestGetProduct(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).getProduct, []handlerCase{
+		{
+			name:   "found",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").
+					WithArgs("1").
+					WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, 5)...))
+				mock.ExpectQuery("SELECT (.+) FROM product_variants WHERE product_id = \\$1").
+					WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "not found",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").
+					WillReturnRows(newProductRows())
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "database failure",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "variant lookup fails",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").
+					WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, 5)...))
+				mock.ExpectQuery("SELECT (.+) FROM product_variants").WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestCreateProduct(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).createProduct, []handlerCase{
+		{
+			name:   "created",
+			method: "POST",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO products").
+					WithArgs("Widget", "d", "9.99", "USD", 5, sqlmock.AnyArg(), nil, "{}", nil, 0, "", "").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+			},
+			wantStatus: http.StatusCreated,
+			wantEvents: []string{"product_created"},
+		},
+		{
+			name:       "bad JSON",
+			method:     "POST",
+			body:       `{"name":`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid price",
+			method:     "POST",
+			body:       `{"name":"Widget","price":-1}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "database failure",
+			method: "POST",
+			body:   `{"name":"Widget","price":9.99}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO products").WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestUpdateProduct(t *testing.T) {
+	const body = `{"name":"Widget","description":"d","price":12.5,"stock":5}`
+	runHandlerCases(t, (*productHandlers).updateProduct, []handlerCase{
+		{
+			name:   "updated",
+			method: "PUT",
+			body:   body,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WithArgs("1").
+					WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, 5)...))
+				mock.ExpectQuery("UPDATE products SET").
+					WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 5)...))
+				mock.ExpectExec("INSERT INTO price_history").
+					WithArgs("1", "9.99", "12.50", "USD", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"product_updated"},
+		},
+		{
+			name:       "bad JSON",
+			method:     "PUT",
+			body:       `not json`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "negative price",
+			method:     "PUT",
+			body:       `{"name":"Widget","price":-1}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "not found",
+			method: "PUT",
+			body:   body,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows())
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "update fails",
+			method: "PUT",
+			body:   body,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, 5)...))
+				mock.ExpectQuery("UPDATE products SET").WillReturnError(errDBDown)
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "cannot begin transaction",
+			method: "PUT",
+			body:   body,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin().WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestDeleteProduct(t *testing.T) {
+	fakeOrderService(t, 0, http.StatusOK)
+	runHandlerCases(t, (*productHandlers).deleteProduct, []handlerCase{
+		{
+			name:   "not found",
+			method: "DELETE",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("DELETE FROM products WHERE id = \\$1").
+					WithArgs("1").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "database failure",
+			method: "DELETE",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("DELETE FROM products WHERE id = \\$1").WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
@@ -0,0 +1,46 @@
+-- Baseline schema. Every statement is idempotent so databases created by
+-- the old initDB adopt the migration history cleanly.
+
+CREATE TABLE IF NOT EXISTS products (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	description TEXT,
+	price DECIMAL(10, 2) NOT NULL,
+	stock INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS images JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+CREATE TABLE IF NOT EXISTS product_variants (
+	id SERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+	sku VARCHAR(100) NOT NULL UNIQUE,
+	attributes JSONB NOT NULL DEFAULT '{}'::jsonb,
+	price_override DECIMAL(10, 2),
+	stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_product_variants_product_id ON product_variants(product_id);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+	id SERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+	variant_id INTEGER REFERENCES product_variants(id) ON DELETE SET NULL,
+	delta INTEGER NOT NULL,
+	reason VARCHAR(50) NOT NULL,
+	reference VARCHAR(255) NOT NULL DEFAULT '',
+	note TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_product_id ON stock_movements(product_id, created_at);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key VARCHAR(255) NOT NULL,
+	scope VARCHAR(255) NOT NULL,
+	response BYTEA,
+	status_code INTEGER,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (key, scope)
+);
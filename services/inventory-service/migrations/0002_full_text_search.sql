@@ -0,0 +1,22 @@
+-- tsvector column for GET /products?q=, maintained by trigger so every
+-- write path keeps it current.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION products_search_vector_update() RETURNS trigger AS $$
+BEGIN
+	NEW.search_vector :=
+		setweight(to_tsvector('english', coalesce(NEW.name, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(NEW.description, '')), 'B');
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_search_vector_trigger ON products;
+CREATE TRIGGER products_search_vector_trigger
+	BEFORE INSERT OR UPDATE OF name, description ON products
+	FOR EACH ROW EXECUTE FUNCTION products_search_vector_update();
+
+CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector);
+
+UPDATE products SET name = name WHERE search_vector IS NULL;
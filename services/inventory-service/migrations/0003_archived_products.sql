@@ -0,0 +1,5 @@
+-- Products that are still referenced by open orders are archived rather
+-- than deleted; archived products drop out of listings but stay readable
+-- by id.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
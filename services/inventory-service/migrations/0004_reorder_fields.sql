@@ -0,0 +1,10 @@
+-- Purchasing data for reorder suggestions. A NULL reorder_point means the
+-- product is never suggested for reordering.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS supplier_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS supplier_contact VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS reorder_point INTEGER CHECK (reorder_point >= 0);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS reorder_quantity INTEGER NOT NULL DEFAULT 0 CHECK (reorder_quantity >= 0);
+
+CREATE INDEX IF NOT EXISTS idx_products_reorder ON products (id)
+	WHERE reorder_point IS NOT NULL AND stock < reorder_point AND archived_at IS NULL;
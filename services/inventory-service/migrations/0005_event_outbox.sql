@@ -0,0 +1,13 @@
+-- Events that could not be delivered to Kafka after retries; the outbox
+-- replayer republishes them in id order.
+
+CREATE TABLE IF NOT EXISTS event_outbox (
+	id BIGSERIAL PRIMARY KEY,
+	event_type VARCHAR(100) NOT NULL,
+	payload JSONB NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	published_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_event_outbox_pending ON event_outbox(id) WHERE published_at IS NULL;
@@ -0,0 +1,6 @@
+-- Stock updates are conditional statements that refuse to go below zero;
+-- this constraint is the backstop for any write path that forgets to.
+-- NOT VALID keeps the migration from failing on rows that already went
+-- negative while still rejecting new negative writes.
+
+ALTER TABLE products ADD CONSTRAINT products_stock_non_negative CHECK (stock >= 0) NOT VALID;
@@ -0,0 +1,13 @@
+-- Every price change made through the API, written in the same
+-- transaction as the update so the history can't drift from the catalog.
+
+CREATE TABLE IF NOT EXISTS price_history (
+	id BIGSERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+	old_price DECIMAL(10, 2) NOT NULL,
+	new_price DECIMAL(10, 2) NOT NULL,
+	currency VARCHAR(3) NOT NULL,
+	changed_by VARCHAR(100) NOT NULL DEFAULT '',
+	changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_price_history_product ON price_history(product_id, changed_at DESC);
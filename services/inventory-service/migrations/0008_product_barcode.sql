@@ -0,0 +1,5 @@
+-- UPC/EAN barcodes for warehouse scanners. NULL means the product has no
+-- barcode; the unique index only covers products that do.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS barcode VARCHAR(13);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_products_barcode ON products(barcode) WHERE barcode IS NOT NULL;
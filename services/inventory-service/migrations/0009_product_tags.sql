@@ -0,0 +1,5 @@
+-- Freeform merchandising tags. GET /products?tag= filters with @>, which
+-- the GIN index serves.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS idx_products_tags ON products USING GIN (tags);
@@ -0,0 +1,36 @@
+-- Stock locations. A product without variants keeps one product_stock row
+-- per warehouse it is held in, and products.stock stays their sum so
+-- listings and orders keep reading a single number. Variant stock is not
+-- split by warehouse.
+--
+-- The default warehouse is pinned to id 1: stock changes that don't name
+-- a warehouse land there.
+
+CREATE TABLE IF NOT EXISTS warehouses (
+	id SERIAL PRIMARY KEY,
+	code VARCHAR(50) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL,
+	low_stock_threshold INTEGER CHECK (low_stock_threshold >= 0),
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO warehouses (id, code, name) VALUES (1, 'default', 'Default')
+ON CONFLICT (id) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('warehouses', 'id'), GREATEST((SELECT MAX(id) FROM warehouses), 1));
+
+CREATE TABLE IF NOT EXISTS product_stock (
+	product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+	warehouse_id INTEGER NOT NULL REFERENCES warehouses(id),
+	stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0),
+	PRIMARY KEY (product_id, warehouse_id)
+);
+
+-- Existing stock moves into the default warehouse. Rows that went
+-- negative before 0006 are clamped rather than failing the migration.
+INSERT INTO product_stock (product_id, warehouse_id, stock)
+SELECT p.id, 1, GREATEST(p.stock, 0) FROM products p
+WHERE NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id)
+ON CONFLICT (product_id, warehouse_id) DO NOTHING;
+
+ALTER TABLE stock_movements ADD COLUMN IF NOT EXISTS warehouse_id INTEGER REFERENCES warehouses(id);
+UPDATE stock_movements SET warehouse_id = 1 WHERE warehouse_id IS NULL AND variant_id IS NULL;
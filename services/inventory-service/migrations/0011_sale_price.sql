@@ -0,0 +1,13 @@
+-- Time-boxed sale pricing. Either bound may be left open. The bounds are
+-- TIMESTAMPTZ so a window sent with an offset starts when the client
+-- meant. sale_active is what the sale ticker last announced, so
+-- product_sale_started and product_sale_ended are published once per
+-- boundary.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sale_price DECIMAL(10, 2);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sale_starts_at TIMESTAMPTZ;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sale_ends_at TIMESTAMPTZ;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sale_active BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE products ADD CONSTRAINT products_sale_window
+	CHECK (sale_starts_at IS NULL OR sale_ends_at IS NULL OR sale_ends_at > sale_starts_at);
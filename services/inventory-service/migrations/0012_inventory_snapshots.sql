@@ -0,0 +1,23 @@
+-- Point-in-time stock valuations for finance. A snapshot is written in
+-- chunks, so readers only see it once completed_at is set. Items keep the
+-- product's name and have no foreign key: a snapshot has to outlive the
+-- products it lists.
+
+CREATE TABLE IF NOT EXISTS inventory_snapshots (
+	id BIGSERIAL PRIMARY KEY,
+	source VARCHAR(20) NOT NULL,
+	taken_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	completed_at TIMESTAMPTZ,
+	product_count INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_inventory_snapshots_taken_at ON inventory_snapshots(taken_at);
+
+CREATE TABLE IF NOT EXISTS inventory_snapshot_items (
+	snapshot_id BIGINT NOT NULL REFERENCES inventory_snapshots(id) ON DELETE CASCADE,
+	product_id INTEGER NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	stock INTEGER NOT NULL,
+	price DECIMAL(10, 2) NOT NULL,
+	currency VARCHAR(3) NOT NULL,
+	PRIMARY KEY (snapshot_id, product_id)
+);
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_later.sql":  {Data: []byte("SELECT 10")},
+		"migrations/0002_second.sql": {Data: []byte("SELECT 2")},
+		"migrations/0001_first.sql":  {Data: []byte("SELECT 1")},
+		"migrations/README":          {Data: []byte("ignored")},
+	}
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("loadMigrations: %s", err)
+	}
+	var got []int
+	for _, m := range migrations {
+		got = append(got, m.Version)
+	}
+	if fmt.Sprint(got) != "[1 2 10]" {
+		t.Errorf("expected versions [1 2 10], got %v", got)
+	}
+}
+
+func TestLoadMigrationsRejectsBadNames(t *testing.T) {
+	for name, fsys := range map[string]fstest.MapFS{
+		"no version": {"migrations/initial.sql": {Data: []byte("SELECT 1")}},
+		"duplicate": {
+			"migrations/0001_a.sql": {Data: []byte("SELECT 1")},
+			"migrations/1_b.sql":    {Data: []byte("SELECT 1")},
+		},
+	} {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("loadMigrations: %s", err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 {
+		t.Fatalf("expected embedded migrations starting at version 1, got %+v", migrations)
+	}
+}
+
+func TestRunMigrationsAppliesOnlyPending(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	fsys := fstest.MapFS{
+		"migrations/0001_first.sql":  {Data: []byte("CREATE TABLE first (id INT)")},
+		"migrations/0002_second.sql": {Data: []byte("CREATE TABLE second (id INT)")},
+	}
+
+	mock.ExpectExec("SELECT pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE second").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(2, "0002_second.sql").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := runMigrations(context.Background(), mockDB, fsys); err != nil {
+		t.Fatalf("runMigrations: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRunMigrationsReportsFailingMigration(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	fsys := fstest.MapFS{
+		"migrations/0001_broken.sql": {Data: []byte("CREATE TABLE broken (")},
+	}
+
+	mock.ExpectExec("SELECT pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE broken").WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = runMigrations(context.Background(), mockDB, fsys)
+	if err == nil || !strings.Contains(err.Error(), "0001_broken.sql") {
+		t.Fatalf("expected error naming the failing migration, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestMigrationsApplyToFreshDatabase runs the embedded migrations twice
+// against a scratch schema in a real Postgres. Set TEST_DATABASE_URL to
+// enable it.
+func TestMigrationsApplyToFreshDatabase(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer admin.Close()
+
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %s", err)
+	}
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	scoped, err := sql.Open("postgres", dsn+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatalf("open scoped: %s", err)
+	}
+	defer scoped.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := runMigrations(context.Background(), scoped, migrationFiles); err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+	}
+
+	embedded, _ := loadMigrations(migrationFiles)
+	var applied int
+	if err := scoped.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("count: %s", err)
+	}
+	if applied != len(embedded) {
+		t.Errorf("expected %d applied migrations, got %d", len(embedded), applied)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// supportedCurrencies lists the ISO 4217 codes products may be priced in.
+// Configured via SUPPORTED_CURRENCIES as a comma-separated list.
+var supportedCurrencies = loadSupportedCurrencies()
+
+const defaultCurrency = "USD"
+
+func loadSupportedCurrencies() map[string]bool {
+	currencies := map[string]bool{}
+	for _, c := range strings.Split(getEnv("SUPPORTED_CURRENCIES", "USD,EUR,GBP"), ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			currencies[c] = true
+		}
+	}
+	return currencies
+}
+
+// centsColumn converts between integer cents and a DECIMAL(10, 2) column
+// so the database schema can stay as it is.
+type centsColumn int64
+
+func (c centsColumn) Value() (driver.Value, error) {
+	sign := ""
+	v := int64(c)
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/100, v%100), nil
+}
+
+func (c *centsColumn) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return c.parse(string(v))
+	case string:
+		return c.parse(v)
+	case float64:
+		*c = centsColumn(math.Round(v * 100))
+		return nil
+	case int64:
+		*c = centsColumn(v * 100)
+		return nil
+	case nil:
+		*c = 0
+		return nil
+	default:
+		return fmt.Errorf("unsupported price column type %T", src)
+	}
+}
+
+// parse reads a decimal string exactly, without going through float64.
+func (c *centsColumn) parse(s string) error {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = (frac + "00")[:2]
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid price %q: %v", s, err)
+	}
+	hundredths, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid price %q: %v", s, err)
+	}
+	v := units*100 + hundredths
+	if negative {
+		v = -v
+	}
+	*c = centsColumn(v)
+	return nil
+}
+
+// nullCentsColumn is the nullable counterpart of centsColumn.
+type nullCentsColumn struct {
+	Cents int64
+	Valid bool
+}
+
+func (n *nullCentsColumn) Scan(src interface{}) error {
+	if src == nil {
+		n.Cents, n.Valid = 0, false
+		return nil
+	}
+	var c centsColumn
+	if err := c.Scan(src); err != nil {
+		return err
+	}
+	n.Cents, n.Valid = int64(c), true
+	return nil
+}
+
+func centsToFloat(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+func floatToCents(price float64) int64 {
+	return int64(math.Round(price * 100))
+}
+
+// normalizePrice reconciles the deprecated float price with price_cents.
+// price_cents wins when both are sent; the float is always re-derived so
+// responses stay consistent.
+func normalizePrice(p *Product) {
+	if p.PriceCents == 0 && p.Price != 0 {
+		p.PriceCents = floatToCents(p.Price)
+	}
+	p.Price = centsToFloat(p.PriceCents)
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	if p.Currency == "" {
+		p.Currency = defaultCurrency
+	}
+}
+
+func validatePrice(cents int64, currency string) error {
+	if cents < 0 {
+		return errors.New("price must not be negative")
+	}
+	if !supportedCurrencies[currency] {
+		return fmt.Errorf("unsupported currency %q", currency)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestCentsColumnRoundTrip(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want int64
+		text string
+	}{
+		{[]byte("19.99"), 1999, "19.99"},
+		{"0.10", 10, "0.10"},
+		{"5", 500, "5.00"},
+		{"-3.5", -350, "-3.50"},
+		{0.29, 29, "0.29"},
+	}
+	for _, tt := range tests {
+		var c centsColumn
+		if err := c.Scan(tt.src); err != nil {
+			t.Fatalf("Scan(%v): %v", tt.src, err)
+		}
+		if int64(c) != tt.want {
+			t.Errorf("Scan(%v) = %d, want %d", tt.src, c, tt.want)
+		}
+		v, _ := c.Value()
+		if v != tt.text {
+			t.Errorf("Value() = %v, want %s", v, tt.text)
+		}
+	}
+}
+
+func TestNormalizeAndValidatePrice(t *testing.T) {
+	p := Product{Price: 10.1}
+	normalizePrice(&p)
+	if p.PriceCents != 1010 || p.Currency != "USD" {
+		t.Errorf("expected 1010 USD, got %d %s", p.PriceCents, p.Currency)
+	}
+
+	p = Product{Price: 99, PriceCents: 1250, Currency: "eur"}
+	normalizePrice(&p)
+	if p.PriceCents != 1250 || p.Price != 12.5 || p.Currency != "EUR" {
+		t.Errorf("expected price_cents to win, got %+v", p)
+	}
+
+	if err := validatePrice(-1, "USD"); err == nil {
+		t.Error("expected negative amount to be rejected")
+	}
+	if err := validatePrice(100, "XYZ"); err == nil {
+		t.Error("expected unsupported currency to be rejected")
+	}
+	if err := validatePrice(100, "GBP"); err != nil {
+		t.Errorf("expected GBP to be accepted: %v", err)
+	}
+}
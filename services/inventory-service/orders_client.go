@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	orderServiceURL = getEnv("ORDER_SERVICE_URL", "http://order-service:8082")
+	orderClient     = &http.Client{Timeout: 5 * time.Second}
+)
+
+// countOpenOrders asks order-service how many non-terminal orders
+// reference the product.
+func countOpenOrders(ctx context.Context, productID string) (int, error) {
+	u := orderServiceURL + "/orders?open=true&product_id=" + url.QueryEscape(productID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	resp, err := orderClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+
+	var orders []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		return 0, err
+	}
+	return len(orders), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// fakeOrderService serves GET /orders with openOrders open orders for
+// any product, recording the query it was asked.
+func fakeOrderService(t *testing.T, openOrders int, status int) *string {
+	t.Helper()
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if status != http.StatusOK {
+			http.Error(w, "boom", status)
+			return
+		}
+		orders := make([]map[string]interface{}, openOrders)
+		for i := range orders {
+			orders[i] = map[string]interface{}{"id": i + 1, "status": "confirmed"}
+		}
+		json.NewEncoder(w).Encode(orders)
+	}))
+	t.Cleanup(srv.Close)
+
+	old := orderServiceURL
+	orderServiceURL = srv.URL
+	t.Cleanup(func() { orderServiceURL = old })
+	return &query
+}
+
+func TestDeleteProductOpenOrders(t *testing.T) {
+	tests := []struct {
+		name        string
+		openOrders  int
+		orderStatus int
+		url         string
+		expectSQL   string
+		wantCode    int
+		wantEvent   string
+	}{
+		{"no open orders deletes", 0, http.StatusOK, "/products/42", "DELETE FROM products WHERE id = \\$1", http.StatusOK, "product_deleted"},
+		{"open orders block delete", 3, http.StatusOK, "/products/42", "", http.StatusConflict, ""},
+		{"force archives", 3, http.StatusOK, "/products/42?force=true", "UPDATE products SET archived_at", http.StatusOK, "product_archived"},
+		{"order service down", 0, http.StatusInternalServerError, "/products/42?force=true", "", http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := fakeOrderService(t, tt.openOrders, tt.orderStatus)
+
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+			handlers, events := newTestProducts(mockDB)
+
+			if tt.expectSQL != "" {
+				mock.ExpectExec(tt.expectSQL).WithArgs("42").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req := mux.SetURLVars(httptest.NewRequest("DELETE", tt.url, nil), map[string]string{"id": "42"})
+			w := httptest.NewRecorder()
+			handlers.deleteProduct(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if !strings.Contains(*query, "product_id=42") || !strings.Contains(*query, "open=true") {
+				t.Errorf("unexpected order-service query %q", *query)
+			}
+			if tt.wantCode == http.StatusConflict {
+				var body map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &body)
+				if body["open_orders"] != float64(tt.openOrders) {
+					t.Errorf("expected open_orders %d in body, got %v", tt.openOrders, body)
+				}
+			}
+			got := strings.Join(eventTypes(*events), ",")
+			if got != tt.wantEvent {
+				t.Errorf("expected events %q, got %q", tt.wantEvent, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
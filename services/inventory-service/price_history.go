@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PriceChange is one row of GET /products/{id}/price-history.
+type PriceChange struct {
+	ID            int64     `json:"id"`
+	ProductID     int       `json:"product_id"`
+	OldPriceCents int64     `json:"old_price_cents"`
+	NewPriceCents int64     `json:"new_price_cents"`
+	Currency      string    `json:"currency"`
+	ChangedBy     string    `json:"changed_by"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// recordPriceChange writes a price_history row when an update changed the
+// price. It runs inside the update's transaction. changed_by is the API key
+// that made the request, or "" when auth is disabled.
+func recordPriceChange(ctx context.Context, q dbExecutor, id string, before, after *Product) error {
+	if before.PriceCents == after.PriceCents {
+		return nil
+	}
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO price_history (product_id, old_price, new_price, currency, changed_by)
+		VALUES ($1, $2, $3, $4, $5)`,
+		id, centsColumn(before.PriceCents), centsColumn(after.PriceCents), after.Currency, apiKeyIDFrom(ctx),
+	)
+	return err
+}
+
+// priceHistorySQL builds the SELECT for one product's price history,
+// newest first.
+func priceHistorySQL(productID string, f historyFilter) (string, []interface{}) {
+	args := []interface{}{productID}
+	where := append([]string{"product_id = $1"}, f.conditions("changed_at", &args)...)
+	query := `SELECT id, product_id, old_price, new_price, currency, changed_by, changed_at
+		FROM price_history WHERE ` + strings.Join(where, " AND ") +
+		" ORDER BY changed_at DESC, id DESC" + f.page(&args)
+	return query, args
+}
+
+// getPriceHistory lists a product's price changes, newest first, with
+// ?from=, ?to=, ?limit= and ?offset=.
+func getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	filter, err := parseHistoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", id).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	query, args := priceHistorySQL(id, filter)
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []PriceChange{}
+	for rows.Next() {
+		var c PriceChange
+		err := rows.Scan(&c.ID, &c.ProductID, (*centsColumn)(&c.OldPriceCents), (*centsColumn)(&c.NewPriceCents),
+			&c.Currency, &c.ChangedBy, &c.ChangedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, c)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestUpdateProductRecordsPriceChange(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, 5)...))
+	mock.ExpectQuery("UPDATE products SET").
+		WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 5)...))
+	mock.ExpectExec("INSERT INTO price_history \\(product_id, old_price, new_price, currency, changed_by\\)").
+		WithArgs("1", "9.99", "7.49", "USD", "pricing-bot").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	body := `{"name":"Widget","description":"d","price":7.49,"stock":5}`
+	req := mux.SetURLVars(httptest.NewRequest("PUT", "/products/1", strings.NewReader(body)), map[string]string{"id": "1"})
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyIDKey, "pricing-bot"))
+	w := httptest.NewRecorder()
+	handlers.updateProduct(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(*events) != 1 {
+		t.Fatalf("expected one event, got %v", eventTypes(*events))
+	}
+	if delta := (*events)[0]["price_delta_cents"]; delta != int64(-250) {
+		t.Errorf("expected price_delta_cents -250, got %v", delta)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPriceHistoryFilterSQL(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantSQL  string
+		wantArgs int
+		wantErr  bool
+	}{
+		{"", "WHERE product_id = $1 ORDER BY changed_at DESC, id DESC LIMIT $2", 2, false},
+		{"from=2024-05-01&to=2024-05-31&limit=10&offset=20",
+			"WHERE product_id = $1 AND changed_at >= $2 AND changed_at < $3 ORDER BY changed_at DESC, id DESC LIMIT $4 OFFSET $5", 5, false},
+		{"from=2024-05-01T12:00:00Z", "WHERE product_id = $1 AND changed_at >= $2 ORDER BY", 3, false},
+		{"from=yesterday", "", 0, true},
+		{"from=2024-06-01&to=2024-05-01", "", 0, true},
+		{"limit=0", "", 0, true},
+		{"offset=-1", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			f, err := parseHistoryFilter(values)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			query, args := priceHistorySQL("1", f)
+			if !strings.Contains(query, tt.wantSQL) {
+				t.Errorf("expected SQL containing %q, got %q", tt.wantSQL, query)
+			}
+			if len(args) != tt.wantArgs {
+				t.Errorf("expected %d args, got %v", tt.wantArgs, args)
+			}
+		})
+	}
+
+	// A plain ?to= date covers the whole day.
+	f, _ := parseHistoryFilter(url.Values{"to": {"2024-05-31"}})
+	if want := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC); !f.To.Equal(want) {
+		t.Errorf("expected to bound %v, got %v", want, f.To)
+	}
+}
+
+func TestGetPriceHistory(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	changedAt := time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM price_history WHERE product_id = \\$1 AND changed_at >= \\$2").
+		WithArgs("1", sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "old_price", "new_price", "currency", "changed_by", "changed_at"}).
+			AddRow(7, 1, "9.99", "7.49", "USD", "pricing-bot", changedAt))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/products/1/price-history?from=2024-05-01&limit=2", nil), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	getPriceHistory(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var history []PriceChange
+	json.NewDecoder(w.Body).Decode(&history)
+	if len(history) != 1 || history[0].OldPriceCents != 999 || history[0].NewPriceCents != 749 || history[0].ChangedBy != "pricing-bot" {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetPriceHistoryUnknownProduct(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	mock.ExpectQuery("SELECT EXISTS").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/products/9/price-history", nil), map[string]string{"id": "9"})
+	w := httptest.NewRecorder()
+	getPriceHistory(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "reflect"
+
+// fieldChange is the old and new value of one field in a product_updated
+// event.
+type fieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// productChanges compares a product before and after an update and
+// returns the JSON names of the fields that changed, in a stable order,
+// with their old and new values.
+func productChanges(before, after *Product) ([]string, map[string]fieldChange) {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"name", before.Name, after.Name},
+		{"description", before.Description, after.Description},
+		{"price_cents", before.PriceCents, after.PriceCents},
+		{"currency", before.Currency, after.Currency},
+		{"stock", before.Stock, after.Stock},
+		{"images", nonNilImages(before.Images), nonNilImages(after.Images)},
+		{"barcode", derefString(before.Barcode), derefString(after.Barcode)},
+		{"tags", nonNilTags(before.Tags), nonNilTags(after.Tags)},
+		{"supplier_name", derefString(before.SupplierName), derefString(after.SupplierName)},
+		{"supplier_contact", derefString(before.SupplierContact), derefString(after.SupplierContact)},
+		{"reorder_point", derefInt(before.ReorderPoint), derefInt(after.ReorderPoint)},
+		{"reorder_quantity", derefInt(before.ReorderQuantity), derefInt(after.ReorderQuantity)},
+	}
+
+	changed := []string{}
+	changes := map[string]fieldChange{}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.old, f.new) {
+			changed = append(changed, f.name)
+			changes[f.name] = fieldChange{Old: f.old, New: f.new}
+		}
+	}
+	return changed, changes
+}
+
+func nonNilImages(images []string) []string {
+	if images == nil {
+		return []string{}
+	}
+	return images
+}
+
+// derefString and derefInt turn optional fields into values that compare
+// and serialize cleanly; a nil *int stays nil (JSON null).
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func derefInt(n *int) interface{} {
+	if n == nil {
+		return nil
+	}
+	return *n
+}
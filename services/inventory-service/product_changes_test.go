@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestProductChanges(t *testing.T) {
+	point := 5
+	supplier := "Acme"
+	before := &Product{Name: "Widget", PriceCents: 1000, Currency: "USD", Stock: 3, Images: nil}
+	after := &Product{Name: "Widget", PriceCents: 1200, Currency: "USD", Stock: 3, Images: []string{},
+		ReorderPoint: &point, SupplierName: &supplier}
+
+	changed, changes := productChanges(before, after)
+	if want := []string{"price_cents", "supplier_name", "reorder_point"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("expected changed fields %v, got %v", want, changed)
+	}
+
+	data, _ := json.Marshal(changes)
+	want := `{"price_cents":{"old":1000,"new":1200},"reorder_point":{"old":null,"new":5},"supplier_name":{"old":"","new":"Acme"}}`
+	if string(data) != want {
+		t.Errorf("unexpected changes\n got: %s\nwant: %s", data, want)
+	}
+}
+
+func TestProductChangesNoop(t *testing.T) {
+	p := &Product{Name: "Widget", Images: []string{"https://img.test/a.png"}}
+	q := *p
+	q.Images = []string{"https://img.test/a.png"}
+	if changed, _ := productChanges(p, &q); len(changed) != 0 {
+		t.Errorf("expected no changes, got %v", changed)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxProductIDs bounds GET /products?ids= so a single request can't pull
+// the whole catalog through the lookup path.
+const maxProductIDs = 200
+
+// parseProductIDs parses a comma-separated list of positive product ids,
+// dropping duplicates but keeping the order of first appearance.
+func parseProductIDs(raw string) ([]int64, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, errors.New("ids must not be empty")
+	}
+
+	parts := strings.Split(raw, ",")
+	ids := make([]int64, 0, len(parts))
+	seen := make(map[int64]bool, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid product id %q", part)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) > maxProductIDs {
+		return nil, fmt.Errorf("too many ids: %d (max %d)", len(ids), maxProductIDs)
+	}
+	return ids, nil
+}
+
+// orderProductsByIDs returns products in the order their ids were
+// requested. Unknown ids are skipped.
+func orderProductsByIDs(products []Product, ids []int64) []Product {
+	byID := make(map[int64]Product, len(products))
+	for _, p := range products {
+		byID[int64(p.ID)] = p
+	}
+	ordered := make([]Product, 0, len(products))
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			ordered = append(ordered, p)
+		}
+	}
+	return ordered
+}
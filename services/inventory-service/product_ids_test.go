@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseProductIDs(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int
+		wantErr bool
+	}{
+		{"3,7,19", 3, false},
+		{" 3, 7 ,3", 2, false},
+		{"", 0, true},
+		{"3,,7", 0, true},
+		{"3,-1", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		ids, err := parseProductIDs(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProductIDs(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if len(ids) != tt.want {
+			t.Errorf("parseProductIDs(%q) = %v, want %d ids", tt.raw, ids, tt.want)
+		}
+	}
+
+	many := "1"
+	for i := 2; i <= maxProductIDs+1; i++ {
+		many += "," + strconv.Itoa(i)
+	}
+	if _, err := parseProductIDs(many); err == nil {
+		t.Error("expected error for too many ids")
+	}
+}
+
+func TestGetProductsByIDsPreservesRequestOrder(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, _ := newTestProducts(mockDB)
+
+	rows := newProductRows().
+		AddRow(productRow(3, "Three", "", 1, 1)...).
+		AddRow(productRow(7, "Seven", "", 1, 1)...).
+		AddRow(productRow(19, "Nineteen", "", 1, 1)...)
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE id = ANY\\(\\$1\\) ORDER BY id").
+		WillReturnRows(rows)
+
+	w := httptest.NewRecorder()
+	handlers.getProducts(w, httptest.NewRequest("GET", "/products?ids=19,3,7", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var products []Product
+	json.NewDecoder(w.Body).Decode(&products)
+	if len(products) != 3 || products[0].ID != 19 || products[1].ID != 3 || products[2].ID != 7 {
+		t.Errorf("expected request order 19,3,7, got %+v", products)
+	}
+}
+
+func TestGetProductsRejectsIDsWithOffset(t *testing.T) {
+	handlers, _ := newTestProducts(nil)
+	w := httptest.NewRecorder()
+	handlers.getProducts(w, httptest.NewRequest("GET", "/products?ids=1,2&offset=10", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
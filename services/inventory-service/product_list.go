@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxListLimit       = 1000
+)
+
+// searchMode selects how ?q= is evaluated: "fulltext" uses the tsvector
+// column and ts_rank, "ilike" is a plain substring match for tiny
+// catalogs where ranking isn't worth it.
+var searchMode = getEnv("SEARCH_MODE", "fulltext")
+
+// productFilter holds the listing options accepted by GET /products.
+type productFilter struct {
+	IDs     []int64
+	Search  string
+	InStock *bool    // nil: any; true: stock > 0; false: out of stock
+	OnSale  *bool    // nil: any; true: sale running now; false: not
+	Tags    []string // products must carry every tag
+	Limit   int      // 0 means no limit
+	Offset  int
+
+	// Cursor is set when the client asked for keyset pagination with
+	// ?cursor=; the page then starts after Cursor.AfterID.
+	Cursor *productCursor
+}
+
+func parseProductFilter(query url.Values) (productFilter, error) {
+	var f productFilter
+
+	if raw, ok := query["ids"]; ok {
+		if query.Get("offset") != "" {
+			return f, errors.New("ids cannot be combined with offset")
+		}
+		ids, err := parseProductIDs(strings.Join(raw, ","))
+		if err != nil {
+			return f, err
+		}
+		f.IDs = ids
+	}
+
+	if raw := query.Get("in_stock"); raw != "" {
+		inStock, err := strconv.ParseBool(raw)
+		if err != nil {
+			return f, errors.New("in_stock must be true or false")
+		}
+		f.InStock = &inStock
+	}
+
+	if raw := query.Get("on_sale"); raw != "" {
+		onSale, err := strconv.ParseBool(raw)
+		if err != nil {
+			return f, errors.New("on_sale must be true or false")
+		}
+		f.OnSale = &onSale
+	}
+
+	if raw, ok := query["tag"]; ok {
+		f.Tags = normalizeTags(raw)
+		for _, t := range f.Tags {
+			if err := validateTag(t); err != nil {
+				return f, err
+			}
+		}
+	}
+
+	f.Search = strings.TrimSpace(query.Get("q"))
+	if f.Search != "" {
+		f.Limit = defaultSearchLimit
+	}
+
+	if _, ok := query["cursor"]; ok {
+		switch {
+		case f.IDs != nil:
+			return f, errors.New("cursor cannot be combined with ids")
+		case query.Get("offset") != "":
+			return f, errors.New("cursor cannot be combined with offset")
+		case f.Search != "" && searchMode != "ilike":
+			// Ranked results have no stable keyset to resume from.
+			return f, errors.New("cursor pagination is not supported with full-text search")
+		}
+		c, err := decodeCursor(query.Get("cursor"))
+		if err != nil {
+			return f, err
+		}
+		f.Cursor = &c
+		f.Limit = defaultCursorLimit
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		f.Limit = limit
+	}
+	if raw := query.Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return f, errors.New("offset must be a non-negative integer")
+		}
+		f.Offset = offset
+	}
+	return f, nil
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sql builds the SELECT for the filter. Full-text searches are ordered by
+// rank, everything else by id.
+func (f productFilter) sql() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// Archived products only come back when asked for by id, so orders
+	// referencing them can still be enriched.
+	orderBy := "id"
+	if f.IDs != nil {
+		where = append(where, "id = ANY("+arg(pq.Array(f.IDs))+")")
+	} else {
+		where = append(where, "archived_at IS NULL")
+	}
+	if f.InStock != nil {
+		if *f.InStock {
+			where = append(where, "stock > 0")
+		} else {
+			where = append(where, "stock = 0")
+		}
+	}
+	if f.OnSale != nil {
+		// Evaluated against the clock rather than sale_active, which lags
+		// by up to one sale ticker interval.
+		if *f.OnSale {
+			where = append(where, saleActiveSQL)
+		} else {
+			where = append(where, "NOT "+saleActiveSQL)
+		}
+	}
+	if len(f.Tags) > 0 {
+		// @> is served by the GIN index on tags.
+		where = append(where, "tags @> "+arg(pq.Array(f.Tags)))
+	}
+	if f.Cursor != nil && f.Cursor.AfterID > 0 {
+		where = append(where, "id > "+arg(f.Cursor.AfterID))
+	}
+	if f.Search != "" {
+		if searchMode == "ilike" {
+			p := arg("%" + escapeLike(f.Search) + "%")
+			where = append(where, "(name ILIKE "+p+" OR description ILIKE "+p+")")
+		} else {
+			p := arg(f.Search)
+			where = append(where, "search_vector @@ plainto_tsquery('english', "+p+")")
+			orderBy = "ts_rank(search_vector, plainto_tsquery('english', " + p + ")) DESC, id"
+		}
+	}
+
+	query := "SELECT " + productColumns + " FROM products"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + orderBy
+	if f.Limit > 0 {
+		query += " LIMIT " + arg(f.Limit)
+	}
+	if f.Offset > 0 {
+		query += " OFFSET " + arg(f.Offset)
+	}
+	return query, args
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// readinessCheck probes one dependency for /readyz. Hard checks failing
+// make the instance unready; soft ones are only reported.
+type readinessCheck struct {
+	Name  string
+	Hard  bool
+	Check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+var (
+	readinessChecks  []readinessCheck
+	readinessTimeout = loadReadinessTimeout()
+)
+
+func loadReadinessTimeout() time.Duration {
+	d, err := time.ParseDuration(getEnv("READINESS_CHECK_TIMEOUT", "2s"))
+	if err != nil || d <= 0 {
+		log.Printf("Invalid READINESS_CHECK_TIMEOUT, using 2s")
+		return 2 * time.Second
+	}
+	return d
+}
+
+func pingDatabase(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+// kafkaBrokerCheck dials the broker and fetches cluster metadata, which is
+// cheap and proves the broker is answering rather than just accepting
+// TCP connections.
+func kafkaBrokerCheck(broker string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		_, err = conn.Brokers()
+		return err
+	}
+}
+
+// readinessCheckHandler serves /readyz: every dependency is checked in
+// parallel with its own timeout and the result reported per dependency.
+// Unlike /health it fails when Kafka is unreachable, so traffic is routed
+// away without the pod being restarted.
+func readinessCheckHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "shutting_down"})
+		return
+	}
+
+	results := make(map[string]checkResult, len(readinessChecks))
+	ready := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range readinessChecks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.Check(ctx)
+			res := checkResult{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Status, res.Error = "failed", err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[c.Name] = res
+			if err != nil && c.Hard {
+				ready = false
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	status := "ready"
+	if !ready {
+		status = "not_ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": results})
+}
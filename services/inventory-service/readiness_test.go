@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withReadinessChecks(t *testing.T, checks ...readinessCheck) {
+	t.Helper()
+	old := readinessChecks
+	readinessChecks = checks
+	t.Cleanup(func() { readinessChecks = old })
+}
+
+func okCheck(context.Context) error { return nil }
+
+func TestReadinessCheckHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     []readinessCheck
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			"all ok",
+			[]readinessCheck{{"database", true, okCheck}, {"kafka", true, okCheck}},
+			http.StatusOK, "ready",
+		},
+		{
+			"kafka down",
+			[]readinessCheck{{"database", true, okCheck}, {"kafka", true, func(context.Context) error { return errors.New("connection refused") }}},
+			http.StatusServiceUnavailable, "not_ready",
+		},
+		{
+			"soft check failing",
+			[]readinessCheck{{"database", true, okCheck}, {"cache", false, func(context.Context) error { return errors.New("down") }}},
+			http.StatusOK, "ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withReadinessChecks(t, tt.checks...)
+			w := httptest.NewRecorder()
+			readinessCheckHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			var body struct {
+				Status string                 `json:"status"`
+				Checks map[string]checkResult `json:"checks"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if body.Status != tt.wantStatus || len(body.Checks) != len(tt.checks) {
+				t.Errorf("unexpected body %+v", body)
+			}
+		})
+	}
+}
+
+func TestReadinessCheckTimesOut(t *testing.T) {
+	old := readinessTimeout
+	readinessTimeout = 50 * time.Millisecond
+	defer func() { readinessTimeout = old }()
+
+	withReadinessChecks(t, readinessCheck{"kafka", true, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	readinessCheckHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readiness check took %s, expected the per-check timeout to apply", elapsed)
+	}
+}
+
+func TestKafkaBrokerCheckUnreachable(t *testing.T) {
+	// Grab a free port and close it so nothing is listening.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := kafkaBrokerCheck(addr)(ctx); err == nil {
+		t.Error("expected an error for an unreachable broker")
+	}
+}
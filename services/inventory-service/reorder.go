@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// reorderColumns are the purchasing columns scanned by reorderPolicy.dest.
+const reorderColumns = "reorder_point, reorder_quantity, supplier_name, supplier_contact"
+
+const maxSupplierFieldLength = 255
+
+// reorderPolicy is a product's purchasing data as stored.
+type reorderPolicy struct {
+	ReorderPoint    *int
+	ReorderQuantity int
+	SupplierName    string
+	SupplierContact string
+}
+
+func (rp *reorderPolicy) dest() []interface{} {
+	return []interface{}{&rp.ReorderPoint, &rp.ReorderQuantity, &rp.SupplierName, &rp.SupplierContact}
+}
+
+// below reports whether stock is under the reorder point.
+func (rp reorderPolicy) below(stock int) bool {
+	return rp.ReorderPoint != nil && stock < *rp.ReorderPoint
+}
+
+// suggestedQuantity is the configured reorder quantity, or enough to get
+// back to the reorder point if that is more.
+func (rp reorderPolicy) suggestedQuantity(stock int) int {
+	qty := rp.ReorderQuantity
+	if rp.ReorderPoint != nil && *rp.ReorderPoint-stock > qty {
+		qty = *rp.ReorderPoint - stock
+	}
+	return qty
+}
+
+// reorderPolicy returns the product's purchasing fields with omitted
+// values defaulted, as stored by an INSERT.
+func (p *Product) reorderPolicy() reorderPolicy {
+	rp := reorderPolicy{ReorderPoint: p.ReorderPoint}
+	if p.ReorderQuantity != nil {
+		rp.ReorderQuantity = *p.ReorderQuantity
+	}
+	if p.SupplierName != nil {
+		rp.SupplierName = *p.SupplierName
+	}
+	if p.SupplierContact != nil {
+		rp.SupplierContact = *p.SupplierContact
+	}
+	return rp
+}
+
+// setReorderPolicy copies stored purchasing fields onto the product.
+func (p *Product) setReorderPolicy(rp reorderPolicy) {
+	p.ReorderPoint = rp.ReorderPoint
+	p.ReorderQuantity = &rp.ReorderQuantity
+	p.SupplierName = &rp.SupplierName
+	p.SupplierContact = &rp.SupplierContact
+}
+
+func validateReorderPolicy(p *Product) error {
+	if p.ReorderPoint != nil && *p.ReorderPoint < 0 {
+		return errors.New("reorder_point must not be negative")
+	}
+	if p.ReorderQuantity != nil && *p.ReorderQuantity < 0 {
+		return errors.New("reorder_quantity must not be negative")
+	}
+	if p.SupplierName != nil && len(*p.SupplierName) > maxSupplierFieldLength {
+		return errors.New("supplier_name is too long")
+	}
+	if p.SupplierContact != nil && len(*p.SupplierContact) > maxSupplierFieldLength {
+		return errors.New("supplier_contact is too long")
+	}
+	return nil
+}
+
+// publishReorderSuggestion publishes reorder_suggested when a product's
+// stock drops below its reorder point.
+func publishReorderSuggestion(events eventPublisher, productID interface{}, name string, previous, current int, rp reorderPolicy) {
+	if rp.below(previous) || !rp.below(current) {
+		return
+	}
+	events.Publish(map[string]interface{}{
+		"event_type":         "reorder_suggested",
+		"product_id":         productID,
+		"name":               name,
+		"stock":              current,
+		"previous_stock":     previous,
+		"reorder_point":      *rp.ReorderPoint,
+		"suggested_quantity": rp.suggestedQuantity(current),
+		"supplier_name":      rp.SupplierName,
+		"supplier_contact":   rp.SupplierContact,
+		"timestamp":          time.Now().Unix(),
+	})
+}
+
+// ReorderSuggestion is one entry of GET /products/reorder-suggestions.
+type ReorderSuggestion struct {
+	ProductID         int    `json:"product_id"`
+	Name              string `json:"name"`
+	Stock             int    `json:"stock"`
+	ReorderPoint      int    `json:"reorder_point"`
+	SuggestedQuantity int    `json:"suggested_quantity"`
+	SupplierName      string `json:"supplier_name"`
+	SupplierContact   string `json:"supplier_contact"`
+}
+
+// getReorderSuggestions lists active products below their reorder point,
+// furthest below first.
+func (h *productHandlers) getReorderSuggestions(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rows, err := h.store.QueryContext(r.Context(),
+		`SELECT id, name, stock, `+reorderColumns+` FROM products
+		WHERE reorder_point IS NOT NULL AND stock < reorder_point AND archived_at IS NULL
+		ORDER BY reorder_point - stock DESC, id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	suggestions := []ReorderSuggestion{}
+	for rows.Next() {
+		var s ReorderSuggestion
+		var rp reorderPolicy
+		if err := rows.Scan(append([]interface{}{&s.ProductID, &s.Name, &s.Stock}, rp.dest()...)...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.ReorderPoint = *rp.ReorderPoint
+		s.SuggestedQuantity = rp.suggestedQuantity(s.Stock)
+		s.SupplierName = rp.SupplierName
+		s.SupplierContact = rp.SupplierContact
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestGetReorderSuggestions(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, _ := newTestProducts(mockDB)
+
+	mock.ExpectQuery("SELECT id, name, stock, " + reorderColumns + " FROM products\\s+WHERE reorder_point IS NOT NULL AND stock < reorder_point").
+		WillReturnRows(reorderRows("id", "name", "stock").
+			AddRow(1, "Widget", 2, 20, 50, "Acme", "orders@acme.test").
+			AddRow(2, "Gadget", 0, 30, 10, "Globex", ""))
+
+	w := httptest.NewRecorder()
+	handlers.getReorderSuggestions(w, httptest.NewRequest("GET", "/products/reorder-suggestions", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got []ReorderSuggestion
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 suggestions, got %+v", got)
+	}
+	if got[0].SuggestedQuantity != 50 || got[0].SupplierName != "Acme" {
+		t.Errorf("expected configured reorder quantity 50 from Acme, got %+v", got[0])
+	}
+	// A reorder quantity too small to reach the reorder point is topped up.
+	if got[1].SuggestedQuantity != 30 {
+		t.Errorf("expected suggested quantity 30, got %+v", got[1])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdjustStockSuggestsReorder(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+		WithArgs(-10, "1").
+		WillReturnRows(reorderRows("stock", "name").AddRow(15, "Widget", 20, 100, "Acme", "orders@acme.test"))
+	expectWarehouseStock(mock, defaultWarehouseID, -10, 15)
+	mock.ExpectExec("INSERT INTO stock_movements").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/products/1/stock", strings.NewReader(`{"delta":-10,"reason":"sale"}`)), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	handlers.adjustStock(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := strings.Join(eventTypes(*events), ","); got != "stock_changed,reorder_suggested" {
+		t.Fatalf("expected stock_changed,reorder_suggested, got %s", got)
+	}
+	suggestion := (*events)[1]
+	if suggestion["suggested_quantity"] != 100 || suggestion["supplier_name"] != "Acme" || suggestion["previous_stock"] != 25 {
+		t.Errorf("unexpected reorder_suggested payload: %v", suggestion)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Order-service decrements stock with a PUT that carries no purchasing
+// fields; those must be left untouched rather than cleared.
+func TestUpdateProductKeepsOmittedReorderFields(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	mock.ExpectBegin()
+	previous := append(productRow(1, "Widget", "", 9.99, 21)[:14], 20, 40, "Acme", "")
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(newProductRows().AddRow(previous...))
+	mock.ExpectQuery("UPDATE products SET").
+		WithArgs("Widget", "", "9.99", 19, nil, "1", "USD", nil, nil, nil, nil, nil, "{}").
+		WillReturnRows(reorderRows("images", "stock").AddRow(`[]`, 19, 20, 40, "Acme", ""))
+	expectWarehouseStock(mock, defaultWarehouseID, -2, 19)
+	mock.ExpectCommit()
+
+	body := `{"name":"Widget","description":"","price":9.99,"stock":19}`
+	req := mux.SetURLVars(httptest.NewRequest("PUT", "/products/1", strings.NewReader(body)), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	handlers.updateProduct(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := strings.Join(eventTypes(*events), ","); got != "product_updated,reorder_suggested" {
+		t.Errorf("expected product_updated,reorder_suggested, got %s", got)
+	}
+	if changed := (*events)[0]["changed_fields"]; !reflect.DeepEqual(changed, []string{"stock"}) {
+		t.Errorf("expected only stock to change, got %v", changed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestValidateReorderPolicy(t *testing.T) {
+	neg := -1
+	if err := validateReorderPolicy(&Product{ReorderPoint: &neg}); err == nil {
+		t.Error("expected negative reorder_point to be rejected")
+	}
+	if err := validateReorderPolicy(&Product{ReorderQuantity: &neg}); err == nil {
+		t.Error("expected negative reorder_quantity to be rejected")
+	}
+	long := strings.Repeat("x", maxSupplierFieldLength+1)
+	if err := validateReorderPolicy(&Product{SupplierName: &long}); err == nil {
+		t.Error("expected overlong supplier_name to be rejected")
+	}
+}
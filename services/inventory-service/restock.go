@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RestockRequest is the body of POST /products/{id}/restock.
+type RestockRequest struct {
+	Quantity    int    `json:"quantity"`
+	VariantID   int    `json:"variant_id,omitempty"`
+	WarehouseID int    `json:"warehouse_id,omitempty"`
+	SupplierRef string `json:"supplier_ref"`
+	Note        string `json:"note"`
+}
+
+// claimIdempotencyKey reserves key for scope inside tx. If the key was
+// already used and its response stored, that response is returned so the
+// caller can replay it. A concurrent request holding the same key blocks
+// on the insert until the first transaction finishes.
+func claimIdempotencyKey(ctx context.Context, tx dbExecutor, key, scope string) (stored []byte, status int, err error) {
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (key, scope) VALUES ($1, $2) ON CONFLICT (key, scope) DO NOTHING",
+		key, scope,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, 0, nil
+	}
+
+	var statusCode sql.NullInt64
+	err = tx.QueryRowContext(ctx,
+		"SELECT response, status_code FROM idempotency_keys WHERE key = $1 AND scope = $2",
+		key, scope,
+	).Scan(&stored, &statusCode)
+	return stored, int(statusCode.Int64), err
+}
+
+func storeIdempotentResponse(ctx context.Context, tx dbExecutor, key, scope string, status int, body []byte) error {
+	_, err := tx.ExecContext(ctx,
+		"UPDATE idempotency_keys SET response = $1, status_code = $2 WHERE key = $3 AND scope = $4",
+		body, status, key, scope,
+	)
+	return err
+}
+
+// restockProduct records received stock from a supplier. Retries carrying
+// the same Idempotency-Key replay the original response instead of adding
+// the stock twice.
+func (h *productHandlers) restockProduct(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	scope := "restock:" + id
+
+	var req RestockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 {
+		http.Error(w, "quantity must be positive", http.StatusBadRequest)
+		return
+	}
+	if err := validateStockTarget(req.VariantID, req.WarehouseID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if idempotencyKey != "" {
+		stored, status, err := claimIdempotencyKey(r.Context(), tx, idempotencyKey, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(status)
+			w.Write(stored)
+			return
+		}
+	}
+
+	res, err := applyStockDelta(r.Context(), tx, id, stockMovement{
+		VariantID:   req.VariantID,
+		WarehouseID: req.WarehouseID,
+		Delta:       req.Quantity,
+		Reason:      "restock",
+		Reference:   req.SupplierRef,
+		Note:        req.Note,
+	})
+	if err == errStockRejected {
+		tx.Rollback()
+		status, msg := h.explainRejectedAdjustment(r, id, req.VariantID, req.WarehouseID)
+		http.Error(w, msg, status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"product_id":     id,
+		"quantity":       req.Quantity,
+		"previous_stock": res.Previous,
+		"stock":          res.Current,
+		"supplier_ref":   req.SupplierRef,
+	}
+	if req.VariantID != 0 {
+		response["variant_id"] = req.VariantID
+	} else {
+		response["warehouse_id"] = res.WarehouseID
+		response["warehouse_stock"] = res.Warehouse.Stock
+	}
+	body, _ := json.Marshal(response)
+
+	if idempotencyKey != "" {
+		if err := storeIdempotentResponse(r.Context(), tx, idempotencyKey, scope, http.StatusOK, body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	h.cache.Invalidate(r.Context(), id)
+	setStockGauge(id, res.Name, res.ParentStock)
+	loggerFrom(r.Context()).Info("stock changed",
+		"product_id", id, "variant_id", req.VariantID, "reason", "restock",
+		"delta", req.Quantity, "previous_stock", res.Previous, "stock", res.Current)
+
+	event := map[string]interface{}{
+		"event_type":     "product_restocked",
+		"product_id":     id,
+		"name":           res.Name,
+		"quantity":       req.Quantity,
+		"stock":          res.Current,
+		"previous_stock": res.Previous,
+		"supplier_ref":   req.SupplierRef,
+		"note":           req.Note,
+		"timestamp":      time.Now().Unix(),
+	}
+	if req.VariantID != 0 {
+		event["variant_id"] = req.VariantID
+		event["sku"] = res.SKU
+	} else {
+		event["warehouse_id"] = res.WarehouseID
+	}
+	h.events.Publish(event)
+	publishStockThresholdEvents(h.events, res.thresholdChange(id, req.VariantID, req.Quantity))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
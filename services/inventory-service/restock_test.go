@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func newRestockRequest(body, key string) *http.Request {
+	req := httptest.NewRequest("POST", "/products/1/restock", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return mux.SetURLVars(req, map[string]string{"id": "1"})
+}
+
+func TestRestockRecoversLowStock(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO idempotency_keys").
+		WithArgs("abc", "restock:1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+		WithArgs(100, "1").
+		WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(103, "Widget")...))
+	expectWarehouseStock(mock, defaultWarehouseID, 100, 103)
+	mock.ExpectExec("INSERT INTO stock_movements").
+		WithArgs("1", nil, defaultWarehouseID, 100, "restock", "PO-42", "dock 3").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE idempotency_keys SET response").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := httptest.NewRecorder()
+	handlers.restockProduct(w, newRestockRequest(`{"quantity":100,"supplier_ref":"PO-42","note":"dock 3"}`, "abc"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := strings.Join(eventTypes(*events), ","); got != "product_restocked,stock_recovered" {
+		t.Errorf("unexpected events: %s", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestockReplaysIdempotentResponse(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	stored := `{"product_id":"1","stock":103}`
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO idempotency_keys").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT response, status_code FROM idempotency_keys").
+		WithArgs("abc", "restock:1").
+		WillReturnRows(sqlmock.NewRows([]string{"response", "status_code"}).AddRow([]byte(stored), 200))
+	mock.ExpectRollback()
+
+	w := httptest.NewRecorder()
+	handlers.restockProduct(w, newRestockRequest(`{"quantity":100}`, "abc"))
+
+	if w.Code != http.StatusOK || w.Body.String() != stored {
+		t.Fatalf("expected replayed response, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events on replay, got %v", eventTypes(*events))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestockRejectsNonPositiveQuantity(t *testing.T) {
+	handlers, _ := newTestProducts(nil)
+	w := httptest.NewRecorder()
+	handlers.restockProduct(w, newRestockRequest(`{"quantity":0}`, ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
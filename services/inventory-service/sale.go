@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// saleCheckInterval is how often the sale ticker looks for sales that
+// started or ended. Configured via SALE_CHECK_INTERVAL.
+var saleCheckInterval = loadDuration("SALE_CHECK_INTERVAL", time.Minute)
+
+// saleActiveSQL is true for rows whose sale is running right now. It
+// matches Product.onSale.
+const saleActiveSQL = `(sale_price IS NOT NULL
+	AND (sale_starts_at IS NULL OR sale_starts_at <= NOW())
+	AND (sale_ends_at IS NULL OR sale_ends_at > NOW()))`
+
+// onSale reports whether the product's sale is running at now.
+func (p *Product) onSale(now time.Time) bool {
+	return p.SalePriceCents != nil &&
+		(p.SaleStartsAt == nil || !p.SaleStartsAt.After(now)) &&
+		(p.SaleEndsAt == nil || p.SaleEndsAt.After(now))
+}
+
+// setEffectivePrice derives the price a customer pays at now. It runs on
+// every read, cached ones included, so a sale boundary never waits for a
+// cache entry to expire.
+func (p *Product) setEffectivePrice(now time.Time) {
+	p.EffectivePriceCents = p.PriceCents
+	if p.onSale(now) {
+		p.EffectivePriceCents = *p.SalePriceCents
+	}
+	p.EffectivePrice = centsToFloat(p.EffectivePriceCents)
+}
+
+// dropSaleFields discards sale fields sent to the product endpoints: sales
+// are scheduled through /products/{id}/sale.
+func dropSaleFields(p *Product) {
+	p.SalePriceCents, p.SaleStartsAt, p.SaleEndsAt = nil, nil, nil
+	p.setEffectivePrice(time.Now())
+}
+
+// Sale is the body of PUT /products/{id}/sale. Either bound may be
+// omitted for a sale that starts now or runs until removed.
+type Sale struct {
+	SalePriceCents *int64     `json:"sale_price_cents"`
+	StartsAt       *time.Time `json:"sale_starts_at"`
+	EndsAt         *time.Time `json:"sale_ends_at"`
+}
+
+func validateSale(s *Sale, priceCents int64, now time.Time) error {
+	switch {
+	case s.SalePriceCents == nil:
+		return errors.New("sale_price_cents is required")
+	case *s.SalePriceCents < 0:
+		return errors.New("sale_price_cents must not be negative")
+	case *s.SalePriceCents >= priceCents:
+		return errors.New("sale_price_cents must be below the product's price")
+	case s.StartsAt != nil && s.EndsAt != nil && !s.EndsAt.After(*s.StartsAt):
+		return errors.New("sale_ends_at must be after sale_starts_at")
+	case s.EndsAt != nil && !s.EndsAt.After(now):
+		return errors.New("sale_ends_at must be in the future")
+	}
+	return nil
+}
+
+// setSale schedules a sale, replacing any existing one. The ticker
+// publishes product_sale_started once the window opens.
+func setSale(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	var s Sale
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the row so a concurrent price change can't slip under the sale
+	// price between the check and the update.
+	var price centsColumn
+	err = tx.QueryRowContext(r.Context(), "SELECT price FROM products WHERE id = $1 FOR UPDATE", id).Scan(&price)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validateSale(&s, int64(price), time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(),
+		"UPDATE products SET sale_price = $1, sale_starts_at = $2, sale_ends_at = $3 WHERE id = $4",
+		centsColumn(*s.SalePriceCents), s.StartsAt, s.EndsAt, id,
+	)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	cache.Invalidate(r.Context(), id)
+	loggerFrom(r.Context()).Info("sale scheduled", "product_id", id,
+		"sale_price_cents", *s.SalePriceCents, "starts_at", s.StartsAt, "ends_at", s.EndsAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// deleteSale removes a product's sale. If it was running, the ticker
+// publishes product_sale_ended.
+func deleteSale(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	res, err := db.ExecContext(r.Context(),
+		"UPDATE products SET sale_price = NULL, sale_starts_at = NULL, sale_ends_at = NULL WHERE id = $1", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	cache.Invalidate(r.Context(), id)
+	loggerFrom(r.Context()).Info("sale removed", "product_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishSaleTransitions flips sale_active on every product whose sale
+// started or ended since the last run and publishes product_sale_started
+// or product_sale_ended for each. The flip and the check are one UPDATE,
+// so replicas running the ticker concurrently announce each boundary once.
+func publishSaleTransitions(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx,
+		`UPDATE products SET sale_active = `+saleActiveSQL+`
+		WHERE sale_active <> `+saleActiveSQL+`
+		RETURNING id, name, price, sale_price, sale_ends_at, sale_active`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type transition struct {
+		id, name  string
+		price     centsColumn
+		salePrice nullCentsColumn
+		endsAt    *time.Time
+		active    bool
+	}
+	var transitions []transition
+	for rows.Next() {
+		var t transition
+		if err := rows.Scan(&t.id, &t.name, &t.price, &t.salePrice, &t.endsAt, &t.active); err != nil {
+			return err
+		}
+		transitions = append(transitions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, t := range transitions {
+		cache.Invalidate(ctx, t.id)
+		event := map[string]interface{}{
+			"event_type":  "product_sale_ended",
+			"product_id":  t.id,
+			"name":        t.name,
+			"price_cents": int64(t.price),
+			"timestamp":   time.Now().Unix(),
+		}
+		if t.active {
+			event["event_type"] = "product_sale_started"
+			event["sale_price_cents"] = t.salePrice.Cents
+			event["sale_ends_at"] = t.endsAt
+		}
+		publishEvent(event)
+	}
+	return nil
+}
+
+func publishSaleTransitionsLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := publishSaleTransitions(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to check sale transitions: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestSetEffectivePrice(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	salePrice := int64(799)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name           string
+		starts, ends   *time.Time
+		salePriceCents *int64
+		want           int64
+	}{
+		{"no sale", nil, nil, nil, 999},
+		{"open-ended sale", nil, nil, &salePrice, 799},
+		{"inside window", &before, &after, &salePrice, 799},
+		{"not started", &after, nil, &salePrice, 999},
+		{"ended", nil, &before, &salePrice, 999},
+		{"ends exactly now", nil, &now, &salePrice, 999},
+	}
+	for _, tt := range tests {
+		p := Product{PriceCents: 999, SalePriceCents: tt.salePriceCents, SaleStartsAt: tt.starts, SaleEndsAt: tt.ends}
+		p.setEffectivePrice(now)
+		if p.EffectivePriceCents != tt.want || p.EffectivePrice != centsToFloat(tt.want) {
+			t.Errorf("%s: expected effective price %d, got %d (%v)", tt.name, tt.want, p.EffectivePriceCents, p.EffectivePrice)
+		}
+	}
+}
+
+func TestValidateSale(t *testing.T) {
+	now := time.Now()
+	price := func(c int64) *int64 { return &c }
+	later, evenLater, earlier := now.Add(time.Hour), now.Add(2*time.Hour), now.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		sale    Sale
+		wantErr bool
+	}{
+		{"valid window", Sale{SalePriceCents: price(799), StartsAt: &later, EndsAt: &evenLater}, false},
+		{"open-ended", Sale{SalePriceCents: price(0)}, false},
+		{"missing price", Sale{}, true},
+		{"not a discount", Sale{SalePriceCents: price(999)}, true},
+		{"negative", Sale{SalePriceCents: price(-1)}, true},
+		{"ends before it starts", Sale{SalePriceCents: price(799), StartsAt: &evenLater, EndsAt: &later}, true},
+		{"already over", Sale{SalePriceCents: price(799), EndsAt: &earlier}, true},
+	}
+	for _, tt := range tests {
+		if err := validateSale(&tt.sale, 999, now); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateSale() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetSale(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+	}{
+		{
+			name: "scheduled",
+			body: `{"sale_price_cents":799,"sale_starts_at":"2099-01-01T00:00:00Z","sale_ends_at":"2099-01-08T00:00:00Z"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT price FROM products WHERE id = \\$1 FOR UPDATE").
+					WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow("9.99"))
+				mock.ExpectExec("UPDATE products SET sale_price = \\$1, sale_starts_at = \\$2, sale_ends_at = \\$3 WHERE id = \\$4").
+					WithArgs("7.99", sqlmock.AnyArg(), sqlmock.AnyArg(), "1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "sale price not below price",
+			body: `{"sale_price_cents":1299}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT price FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow("9.99"))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "unknown product",
+			body: `{"sale_price_cents":100}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT price FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(sqlmock.NewRows([]string{"price"}))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			oldDB := db
+			db = mockDB
+			defer func() { db = oldDB }()
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest("PUT", "/products/1/sale", strings.NewReader(tt.body)), map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			setSale(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestUpdateProductKeepsPriceAboveSale(t *testing.T) {
+	onSale := productRow(1, "Widget", "d", 9.99, 5)
+	onSale[11] = "7.99"
+
+	runHandlerCases(t, (*productHandlers).updateProduct, []handlerCase{
+		{
+			name:   "price cut below the sale price",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":7.49,"stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(onSale...))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	})
+}
+
+func TestGetProductReportsEffectivePrice(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, _ := newTestProducts(mockDB)
+
+	onSale := productRow(1, "Widget", "d", 9.99, 5)
+	onSale[11], onSale[13] = "7.99", time.Now().Add(time.Hour)
+	mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1").
+		WithArgs("1").
+		WillReturnRows(newProductRows().AddRow(onSale...))
+	mock.ExpectQuery("SELECT (.+) FROM product_variants WHERE product_id = \\$1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/products/1", nil), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	handlers.getProduct(w, req)
+
+	var p Product
+	json.NewDecoder(w.Body).Decode(&p)
+	if p.PriceCents != 999 || p.SalePriceCents == nil || p.EffectivePriceCents != 799 || p.EffectivePrice != 7.99 {
+		t.Errorf("unexpected pricing %+v", p)
+	}
+}
+
+func TestPublishSaleTransitions(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+	events := capturePublishedEvents(t)
+
+	mock.ExpectQuery("UPDATE products SET sale_active = (.+) WHERE sale_active <> (.+) RETURNING").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "price", "sale_price", "sale_ends_at", "sale_active"}).
+			AddRow(1, "Widget", "9.99", "7.99", nil, true).
+			AddRow(2, "Gadget", "5.00", nil, nil, false))
+
+	if err := publishSaleTransitions(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(eventTypes(*events), ","); got != "product_sale_started,product_sale_ended" {
+		t.Fatalf("unexpected events %v", got)
+	}
+	if (*events)[0]["sale_price_cents"] != int64(799) {
+		t.Errorf("expected sale_price_cents 799, got %v", (*events)[0]["sale_price_cents"])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// snapshotInterval is how often a scheduled snapshot is taken, and
+	// snapshotRetention how long snapshots are kept. Configured via
+	// SNAPSHOT_INTERVAL and SNAPSHOT_RETENTION.
+	snapshotInterval  = loadDuration("SNAPSHOT_INTERVAL", 24*time.Hour)
+	snapshotRetention = loadDuration("SNAPSHOT_RETENTION", 400*24*time.Hour)
+	snapshotChunkSize = loadSnapshotChunkSize()
+
+	// snapshotSlot lets one snapshot run at a time per instance.
+	snapshotSlot = make(chan struct{}, 1)
+)
+
+func loadSnapshotChunkSize() int {
+	n, err := strconv.Atoi(getEnv("SNAPSHOT_CHUNK_SIZE", "1000"))
+	if err != nil || n < 1 {
+		log.Printf("Invalid SNAPSHOT_CHUNK_SIZE, using 1000")
+		return 1000
+	}
+	return n
+}
+
+// Snapshot is one entry of GET /snapshots.
+type Snapshot struct {
+	ID           int64      `json:"id"`
+	Source       string     `json:"source"`
+	TakenAt      time.Time  `json:"taken_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+	ProductCount int        `json:"product_count"`
+}
+
+// SnapshotItem is one product's line in a snapshot.
+type SnapshotItem struct {
+	ProductID  int    `json:"product_id"`
+	Name       string `json:"name"`
+	Stock      int    `json:"stock"`
+	PriceCents int64  `json:"price_cents"`
+	Currency   string `json:"currency"`
+	ValueCents int64  `json:"value_cents"`
+}
+
+// startSnapshot records a new, incomplete snapshot.
+func startSnapshot(ctx context.Context, source string) (Snapshot, error) {
+	s := Snapshot{Source: source}
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO inventory_snapshots (source) VALUES ($1) RETURNING id, taken_at", source,
+	).Scan(&s.ID, &s.TakenAt)
+	return s, err
+}
+
+// fillSnapshot copies every active product into the snapshot, one chunk
+// of snapshotChunkSize products per statement in id order, so a large
+// catalog never sits in one long transaction. Each chunk reads the
+// products as they are when it runs; stock moving mid-snapshot lands in
+// whichever chunk reads it. The snapshot is marked complete last. On
+// failure it is deleted rather than left half written.
+func fillSnapshot(ctx context.Context, snapshotID int64) (int, error) {
+	var afterID, total int
+	for {
+		var lastID, n int
+		err := db.QueryRowContext(ctx,
+			`WITH chunk AS (
+				SELECT id, name, stock, price, currency FROM products
+				WHERE archived_at IS NULL AND id > $2 ORDER BY id LIMIT $3
+			), saved AS (
+				INSERT INTO inventory_snapshot_items (snapshot_id, product_id, name, stock, price, currency)
+				SELECT $1, id, name, stock, price, currency FROM chunk
+			)
+			SELECT COALESCE(MAX(id), 0), COUNT(*) FROM chunk`,
+			snapshotID, afterID, snapshotChunkSize,
+		).Scan(&lastID, &n)
+		if err != nil {
+			discardSnapshot(snapshotID)
+			return total, err
+		}
+		total += n
+		if n < snapshotChunkSize {
+			break
+		}
+		afterID = lastID
+	}
+
+	_, err := db.ExecContext(ctx,
+		"UPDATE inventory_snapshots SET completed_at = NOW(), product_count = $1 WHERE id = $2", total, snapshotID)
+	if err != nil {
+		discardSnapshot(snapshotID)
+	}
+	return total, err
+}
+
+// discardSnapshot deletes a snapshot that failed part way. It uses its
+// own context so a cancelled fill still cleans up.
+func discardSnapshot(snapshotID int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "DELETE FROM inventory_snapshots WHERE id = $1", snapshotID); err != nil {
+		log.Printf("Failed to discard incomplete snapshot %d: %v", snapshotID, err)
+	}
+}
+
+// pruneSnapshots deletes snapshots older than snapshotRetention.
+func pruneSnapshots(ctx context.Context) (int64, error) {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM inventory_snapshots WHERE taken_at < $1", time.Now().Add(-snapshotRetention))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runScheduledSnapshot takes a scheduled snapshot unless one completed
+// within the last interval, which keeps restarts and multiple replicas
+// from piling up snapshots, then prunes old ones.
+func runScheduledSnapshot(ctx context.Context, interval time.Duration) error {
+	select {
+	case snapshotSlot <- struct{}{}:
+		defer func() { <-snapshotSlot }()
+	default:
+		return nil
+	}
+
+	var recent bool
+	err := db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM inventory_snapshots
+		WHERE source = 'scheduled' AND completed_at IS NOT NULL AND taken_at > $1)`,
+		time.Now().Add(-interval),
+	).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if !recent {
+		s, err := startSnapshot(ctx, "scheduled")
+		if err != nil {
+			return err
+		}
+		n, err := fillSnapshot(ctx, s.ID)
+		if err != nil {
+			return err
+		}
+		log.Printf("Inventory snapshot %d taken: %d products", s.ID, n)
+	}
+
+	pruned, err := pruneSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d inventory snapshots older than %s", pruned, snapshotRetention)
+	}
+	return nil
+}
+
+func snapshotLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := runScheduledSnapshot(ctx, interval); err != nil && ctx.Err() == nil {
+			log.Printf("Scheduled inventory snapshot failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// createSnapshot starts a snapshot on demand and answers 202 right away;
+// the products are copied in the background. Poll GET /snapshots for
+// completed_at.
+func createSnapshot(w http.ResponseWriter, r *http.Request) {
+	select {
+	case snapshotSlot <- struct{}{}:
+	default:
+		http.Error(w, "A snapshot is already being taken", http.StatusConflict)
+		return
+	}
+
+	s, err := startSnapshot(r.Context(), "manual")
+	if err != nil {
+		<-snapshotSlot
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go func() {
+		defer func() { <-snapshotSlot }()
+		n, err := fillSnapshot(context.Background(), s.ID)
+		if err != nil {
+			log.Printf("Inventory snapshot %d failed: %v", s.ID, err)
+			return
+		}
+		log.Printf("Inventory snapshot %d taken: %d products", s.ID, n)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s)
+}
+
+// getSnapshots lists snapshots newest first, incomplete ones included,
+// with the shared history window and paging parameters.
+func getSnapshots(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseHistoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	query := "SELECT id, source, taken_at, completed_at, product_count FROM inventory_snapshots"
+	if where := filter.conditions("taken_at", &args); len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY taken_at DESC, id DESC" + filter.page(&args)
+
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	snapshots := []Snapshot{}
+	for rows.Next() {
+		var s Snapshot
+		if err := rows.Scan(&s.ID, &s.Source, &s.TakenAt, &s.CompletedAt, &s.ProductCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snapshots = append(snapshots, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+var snapshotCSVHeader = []string{"product_id", "name", "stock", "price", "price_cents", "currency", "value_cents"}
+
+// getSnapshot streams the latest completed snapshot taken on a UTC date
+// (YYYY-MM-DD) as CSV or NDJSON, like the product export. The snapshot's
+// id and time are in the X-Snapshot-Id and X-Snapshot-Taken-At headers.
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	day, err := time.Parse("2006-01-02", mux.Vars(r)["date"])
+	if err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	var s Snapshot
+	err = db.QueryRowContext(r.Context(),
+		`SELECT id, source, taken_at, completed_at, product_count FROM inventory_snapshots
+		WHERE completed_at IS NOT NULL AND taken_at >= $1 AND taken_at < $2
+		ORDER BY taken_at DESC LIMIT 1`,
+		day, day.AddDate(0, 0, 1),
+	).Scan(&s.ID, &s.Source, &s.TakenAt, &s.CompletedAt, &s.ProductCount)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No snapshot for that date", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case exportSlots <- struct{}{}:
+		defer func() { <-exportSlots }()
+	default:
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many concurrent exports", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT product_id, name, stock, price, currency FROM inventory_snapshot_items
+		WHERE snapshot_id = $1 ORDER BY product_id`, s.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var cw *csv.Writer
+	var enc *json.Encoder
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw.Write(snapshotCSVHeader)
+	} else {
+		enc = json.NewEncoder(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="inventory-snapshot-%s.%s"`, day.Format("20060102"), format))
+	w.Header().Set("X-Snapshot-Id", strconv.FormatInt(s.ID, 10))
+	w.Header().Set("X-Snapshot-Taken-At", s.TakenAt.UTC().Format(time.RFC3339))
+
+	rc := http.NewResponseController(w)
+	logger := loggerFrom(r.Context())
+	count := 0
+	for rows.Next() {
+		var item SnapshotItem
+		var price centsColumn
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.Stock, &price, &item.Currency); err != nil {
+			logger.Error("snapshot export aborted", "error", err, "rows", count)
+			return
+		}
+		item.PriceCents = int64(price)
+		item.ValueCents = item.PriceCents * int64(item.Stock)
+
+		if cw != nil {
+			err = cw.Write([]string{
+				strconv.Itoa(item.ProductID), item.Name, strconv.Itoa(item.Stock),
+				strconv.FormatFloat(centsToFloat(item.PriceCents), 'f', 2, 64), strconv.FormatInt(item.PriceCents, 10),
+				item.Currency, strconv.FormatInt(item.ValueCents, 10),
+			})
+		} else {
+			err = enc.Encode(item)
+		}
+		if err != nil {
+			logger.Warn("snapshot export aborted, client write failed", "error", err, "rows", count)
+			return
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			if cw != nil {
+				cw.Flush()
+			}
+			if err := rc.Flush(); err != nil {
+				logger.Warn("snapshot export aborted, client write failed", "error", err, "rows", count)
+				return
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger.Warn("snapshot export aborted", "error", err, "rows", count)
+		return
+	}
+	if cw != nil {
+		cw.Flush()
+	}
+	logger.Info("snapshot exported", "snapshot_id", s.ID, "format", format, "rows", count,
+		"duration_ms", time.Since(start).Milliseconds())
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestFillSnapshotChunks(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB, oldChunk := db, snapshotChunkSize
+	db, snapshotChunkSize = mockDB, 2
+	defer func() { db, snapshotChunkSize = oldDB, oldChunk }()
+
+	chunk := "WITH chunk AS \\((.+) INSERT INTO inventory_snapshot_items"
+	mock.ExpectQuery(chunk).WithArgs(int64(7), 0, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"max", "count"}).AddRow(4, 2))
+	mock.ExpectQuery(chunk).WithArgs(int64(7), 4, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"max", "count"}).AddRow(9, 1))
+	mock.ExpectExec("UPDATE inventory_snapshots SET completed_at = NOW\\(\\), product_count = \\$1").
+		WithArgs(3, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := fillSnapshot(t.Context(), 7)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 products, got %d (%v)", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFillSnapshotDiscardsOnFailure(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	mock.ExpectQuery("WITH chunk AS").WillReturnError(errDBDown)
+	mock.ExpectExec("DELETE FROM inventory_snapshots WHERE id = \\$1").
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := fillSnapshot(t.Context(), 7); !errors.Is(err, errDBDown) {
+		t.Fatalf("expected the chunk error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRunScheduledSnapshotSkipsRecent(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM inventory_snapshots").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("DELETE FROM inventory_snapshots WHERE taken_at < \\$1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := runScheduledSnapshot(t.Context(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetSnapshot(t *testing.T) {
+	takenAt := time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		date       string
+		query      string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name: "csv",
+			date: "2024-05-31",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM inventory_snapshots WHERE completed_at IS NOT NULL").
+					WithArgs(time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "source", "taken_at", "completed_at", "product_count"}).
+						AddRow(12, "scheduled", takenAt, takenAt, 2))
+				mock.ExpectQuery("SELECT (.+) FROM inventory_snapshot_items WHERE snapshot_id = \\$1").
+					WithArgs(int64(12)).
+					WillReturnRows(sqlmock.NewRows([]string{"product_id", "name", "stock", "price", "currency"}).
+						AddRow(1, "Widget", 4, "2.50", "USD").
+						AddRow(2, "Gadget", 0, "10.00", "EUR"))
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "product_id,name,stock,price,price_cents,currency,value_cents\n1,Widget,4,2.50,250,USD,1000\n2,Gadget,0,10.00,1000,EUR,0\n",
+		},
+		{
+			name:  "ndjson",
+			date:  "2024-05-31",
+			query: "?format=ndjson",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM inventory_snapshots").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "source", "taken_at", "completed_at", "product_count"}).
+						AddRow(12, "scheduled", takenAt, takenAt, 1))
+				mock.ExpectQuery("SELECT (.+) FROM inventory_snapshot_items").
+					WillReturnRows(sqlmock.NewRows([]string{"product_id", "name", "stock", "price", "currency"}).
+						AddRow(1, "Widget", 4, "2.50", "USD"))
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"product_id":1,"name":"Widget","stock":4,"price_cents":250,"currency":"USD","value_cents":1000}` + "\n",
+		},
+		{
+			name: "no snapshot that day",
+			date: "2024-06-01",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM inventory_snapshots").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "source", "taken_at", "completed_at", "product_count"}))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "bad date",
+			date:       "31-05-2024",
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			oldDB := db
+			db = mockDB
+			defer func() { db = oldDB }()
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/snapshots/"+tt.date+tt.query, nil), map[string]string{"date": tt.date})
+			w := httptest.NewRecorder()
+			getSnapshot(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantBody != "" {
+				if got := w.Body.String(); got != tt.wantBody {
+					t.Errorf("unexpected body %q", got)
+				}
+				if w.Header().Get("X-Snapshot-Id") != "12" {
+					t.Errorf("expected X-Snapshot-Id 12, got %q", w.Header().Get("X-Snapshot-Id"))
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotOneAtATime(t *testing.T) {
+	snapshotSlot <- struct{}{}
+	defer func() { <-snapshotSlot }()
+
+	w := httptest.NewRecorder()
+	createSnapshot(w, httptest.NewRequest("POST", "/snapshots", strings.NewReader("")))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409 while a snapshot runs, got %d", w.Code)
+	}
+}
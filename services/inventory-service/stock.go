@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StockAdjustment is the body of POST /products/{id}/stock. Delta is added
+// to the current stock; VariantID targets a single variant and WarehouseID
+// a warehouse other than the default. Reason must be one of stockReasons.
+type StockAdjustment struct {
+	Delta       int    `json:"delta"`
+	VariantID   int    `json:"variant_id,omitempty"`
+	WarehouseID int    `json:"warehouse_id,omitempty"`
+	Reason      string `json:"reason"`
+	Note        string `json:"note,omitempty"`
+}
+
+// stockMovement is one row of the stock_movements ledger. WarehouseID is
+// ignored for variant movements and defaults to defaultWarehouseID
+// otherwise.
+type stockMovement struct {
+	VariantID   int
+	WarehouseID int
+	Delta       int
+	Reason      string
+	Reference   string
+	Note        string
+}
+
+// stockResult is the outcome of applyStockDelta.
+type stockResult struct {
+	Name        string
+	SKU         string
+	Previous    int // stock of the adjusted product or variant before the change
+	Current     int // stock of the adjusted product or variant after the change
+	ParentStock int // product stock after the change (sum over variants, if any)
+	Reorder     reorderPolicy
+
+	WarehouseID int // warehouse the change landed in; 0 for variant changes
+	Warehouse   warehouseLevel
+}
+
+// thresholdChange describes res for publishStockThresholdEvents. Under
+// warehouse-scoped low-stock evaluation a product-level change is checked
+// against the warehouse it landed in rather than the product total.
+func (res stockResult) thresholdChange(id string, variantID, delta int) stockChange {
+	c := stockChange{
+		ProductID: id, Name: res.Name, VariantID: variantID, SKU: res.SKU,
+		Previous: res.Previous, Current: res.Current,
+		Reorder: &res.Reorder, ParentPrevious: res.ParentStock - delta, ParentCurrent: res.ParentStock,
+	}
+	if lowStockScope == "warehouse" && res.WarehouseID != 0 {
+		c.WarehouseID = res.WarehouseID
+		c.Threshold = res.Warehouse.Threshold
+		c.Previous, c.Current = res.Warehouse.Stock-delta, res.Warehouse.Stock
+	}
+	return c
+}
+
+// validateStockTarget rejects a warehouse_id alongside a variant_id:
+// variant stock isn't split by warehouse.
+func validateStockTarget(variantID, warehouseID int) error {
+	if warehouseID < 0 {
+		return errors.New("warehouse_id must be a positive integer")
+	}
+	if variantID != 0 && warehouseID != 0 {
+		return errors.New("warehouse_id is not supported for variant stock")
+	}
+	return nil
+}
+
+// errStockRejected means the conditional update matched no rows; callers
+// use explainRejectedAdjustment to find out why.
+var errStockRejected = errors.New("stock update rejected")
+
+// applyStockDelta applies a relative stock change inside tx and records it
+// in stock_movements. The change is a conditional UPDATE so concurrent
+// decrements can never drive stock negative; for products without
+// variants the warehouse's share is then adjusted the same way, keeping
+// products.stock the sum over warehouses.
+func applyStockDelta(ctx context.Context, tx dbExecutor, id string, m stockMovement) (stockResult, error) {
+	var res stockResult
+	var err error
+	if m.VariantID != 0 {
+		err = tx.QueryRowContext(ctx,
+			`UPDATE product_variants SET stock = stock + $1
+			WHERE id = $2 AND product_id = $3 AND stock + $1 >= 0
+			RETURNING stock, sku`,
+			m.Delta, m.VariantID, id,
+		).Scan(&res.Current, &res.SKU)
+	} else {
+		err = tx.QueryRowContext(ctx,
+			`UPDATE products SET stock = stock + $1
+			WHERE id = $2 AND stock + $1 >= 0
+				AND NOT EXISTS (SELECT 1 FROM product_variants WHERE product_id = $2)
+			RETURNING stock, name, `+reorderColumns,
+			m.Delta, id,
+		).Scan(append([]interface{}{&res.Current, &res.Name}, res.Reorder.dest()...)...)
+	}
+	if err == sql.ErrNoRows {
+		return res, errStockRejected
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Previous = res.Current - m.Delta
+	res.ParentStock = res.Current
+
+	var warehouseID interface{}
+	if m.VariantID == 0 {
+		res.WarehouseID = m.WarehouseID
+		if res.WarehouseID == 0 {
+			res.WarehouseID = defaultWarehouseID
+		}
+		warehouseID = res.WarehouseID
+		res.Warehouse, err = adjustWarehouseStock(ctx, tx, id, res.WarehouseID, m.Delta)
+		if err != nil {
+			return res, err
+		}
+	} else {
+		ps, err := syncParentStock(ctx, tx, id)
+		if err != nil {
+			return res, err
+		}
+		res.Name, res.ParentStock, res.Reorder = ps.Name, ps.Stock, ps.Reorder
+	}
+
+	var variantID interface{}
+	if m.VariantID != 0 {
+		variantID = m.VariantID
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO stock_movements (product_id, variant_id, warehouse_id, delta, reason, reference, note)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		id, variantID, warehouseID, m.Delta, m.Reason, m.Reference, m.Note,
+	)
+	return res, err
+}
+
+func (h *productHandlers) adjustStock(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	var req StockAdjustment
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Delta == 0 {
+		http.Error(w, "delta must be non-zero", http.StatusBadRequest)
+		return
+	}
+	if err := validateStockReason(req.Reason); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateStockTarget(req.VariantID, req.WarehouseID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := applyStockDelta(r.Context(), tx, id, stockMovement{
+		VariantID:   req.VariantID,
+		WarehouseID: req.WarehouseID,
+		Delta:       req.Delta,
+		Reason:      req.Reason,
+		Note:        req.Note,
+	})
+	if err == errStockRejected {
+		tx.Rollback()
+		status, msg := h.explainRejectedAdjustment(r, id, req.VariantID, req.WarehouseID)
+		http.Error(w, msg, status)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	h.cache.Invalidate(r.Context(), id)
+	setStockGauge(id, res.Name, res.ParentStock)
+	loggerFrom(r.Context()).Info("stock changed",
+		"product_id", id, "variant_id", req.VariantID, "reason", req.Reason,
+		"delta", req.Delta, "previous_stock", res.Previous, "stock", res.Current)
+
+	event := map[string]interface{}{
+		"event_type":     "stock_changed",
+		"product_id":     id,
+		"name":           res.Name,
+		"delta":          req.Delta,
+		"stock":          res.Current,
+		"previous_stock": res.Previous,
+		"reason":         req.Reason,
+		"timestamp":      time.Now().Unix(),
+	}
+	if req.VariantID != 0 {
+		event["variant_id"] = req.VariantID
+		event["sku"] = res.SKU
+	} else {
+		event["warehouse_id"] = res.WarehouseID
+		event["warehouse_stock"] = res.Warehouse.Stock
+	}
+	h.events.Publish(event)
+	publishStockThresholdEvents(h.events, res.thresholdChange(id, req.VariantID, req.Delta))
+
+	response := map[string]interface{}{"product_id": id, "stock": res.ParentStock}
+	if req.VariantID != 0 {
+		response["variant_id"] = req.VariantID
+		response["variant_stock"] = res.Current
+	} else {
+		response["warehouse_id"] = res.WarehouseID
+		response["warehouse_stock"] = res.Warehouse.Stock
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StockLevel is the body of PUT /products/{id}/stock: an absolute stock
+// level for one warehouse's share of the product (the default warehouse
+// unless WarehouseID is set), or for one variant when VariantID is set,
+// with a reason from stockReasons.
+type StockLevel struct {
+	Stock       *int   `json:"stock"`
+	VariantID   int    `json:"variant_id,omitempty"`
+	WarehouseID int    `json:"warehouse_id,omitempty"`
+	Reason      string `json:"reason"`
+	Note        string `json:"note,omitempty"`
+}
+
+// setStock sets stock to an absolute value without touching any other
+// field, for callers that used to send a full PUT just to change stock.
+// The current level is locked and the difference applied through
+// applyStockDelta so it lands in the ledger like any other movement.
+func (h *productHandlers) setStock(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	var req StockLevel
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Stock == nil {
+		http.Error(w, "stock is required", http.StatusBadRequest)
+		return
+	}
+	if *req.Stock < 0 {
+		http.Error(w, "stock must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateStockReason(req.Reason); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateStockTarget(req.VariantID, req.WarehouseID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var current int
+	if req.VariantID != 0 {
+		err = tx.QueryRowContext(r.Context(),
+			"SELECT stock FROM product_variants WHERE id = $1 AND product_id = $2 FOR UPDATE", req.VariantID, id,
+		).Scan(&current)
+	} else {
+		// Lock the product first like every other stock writer, then read
+		// the warehouse's share under that lock.
+		err = tx.QueryRowContext(r.Context(),
+			"SELECT stock FROM products WHERE id = $1 FOR UPDATE", id,
+		).Scan(&current)
+		if err == nil {
+			warehouseID := req.WarehouseID
+			if warehouseID == 0 {
+				warehouseID = defaultWarehouseID
+			}
+			err = tx.QueryRowContext(r.Context(),
+				"SELECT COALESCE((SELECT stock FROM product_stock WHERE product_id = $1 AND warehouse_id = $2), 0)", id, warehouseID,
+			).Scan(&current)
+		}
+	}
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		status, msg := h.explainRejectedAdjustment(r, id, req.VariantID, req.WarehouseID)
+		http.Error(w, msg, status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A set to the current level is still recorded: it documents a count.
+	delta := *req.Stock - current
+	res, err := applyStockDelta(r.Context(), tx, id, stockMovement{
+		VariantID:   req.VariantID,
+		WarehouseID: req.WarehouseID,
+		Delta:       delta,
+		Reason:      req.Reason,
+		Note:        req.Note,
+	})
+	if err == errStockRejected {
+		tx.Rollback()
+		status, msg := h.explainRejectedAdjustment(r, id, req.VariantID, req.WarehouseID)
+		http.Error(w, msg, status)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	h.cache.Invalidate(r.Context(), id)
+	setStockGauge(id, res.Name, res.ParentStock)
+	if delta != 0 {
+		loggerFrom(r.Context()).Info("stock changed",
+			"product_id", id, "variant_id", req.VariantID, "reason", req.Reason,
+			"delta", delta, "previous_stock", res.Previous, "stock", res.Current)
+
+		event := map[string]interface{}{
+			"event_type":     "stock_changed",
+			"product_id":     id,
+			"name":           res.Name,
+			"delta":          delta,
+			"stock":          res.Current,
+			"previous_stock": res.Previous,
+			"reason":         req.Reason,
+			"timestamp":      time.Now().Unix(),
+		}
+		if req.VariantID != 0 {
+			event["variant_id"] = req.VariantID
+			event["sku"] = res.SKU
+		} else {
+			event["warehouse_id"] = res.WarehouseID
+			event["warehouse_stock"] = res.Warehouse.Stock
+		}
+		h.events.Publish(event)
+		publishStockThresholdEvents(h.events, res.thresholdChange(id, req.VariantID, delta))
+	}
+
+	response := map[string]interface{}{"product_id": id, "stock": res.ParentStock, "previous_stock": res.Previous}
+	if req.VariantID != 0 {
+		response["variant_id"] = req.VariantID
+		response["variant_stock"] = res.Current
+	} else {
+		response["warehouse_id"] = res.WarehouseID
+		response["warehouse_stock"] = res.Warehouse.Stock
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// explainRejectedAdjustment works out why a conditional stock update
+// matched no rows.
+func (h *productHandlers) explainRejectedAdjustment(r *http.Request, id string, variantID, warehouseID int) (int, string) {
+	if variantID != 0 {
+		var exists bool
+		err := h.store.QueryRowContext(r.Context(),
+			"SELECT EXISTS (SELECT 1 FROM product_variants WHERE id = $1 AND product_id = $2)", variantID, id,
+		).Scan(&exists)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		if !exists {
+			return http.StatusNotFound, "Variant not found"
+		}
+		return http.StatusConflict, "Insufficient stock"
+	}
+
+	var exists, hasVariants bool
+	err := h.store.QueryRowContext(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM products WHERE id = $1),
+			EXISTS (SELECT 1 FROM product_variants WHERE product_id = $1)`, id,
+	).Scan(&exists, &hasVariants)
+	switch {
+	case err != nil:
+		return http.StatusInternalServerError, err.Error()
+	case !exists:
+		return http.StatusNotFound, "Product not found"
+	case hasVariants:
+		return http.StatusBadRequest, "Product has variants; variant_id is required"
+	case warehouseID != 0 && warehouseID != defaultWarehouseID:
+		err = h.store.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM warehouses WHERE id = $1)", warehouseID).Scan(&exists)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		if !exists {
+			return http.StatusNotFound, "Warehouse not found"
+		}
+	}
+	return http.StatusConflict, "Insufficient stock"
+}
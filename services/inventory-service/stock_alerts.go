@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// lowStockThreshold is the stock level below which a product is considered
+// low on stock. Configured via LOW_STOCK_THRESHOLD.
+var lowStockThreshold = loadLowStockThreshold()
+
+func loadLowStockThreshold() int {
+	threshold, err := strconv.Atoi(getEnv("LOW_STOCK_THRESHOLD", "10"))
+	if err != nil || threshold < 0 {
+		log.Printf("Invalid LOW_STOCK_THRESHOLD, using 10")
+		return 10
+	}
+	return threshold
+}
+
+// stockChange describes a stock transition for a product, for one of its
+// variants when VariantID is set, or for one warehouse's share of it when
+// WarehouseID is set. Threshold overrides lowStockThreshold. When Reorder
+// is set, ParentPrevious and ParentCurrent carry the product-level stock
+// it is checked against.
+type stockChange struct {
+	ProductID   interface{}
+	Name        string
+	VariantID   int
+	SKU         string
+	WarehouseID int
+	Threshold   *int
+	Previous    int
+	Current     int
+
+	Reorder        *reorderPolicy
+	ParentPrevious int
+	ParentCurrent  int
+}
+
+// publishStockThresholdEvents publishes low_stock_alert to events when
+// stock drops below the threshold and stock_recovered when it climbs back
+// to or above it. Changes that stay on the same side of the threshold
+// publish nothing. It also publishes reorder_suggested when the product
+// crosses below its reorder point.
+func publishStockThresholdEvents(events eventPublisher, c stockChange) {
+	threshold := lowStockThreshold
+	if c.Threshold != nil {
+		threshold = *c.Threshold
+	}
+
+	var eventType string
+	switch {
+	case c.Previous >= threshold && c.Current < threshold:
+		eventType = "low_stock_alert"
+	case c.Previous < threshold && c.Current >= threshold:
+		eventType = "stock_recovered"
+	}
+
+	if eventType != "" {
+		event := map[string]interface{}{
+			"event_type":     eventType,
+			"product_id":     c.ProductID,
+			"name":           c.Name,
+			"stock":          c.Current,
+			"previous_stock": c.Previous,
+			"threshold":      threshold,
+			"timestamp":      time.Now().Unix(),
+		}
+		if c.VariantID != 0 {
+			event["variant_id"] = c.VariantID
+			event["sku"] = c.SKU
+		}
+		if c.WarehouseID != 0 {
+			event["warehouse_id"] = c.WarehouseID
+		}
+		events.Publish(event)
+	}
+
+	if c.Reorder != nil {
+		publishReorderSuggestion(events, c.ProductID, c.Name, c.ParentPrevious, c.ParentCurrent, *c.Reorder)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// capturePublishedEvents replaces publishEvent for the duration of a test
+// and returns a pointer to the events published.
+func capturePublishedEvents(t *testing.T) *[]map[string]interface{} {
+	t.Helper()
+	var events []map[string]interface{}
+	old := publishEvent
+	publishEvent = func(event map[string]interface{}) { events = append(events, event) }
+	t.Cleanup(func() { publishEvent = old })
+	return &events
+}
+
+func eventTypes(events []map[string]interface{}) []string {
+	types := make([]string, 0, len(events))
+	for _, e := range events {
+		types = append(types, e["event_type"].(string))
+	}
+	return types
+}
+
+func TestUpdateProductStockThresholdEvents(t *testing.T) {
+	tests := []struct {
+		name          string
+		previousStock int
+		newStock      int
+		wantEvents    []string
+	}{
+		{"edit without stock change below threshold", 3, 3, []string{"product_updated"}},
+		{"stays above threshold", 50, 40, []string{"product_updated"}},
+		{"crosses below threshold", 12, 5, []string{"product_updated", "low_stock_alert"}},
+		{"crosses back above threshold", 5, 15, []string{"product_updated", "stock_recovered"}},
+		{"lands exactly on threshold", 4, 10, []string{"product_updated", "stock_recovered"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			handlers, events := newTestProducts(mockDB)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+				WithArgs("1").
+				WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, tt.previousStock)...))
+			mock.ExpectQuery("UPDATE products SET").
+				WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, tt.newStock)...))
+			if tt.newStock != tt.previousStock {
+				expectWarehouseStock(mock, defaultWarehouseID, tt.newStock-tt.previousStock, tt.newStock)
+			}
+			mock.ExpectCommit()
+
+			body := fmt.Sprintf(`{"name":"Widget","description":"d","price":9.99,"stock":%d}`, tt.newStock)
+			req := mux.SetURLVars(httptest.NewRequest("PUT", "/products/1", strings.NewReader(body)), map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			handlers.updateProduct(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			got := eventTypes(*events)
+			if strings.Join(got, ",") != strings.Join(tt.wantEvents, ",") {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, got)
+			}
+			if len(*events) > 1 {
+				alert := (*events)[1]
+				if alert["previous_stock"] != tt.previousStock || alert["threshold"] != lowStockThreshold {
+					t.Errorf("unexpected alert payload: %v", alert)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
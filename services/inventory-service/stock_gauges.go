@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stockGauges tracks the series in stockLevels the way valuation tracks
+// values: seq orders every change, and replace keeps changes made after
+// its scan started, so a refresh never drops or rolls back a series set
+// while it ran.
+type stockGaugeSet struct {
+	mu      sync.Mutex
+	seq     uint64
+	names   map[string]string // id -> product_name label of its series
+	changed map[string]uint64 // id -> seq of the last incremental change, including removals
+}
+
+var stockGauges = newStockGaugeSet()
+
+func newStockGaugeSet() *stockGaugeSet {
+	return &stockGaugeSet{names: map[string]string{}, changed: map[string]uint64{}}
+}
+
+type stockLevel struct {
+	name  string
+	stock int
+}
+
+func (g *stockGaugeSet) set(id, name string, stock int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.put(id, stockLevel{name, stock})
+	g.seq++
+	g.changed[id] = g.seq
+}
+
+func (g *stockGaugeSet) remove(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stockLevels.DeletePartialMatch(prometheus.Labels{"product_id": id})
+	delete(g.names, id)
+	g.seq++
+	g.changed[id] = g.seq
+}
+
+// scanStarted returns a token to pass to replace once the scan finishes.
+func (g *stockGaugeSet) scanStarted() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.seq
+}
+
+// replace sets the scanned levels and deletes the series of products the
+// scan no longer found, leaving alone products changed incrementally
+// since the scan identified by token started.
+func (g *stockGaugeSet) replace(token uint64, scanned map[string]stockLevel) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id := range g.names {
+		if _, ok := scanned[id]; !ok && g.changed[id] <= token {
+			stockLevels.DeletePartialMatch(prometheus.Labels{"product_id": id})
+			delete(g.names, id)
+		}
+	}
+	for id, l := range scanned {
+		if g.changed[id] <= token {
+			g.put(id, l)
+		}
+	}
+	for id, s := range g.changed {
+		if s <= token {
+			delete(g.changed, id)
+		}
+	}
+}
+
+// put sets id's series, first removing it under a previous name so
+// renamed products don't leave ghosts.
+func (g *stockGaugeSet) put(id string, l stockLevel) {
+	if name, ok := g.names[id]; !ok || name != l.name {
+		stockLevels.DeletePartialMatch(prometheus.Labels{"product_id": id})
+	}
+	stockLevels.WithLabelValues(id, l.name).Set(float64(l.stock))
+	g.names[id] = l.name
+}
+
+// setStockGauge records the stock level for a product.
+func setStockGauge(id, name string, stock int) {
+	stockGauges.set(id, name, stock)
+	valuation.setStock(id, stock)
+}
+
+// setProductGauges records the stock and value of a product whose price
+// is known; archived products are dropped from both.
+func setProductGauges(id string, p *Product) {
+	if p.ArchivedAt != nil {
+		clearStockGauge(id)
+		return
+	}
+	valuation.set(id, valuedProduct{PriceCents: p.PriceCents, Currency: p.Currency, Stock: p.Stock})
+	setStockGauge(id, p.Name, p.Stock)
+}
+
+// clearStockGauge drops every series for a deleted or archived product.
+func clearStockGauge(id string) {
+	stockGauges.remove(id)
+	valuation.remove(id)
+}
+
+// refreshStockGauges rebuilds the stock and inventory value gauges from a
+// full table scan so restarts and any missed update paths converge on the
+// database state. Series are overwritten in place rather than reset, so
+// scrapes during a refresh still see every product.
+func refreshStockGauges(ctx context.Context) error {
+	token, gaugeToken := valuation.scanStarted(), stockGauges.scanStarted()
+	rows, err := db.QueryContext(ctx, "SELECT id, name, stock, price, currency FROM products WHERE archived_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	levels := map[string]stockLevel{}
+	values := map[string]valuedProduct{}
+	for rows.Next() {
+		var id, stock int
+		var name, currency string
+		var price centsColumn
+		if err := rows.Scan(&id, &name, &stock, &price, &currency); err != nil {
+			return err
+		}
+		levels[strconv.Itoa(id)] = stockLevel{name, stock}
+		values[strconv.Itoa(id)] = valuedProduct{PriceCents: int64(price), Currency: currency, Stock: stock}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stockGauges.replace(gaugeToken, levels)
+	valuation.replace(token, values)
+	return nil
+}
+
+func refreshStockGaugesLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := refreshStockGauges(ctx); err != nil {
+			log.Printf("Failed to refresh stock gauges: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStockGaugeRenameAndDelete(t *testing.T) {
+	stockLevels.Reset()
+	defer stockLevels.Reset()
+
+	setStockGauge("1", "Widget", 5)
+	setStockGauge("2", "Gadget", 7)
+	if n := testutil.CollectAndCount(stockLevels); n != 2 {
+		t.Fatalf("expected 2 series, got %d", n)
+	}
+
+	setStockGauge("1", "Widget Pro", 4)
+	if n := testutil.CollectAndCount(stockLevels); n != 2 {
+		t.Fatalf("expected rename to replace the series, got %d series", n)
+	}
+	if v := testutil.ToFloat64(stockLevels.WithLabelValues("1", "Widget Pro")); v != 4 {
+		t.Errorf("expected renamed series to report 4, got %v", v)
+	}
+
+	clearStockGauge("1")
+	if n := testutil.CollectAndCount(stockLevels); n != 1 {
+		t.Fatalf("expected delete to remove the series, got %d series", n)
+	}
+}
+
+func TestRefreshStockGaugesDropsMissingProducts(t *testing.T) {
+	stockLevels.Reset()
+	defer stockLevels.Reset()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	setStockGauge("99", "Deleted elsewhere", 3)
+
+	mock.ExpectQuery("SELECT id, name, stock, price, currency FROM products").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "stock", "price", "currency"}).
+			AddRow(1, "Widget", 5, "2.50", "USD").
+			AddRow(2, "Gadget", 7, "1.00", "USD"))
+
+	if err := refreshStockGauges(context.Background()); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	if n := testutil.CollectAndCount(stockLevels); n != 2 {
+		t.Errorf("expected 2 series after refresh, got %d", n)
+	}
+}
+
+func TestStockGaugeScanKeepsNewerUpdates(t *testing.T) {
+	g := newStockGaugeSet()
+	stockLevels.Reset()
+	defer stockLevels.Reset()
+
+	g.set("1", "Widget", 1)
+	g.set("3", "Sprocket", 1)
+
+	token := g.scanStarted()
+	// While the scan runs, product 1 is restocked and product 2 created.
+	g.set("1", "Widget", 50)
+	g.set("2", "Gadget", 5)
+
+	// The scan saw the old stock of 1, missed 2, and no longer sees 3.
+	g.replace(token, map[string]stockLevel{"1": {"Widget", 1}})
+
+	if v := testutil.ToFloat64(stockLevels.WithLabelValues("1", "Widget")); v != 50 {
+		t.Errorf("expected the restock to survive the scan, got %v", v)
+	}
+	if n := testutil.CollectAndCount(stockLevels); n != 2 {
+		t.Errorf("expected products 1 and 2, got %d series", n)
+	}
+
+	// A later scan is authoritative again.
+	g.replace(g.scanStarted(), map[string]stockLevel{})
+	if n := testutil.CollectAndCount(stockLevels); n != 0 {
+		t.Errorf("expected no series after empty scan, got %d", n)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// stockReasons are the reason codes accepted on manual stock changes
+// (POST and PUT /products/{id}/stock), from STOCK_ADJUSTMENT_REASONS.
+// Restocks record "restock" on their own and don't take a reason.
+var stockReasons = loadStockReasons()
+
+const defaultStockReasons = "shrinkage,damage,count_correction,return,sale,sale_reversal"
+
+func loadStockReasons() []string {
+	var reasons []string
+	for _, r := range strings.Split(getEnv("STOCK_ADJUSTMENT_REASONS", defaultStockReasons), ",") {
+		if r = strings.ToLower(strings.TrimSpace(r)); r != "" {
+			reasons = append(reasons, r)
+		}
+	}
+	if len(reasons) == 0 {
+		log.Printf("Invalid STOCK_ADJUSTMENT_REASONS, using %s", defaultStockReasons)
+		return strings.Split(defaultStockReasons, ",")
+	}
+	return reasons
+}
+
+// validateStockReason rejects missing or unknown reasons with a message
+// listing the valid ones.
+func validateStockReason(reason string) error {
+	for _, r := range stockReasons {
+		if r == reason {
+			return nil
+		}
+	}
+	valid := strings.Join(stockReasons, ", ")
+	if reason == "" {
+		return fmt.Errorf("reason is required; valid reasons: %s", valid)
+	}
+	return fmt.Errorf("unknown reason %q; valid reasons: %s", reason, valid)
+}
+
+// StockMovementEntry is one row of GET /products/{id}/stock-history.
+type StockMovementEntry struct {
+	ID          int64     `json:"id"`
+	ProductID   int       `json:"product_id"`
+	VariantID   *int      `json:"variant_id,omitempty"`
+	WarehouseID *int      `json:"warehouse_id,omitempty"`
+	Delta       int       `json:"delta"`
+	Reason      string    `json:"reason"`
+	Reference   string    `json:"reference"`
+	Note        string    `json:"note"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// stockHistoryFilter narrows the ledger by reason (any of Reasons) and
+// variant on top of the shared window and paging.
+type stockHistoryFilter struct {
+	historyFilter
+	Reasons   []string
+	VariantID int
+}
+
+func (f stockHistoryFilter) sql(productID string) (string, []interface{}) {
+	args := []interface{}{productID}
+	where := []string{"product_id = $1"}
+	if len(f.Reasons) > 0 {
+		where = append(where, "reason = ANY("+addArg(&args, pq.Array(f.Reasons))+")")
+	}
+	if f.VariantID != 0 {
+		where = append(where, "variant_id = "+addArg(&args, f.VariantID))
+	}
+	where = append(where, f.conditions("created_at", &args)...)
+	query := `SELECT id, product_id, variant_id, warehouse_id, delta, reason, reference, note, created_at
+		FROM stock_movements WHERE ` + strings.Join(where, " AND ") +
+		" ORDER BY created_at DESC, id DESC" + f.page(&args)
+	return query, args
+}
+
+// getStockHistory lists a product's stock movements, newest first. It
+// takes the history window and paging parameters plus repeatable
+// ?reason= and ?variant_id=. Any recorded reason can be filtered on,
+// including ones no longer configured.
+func getStockHistory(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	window, err := parseHistoryFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := stockHistoryFilter{historyFilter: window}
+	for _, reason := range query["reason"] {
+		if reason = strings.ToLower(strings.TrimSpace(reason)); reason != "" {
+			filter.Reasons = append(filter.Reasons, reason)
+		}
+	}
+	if raw := query.Get("variant_id"); raw != "" {
+		filter.VariantID, err = strconv.Atoi(raw)
+		if err != nil || filter.VariantID < 1 {
+			http.Error(w, "variant_id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var exists bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", id).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	sqlQuery, args := filter.sql(id)
+	rows, err := db.QueryContext(r.Context(), sqlQuery, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []StockMovementEntry{}
+	for rows.Next() {
+		var m StockMovementEntry
+		if err := rows.Scan(&m.ID, &m.ProductID, &m.VariantID, &m.WarehouseID, &m.Delta, &m.Reason, &m.Reference, &m.Note, &m.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, m)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
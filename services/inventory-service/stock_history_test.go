@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestValidateStockReason(t *testing.T) {
+	old := stockReasons
+	stockReasons = []string{"shrinkage", "damage"}
+	defer func() { stockReasons = old }()
+
+	if err := validateStockReason("damage"); err != nil {
+		t.Errorf("expected damage to be valid, got %v", err)
+	}
+	for _, reason := range []string{"", "theft"} {
+		err := validateStockReason(reason)
+		if err == nil || !strings.Contains(err.Error(), "shrinkage, damage") {
+			t.Errorf("expected %q to be rejected with the valid reasons listed, got %v", reason, err)
+		}
+	}
+}
+
+func TestStockChangeRequiresKnownReason(t *testing.T) {
+	handlers, _ := newTestProducts(nil)
+	for _, body := range []string{`{"delta":-1}`, `{"delta":-1,"reason":"theft"}`, `{"stock":3,"reason":"theft"}`} {
+		handler := handlers.adjustStock
+		if strings.Contains(body, `"stock"`) {
+			handler = handlers.setStock
+		}
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/products/1/stock", strings.NewReader(body)), map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "count_correction") {
+			t.Errorf("%s: expected 400 listing valid reasons, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAdjustStockEventCarriesReason(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	handlers, events := newTestProducts(mockDB)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+		WithArgs(-1, "1").
+		WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(40, "Widget")...))
+	expectWarehouseStock(mock, defaultWarehouseID, -1, 40)
+	mock.ExpectExec("INSERT INTO stock_movements").
+		WithArgs("1", nil, defaultWarehouseID, -1, "shrinkage", "", "cycle count found one missing").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	body := `{"delta":-1,"reason":"shrinkage","note":"cycle count found one missing"}`
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/products/1/stock", strings.NewReader(body)), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	handlers.adjustStock(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(*events) != 1 || (*events)[0]["reason"] != "shrinkage" {
+		t.Errorf("expected a stock_changed event with reason shrinkage, got %v", *events)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStockHistoryFilterSQL(t *testing.T) {
+	window, _ := parseHistoryFilter(url.Values{"from": {"2024-05-01"}, "limit": {"10"}})
+	f := stockHistoryFilter{historyFilter: window, Reasons: []string{"damage", "shrinkage"}, VariantID: 7}
+
+	query, args := f.sql("1")
+	want := "WHERE product_id = $1 AND reason = ANY($2) AND variant_id = $3 AND created_at >= $4 ORDER BY created_at DESC, id DESC LIMIT $5"
+	if !strings.Contains(query, want) {
+		t.Errorf("expected SQL containing %q, got %q", want, query)
+	}
+	if len(args) != 5 {
+		t.Errorf("expected 5 args, got %v", args)
+	}
+}
+
+func TestGetStockHistory(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM stock_movements WHERE product_id = \\$1 AND reason = ANY\\(\\$2\\)").
+		WithArgs("1", "{\"damage\"}", defaultHistoryLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "variant_id", "warehouse_id", "delta", "reason", "reference", "note", "created_at"}).
+			AddRow(3, 1, nil, 1, -2, "damage", "", "dropped pallet", time.Now()))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/products/1/stock-history?reason=Damage", nil), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	getStockHistory(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var history []StockMovementEntry
+	json.NewDecoder(w.Body).Decode(&history)
+	if len(history) != 1 || history[0].Reason != "damage" || history[0].VariantID != nil || history[0].Delta != -2 {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
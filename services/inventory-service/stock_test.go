@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestAdjustStock(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantEvents []string
+	}{
+		{
+			name: "product decrement",
+			body: `{"delta":-2,"reason":"damage"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WithArgs(-2, "1").
+					WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(20, "Widget")...))
+				expectWarehouseStock(mock, defaultWarehouseID, -2, 20)
+				mock.ExpectExec("INSERT INTO stock_movements").
+					WithArgs("1", nil, defaultWarehouseID, -2, "damage", "", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"stock_changed"},
+		},
+		{
+			name: "variant crosses low stock threshold",
+			body: `{"delta":-3,"variant_id":7,"reason":"damage"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE product_variants SET stock = stock \\+ \\$1").
+					WithArgs(-3, 7, "1").
+					WillReturnRows(sqlmock.NewRows([]string{"stock", "sku"}).AddRow(8, "TS-M"))
+				mock.ExpectQuery("SELECT 1 FROM products WHERE id = \\$1 FOR UPDATE").
+					WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+				mock.ExpectQuery("UPDATE products SET stock = \\(SELECT COALESCE\\(SUM\\(stock\\), 0\\)").
+					WithArgs("1").
+					WillReturnRows(reorderRows("name", "stock").AddRow(noReorder("T-Shirt", 40)...))
+				mock.ExpectExec("INSERT INTO stock_movements").
+					WithArgs("1", 7, nil, -3, "damage", "", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"stock_changed", "low_stock_alert"},
+		},
+		{
+			name: "insufficient stock",
+			body: `{"delta":-50,"reason":"sale"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WillReturnRows(sqlmock.NewRows([]string{"stock", "name"}))
+				mock.ExpectRollback()
+				mock.ExpectQuery("SELECT EXISTS").
+					WillReturnRows(sqlmock.NewRows([]string{"exists", "has_variants"}).AddRow(true, false))
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name: "variant product requires variant_id",
+			body: `{"delta":1,"reason":"return"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WillReturnRows(sqlmock.NewRows([]string{"stock", "name"}))
+				mock.ExpectRollback()
+				mock.ExpectQuery("SELECT EXISTS").
+					WillReturnRows(sqlmock.NewRows([]string{"exists", "has_variants"}).AddRow(true, true))
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "zero delta",
+			body:       `{"delta":0,"reason":"return"}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			handlers, events := newTestProducts(mockDB)
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest("POST", "/products/1/stock", strings.NewReader(tt.body)), map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			handlers.adjustStock(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got := strings.Join(eventTypes(*events), ","); got != strings.Join(tt.wantEvents, ",") {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSetStock(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantEvents []string
+	}{
+		{
+			name: "set below threshold",
+			body: `{"stock":4,"reason":"count_correction"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM products WHERE id = \\$1 FOR UPDATE").
+					WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("SELECT COALESCE\\(\\(SELECT stock FROM product_stock").
+					WithArgs("1", defaultWarehouseID).
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WithArgs(-16, "1").
+					WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(4, "Widget")...))
+				expectWarehouseStock(mock, defaultWarehouseID, -16, 4)
+				mock.ExpectExec("INSERT INTO stock_movements").
+					WithArgs("1", nil, defaultWarehouseID, -16, "count_correction", "", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"stock_changed", "low_stock_alert"},
+		},
+		{
+			name: "unchanged level is recorded without events",
+			body: `{"stock":20,"reason":"count_correction"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("SELECT COALESCE\\(\\(SELECT stock FROM product_stock").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WithArgs(0, "1").
+					WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(20, "Widget")...))
+				expectWarehouseStock(mock, defaultWarehouseID, 0, 20)
+				mock.ExpectExec("INSERT INTO stock_movements").
+					WithArgs("1", nil, defaultWarehouseID, 0, "count_correction", "", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "product not found",
+			body: `{"stock":5,"reason":"count_correction"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}))
+				mock.ExpectRollback()
+				mock.ExpectQuery("SELECT EXISTS").
+					WillReturnRows(sqlmock.NewRows([]string{"exists", "has_variants"}).AddRow(false, false))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "negative stock",
+			body:       `{"stock":-1,"reason":"count_correction"}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing stock",
+			body:       `{"name":"Widget"}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			handlers, events := newTestProducts(mockDB)
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest("PUT", "/products/1/stock", strings.NewReader(tt.body)), map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			handlers.setStock(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got := strings.Join(eventTypes(*events), ","); got != strings.Join(tt.wantEvents, ",") {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+// TestConcurrentStockDecrements hammers the adjustment endpoint from many
+// goroutines against a real Postgres and checks that stock never goes
+// negative and that parent totals stay equal to the sum of their variants.
+// Set TEST_DATABASE_URL to enable it.
+func TestConcurrentStockDecrements(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	testDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(20)
+
+	oldDB := db
+	db = testDB
+	defer func() { db = oldDB }()
+	initDB()
+
+	handlers := newProductHandlers(sqlStore{testDB}, discardEvents{}, noopCache{})
+
+	// decrement fires n concurrent -1 adjustments and returns how many of
+	// them succeeded.
+	decrement := func(t *testing.T, productID, body string, n int) int {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var succeeded int
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := mux.SetURLVars(httptest.NewRequest("POST", "/products/"+productID+"/stock", strings.NewReader(body)),
+					map[string]string{"id": productID})
+				w := httptest.NewRecorder()
+				handlers.adjustStock(w, req)
+				switch w.Code {
+				case http.StatusOK:
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				case http.StatusConflict:
+				default:
+					t.Errorf("unexpected status %d: %s", w.Code, w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+		return succeeded
+	}
+
+	t.Run("product", func(t *testing.T) {
+		var id int
+		if err := db.QueryRow("INSERT INTO products (name, price, stock) VALUES ('concurrency-test', 1, 5) RETURNING id").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Exec("DELETE FROM products WHERE id = $1", id)
+		if _, err := db.Exec("INSERT INTO product_stock (product_id, warehouse_id, stock) VALUES ($1, $2, 5)", id, defaultWarehouseID); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := decrement(t, strconv.Itoa(id), `{"delta":-1,"reason":"sale"}`, 40); got != 5 {
+			t.Errorf("expected 5 successful decrements, got %d", got)
+		}
+
+		var stock, warehouseStock, moved int
+		db.QueryRow("SELECT stock FROM products WHERE id = $1", id).Scan(&stock)
+		db.QueryRow("SELECT stock FROM product_stock WHERE product_id = $1", id).Scan(&warehouseStock)
+		db.QueryRow("SELECT COALESCE(SUM(delta), 0) FROM stock_movements WHERE product_id = $1", id).Scan(&moved)
+		if stock != 0 || warehouseStock != 0 || moved != -5 {
+			t.Errorf("expected stock 0 and ledger -5, got stock %d, warehouse stock %d and ledger %d", stock, warehouseStock, moved)
+		}
+	})
+
+	t.Run("variants", func(t *testing.T) {
+		var id int
+		if err := db.QueryRow("INSERT INTO products (name, price, stock) VALUES ('concurrency-test', 1, 0) RETURNING id").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Exec("DELETE FROM products WHERE id = $1", id)
+
+		suffix := time.Now().UnixNano()
+		var variantIDs [2]int
+		for i := range variantIDs {
+			err := db.QueryRow("INSERT INTO product_variants (product_id, sku, stock) VALUES ($1, $2, 8) RETURNING id",
+				id, fmt.Sprintf("CONC-%d-%d", suffix, i)).Scan(&variantIDs[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Exec("UPDATE products SET stock = 16 WHERE id = $1", id)
+
+		var wg sync.WaitGroup
+		var succeeded [2]int
+		for i, variantID := range variantIDs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				succeeded[i] = decrement(t, strconv.Itoa(id), fmt.Sprintf(`{"delta":-1,"variant_id":%d,"reason":"sale"}`, variantID), 20)
+			}()
+		}
+		wg.Wait()
+
+		if succeeded != [2]int{8, 8} {
+			t.Errorf("expected 8 successful decrements per variant, got %v", succeeded)
+		}
+		var stock, variantSum int
+		db.QueryRow("SELECT stock FROM products WHERE id = $1", id).Scan(&stock)
+		db.QueryRow("SELECT SUM(stock) FROM product_variants WHERE product_id = $1", id).Scan(&variantSum)
+		if stock != 0 || variantSum != 0 {
+			t.Errorf("expected parent and variants at 0, got parent %d and variants %d", stock, variantSum)
+		}
+	})
+}
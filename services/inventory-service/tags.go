@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxProductTags = 20
+	maxTagLength   = 50
+)
+
+// validTag keeps tags URL- and CSV-friendly: lowercase letters, digits,
+// '-', '_' and ':' (for namespaced tags like "season:summer").
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_:-]*$`)
+
+// normalizeTags lowercases and trims each tag and drops duplicates,
+// keeping the first occurrence's position.
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// validateTags checks tags after normalizeTags has run.
+func validateTags(tags []string) error {
+	if len(tags) > maxProductTags {
+		return fmt.Errorf("a product can have at most %d tags", maxProductTags)
+	}
+	for _, t := range tags {
+		if err := validateTag(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTag(t string) error {
+	if len(t) > maxTagLength {
+		return fmt.Errorf("tag %q is longer than %d characters", t, maxTagLength)
+	}
+	if !validTag.MatchString(t) {
+		return fmt.Errorf("tag %q must be lowercase letters, digits, '-', '_' or ':'", t)
+	}
+	return nil
+}
+
+func nonNilTags(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNormalizeAndValidateTags(t *testing.T) {
+	got := normalizeTags([]string{" Summer-Sale", "clearance", "summer-sale "})
+	if want := []string{"summer-sale", "clearance"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeTags = %v, want %v", got, want)
+	}
+	if normalizeTags(nil) != nil {
+		t.Error("expected omitted tags to stay nil")
+	}
+
+	tooMany := make([]string, maxProductTags+1)
+	for i := range tooMany {
+		tooMany[i] = "t" + strings.Repeat("x", i)
+	}
+	tests := []struct {
+		tags    []string
+		wantErr bool
+	}{
+		{[]string{"clearance", "season:summer", "top_100"}, false},
+		{[]string{}, false},
+		{[]string{""}, true},
+		{[]string{"half off"}, true},
+		{[]string{"-leading-dash"}, true},
+		{[]string{strings.Repeat("a", maxTagLength+1)}, true},
+		{tooMany, true},
+	}
+	for _, tt := range tests {
+		if err := validateTags(tt.tags); (err != nil) != tt.wantErr {
+			t.Errorf("validateTags(%v) = %v, wantErr %v", tt.tags, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProductTagWrites(t *testing.T) {
+	tagged := productRow(1, "Widget", "d", 9.99, 5)
+	tagged[10] = "{clearance}"
+
+	runHandlerCases(t, (*productHandlers).createProduct, []handlerCase{
+		{
+			name:   "tags are normalized",
+			method: "POST",
+			body:   `{"name":"Widget","price":1,"tags":["Clearance","clearance","summer-sale"]}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO products").
+					WithArgs("Widget", "", "1.00", "USD", 0, "[]", nil, "{\"clearance\",\"summer-sale\"}", nil, 0, "", "").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, tagged[7]))
+			},
+			wantStatus: http.StatusCreated,
+			wantEvents: []string{"product_created"},
+		},
+		{
+			name:       "invalid tag",
+			method:     "POST",
+			body:       `{"name":"Widget","price":1,"tags":["half off"]}`,
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	})
+
+	runHandlerCases(t, (*productHandlers).updateProduct, []handlerCase{
+		{
+			name:   "omitted tags are kept",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(tagged...))
+				mock.ExpectQuery("UPDATE products SET (.+) tags = \\$13").
+					WithArgs("Widget", "d", "9.99", 5, nil, "1", "USD", nil, nil, nil, nil, nil, "{\"clearance\"}").
+					WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 5)...))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"product_updated"},
+		},
+		{
+			name:   "empty list clears tags",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":5,"tags":[]}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(tagged...))
+				mock.ExpectQuery("UPDATE products SET (.+) tags = \\$13").
+					WithArgs("Widget", "d", "9.99", 5, nil, "1", "USD", nil, nil, nil, nil, nil, "{}").
+					WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 5)...))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"product_updated"},
+		},
+	})
+}
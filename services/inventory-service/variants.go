@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Variant is a sellable variation of a product (e.g. size or color) with
+// its own stock. A product's stock is the sum over its variants.
+type Variant struct {
+	ID                 int               `json:"id"`
+	ProductID          int               `json:"product_id"`
+	SKU                string            `json:"sku"`
+	Attributes         map[string]string `json:"attributes"`
+	PriceOverride      *float64          `json:"price_override,omitempty"` // Deprecated: derived from PriceOverrideCents.
+	PriceOverrideCents *int64            `json:"price_override_cents,omitempty"`
+	Stock              int               `json:"stock"`
+	CreatedAt          time.Time         `json:"created_at"`
+}
+
+const variantColumns = "id, product_id, sku, attributes, price_override, stock, created_at"
+
+// variantAttributes stores variant attributes in a JSONB column.
+type variantAttributes map[string]string
+
+func (a variantAttributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(map[string]string(a))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (a *variantAttributes) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = variantAttributes{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported attributes column type %T", src)
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*a = m
+	return nil
+}
+
+func scanVariant(row rowScanner, v *Variant) error {
+	var priceOverride nullCentsColumn
+	err := row.Scan(&v.ID, &v.ProductID, &v.SKU, (*variantAttributes)(&v.Attributes), &priceOverride, &v.Stock, &v.CreatedAt)
+	if err != nil {
+		return err
+	}
+	v.PriceOverrideCents = nil
+	if priceOverride.Valid {
+		v.PriceOverrideCents = &priceOverride.Cents
+	}
+	normalizeVariantPrice(v)
+	return nil
+}
+
+// normalizeVariantPrice mirrors normalizePrice for the optional override.
+func normalizeVariantPrice(v *Variant) {
+	if v.PriceOverrideCents == nil && v.PriceOverride != nil {
+		cents := floatToCents(*v.PriceOverride)
+		v.PriceOverrideCents = &cents
+	}
+	v.PriceOverride = nil
+	if v.PriceOverrideCents != nil {
+		price := centsToFloat(*v.PriceOverrideCents)
+		v.PriceOverride = &price
+	}
+}
+
+// priceOverrideValue converts the optional override for a DECIMAL column.
+func priceOverrideValue(v *Variant) interface{} {
+	if v.PriceOverrideCents == nil {
+		return nil
+	}
+	return centsColumn(*v.PriceOverrideCents)
+}
+
+func validateVariant(v *Variant) error {
+	normalizeVariantPrice(v)
+	if v.SKU == "" {
+		return errors.New("sku is required")
+	}
+	if v.Stock < 0 {
+		return errors.New("stock must not be negative")
+	}
+	if v.PriceOverrideCents != nil && *v.PriceOverrideCents < 0 {
+		return errors.New("price_override must not be negative")
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func loadVariants(ctx context.Context, q dbExecutor, productID string) ([]Variant, error) {
+	rows, err := q.QueryContext(ctx, "SELECT "+variantColumns+" FROM product_variants WHERE product_id = $1 ORDER BY id", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []Variant
+	for rows.Next() {
+		var v Variant
+		if err := scanVariant(rows, &v); err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
+
+// parentStock is a product's state after syncParentStock.
+type parentStock struct {
+	Name    string
+	Stock   int
+	Reorder reorderPolicy
+}
+
+// syncParentStock sets the product's stock to the sum over its variants and
+// returns the product's name, new stock and purchasing data. Variant stock
+// isn't split by warehouse, so any product_stock rows left from before
+// the product had variants are dropped.
+//
+// The product row is locked in its own statement first: under READ
+// COMMITTED each statement takes a fresh snapshot, so the SUM below then
+// sees variant changes committed by whoever held the lock before us.
+// Summing in the UPDATE alone would use a snapshot from before the wait and
+// silently drop a concurrent change to a sibling variant.
+func syncParentStock(ctx context.Context, q dbExecutor, productID string) (parentStock, error) {
+	var ps parentStock
+	var locked int
+	err := q.QueryRowContext(ctx, "SELECT 1 FROM products WHERE id = $1 FOR UPDATE", productID).Scan(&locked)
+	if err != nil {
+		return ps, err
+	}
+	err = q.QueryRowContext(ctx,
+		`WITH unwarehoused AS (DELETE FROM product_stock WHERE product_id = $1)
+		UPDATE products SET stock = (SELECT COALESCE(SUM(stock), 0) FROM product_variants WHERE product_id = $1)
+		WHERE id = $1 RETURNING name, stock, `+reorderColumns, productID,
+	).Scan(append([]interface{}{&ps.Name, &ps.Stock}, ps.Reorder.dest()...)...)
+	return ps, err
+}
+
+func (h *productHandlers) getVariants(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var exists bool
+	err := h.store.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", id).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	variants, err := loadVariants(r.Context(), h.store, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if variants == nil {
+		variants = []Variant{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(variants)
+}
+
+func (h *productHandlers) getVariant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var v Variant
+	err := scanVariant(h.store.QueryRowContext(r.Context(),
+		"SELECT "+variantColumns+" FROM product_variants WHERE id = $1 AND product_id = $2",
+		vars["variantId"], vars["id"]), &v)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *productHandlers) createVariant(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	var v Variant
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateVariant(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(r.Context(),
+		`INSERT INTO product_variants (product_id, sku, attributes, price_override, stock)
+		SELECT id, $2, $3, $4, $5 FROM products WHERE id = $1
+		RETURNING id, product_id, created_at`,
+		id, v.SKU, variantAttributes(v.Attributes), priceOverrideValue(&v), v.Stock,
+	).Scan(&v.ID, &v.ProductID, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if isUniqueViolation(err) {
+		http.Error(w, "SKU already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ps, err := syncParentStock(r.Context(), tx, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if v.Attributes == nil {
+		v.Attributes = map[string]string{}
+	}
+
+	h.cache.Invalidate(r.Context(), id)
+	setStockGauge(id, ps.Name, ps.Stock)
+
+	h.events.Publish(map[string]interface{}{
+		"event_type": "variant_created",
+		"product_id": v.ProductID,
+		"variant_id": v.ID,
+		"sku":        v.SKU,
+		"stock":      v.Stock,
+		"timestamp":  time.Now().Unix(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *productHandlers) updateVariant(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	id, variantID := vars["id"], vars["variantId"]
+
+	var v Variant
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateVariant(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var previousStock int
+	err = tx.QueryRowContext(r.Context(),
+		"SELECT stock FROM product_variants WHERE id = $1 AND product_id = $2 FOR UPDATE", variantID, id,
+	).Scan(&previousStock)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = scanVariant(tx.QueryRowContext(r.Context(),
+		`UPDATE product_variants SET sku = $1, attributes = $2, price_override = $3, stock = $4
+		WHERE id = $5 RETURNING `+variantColumns,
+		v.SKU, variantAttributes(v.Attributes), priceOverrideValue(&v), v.Stock, variantID), &v)
+	if isUniqueViolation(err) {
+		http.Error(w, "SKU already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ps, err := syncParentStock(r.Context(), tx, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.cache.Invalidate(r.Context(), id)
+	setStockGauge(id, ps.Name, ps.Stock)
+
+	h.events.Publish(map[string]interface{}{
+		"event_type": "variant_updated",
+		"product_id": v.ProductID,
+		"variant_id": v.ID,
+		"sku":        v.SKU,
+		"stock":      v.Stock,
+		"timestamp":  time.Now().Unix(),
+	})
+	publishStockThresholdEvents(h.events, stockChange{
+		ProductID: v.ProductID, Name: ps.Name, VariantID: v.ID, SKU: v.SKU,
+		Previous: previousStock, Current: v.Stock,
+		Reorder: &ps.Reorder, ParentPrevious: ps.Stock - (v.Stock - previousStock), ParentCurrent: ps.Stock,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *productHandlers) deleteVariant(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	id, variantID := vars["id"], vars["variantId"]
+
+	tx, err := h.store.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), "DELETE FROM product_variants WHERE id = $1 AND product_id = $2", variantID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	}
+
+	ps, err := syncParentStock(r.Context(), tx, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.cache.Invalidate(r.Context(), id)
+	setStockGauge(id, ps.Name, ps.Stock)
+
+	vid, _ := strconv.Atoi(variantID)
+	h.events.Publish(map[string]interface{}{
+		"event_type": "variant_deleted",
+		"product_id": id,
+		"variant_id": vid,
+		"timestamp":  time.Now().Unix(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Variant deleted successfully"})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// variantRow returns variant 2 of product 1 in variantColumns order.
+func variantRow(sku string, stock int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "product_id", "sku", "attributes", "price_override", "stock", "created_at"}).
+		AddRow(2, 1, sku, `{"size":"M"}`, nil, stock, time.Now())
+}
+
+// expectSyncParentStock expects syncParentStock to leave product 1 at stock.
+func expectSyncParentStock(mock sqlmock.Sqlmock, stock int) {
+	mock.ExpectQuery("SELECT 1 FROM products WHERE id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("UPDATE products SET stock").
+		WithArgs("1").
+		WillReturnRows(reorderRows("name", "stock").AddRow(noReorder("Widget", stock)...))
+}
+
+func TestGetVariants(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).getVariants, []handlerCase{
+		{
+			name:   "lists variants",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT EXISTS").WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery("FROM product_variants WHERE product_id = \\$1").WithArgs("1").
+					WillReturnRows(variantRow("W-M", 5))
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "product not found",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT EXISTS").WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "database failure",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT EXISTS").WithArgs("1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery("FROM product_variants WHERE product_id = \\$1").WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestGetVariant(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).getVariant, []handlerCase{
+		{
+			name:   "found",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM product_variants WHERE id = \\$1 AND product_id = \\$2").
+					WithArgs("2", "1").
+					WillReturnRows(variantRow("W-M", 5))
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "not found",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM product_variants WHERE id = \\$1 AND product_id = \\$2").
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "database failure",
+			method: "GET",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM product_variants WHERE id = \\$1 AND product_id = \\$2").
+					WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestCreateVariant(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).createVariant, []handlerCase{
+		{
+			name:   "created",
+			method: "POST",
+			body:   `{"sku":"W-M","attributes":{"size":"M"},"stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO product_variants").
+					WithArgs("1", "W-M", sqlmock.AnyArg(), nil, 5).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "created_at"}).AddRow(2, 1, time.Now()))
+				expectSyncParentStock(mock, 5)
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusCreated,
+			wantEvents: []string{"variant_created"},
+		},
+		{
+			name:       "missing sku",
+			method:     "POST",
+			body:       `{"stock":5}`,
+			setup:      func(sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "negative stock",
+			method:     "POST",
+			body:       `{"sku":"W-M","stock":-1}`,
+			setup:      func(sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid JSON",
+			method:     "POST",
+			body:       `{`,
+			setup:      func(sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "product not found",
+			method: "POST",
+			body:   `{"sku":"W-M","stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO product_variants").WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "duplicate sku",
+			method: "POST",
+			body:   `{"sku":"W-M","stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO product_variants").WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:   "sync fails",
+			method: "POST",
+			body:   `{"sku":"W-M","stock":5}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO product_variants").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "created_at"}).AddRow(2, 1, time.Now()))
+				mock.ExpectQuery("SELECT 1 FROM products WHERE id = \\$1 FOR UPDATE").WillReturnError(errDBDown)
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestUpdateVariant(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).updateVariant, []handlerCase{
+		{
+			name:   "drops below the threshold",
+			method: "PUT",
+			body:   `{"sku":"W-M","stock":8}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM product_variants WHERE id = \\$1 AND product_id = \\$2 FOR UPDATE").
+					WithArgs("2", "1").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("UPDATE product_variants SET").
+					WithArgs("W-M", sqlmock.AnyArg(), nil, 8, "2").
+					WillReturnRows(variantRow("W-M", 8))
+				expectSyncParentStock(mock, 8)
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"variant_updated", "low_stock_alert"},
+		},
+		{
+			name:       "missing sku",
+			method:     "PUT",
+			body:       `{"stock":8}`,
+			setup:      func(sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "not found",
+			method: "PUT",
+			body:   `{"sku":"W-M","stock":8}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM product_variants").WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "duplicate sku",
+			method: "PUT",
+			body:   `{"sku":"W-L","stock":8}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM product_variants").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("UPDATE product_variants SET").WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:   "commit fails",
+			method: "PUT",
+			body:   `{"sku":"W-M","stock":8}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT stock FROM product_variants").
+					WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(20))
+				mock.ExpectQuery("UPDATE product_variants SET").WillReturnRows(variantRow("W-M", 8))
+				expectSyncParentStock(mock, 8)
+				mock.ExpectCommit().WillReturnError(errDBDown)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+func TestDeleteVariant(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).deleteVariant, []handlerCase{
+		{
+			name:   "deleted",
+			method: "DELETE",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM product_variants WHERE id = \\$1 AND product_id = \\$2").
+					WithArgs("2", "1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectSyncParentStock(mock, 0)
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"variant_deleted"},
+		},
+		{
+			name:   "not found",
+			method: "DELETE",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM product_variants").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "database failure",
+			method: "DELETE",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM product_variants").WillReturnError(errDBDown)
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	})
+}
+
+// unavailableStore is a productStore whose database can't be reached.
+type unavailableStore struct{ dbExecutor }
+
+func (unavailableStore) BeginTx(context.Context, *sql.TxOptions) (storeTx, error) {
+	return nil, errDBDown
+}
+
+func TestVariantWritesWithoutDatabase(t *testing.T) {
+	events := &recordedEvents{}
+	handlers := newProductHandlers(unavailableStore{}, events, noopCache{})
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"create": handlers.createVariant,
+		"update": handlers.updateVariant,
+		"delete": handlers.deleteVariant,
+	} {
+		req := httptest.NewRequest("POST", "/products/1/variants/2", strings.NewReader(`{"sku":"W-M","stock":1}`))
+		req = mux.SetURLVars(req, map[string]string{"id": "1", "variantId": "2"})
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected 500, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events, got %q", eventTypes(*events))
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// defaultWarehouseID is the warehouse seeded by migration 0010. Stock
+// changes that don't name a warehouse, and stock set through the product
+// endpoints, land there.
+const defaultWarehouseID = 1
+
+// lowStockScope decides what low_stock_alert and stock_recovered are
+// evaluated on for products without variants: "aggregate" (the default)
+// checks the product's total against LOW_STOCK_THRESHOLD, "warehouse"
+// checks the changed warehouse against its own low_stock_threshold, or
+// LOW_STOCK_THRESHOLD when it has none. Configured via LOW_STOCK_SCOPE.
+var lowStockScope = loadLowStockScope()
+
+func loadLowStockScope() string {
+	scope := strings.ToLower(getEnv("LOW_STOCK_SCOPE", "aggregate"))
+	if scope != "aggregate" && scope != "warehouse" {
+		log.Printf("Invalid LOW_STOCK_SCOPE, using aggregate")
+		return "aggregate"
+	}
+	return scope
+}
+
+// Warehouse is a stock location.
+type Warehouse struct {
+	ID                int       `json:"id"`
+	Code              string    `json:"code"`
+	Name              string    `json:"name"`
+	LowStockThreshold *int      `json:"low_stock_threshold"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// WarehouseStock is one warehouse's share of a product's stock.
+type WarehouseStock struct {
+	WarehouseID int    `json:"warehouse_id"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Stock       int    `json:"stock"`
+	Threshold   int    `json:"low_stock_threshold"`
+	LowStock    bool   `json:"low_stock"`
+}
+
+// warehouseLevel is a warehouse's stock after adjustWarehouseStock.
+// Threshold is the warehouse's own low-stock threshold, if it has one.
+type warehouseLevel struct {
+	Stock     int
+	Threshold *int
+}
+
+// adjustWarehouseStock applies delta to one warehouse's share of a
+// product's stock inside tx. Decrements are conditional like the product
+// update. A warehouse that doesn't hold enough, or doesn't exist, returns
+// errStockRejected; explainRejectedAdjustment tells the two apart.
+// Callers update products.stock first, so the product row lock orders
+// concurrent writers to the same product.
+func adjustWarehouseStock(ctx context.Context, tx dbExecutor, productID string, warehouseID, delta int) (warehouseLevel, error) {
+	var wl warehouseLevel
+	var err error
+	if delta >= 0 {
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO product_stock (product_id, warehouse_id, stock) VALUES ($1, $2, $3)
+			ON CONFLICT (product_id, warehouse_id) DO UPDATE SET stock = product_stock.stock + EXCLUDED.stock
+			RETURNING stock, (SELECT low_stock_threshold FROM warehouses WHERE id = $2)`,
+			productID, warehouseID, delta,
+		).Scan(&wl.Stock, &wl.Threshold)
+	} else {
+		err = tx.QueryRowContext(ctx,
+			`UPDATE product_stock SET stock = stock + $3
+			WHERE product_id = $1 AND warehouse_id = $2 AND stock + $3 >= 0
+			RETURNING stock, (SELECT low_stock_threshold FROM warehouses WHERE id = $2)`,
+			productID, warehouseID, delta,
+		).Scan(&wl.Stock, &wl.Threshold)
+	}
+	var pqErr *pq.Error
+	if err == sql.ErrNoRows || (errors.As(err, &pqErr) && pqErr.Code == "23503") {
+		return wl, errStockRejected
+	}
+	return wl, err
+}
+
+// withDefaultWarehouseStock wraps an INSERT INTO products ... RETURNING
+// id, created_at, stock so the new products' stock is recorded in the
+// default warehouse by the same statement.
+func withDefaultWarehouseStock(insert string) string {
+	return `WITH inserted AS (` + insert + `),
+		warehoused AS (INSERT INTO product_stock (product_id, warehouse_id, stock)
+			SELECT id, ` + strconv.Itoa(defaultWarehouseID) + `, stock FROM inserted)
+		SELECT id, created_at FROM inserted`
+}
+
+func getWarehouses(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT id, code, name, low_stock_threshold, created_at FROM warehouses ORDER BY id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	warehouses := []Warehouse{}
+	for rows.Next() {
+		var wh Warehouse
+		if err := rows.Scan(&wh.ID, &wh.Code, &wh.Name, &wh.LowStockThreshold, &wh.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		warehouses = append(warehouses, wh)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouses)
+}
+
+func createWarehouse(w http.ResponseWriter, r *http.Request) {
+	var wh Warehouse
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh.Code = strings.ToLower(strings.TrimSpace(wh.Code))
+	if wh.Code == "" || wh.Name == "" {
+		http.Error(w, "code and name are required", http.StatusBadRequest)
+		return
+	}
+	if wh.LowStockThreshold != nil && *wh.LowStockThreshold < 0 {
+		http.Error(w, "low_stock_threshold must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRowContext(r.Context(),
+		"INSERT INTO warehouses (code, name, low_stock_threshold) VALUES ($1, $2, $3) RETURNING id, created_at",
+		wh.Code, wh.Name, wh.LowStockThreshold,
+	).Scan(&wh.ID, &wh.CreatedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "Warehouse code already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wh)
+}
+
+// getProductStock returns a product's total stock and its per-warehouse
+// breakdown. Products with variants have no breakdown: their stock is
+// tracked per variant instead.
+func getProductStock(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := mux.Vars(r)["id"]
+
+	var stock int
+	err := db.QueryRowContext(r.Context(), "SELECT stock FROM products WHERE id = $1", id).Scan(&stock)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT w.id, w.code, w.name, ps.stock, COALESCE(w.low_stock_threshold, $2)
+		FROM product_stock ps JOIN warehouses w ON w.id = ps.warehouse_id
+		WHERE ps.product_id = $1 ORDER BY w.id`, id, lowStockThreshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	breakdown := []WarehouseStock{}
+	for rows.Next() {
+		var ws WarehouseStock
+		if err := rows.Scan(&ws.WarehouseID, &ws.Code, &ws.Name, &ws.Stock, &ws.Threshold); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ws.LowStock = ws.Stock < ws.Threshold
+		breakdown = append(breakdown, ws)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbQueryDuration.Observe(time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"product_id": id,
+		"stock":      stock,
+		"warehouses": breakdown,
+	})
+}
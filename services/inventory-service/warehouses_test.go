@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// expectWarehouseStock expects adjustWarehouseStock to move product 1's
+// share of warehouseID by delta, leaving stock behind.
+func expectWarehouseStock(mock sqlmock.Sqlmock, warehouseID, delta, stock int) {
+	query := "INSERT INTO product_stock"
+	if delta < 0 {
+		query = "UPDATE product_stock SET stock = stock \\+ \\$3"
+	}
+	mock.ExpectQuery(query).
+		WithArgs("1", warehouseID, delta).
+		WillReturnRows(sqlmock.NewRows([]string{"stock", "low_stock_threshold"}).AddRow(stock, nil))
+}
+
+func TestAdjustStockInWarehouse(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		scope      string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantEvents []string
+	}{
+		{
+			name:  "aggregate scope ignores the warehouse level",
+			body:  `{"delta":-5,"warehouse_id":2,"reason":"damage"}`,
+			scope: "aggregate",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WithArgs(-5, "1").
+					WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(40, "Widget")...))
+				mock.ExpectQuery("UPDATE product_stock SET stock = stock \\+ \\$3").
+					WithArgs("1", 2, -5).
+					WillReturnRows(sqlmock.NewRows([]string{"stock", "low_stock_threshold"}).AddRow(1, nil))
+				mock.ExpectExec("INSERT INTO stock_movements").
+					WithArgs("1", nil, 2, -5, "damage", "", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"stock_changed"},
+		},
+		{
+			name:  "warehouse scope uses the warehouse threshold",
+			body:  `{"delta":-5,"warehouse_id":2,"reason":"damage"}`,
+			scope: "warehouse",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(40, "Widget")...))
+				mock.ExpectQuery("UPDATE product_stock SET stock = stock \\+ \\$3").
+					WithArgs("1", 2, -5).
+					WillReturnRows(sqlmock.NewRows([]string{"stock", "low_stock_threshold"}).AddRow(4, 5))
+				mock.ExpectExec("INSERT INTO stock_movements").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"stock_changed", "low_stock_alert"},
+		},
+		{
+			name:  "unknown warehouse",
+			body:  `{"delta":3,"warehouse_id":9,"reason":"return"}`,
+			scope: "aggregate",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE products SET stock = stock \\+ \\$1").
+					WillReturnRows(reorderRows("stock", "name").AddRow(noReorder(43, "Widget")...))
+				mock.ExpectQuery("INSERT INTO product_stock").
+					WillReturnError(&pq.Error{Code: "23503"})
+				mock.ExpectRollback()
+				mock.ExpectQuery("SELECT EXISTS").
+					WillReturnRows(sqlmock.NewRows([]string{"exists", "has_variants"}).AddRow(true, false))
+				mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM warehouses WHERE id = \\$1\\)").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "warehouse with variant",
+			body:       `{"delta":1,"variant_id":7,"warehouse_id":2,"reason":"return"}`,
+			scope:      "aggregate",
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to open sqlmock: %s", err)
+			}
+			defer mockDB.Close()
+
+			oldScope := lowStockScope
+			lowStockScope = tt.scope
+			defer func() { lowStockScope = oldScope }()
+
+			handlers, events := newTestProducts(mockDB)
+			tt.setup(mock)
+
+			req := mux.SetURLVars(httptest.NewRequest("POST", "/products/1/stock", strings.NewReader(tt.body)), map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			handlers.adjustStock(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got := strings.Join(eventTypes(*events), ","); got != strings.Join(tt.wantEvents, ",") {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetProductStock(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	defer mockDB.Close()
+
+	oldDB := db
+	db = mockDB
+	defer func() { db = oldDB }()
+
+	mock.ExpectQuery("SELECT stock FROM products WHERE id = \\$1").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(25))
+	mock.ExpectQuery("SELECT (.+) FROM product_stock ps JOIN warehouses w").
+		WithArgs("1", lowStockThreshold).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "code", "name", "stock", "threshold"}).
+			AddRow(1, "default", "Default", 20, 10).
+			AddRow(2, "east", "East DC", 5, 10))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/products/1/stock", nil), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	getProductStock(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Stock      int              `json:"stock"`
+		Warehouses []WarehouseStock `json:"warehouses"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Stock != 25 || len(resp.Warehouses) != 2 || resp.Warehouses[0].LowStock || !resp.Warehouses[1].LowStock {
+		t.Errorf("unexpected breakdown %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateProductStockSplitAcrossWarehouses(t *testing.T) {
+	runHandlerCases(t, (*productHandlers).updateProduct, []handlerCase{
+		{
+			name:   "default warehouse can't cover the decrease",
+			method: "PUT",
+			body:   `{"name":"Widget","description":"d","price":9.99,"stock":2}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM products WHERE id = \\$1 FOR UPDATE").
+					WillReturnRows(newProductRows().AddRow(productRow(1, "Widget", "d", 9.99, 10)...))
+				mock.ExpectQuery("UPDATE products SET").
+					WillReturnRows(reorderRows("images", "stock").AddRow(noReorder(`[]`, 2)...))
+				mock.ExpectQuery("UPDATE product_stock SET stock = stock \\+ \\$3").
+					WithArgs("1", defaultWarehouseID, -8).
+					WillReturnRows(sqlmock.NewRows([]string{"stock", "low_stock_threshold"}))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusConflict,
+		},
+	})
+}
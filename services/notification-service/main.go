@@ -32,6 +32,7 @@ var (
 			Buckets: prometheus.DefBuckets,
 		},
 	)
+	consumerStats = newConsumerMetrics("notification")
 )
 
 func main() {
@@ -77,6 +78,7 @@ func main() {
 	// Start consuming from all topics
 	for i, reader := range readers {
 		go consumeMessages(ctx, reader, topics[i])
+		go consumerStats.watch(ctx, reader, 15*time.Second)
 	}
 
 	log.Println("Notification Service started, waiting for messages...")
@@ -105,6 +107,7 @@ func consumeMessages(ctx context.Context, reader *kafka.Reader, topic string) {
 				log.Printf("Error reading message from %s: %v", topic, err)
 				continue
 			}
+			consumerStats.messageReceived(topic)
 
 			// Parse message
 			var event map[string]interface{}
@@ -136,10 +139,30 @@ func processNotification(event map[string]interface{}, eventType string) {
 	case "product_updated":
 		log.Printf("🔄 NOTIFICATION: Product updated! Product ID: %s, Name: %s, Stock: %.0f",
 			event["product_id"], event["name"], event["stock"])
+		if changes, ok := event["changes"].(map[string]interface{}); ok {
+			for field, c := range changes {
+				if change, ok := c.(map[string]interface{}); ok {
+					log.Printf("   %s changed from %v to %v", field, change["old"], change["new"])
+				}
+			}
+		}
 
 	case "low_stock_alert":
-		log.Printf("⚠️  ALERT: Low stock warning! Product ID: %s, Name: %s, Remaining stock: %.0f",
-			event["product_id"], event["name"], event["stock"])
+		log.Printf("⚠️  ALERT: Low stock warning! Product ID: %s, Name: %s, Remaining stock: %.0f (was %.0f, threshold %.0f)",
+			event["product_id"], event["name"], event["stock"], event["previous_stock"], event["threshold"])
+
+	case "stock_recovered":
+		log.Printf("✅ NOTIFICATION: Stock recovered! Product ID: %s, Name: %s, Stock: %.0f (threshold %.0f)",
+			event["product_id"], event["name"], event["stock"], event["threshold"])
+
+	case "product_restocked":
+		log.Printf("🚚 NOTIFICATION: Product restocked! Product ID: %s, Name: %s, Quantity: %.0f, Stock: %.0f, Supplier ref: %s",
+			event["product_id"], event["name"], event["quantity"], event["stock"], event["supplier_ref"])
+
+	case "reorder_suggested":
+		log.Printf("🛒 NOTIFICATION: Reorder suggested! Product ID: %v, Name: %s, Stock: %.0f (reorder point %.0f), Order %.0f from %s <%s>",
+			event["product_id"], event["name"], event["stock"], event["reorder_point"],
+			event["suggested_quantity"], event["supplier_name"], event["supplier_contact"])
 
 	case "product_deleted":
 		log.Printf("🗑️  NOTIFICATION: Product deleted! Product ID: %s",
@@ -149,6 +172,26 @@ func processNotification(event map[string]interface{}, eventType string) {
 		log.Printf("💸 NOTIFICATION: Payment processed! Payment ID: %.0f, Order ID: %.0f, Amount: %.2f, Status: %s",
 			event["payment_id"], event["order_id"], event["amount"], event["status"])
 
+	case "payment_authorized":
+		log.Printf("🔒 NOTIFICATION: Payment authorized! Payment ID: %.0f, Order ID: %.0f, Amount: %.2f %s (captured when the order ships)",
+			event["payment_id"], event["order_id"], event["amount"], event["currency"])
+
+	case "payment_captured":
+		log.Printf("💳 NOTIFICATION: Payment captured! Payment ID: %.0f, Order ID: %.0f, Amount: %.2f %s",
+			event["payment_id"], event["order_id"], event["amount"], event["currency"])
+
+	case "payment_voided":
+		log.Printf("🚫 NOTIFICATION: Payment authorization voided! Payment ID: %.0f, Order ID: %.0f, Amount: %.2f %s",
+			event["payment_id"], event["order_id"], event["amount"], event["currency"])
+
+	case "payment_failed":
+		log.Printf("❌ NOTIFICATION: Payment failed! Payment ID: %.0f, Order ID: %.0f, Amount: %.2f %s, Reason: %s",
+			event["payment_id"], event["order_id"], event["amount"], event["currency"], event["reason"])
+
+	case "payment_refunded":
+		log.Printf("↩️  NOTIFICATION: Payment refunded! Refund ID: %.0f, Payment ID: %.0f, Order ID: %.0f, Amount: %.2f, Remaining: %.2f",
+			event["refund_id"], event["payment_id"], event["order_id"], event["amount"], event["remaining"])
+
 	default:
 		log.Printf("📨 NOTIFICATION: Unknown event type: %s", eventType)
 	}
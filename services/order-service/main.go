@@ -3,18 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -26,10 +30,67 @@ type Order struct {
 	ID         int       `json:"id"`
 	UserID     int       `json:"user_id"`
 	ProductID  int       `json:"product_id"`
+	VariantID  int       `json:"variant_id,omitempty"`
 	Quantity   int       `json:"quantity"`
 	TotalPrice float64   `json:"total_price"`
 	Status     string    `json:"status"`
 	CreatedAt  time.Time `json:"created_at"`
+
+	// PaymentMethod is passed on to payment-service in order_created; it
+	// isn't stored with the order.
+	PaymentMethod string `json:"payment_method,omitempty"`
+}
+
+// OrderCreatedEvent is the order_created message published for each new
+// order. payment-service decodes it into a matching type; keep the two in
+// step.
+type OrderCreatedEvent struct {
+	EventType     string  `json:"event_type"`
+	EventID       string  `json:"event_id"`
+	OrderID       int     `json:"order_id"`
+	ProductID     int     `json:"product_id"`
+	VariantID     int     `json:"variant_id,omitempty"`
+	Quantity      int     `json:"quantity"`
+	TotalPrice    float64 `json:"total_price"`
+	PaymentMethod string  `json:"payment_method,omitempty"`
+	Timestamp     int64   `json:"timestamp"`
+}
+
+func newOrderCreatedEvent(order Order) OrderCreatedEvent {
+	return OrderCreatedEvent{
+		EventType:     "order_created",
+		EventID:       newEventID(),
+		OrderID:       order.ID,
+		ProductID:     order.ProductID,
+		VariantID:     order.VariantID,
+		Quantity:      order.Quantity,
+		TotalPrice:    order.TotalPrice,
+		PaymentMethod: order.PaymentMethod,
+		Timestamp:     time.Now().Unix(),
+	}
+}
+
+// newEventID returns a random id that lets consumers' logs follow one
+// event.
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// paymentMethods are the payment methods an order can be placed with.
+var paymentMethods = map[string]bool{"card": true, "wallet": true, "invoice": true}
+
+// resolvePaymentMethod defaults an empty payment method to "card" and
+// rejects ones payment-service doesn't accept.
+func resolvePaymentMethod(method string) (string, error) {
+	if method == "" {
+		return "card", nil
+	}
+	if !paymentMethods[method] {
+		return "", fmt.Errorf("payment_method must be one of card, wallet, invoice")
+	}
+	return method, nil
 }
 
 // Product represents product info from inventory service
@@ -38,13 +99,66 @@ type Product struct {
 	Name  string  `json:"name"`
 	Price float64 `json:"price"`
 	Stock int     `json:"stock"`
+
+	// EffectivePrice is the price after any running sale. Inventory
+	// services that predate sales don't send it.
+	EffectivePrice *float64 `json:"effective_price"`
+
+	// Variants, when the product has any, hold its stock; orders for it
+	// must name one.
+	Variants []Variant `json:"variants"`
+}
+
+// Variant is one variant of a product, from inventory service.
+type Variant struct {
+	ID            int      `json:"id"`
+	PriceOverride *float64 `json:"price_override"`
+	Stock         int      `json:"stock"`
+}
+
+// unitPrice is what one unit of the product costs right now.
+func (p *Product) unitPrice() float64 {
+	if p.EffectivePrice != nil {
+		return *p.EffectivePrice
+	}
+	return p.Price
+}
+
+// stockFor returns the stock and unit price of the variant of p with
+// variantID, or of p itself for 0. A product with variants must be
+// ordered by variant, as inventory only takes stock from those.
+func (p *Product) stockFor(variantID int) (stock int, price float64, err error) {
+	if variantID == 0 {
+		if len(p.Variants) > 0 {
+			return 0, 0, fmt.Errorf("product %d has variants; variant_id is required", p.ID)
+		}
+		return p.Stock, p.unitPrice(), nil
+	}
+	for _, v := range p.Variants {
+		if v.ID == variantID {
+			if v.PriceOverride != nil {
+				return v.Stock, *v.PriceOverride, nil
+			}
+			return v.Stock, p.unitPrice(), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("variant %d not found for product %d", variantID, p.ID)
+}
+
+// stockKey is what an order takes stock from: a product, or one of its
+// variants.
+type stockKey struct {
+	ProductID int
+	VariantID int
 }
 
 type BulkOrderRequest struct {
 	Items []struct {
 		ProductID int `json:"product_id"`
+		VariantID int `json:"variant_id"`
 		Quantity  int `json:"quantity"`
 	} `json:"items"`
+	PaymentMethod string `json:"payment_method"`
 }
 
 // Prometheus metrics
@@ -176,6 +290,10 @@ func initDB() {
 	if err != nil {
 		log.Println("Warning: Failed to add user_id column (might already exist or other error):", err)
 	}
+	_, err = db.Exec("ALTER TABLE orders ADD COLUMN IF NOT EXISTS variant_id INTEGER;")
+	if err != nil {
+		log.Println("Warning: Failed to add variant_id column (might already exist or other error):", err)
+	}
 
 	log.Println("Database schema initialized")
 }
@@ -208,14 +326,22 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 	
 	var orderReq struct {
 		ProductID int `json:"product_id"`
+		VariantID int `json:"variant_id"`
 		Quantity  int `json:"quantity"`
 		UserID    int `json:"user_id"`
+
+		PaymentMethod string `json:"payment_method"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&orderReq); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	paymentMethod, err := resolvePaymentMethod(orderReq.PaymentMethod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Fetch product info from inventory service
 	inventoryURL := getEnv("INVENTORY_SERVICE_URL", "http://localhost:8081")
@@ -226,52 +352,63 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	stock, unitPrice, err := product.stockFor(orderReq.VariantID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		ordersTotal.WithLabelValues("failed").Inc()
+		return
+	}
+
 	// Check stock availability
-	if product.Stock < orderReq.Quantity {
+	if stock < orderReq.Quantity {
 		http.Error(w, "Insufficient stock", http.StatusBadRequest)
 		ordersTotal.WithLabelValues("failed").Inc()
 		return
 	}
 
 	// Calculate total price
-	totalPrice := product.Price * float64(orderReq.Quantity)
+	totalPrice := unitPrice * float64(orderReq.Quantity)
+	target := stockKey{ProductID: orderReq.ProductID, VariantID: orderReq.VariantID}
+
+	// Take the stock before creating the order. The decrement is
+	// conditional in inventory-service, so concurrent orders can't both
+	// claim the last unit the way a read-then-write could.
+	err = adjustProductStock(inventoryURL, target, -orderReq.Quantity, "sale")
+	if errors.Is(err, errInsufficientStock) {
+		http.Error(w, "Insufficient stock", http.StatusBadRequest)
+		ordersTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reserve stock: "+err.Error(), http.StatusBadGateway)
+		ordersTotal.WithLabelValues("failed").Inc()
+		return
+	}
 
 	// Create order
 	var order Order
 	err = db.QueryRow(
-		"INSERT INTO orders (product_id, quantity, total_price, status, user_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
-		orderReq.ProductID, orderReq.Quantity, totalPrice, "confirmed", orderReq.UserID,
+		"INSERT INTO orders (product_id, variant_id, quantity, total_price, status, user_id) VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6) RETURNING id, created_at",
+		orderReq.ProductID, orderReq.VariantID, orderReq.Quantity, totalPrice, "confirmed", orderReq.UserID,
 	).Scan(&order.ID, &order.CreatedAt)
 
 	if err != nil {
+		restockProducts(inventoryURL, map[stockKey]int{target: orderReq.Quantity})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		ordersTotal.WithLabelValues("failed").Inc()
 		return
 	}
 
 	order.ProductID = orderReq.ProductID
+	order.VariantID = orderReq.VariantID
 	order.Quantity = orderReq.Quantity
 	order.TotalPrice = totalPrice
 	order.Status = "confirmed"
 	order.UserID = orderReq.UserID
-
-	// Update inventory (reduce stock)
-	newStock := product.Stock - orderReq.Quantity
-	err = updateProductStock(inventoryURL, orderReq.ProductID, product, newStock)
-	if err != nil {
-		log.Printf("Failed to update inventory: %v", err)
-	}
+	order.PaymentMethod = paymentMethod
 
 	// Publish event to Kafka
-	event := map[string]interface{}{
-		"event_type":  "order_created",
-		"order_id":    order.ID,
-		"product_id":  order.ProductID,
-		"quantity":    order.Quantity,
-		"total_price": order.TotalPrice,
-		"timestamp":   time.Now().Unix(),
-	}
-	publishEvent(event)
+	publishEvent(newOrderCreatedEvent(order))
 
 	ordersTotal.WithLabelValues("confirmed").Inc()
 	orderProcessingDuration.Observe(time.Since(start).Seconds())
@@ -289,14 +426,20 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	paymentMethod, err := resolvePaymentMethod(bulkReq.PaymentMethod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	inventoryURL := getEnv("INVENTORY_SERVICE_URL", "http://localhost:8081")
 
 	// Validation Phase
 	type ValidatedItem struct {
 		ProductID int
+		VariantID int
 		Quantity  int
-		Product   *Product
+		UnitPrice float64
 	}
 	validatedItems := make([]ValidatedItem, 0, len(bulkReq.Items))
 
@@ -308,7 +451,14 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if product.Stock < item.Quantity {
+		stock, unitPrice, err := product.stockFor(item.VariantID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			ordersTotal.WithLabelValues("failed").Inc()
+			return
+		}
+
+		if stock < item.Quantity {
 			http.Error(w, fmt.Sprintf("Insufficient stock for product %d", item.ProductID), http.StatusBadRequest)
 			ordersTotal.WithLabelValues("failed").Inc()
 			return
@@ -316,11 +466,38 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 
 		validatedItems = append(validatedItems, ValidatedItem{
 			ProductID: item.ProductID,
+			VariantID: item.VariantID,
 			Quantity:  item.Quantity,
-			Product:   product,
+			UnitPrice: unitPrice,
 		})
 	}
 
+	// Reservation Phase: take stock for every item up front, giving back
+	// whatever was already taken if any item can't be fulfilled or the
+	// orders can't be written.
+	reserved := make(map[stockKey]int, len(validatedItems))
+	committed := false
+	defer func() {
+		if !committed {
+			restockProducts(inventoryURL, reserved)
+		}
+	}()
+	for _, item := range validatedItems {
+		target := stockKey{ProductID: item.ProductID, VariantID: item.VariantID}
+		err := adjustProductStock(inventoryURL, target, -item.Quantity, "sale")
+		if errors.Is(err, errInsufficientStock) {
+			http.Error(w, fmt.Sprintf("Insufficient stock for product %d", item.ProductID), http.StatusBadRequest)
+			ordersTotal.WithLabelValues("failed").Inc()
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reserve stock for product %d: %v", item.ProductID, err), http.StatusBadGateway)
+			ordersTotal.WithLabelValues("failed").Inc()
+			return
+		}
+		reserved[target] += item.Quantity
+	}
+
 	// Transaction Phase
 	tx, err := db.Begin()
 	if err != nil {
@@ -332,12 +509,12 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 	var createdOrders []Order
 
 	for _, item := range validatedItems {
-		totalPrice := item.Product.Price * float64(item.Quantity)
+		totalPrice := item.UnitPrice * float64(item.Quantity)
 
 		var order Order
 		err := tx.QueryRow(
-			"INSERT INTO orders (product_id, quantity, total_price, status) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
-			item.ProductID, item.Quantity, totalPrice, "confirmed",
+			"INSERT INTO orders (product_id, variant_id, quantity, total_price, status) VALUES ($1, NULLIF($2, 0), $3, $4, $5) RETURNING id, created_at",
+			item.ProductID, item.VariantID, item.Quantity, totalPrice, "confirmed",
 		).Scan(&order.ID, &order.CreatedAt)
 
 		if err != nil {
@@ -348,9 +525,11 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 		}
 
 		order.ProductID = item.ProductID
+		order.VariantID = item.VariantID
 		order.Quantity = item.Quantity
 		order.TotalPrice = totalPrice
 		order.Status = "confirmed"
+		order.PaymentMethod = paymentMethod
 		createdOrders = append(createdOrders, order)
 	}
 
@@ -359,26 +538,11 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	committed = true
 
-	// External Phase (Inventory & Kafka)
-	for i, order := range createdOrders {
-		item := validatedItems[i]
-
-		newStock := item.Product.Stock - item.Quantity
-		err = updateProductStock(inventoryURL, item.ProductID, item.Product, newStock)
-		if err != nil {
-			log.Printf("Failed to update inventory for product %d: %v", item.ProductID, err)
-		}
-
-		event := map[string]interface{}{
-			"event_type":  "order_created",
-			"order_id":    order.ID,
-			"product_id":  order.ProductID,
-			"quantity":    order.Quantity,
-			"total_price": order.TotalPrice,
-			"timestamp":   time.Now().Unix(),
-		}
-		publishEvent(event)
+	// External Phase (Kafka)
+	for _, order := range createdOrders {
+		publishEvent(newOrderCreatedEvent(order))
 
 		ordersTotal.WithLabelValues("confirmed").Inc()
 	}
@@ -390,8 +554,58 @@ func createBulkOrder(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(createdOrders)
 }
 
+// terminalOrderStatuses are statuses after which an order no longer
+// depends on its product.
+var terminalOrderStatuses = []string{"delivered", "completed", "cancelled", "refunded", "failed"}
+
+// getOrders lists orders newest first, optionally filtered by
+// ?product_id= and ?status= and, with ?open=true, limited to orders not
+// yet in a terminal status. ?limit= and ?before_id= page through them:
+// pass the last id of one page as before_id for the next.
 func getOrders(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, user_id, product_id, quantity, total_price, status, created_at FROM orders ORDER BY id DESC")
+	query := "SELECT id, user_id, product_id, COALESCE(variant_id, 0), quantity, total_price, status, created_at FROM orders"
+	var where []string
+	var args []interface{}
+
+	if productID := r.URL.Query().Get("product_id"); productID != "" {
+		if _, err := strconv.Atoi(productID); err != nil {
+			http.Error(w, "product_id must be an integer", http.StatusBadRequest)
+			return
+		}
+		args = append(args, productID)
+		where = append(where, fmt.Sprintf("product_id = $%d", len(args)))
+	}
+	if open, _ := strconv.ParseBool(r.URL.Query().Get("open")); open {
+		args = append(args, pq.Array(terminalOrderStatuses))
+		where = append(where, fmt.Sprintf("status <> ALL($%d)", len(args)))
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		args = append(args, status)
+		where = append(where, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if beforeID := r.URL.Query().Get("before_id"); beforeID != "" {
+		if _, err := strconv.Atoi(beforeID); err != nil {
+			http.Error(w, "before_id must be an integer", http.StatusBadRequest)
+			return
+		}
+		args = append(args, beforeID)
+		where = append(where, fmt.Sprintf("id < $%d", len(args)))
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		args = append(args, n)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -401,7 +615,7 @@ func getOrders(w http.ResponseWriter, r *http.Request) {
 	orders := []Order{}
 	for rows.Next() {
 		var o Order
-		err := rows.Scan(&o.ID, &o.UserID, &o.ProductID, &o.Quantity, &o.TotalPrice, &o.Status, &o.CreatedAt)
+		err := rows.Scan(&o.ID, &o.UserID, &o.ProductID, &o.VariantID, &o.Quantity, &o.TotalPrice, &o.Status, &o.CreatedAt)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -418,8 +632,8 @@ func getOrder(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	var o Order
-	err := db.QueryRow("SELECT id, user_id, product_id, quantity, total_price, status, created_at FROM orders WHERE id = $1", id).
-		Scan(&o.ID, &o.UserID, &o.ProductID, &o.Quantity, &o.TotalPrice, &o.Status, &o.CreatedAt)
+	err := db.QueryRow("SELECT id, user_id, product_id, COALESCE(variant_id, 0), quantity, total_price, status, created_at FROM orders WHERE id = $1", id).
+		Scan(&o.ID, &o.UserID, &o.ProductID, &o.VariantID, &o.Quantity, &o.TotalPrice, &o.Status, &o.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Order not found", http.StatusNotFound)
@@ -438,7 +652,7 @@ func getOrdersByUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userId := vars["userId"]
 
-	rows, err := db.Query("SELECT id, user_id, product_id, quantity, total_price, status, created_at FROM orders WHERE user_id = $1 ORDER BY id DESC", userId)
+	rows, err := db.Query("SELECT id, user_id, product_id, COALESCE(variant_id, 0), quantity, total_price, status, created_at FROM orders WHERE user_id = $1 ORDER BY id DESC", userId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -448,7 +662,7 @@ func getOrdersByUser(w http.ResponseWriter, r *http.Request) {
 	orders := []Order{}
 	for rows.Next() {
 		var o Order
-		err := rows.Scan(&o.ID, &o.UserID, &o.ProductID, &o.Quantity, &o.TotalPrice, &o.Status, &o.CreatedAt)
+		err := rows.Scan(&o.ID, &o.UserID, &o.ProductID, &o.VariantID, &o.Quantity, &o.TotalPrice, &o.Status, &o.CreatedAt)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -492,26 +706,36 @@ func getProductInfo(baseURL string, productID int) (*Product, error) {
 	return &product, nil
 }
 
-func updateProductStock(baseURL string, productID int, product *Product, newStock int) error {
-	url := fmt.Sprintf("%s/products/%d", baseURL, productID)
-	
-	updateData := map[string]interface{}{
-		"name":        product.Name,
-		"description": "",
-		"price":       product.Price,
-		"stock":       newStock,
-	}
+// errInsufficientStock means inventory-service refused a decrement because
+// it would take stock below zero.
+var errInsufficientStock = errors.New("insufficient stock")
+
+// adjustProductStock applies a relative stock change through inventory's
+// POST /products/{id}/stock, to the variant target names if any, recorded
+// in inventory's ledger under reason. Inventory applies it as a single
+// conditional update, so a decrement either fits in the current stock or
+// fails with errInsufficientStock; it never overwrites a concurrent
+// change.
+func adjustProductStock(baseURL string, target stockKey, delta int, reason string) error {
+	url := fmt.Sprintf("%s/products/%d/stock", baseURL, target.ProductID)
 
-	jsonData, err := json.Marshal(updateData)
+	body := map[string]interface{}{"delta": delta, "reason": reason}
+	if target.VariantID != 0 {
+		body["variant_id"] = target.VariantID
+	}
+	jsonData, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if key := os.Getenv("INVENTORY_API_KEY"); key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -519,15 +743,29 @@ func updateProductStock(baseURL string, productID int, product *Product, newStoc
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return errInsufficientStock
+	}
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to update stock: %s", string(bodyBytes))
+		return fmt.Errorf("failed to update stock (inventory request_id %s): %s",
+			resp.Header.Get("X-Request-ID"), string(bodyBytes))
 	}
 
 	return nil
 }
 
-var publishEvent = func(event map[string]interface{}) {
+// restockProducts gives back stock taken for orders that were never
+// created. Failures are logged; there is nothing left to roll back to.
+func restockProducts(baseURL string, quantities map[stockKey]int) {
+	for target, quantity := range quantities {
+		if err := adjustProductStock(baseURL, target, quantity, "sale_reversal"); err != nil {
+			log.Printf("Failed to restock product %d (variant %d) after aborted order: %v", target.ProductID, target.VariantID, err)
+		}
+	}
+}
+
+var publishEvent = func(event interface{}) {
 	data, err := json.Marshal(event)
 	if err != nil {
 		log.Printf("Failed to marshal event: %v", err)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// withInventory serves GET /products/5 as a product with one variant, 11,
+// and records the stock adjustments posted to it.
+func withInventory(t *testing.T) *[]map[string]interface{} {
+	t.Helper()
+	var adjustments []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/products/5":
+			w.Write([]byte(`{"id":5,"name":"T-shirt","price":10,"stock":3,
+				"variants":[{"id":11,"price_override":12.5,"stock":3}]}`))
+		case r.Method == "POST" && r.URL.Path == "/products/5/stock":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			adjustments = append(adjustments, body)
+			if body["variant_id"] == nil {
+				http.Error(w, "Product has variants; variant_id is required", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("INVENTORY_SERVICE_URL", srv.URL)
+
+	oldClient, oldPublish := httpClient, publishEvent
+	httpClient = srv.Client()
+	publishEvent = func(event interface{}) {}
+	t.Cleanup(func() { httpClient, publishEvent = oldClient, oldPublish })
+	return &adjustments
+}
+
+func withMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	oldDB := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = oldDB
+		mockDB.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+	return mock
+}
+
+func TestCreateOrderForVariant(t *testing.T) {
+	mock := withMockDB(t)
+	adjustments := withInventory(t)
+
+	mock.ExpectQuery("INSERT INTO orders").
+		WithArgs(5, 11, 2, 25.0, "confirmed", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+
+	w := httptest.NewRecorder()
+	createOrder(w, httptest.NewRequest("POST", "/orders", strings.NewReader(`{"product_id":5,"variant_id":11,"quantity":2}`)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var order Order
+	json.NewDecoder(w.Body).Decode(&order)
+	if order.VariantID != 11 || order.TotalPrice != 25 {
+		t.Errorf("expected variant 11 at 12.50 each, got %+v", order)
+	}
+	if len(*adjustments) != 1 || (*adjustments)[0]["variant_id"] != 11.0 || (*adjustments)[0]["delta"] != -2.0 {
+		t.Errorf("expected 2 taken from variant 11, got %v", *adjustments)
+	}
+}
+
+func TestCreateOrderRequiresVariant(t *testing.T) {
+	withMockDB(t)
+	adjustments := withInventory(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "missing", body: `{"product_id":5,"quantity":1}`},
+		{name: "unknown", body: `{"product_id":5,"variant_id":99,"quantity":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			createOrder(w, httptest.NewRequest("POST", "/orders", strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	createBulkOrder(w, httptest.NewRequest("POST", "/orders/bulk", strings.NewReader(`{"items":[{"product_id":5,"quantity":1}]}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "variant_id is required") {
+		t.Errorf("expected 400 naming variant_id for a bulk order, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(*adjustments) != 0 {
+		t.Errorf("expected no stock taken, got %v", *adjustments)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	shipmentCaptures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_shipment_captures_total",
+		Help: "Captures triggered by shipped orders, by outcome",
+	}, []string{"outcome"})
+	authorizationsVoided = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_authorizations_voided_total",
+		Help: "Stale authorizations the void job handled, by outcome",
+	}, []string{"outcome"})
+)
+
+var (
+	// authorizationVoidAfter is how long a payment may stay authorized
+	// before it is voided, releasing the hold on the customer's card.
+	// Card authorizations typically lapse after about a week anyway.
+	authorizationVoidAfter    = loadDuration("AUTHORIZATION_VOID_AFTER", 7*24*time.Hour)
+	authorizationVoidInterval = loadDuration("AUTHORIZATION_VOID_INTERVAL", 10*time.Minute)
+)
+
+const authorizationVoidBatch = 100
+
+// orderStatusShipped is the order status that captures its payment.
+const orderStatusShipped = "shipped"
+
+// handleOrderStatusChanged captures the order's authorized payment once
+// it ships. Orders whose payment was captured up front, or failed, have
+// nothing to capture. A declined capture is left authorized for the void
+// job; an unreachable gateway is returned so the message is retried.
+func handleOrderStatusChanged(ctx context.Context, event OrderStatusChangedEvent) error {
+	if event.Status != orderStatusShipped {
+		return nil
+	}
+	logger := loggerFrom(ctx).With("order_id", event.OrderID)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, gatewayRef, err := lockPaymentWhere(ctx, tx,
+		"order_id = $1 AND status = $2 ORDER BY id DESC LIMIT 1", event.OrderID, statusAuthorized)
+	if err == sql.ErrNoRows {
+		shipmentCaptures.WithLabelValues("no_authorization").Inc()
+		logger.Info("order shipped with no authorized payment to capture")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := markCaptured(ctx, tx, &p); err != nil {
+		return err
+	}
+	err = captureAtGateway(ctx, gatewayRef, p.Amount)
+	if isDeclined(err) {
+		shipmentCaptures.WithLabelValues("declined").Inc()
+		logger.Warn("gateway declined capture of shipped order", "payment_id", p.ID, "error", err)
+		return nil
+	}
+	if err != nil {
+		shipmentCaptures.WithLabelValues("error").Inc()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	kickOutboxRelay()
+	shipmentCaptures.WithLabelValues("captured").Inc()
+	logger.Info("captured payment for shipped order", "payment_id", p.ID)
+	return nil
+}
+
+// voidStaleAuthorizations voids up to a batch of payments that have been
+// authorized for longer than olderThan, and returns how many it voided.
+func voidStaleAuthorizations(ctx context.Context, olderThan time.Duration) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id FROM payments WHERE status = $1 AND created_at < $2 ORDER BY id LIMIT $3",
+		statusAuthorized, time.Now().Add(-olderThan), authorizationVoidBatch)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	voided := 0
+	for _, id := range ids {
+		ok, err := voidAuthorization(ctx, id)
+		switch {
+		case isDeclined(err):
+			authorizationsVoided.WithLabelValues("declined").Inc()
+			log.Printf("Gateway declined voiding payment %d: %v", id, err)
+		case err != nil:
+			authorizationsVoided.WithLabelValues("error").Inc()
+			log.Printf("Failed to void payment %d: %v", id, err)
+		case ok:
+			authorizationsVoided.WithLabelValues("voided").Inc()
+			voided++
+		}
+	}
+	return voided, nil
+}
+
+// voidAuthorization voids payment id if it is still authorized, releasing
+// the hold at the gateway. It reports false if the payment moved on, for
+// instance by being captured, since it was selected.
+func voidAuthorization(ctx context.Context, id int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	p, gatewayRef, err := lockPayment(ctx, tx, strconv.Itoa(id))
+	if err != nil {
+		return false, err
+	}
+	if p.Status != statusAuthorized {
+		return false, nil
+	}
+	if err := transitionPayment(ctx, tx, &p, statusVoided); err != nil {
+		return false, err
+	}
+	if err := enqueuePaymentEvent(ctx, tx, "payment_voided", p); err != nil {
+		return false, err
+	}
+
+	// As with captures the gateway is asked last, so a void it refuses
+	// rolls back and is tried again on the next run.
+	gatewayCtx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	if err := observeGateway("void", func() error {
+		return gateway.Void(gatewayCtx, gatewayRef)
+	}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	kickOutboxRelay()
+	return true, nil
+}
+
+// voidStaleAuthorizationsLoop runs voidStaleAuthorizations on every tick
+// until ctx is done.
+func voidStaleAuthorizationsLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := voidStaleAuthorizations(ctx, authorizationVoidAfter)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Voiding stale authorizations failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Voided %d authorizations older than %s", n, authorizationVoidAfter)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
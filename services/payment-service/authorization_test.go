@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+func shipped(orderID int) OrderStatusChangedEvent {
+	return OrderStatusChangedEvent{EventType: "order_status_changed", OrderID: orderID, Status: "shipped", PreviousStatus: "confirmed"}
+}
+
+func expectAuthorizedPaymentForOrder(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE order_id = \\$1 AND status = \\$2 ORDER BY id DESC LIMIT 1 FOR UPDATE").
+		WithArgs(42, "authorized").
+		WillReturnRows(rows)
+}
+
+func authorizedPaymentRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of", "gateway_ref"}).
+		AddRow(7, 42, 30.0, "EUR", "authorized", "card", time.Now(), 0, "auth_7")
+}
+
+func TestHandleOrderStatusChangedCapturesShippedOrder(t *testing.T) {
+	mock := withMockDB(t)
+	captured := &[]map[string]interface{}{}
+
+	expectAuthorizedPaymentForOrder(mock, authorizedPaymentRows())
+	expectTransition(mock, &[]map[string]interface{}{}, 7, "authorized", "captured")
+	expectPaymentEvent(mock, captured, "payment_captured")
+	mock.ExpectCommit()
+
+	if err := handleOrderStatusChanged(context.Background(), shipped(42)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*captured) != 1 || (*captured)[0]["order_id"] != float64(42) {
+		t.Errorf("expected a payment_captured event, got %v", *captured)
+	}
+}
+
+func TestHandleOrderStatusChangedWithoutAuthorization(t *testing.T) {
+	mock := withMockDB(t)
+
+	expectAuthorizedPaymentForOrder(mock, sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	if err := handleOrderStatusChanged(context.Background(), shipped(42)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleOrderStatusChangedIgnoresOtherStatuses(t *testing.T) {
+	// No DB expectations: only shipping captures.
+	withMockDB(t)
+
+	event := shipped(42)
+	event.Status = "confirmed"
+	if err := handleOrderStatusChanged(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleOrderStatusChangedCaptureDeclined(t *testing.T) {
+	mock := withMockDB(t)
+	withGateway(t, decliningCaptureGateway{})
+
+	expectAuthorizedPaymentForOrder(mock, authorizedPaymentRows())
+	expectTransition(mock, &[]map[string]interface{}{}, 7, "authorized", "captured")
+	expectPaymentEvent(mock, &[]map[string]interface{}{}, "payment_captured")
+	mock.ExpectRollback()
+
+	if err := handleOrderStatusChanged(context.Background(), shipped(42)); err != nil {
+		t.Fatalf("expected a declined capture to be handled, got %v", err)
+	}
+}
+
+func TestHandleMessageMalformedOrderStatusChanged(t *testing.T) {
+	withMockDB(t)
+	dlq := withFakeOrderDLQ(t)
+
+	msg := kafka.Message{Value: []byte(`{"event_type":"order_status_changed","order_id":42}`)}
+	if err := handleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(dlq.msgs) != 1 {
+		t.Fatalf("expected the event dead-lettered, got %d messages", len(dlq.msgs))
+	}
+	if reason, _ := header(dlq.msgs[0], headerDLQReason); reason != "missing_status" {
+		t.Errorf("expected reason missing_status, got %q", reason)
+	}
+}
+
+func TestVoidStaleAuthorizations(t *testing.T) {
+	mock := withMockDB(t)
+	voided := &[]map[string]interface{}{}
+
+	mock.ExpectQuery("SELECT id FROM payments WHERE status = \\$1 AND created_at < \\$2 ORDER BY id LIMIT \\$3").
+		WithArgs("authorized", sqlmock.AnyArg(), authorizationVoidBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7).AddRow(7))
+	expectLockedPayment(mock, 30, "authorized")
+	expectTransition(mock, &[]map[string]interface{}{}, 7, "authorized", "voided")
+	expectPaymentEvent(mock, voided, "payment_voided")
+	mock.ExpectCommit()
+	// The second row was captured in the meantime and is left alone.
+	expectLockedPayment(mock, 30, "captured")
+	mock.ExpectRollback()
+
+	n, err := voidStaleAuthorizations(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 authorization voided, got %d", n)
+	}
+	if len(*voided) != 1 || (*voided)[0]["payment_id"] != float64(7) {
+		t.Errorf("expected a payment_voided event, got %v", *voided)
+	}
+}
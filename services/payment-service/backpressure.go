@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	consumerPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_consumer_paused",
+		Help: "1 while the order-events consumer has stopped fetching because payments can't be saved",
+	})
+	consumerPauses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_consumer_pauses_total",
+		Help: "Times the order-events consumer paused after repeated persistence failures",
+	})
+	consumerResumes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_consumer_resumes_total",
+		Help: "Times the order-events consumer resumed once the database accepted writes again",
+	})
+)
+
+// dbBackpressure pauses the order-events consumer while the database is
+// failing, for instance during a failover, rather than failing every
+// fetched message and dead-lettering it.
+var dbBackpressure = &backpressure{
+	threshold: loadPositiveInt("BACKPRESSURE_FAILURE_THRESHOLD", 5),
+	minPause:  loadDuration("BACKPRESSURE_MIN_PAUSE", time.Second),
+	maxPause:  loadDuration("BACKPRESSURE_MAX_PAUSE", time.Minute),
+	probe:     probeInsert,
+}
+
+// backpressure counts consecutive persistence failures and, past
+// threshold, holds the fetch loop until probe succeeds.
+type backpressure struct {
+	threshold          int
+	minPause, maxPause time.Duration
+	probe              func(context.Context) error
+
+	mu       sync.Mutex
+	failures int
+	paused   bool
+}
+
+// record notes the outcome of saving a payment.
+func (b *backpressure) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.resumeLocked()
+		return
+	}
+	b.failures++
+	if !b.paused && b.failures >= b.threshold {
+		b.paused = true
+		consumerPaused.Set(1)
+		consumerPauses.Inc()
+		log.Printf("Pausing order-events consumer after %d consecutive persistence failures: %v", b.failures, err)
+	}
+}
+
+func (b *backpressure) resumeLocked() {
+	if !b.paused {
+		return
+	}
+	b.paused = false
+	consumerPaused.Set(0)
+	consumerResumes.Inc()
+	log.Println("Database accepting writes again, resuming order-events consumer")
+}
+
+// wait blocks while paused, probing the database with exponential
+// backoff between minPause and maxPause. It returns early with ctx's
+// error.
+func (b *backpressure) wait(ctx context.Context) error {
+	pause := b.minPause
+	for b.check() != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+		if err := b.probe(ctx); err != nil {
+			log.Printf("Database probe failed, consumer stays paused: %v", err)
+			if pause *= 2; pause > b.maxPause {
+				pause = b.maxPause
+			}
+			continue
+		}
+		b.record(nil)
+	}
+	return nil
+}
+
+// check returns why the consumer is paused, or nil.
+func (b *backpressure) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused {
+		return fmt.Errorf("consumer paused after %d consecutive persistence failures", b.failures)
+	}
+	return nil
+}
+
+// probeInsert tries a write the way saving a payment does, then rolls it
+// back. A plain ping would pass against a replica that is still read-only.
+func probeInsert(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO processed_events (event_id) VALUES ('backpressure-probe') ON CONFLICT (event_id) DO NOTHING")
+	return err
+}
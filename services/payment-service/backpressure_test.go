@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withBackpressure replaces dbBackpressure with one pausing after
+// threshold failures and probing with probe.
+func withBackpressure(t *testing.T, threshold int, probe func(context.Context) error) *backpressure {
+	t.Helper()
+	b := &backpressure{threshold: threshold, minPause: time.Millisecond, maxPause: 4 * time.Millisecond, probe: probe}
+	old := dbBackpressure
+	dbBackpressure = b
+	t.Cleanup(func() { dbBackpressure = old })
+	return b
+}
+
+func TestBackpressurePausesAfterConsecutiveFailures(t *testing.T) {
+	b := withBackpressure(t, 3, nil)
+	pauses := testutil.ToFloat64(consumerPauses)
+	failed := errors.New("connection refused")
+
+	b.record(failed)
+	b.record(failed)
+	b.record(nil)
+	b.record(failed)
+	b.record(failed)
+	if b.check() != nil {
+		t.Fatal("expected a success to reset the failure count")
+	}
+
+	b.record(failed)
+	if b.check() == nil {
+		t.Fatal("expected the consumer to pause after 3 consecutive failures")
+	}
+	if got := testutil.ToFloat64(consumerPauses) - pauses; got != 1 {
+		t.Errorf("expected 1 pause, got %v", got)
+	}
+	if got := testutil.ToFloat64(consumerPaused); got != 1 {
+		t.Errorf("expected the paused gauge at 1, got %v", got)
+	}
+}
+
+func TestBackpressureWaitResumesWhenProbeSucceeds(t *testing.T) {
+	probes := 0
+	b := withBackpressure(t, 1, func(context.Context) error {
+		probes++
+		if probes < 3 {
+			return errors.New("read-only transaction")
+		}
+		return nil
+	})
+	resumes := testutil.ToFloat64(consumerResumes)
+
+	b.record(errors.New("read-only transaction"))
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatalf("wait: %s", err)
+	}
+	if probes != 3 {
+		t.Errorf("expected 3 probes, got %d", probes)
+	}
+	if b.check() != nil {
+		t.Error("expected the consumer to be resumed")
+	}
+	if got := testutil.ToFloat64(consumerResumes) - resumes; got != 1 {
+		t.Errorf("expected 1 resume, got %v", got)
+	}
+	if got := testutil.ToFloat64(consumerPaused); got != 0 {
+		t.Errorf("expected the paused gauge at 0, got %v", got)
+	}
+}
+
+func TestBackpressureWaitStopsOnCancel(t *testing.T) {
+	b := withBackpressure(t, 1, func(context.Context) error { return errors.New("down") })
+	b.record(errors.New("down"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx); err == nil {
+		t.Fatal("expected wait to return the context's error")
+	}
+}
+
+func TestReadinessFailsWhilePaused(t *testing.T) {
+	withMockDB(t)
+	old := consumerHealth
+	consumerHealth = &consumerHeartbeat{}
+	t.Cleanup(func() { consumerHealth = old })
+	consumerHealth.setRunning(true, time.Now())
+
+	b := withBackpressure(t, 1, nil)
+	b.record(errors.New("down"))
+
+	w := httptest.NewRecorder()
+	readinessCheck(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while paused, got %d", w.Code)
+	}
+}
+
+func TestProbeInsertRollsBack(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO processed_events").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	if err := probeInsert(context.Background()); err != nil {
+		t.Fatalf("probeInsert: %s", err)
+	}
+}
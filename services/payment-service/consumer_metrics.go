@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+// statsReader is the part of *kafka.Reader consumerMetrics reads.
+type statsReader interface {
+	Stats() kafka.ReaderStats
+}
+
+// consumerMetrics exports kafka-go reader stats, labelled by topic, so a
+// lagging or stuck consumer can be alerted on. Metric names take the
+// service's prefix, e.g. payment_kafka_consumer_lag.
+type consumerMetrics struct {
+	messages    *prometheus.CounterVec
+	fetchErrors *prometheus.CounterVec
+	rebalances  *prometheus.CounterVec
+	lag         *prometheus.GaugeVec
+	sinceLast   *prometheus.GaugeVec
+
+	mu          sync.Mutex
+	lastMessage map[string]time.Time
+}
+
+func newConsumerMetrics(prefix string) *consumerMetrics {
+	return &consumerMetrics{
+		messages: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_kafka_consumer_messages_total",
+			Help: "Messages fetched from Kafka",
+		}, []string{"topic"}),
+		fetchErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_kafka_consumer_errors_total",
+			Help: "Kafka fetch errors",
+		}, []string{"topic"}),
+		rebalances: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_kafka_consumer_rebalances_total",
+			Help: "Consumer group rebalances",
+		}, []string{"topic"}),
+		lag: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_kafka_consumer_lag",
+			Help: "Messages between the consumer's offset and the end of the partition",
+		}, []string{"topic"}),
+		sinceLast: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_kafka_consumer_seconds_since_last_message",
+			Help: "Seconds since the consumer last received a message, or since it started",
+		}, []string{"topic"}),
+		lastMessage: make(map[string]time.Time),
+	}
+}
+
+// messageReceived records that topic delivered a message just now.
+func (m *consumerMetrics) messageReceived(topic string) {
+	m.mu.Lock()
+	m.lastMessage[topic] = time.Now()
+	m.mu.Unlock()
+}
+
+// collect folds one Stats() snapshot into the metrics. kafka-go resets
+// the counters in ReaderStats on every call, so they are added, not set.
+func (m *consumerMetrics) collect(stats kafka.ReaderStats, now time.Time) {
+	m.messages.WithLabelValues(stats.Topic).Add(float64(stats.Messages))
+	m.fetchErrors.WithLabelValues(stats.Topic).Add(float64(stats.Errors))
+	m.rebalances.WithLabelValues(stats.Topic).Add(float64(stats.Rebalances))
+	m.lag.WithLabelValues(stats.Topic).Set(float64(stats.Lag))
+
+	m.mu.Lock()
+	last, ok := m.lastMessage[stats.Topic]
+	if !ok {
+		last = now
+		m.lastMessage[stats.Topic] = now
+	}
+	m.mu.Unlock()
+	m.sinceLast.WithLabelValues(stats.Topic).Set(now.Sub(last).Seconds())
+}
+
+// watch collects reader stats every interval until ctx is done.
+func (m *consumerMetrics) watch(ctx context.Context, reader statsReader, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.collect(reader.Stats(), time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
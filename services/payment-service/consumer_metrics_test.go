@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestConsumerMetricsCollect(t *testing.T) {
+	m := newConsumerMetrics("test")
+	start := time.Now()
+
+	m.collect(kafka.ReaderStats{Topic: "order-events", Messages: 3, Errors: 1, Rebalances: 1, Lag: 40}, start)
+	m.collect(kafka.ReaderStats{Topic: "order-events", Messages: 2, Lag: 12}, start.Add(30*time.Second))
+
+	if got := testutil.ToFloat64(m.messages.WithLabelValues("order-events")); got != 5 {
+		t.Errorf("expected 5 messages, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.fetchErrors.WithLabelValues("order-events")); got != 1 {
+		t.Errorf("expected 1 fetch error, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.lag.WithLabelValues("order-events")); got != 12 {
+		t.Errorf("expected lag to be set to the latest value 12, got %v", got)
+	}
+	// No message yet: measured from the first collection.
+	if got := testutil.ToFloat64(m.sinceLast.WithLabelValues("order-events")); got != 30 {
+		t.Errorf("expected 30s since start, got %v", got)
+	}
+
+	m.messageReceived("order-events")
+	m.collect(kafka.ReaderStats{Topic: "order-events"}, time.Now())
+	if got := testutil.ToFloat64(m.sinceLast.WithLabelValues("order-events")); got > 1 {
+		t.Errorf("expected the gauge to reset after a message, got %v", got)
+	}
+}
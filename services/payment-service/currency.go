@@ -0,0 +1,34 @@
+package main
+
+import "strings"
+
+// supportedCurrencies lists the ISO 4217 codes payments may be taken in.
+// Configured via SUPPORTED_CURRENCIES as a comma-separated list.
+var supportedCurrencies = loadSupportedCurrencies()
+
+const defaultCurrency = "USD"
+
+func loadSupportedCurrencies() map[string]bool {
+	currencies := map[string]bool{}
+	for _, c := range strings.Split(getEnv("SUPPORTED_CURRENCIES", "USD,EUR,GBP"), ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			currencies[c] = true
+		}
+	}
+	return currencies
+}
+
+// validatePaymentRequest returns why an order_created event can't be
+// charged, or "" if it can.
+func validatePaymentRequest(event OrderCreatedEvent, currency string) string {
+	if event.TotalPrice == nil {
+		return "missing_amount"
+	}
+	if toCents(*event.TotalPrice) <= 0 {
+		return "non_positive_amount"
+	}
+	if !supportedCurrencies[currency] {
+		return "unsupported_currency"
+	}
+	return ""
+}
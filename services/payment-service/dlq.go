@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+const dlqTopic = "payment-dlq"
+
+var deadLettered = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "payment_dead_letters_total",
+		Help: "Events sent to the payment-dlq topic after exhausting retries, by outcome of the dead-letter publish",
+	},
+	[]string{"outcome"},
+)
+
+var dlqReplays = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "payment_dlq_replays_total",
+		Help: "Dead letters taken off a DLQ by a replay, by DLQ topic and outcome",
+	},
+	[]string{"topic", "outcome"},
+)
+
+var (
+	persistMaxAttempts  = loadPositiveInt("PAYMENT_PERSIST_ATTEMPTS", 5)
+	persistRetryBackoff = loadDuration("PAYMENT_PERSIST_BACKOFF", 200*time.Millisecond)
+	dlqReplayWait       = loadDuration("DLQ_REPLAY_WAIT", 2*time.Second)
+)
+
+// messageWriter is the part of *kafka.Writer used for dead-lettering, so
+// tests can substitute a fake broker.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// messageFetcher is the part of *kafka.Reader used to replay the DLQ.
+type messageFetcher interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+var (
+	dlqWriter messageWriter
+	// newDLQReader opens a consumer on the DLQ topic; set up in main.
+	newDLQReader func() messageFetcher
+	// replaySlot lets one DLQ replay run at a time.
+	replaySlot = make(chan struct{}, 1)
+)
+
+// deadLetter is the payload written to the DLQ: the original event plus
+// why it could not be processed.
+type deadLetter struct {
+	Event    *OrderCreatedEvent `json:"event"`
+	Error    string             `json:"error"`
+	Attempts int                `json:"attempts"`
+	Replays  int                `json:"replays"`
+	FailedAt int64              `json:"failed_at"`
+}
+
+func loadPositiveInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil || n < 1 {
+		log.Printf("Invalid %s, using %d", key, def)
+		return def
+	}
+	return n
+}
+
+func loadDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, def.String()))
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s, using %s", key, def)
+		return def
+	}
+	return d
+}
+
+// withRetry runs fn up to persistMaxAttempts times with exponential
+// backoff, returning the last error. Failed attempts are logged with
+// ctx's logger.
+func withRetry(ctx context.Context, fn func() error) error {
+	backoff := persistRetryBackoff
+	var err error
+	for attempt := 1; attempt <= persistMaxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < persistMaxAttempts {
+			loggerFrom(ctx).Warn("attempt failed, retrying",
+				"attempt", attempt, "max_attempts", persistMaxAttempts, "backoff", backoff.String(), "error", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// sendToDLQ publishes an event that could not be processed to the DLQ so
+// it can be replayed once the cause is fixed. An error means the event is
+// in neither place and its offset must not be committed.
+func sendToDLQ(ctx context.Context, dl deadLetter) error {
+	logger := loggerFrom(ctx)
+	dl.FailedAt = time.Now().Unix()
+	data, err := json.Marshal(dl)
+	if err != nil {
+		deadLettered.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	writeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dlqWriter.WriteMessages(writeCtx, kafka.Message{Value: data}); err != nil {
+		logger.Error("failed to publish dead letter", "dlq_topic", dlqTopic, "cause", dl.Error, "error", err)
+		deadLettered.WithLabelValues("failed").Inc()
+		return err
+	}
+	deadLettered.WithLabelValues("published").Inc()
+	logger.Warn("dead-lettered event", "dlq_topic", dlqTopic, "cause", dl.Error, "attempts", dl.Attempts, "replays", dl.Replays)
+	return nil
+}
+
+// replayHandler reprocesses one DLQ message. failed reports that the
+// message went back to a DLQ; an error means it is in neither place and
+// must not be committed.
+type replayHandler func(msg kafka.Message) (failed bool, err error)
+
+// replaySummary is the body of a DLQ replay response. Replayed counts
+// every message taken off the DLQ, or that would be with dry_run.
+type replaySummary struct {
+	Replayed  int  `json:"replayed"`
+	Succeeded int  `json:"succeeded"`
+	Failed    int  `json:"failed"`
+	DryRun    bool `json:"dry_run,omitempty"`
+}
+
+// replayFrom drains up to ?max= (or ?limit=) messages from the DLQ topic
+// through handle, stopping once the topic has been idle for
+// dlqReplayWait. With ?dry_run=true messages are only counted and stay
+// on the DLQ.
+func replayFrom(w http.ResponseWriter, r *http.Request, topic string, newReader func() messageFetcher, handle replayHandler) {
+	query := r.URL.Query()
+	limit := 100
+	raw := query.Get("max")
+	if raw == "" {
+		raw = query.Get("limit")
+	}
+	if raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "max must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var summary replaySummary
+	if raw := query.Get("dry_run"); raw != "" {
+		dryRun, err := strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		summary.DryRun = dryRun
+	}
+
+	select {
+	case replaySlot <- struct{}{}:
+		defer func() { <-replaySlot }()
+	default:
+		http.Error(w, "A DLQ replay is already running", http.StatusConflict)
+		return
+	}
+
+	reader := newReader()
+	defer reader.Close()
+
+	log.Printf("Replaying up to %d messages from %s (dry run: %t)", limit, topic, summary.DryRun)
+	for summary.Replayed < limit {
+		ctx, cancel := context.WithTimeout(r.Context(), dlqReplayWait)
+		msg, err := reader.FetchMessage(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		summary.Replayed++
+
+		// A dry run never commits, so the messages are fetched again by
+		// the next replay.
+		if summary.DryRun {
+			messageLogger(msg).Info("dead letter would be replayed")
+			continue
+		}
+
+		refailed, err := handle(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		outcome := "succeeded"
+		if refailed {
+			outcome = "failed"
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+		dlqReplays.WithLabelValues(topic, outcome).Inc()
+
+		if err := reader.CommitMessages(r.Context(), msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		messageLogger(msg).Info("replayed dead letter", "outcome", outcome,
+			"replayed", summary.Replayed, "succeeded", summary.Succeeded, "failed", summary.Failed)
+	}
+	log.Printf("Replayed %d messages from %s: %d succeeded, %d failed", summary.Replayed, topic, summary.Succeeded, summary.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// replayDLQ reprocesses events from payment-dlq, served at both
+// POST /admin/dlq/replay and POST /payments/replay-dlq. Events that fail
+// again go back to the DLQ with their replay count bumped.
+func replayDLQ(w http.ResponseWriter, r *http.Request) {
+	replayFrom(w, r, dlqTopic, newDLQReader, func(msg kafka.Message) (bool, error) {
+		var dl deadLetter
+		logger := messageLogger(msg)
+		if err := json.Unmarshal(msg.Value, &dl); err != nil || dl.Event == nil {
+			logger.Warn("skipping malformed dead letter", "value", string(msg.Value))
+			return true, nil
+		}
+		ctx := orderContext(withLogger(r.Context(), logger), *dl.Event)
+		if err := handleOrderCreated(ctx, *dl.Event); err != nil {
+			dl.Error = err.Error()
+			dl.Attempts = persistMaxAttempts
+			dl.Replays++
+			return true, sendToDLQ(ctx, dl)
+		}
+		return false, nil
+	})
+}
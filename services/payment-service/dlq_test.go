@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+type fakeWriter struct {
+	msgs []kafka.Message
+	err  error
+}
+
+func (f *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.msgs = append(f.msgs, msgs...)
+	return nil
+}
+
+// fakeFetcher serves queued messages, then blocks until the context
+// expires like an idle topic.
+type fakeFetcher struct {
+	queue     []kafka.Message
+	committed []kafka.Message
+	mu        sync.Mutex
+}
+
+func (f *fakeFetcher) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if len(f.queue) == 0 {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	msg := f.queue[0]
+	f.queue = f.queue[1:]
+	return msg, nil
+}
+
+func (f *fakeFetcher) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.committed = append(f.committed, msgs...)
+	return nil
+}
+
+func (f *fakeFetcher) Close() error { return nil }
+
+// withFastRetries shrinks the persistence retry settings for a test.
+func withFastRetries(t *testing.T, attempts int) {
+	t.Helper()
+	oldAttempts, oldBackoff := persistMaxAttempts, persistRetryBackoff
+	persistMaxAttempts, persistRetryBackoff = attempts, time.Millisecond
+	t.Cleanup(func() { persistMaxAttempts, persistRetryBackoff = oldAttempts, oldBackoff })
+}
+
+func withFakeDLQ(t *testing.T) *fakeWriter {
+	t.Helper()
+	old := dlqWriter
+	fw := &fakeWriter{}
+	dlqWriter = fw
+	t.Cleanup(func() { dlqWriter = old })
+	return fw
+}
+
+func orderCreated(orderID int, total float64) OrderCreatedEvent {
+	return OrderCreatedEvent{EventType: "order_created", OrderID: orderID, TotalPrice: &total}
+}
+
+func TestProcessPaymentRetriesTransientFailures(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 3)
+	dlq := withFakeDLQ(t)
+	events := capturePublishedEvents(t)
+
+	expectOrderPaid(mock, 42, false)
+	expectPaymentInsertFails(mock, errors.New("connection reset"))
+	expectPaymentTx(mock, events, "", 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	processPayment(context.Background(), orderCreated(42, 19.99))
+
+	if len(dlq.msgs) != 0 {
+		t.Errorf("expected nothing dead-lettered, got %d messages", len(dlq.msgs))
+	}
+	if len(*events) != 1 || (*events)[0]["event_type"] != "payment_processed" {
+		t.Errorf("expected a payment_processed event, got %v", *events)
+	}
+}
+
+func TestProcessPaymentDeadLettersAfterRetries(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 2)
+	dlq := withFakeDLQ(t)
+	events := capturePublishedEvents(t)
+
+	expectOrderPaid(mock, 42, false)
+	expectPaymentInsertFails(mock, errors.New("connection reset"))
+	expectPaymentInsertFails(mock, errors.New("connection reset"))
+
+	processPayment(context.Background(), orderCreated(42, 19.99))
+
+	if len(*events) != 0 {
+		t.Errorf("expected no payment events, got %v", *events)
+	}
+	if len(dlq.msgs) != 1 {
+		t.Fatalf("expected one dead letter, got %d", len(dlq.msgs))
+	}
+	var dl deadLetter
+	if err := json.Unmarshal(dlq.msgs[0].Value, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Event == nil || dl.Event.OrderID != 42 || dl.Error != "connection reset" || dl.Attempts != 2 {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+}
+
+func TestReplayDLQ(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	dlq := withFakeDLQ(t)
+	events := capturePublishedEvents(t)
+
+	oldWait := dlqReplayWait
+	dlqReplayWait = 10 * time.Millisecond
+	t.Cleanup(func() { dlqReplayWait = oldWait })
+
+	letter := func(orderID int) kafka.Message {
+		event := orderCreated(orderID, 10)
+		data, _ := json.Marshal(deadLetter{Event: &event, Error: "connection reset", Attempts: 5})
+		return kafka.Message{Value: data}
+	}
+	fetcher := &fakeFetcher{queue: []kafka.Message{letter(1), letter(2), {Value: []byte("not json")}}}
+	oldReader := newDLQReader
+	newDLQReader = func() messageFetcher { return fetcher }
+	t.Cleanup(func() { newDLQReader = oldReader })
+
+	expectPaymentSaved(mock, events, 1, 10.0, "captured", sqlmock.AnyArg(), "card", "USD")
+	expectOrderPaid(mock, 2, false)
+	expectPaymentInsertFails(mock, errors.New("still down"))
+
+	w := httptest.NewRecorder()
+	replayDLQ(w, httptest.NewRequest("POST", "/payments/replay-dlq", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got replaySummary
+	json.NewDecoder(w.Body).Decode(&got)
+	if got != (replaySummary{Replayed: 3, Succeeded: 1, Failed: 2}) {
+		t.Errorf("expected 3 replayed, 1 succeeded and 2 failed, got %+v", got)
+	}
+	if len(fetcher.committed) != 3 {
+		t.Errorf("expected all 3 messages committed, got %d", len(fetcher.committed))
+	}
+	if len(dlq.msgs) != 1 {
+		t.Fatalf("expected the failing event to be dead-lettered again, got %d", len(dlq.msgs))
+	}
+	var dl deadLetter
+	json.Unmarshal(dlq.msgs[0].Value, &dl)
+	if dl.Replays != 1 || dl.Error != "still down" {
+		t.Errorf("unexpected re-dead-lettered event %+v", dl)
+	}
+}
+
+func TestReplayDLQDryRun(t *testing.T) {
+	// No DB expectations: a dry run processes nothing.
+	withMockDB(t)
+	dlq := withFakeDLQ(t)
+
+	oldWait := dlqReplayWait
+	dlqReplayWait = 10 * time.Millisecond
+	t.Cleanup(func() { dlqReplayWait = oldWait })
+
+	event := orderCreated(1, 10)
+	data, _ := json.Marshal(deadLetter{Event: &event, Error: "connection reset", Attempts: 5})
+	fetcher := &fakeFetcher{queue: []kafka.Message{{Value: data}, {Value: data}, {Value: data}}}
+	oldReader := newDLQReader
+	newDLQReader = func() messageFetcher { return fetcher }
+	t.Cleanup(func() { newDLQReader = oldReader })
+
+	w := httptest.NewRecorder()
+	replayDLQ(w, httptest.NewRequest("POST", "/admin/dlq/replay?dry_run=true&max=2", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got replaySummary
+	json.NewDecoder(w.Body).Decode(&got)
+	if got != (replaySummary{Replayed: 2, DryRun: true}) {
+		t.Errorf("expected 2 messages counted in a dry run, got %+v", got)
+	}
+	if len(fetcher.committed) != 0 || len(dlq.msgs) != 0 {
+		t.Errorf("expected a dry run to leave the DLQ alone, got %d commits and %d dead letters", len(fetcher.committed), len(dlq.msgs))
+	}
+}
+
+func TestReplayDLQRejectsConcurrentReplay(t *testing.T) {
+	replaySlot <- struct{}{}
+	t.Cleanup(func() { <-replaySlot })
+
+	w := httptest.NewRecorder()
+	replayDLQ(w, httptest.NewRequest("POST", "/admin/dlq/replay", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+}
+
+func TestReplayDLQRequiresAdminKey(t *testing.T) {
+	withAdminKey(t, "secret")
+	// Held so a request that gets past the key stops at 409 without
+	// reading the DLQ.
+	replaySlot <- struct{}{}
+	t.Cleanup(func() { <-replaySlot })
+
+	for _, path := range []string{"/payments/replay-dlq", "/admin/dlq/replay"} {
+		for key, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusConflict} {
+			req := httptest.NewRequest("POST", path, nil)
+			if key != "" {
+				req.Header.Set("X-API-Key", key)
+			}
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, req)
+			if w.Code != want {
+				t.Errorf("%s with key %q: expected %d, got %d", path, key, want, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// orderEventEnvelope is the part every order-events message shares.
+type orderEventEnvelope struct {
+	EventType string `json:"event_type"`
+}
+
+// OrderCreatedEvent is the order_created message order-service publishes.
+// order-service declares a matching type; keep the two in step. Fields
+// order-service adds later are ignored until this copy learns them.
+type OrderCreatedEvent struct {
+	EventType string `json:"event_type"`
+	// EventID identifies the message in logs; events from before it was
+	// added have none.
+	EventID   string `json:"event_id,omitempty"`
+	OrderID   int    `json:"order_id"`
+	ProductID int    `json:"product_id,omitempty"`
+	VariantID int    `json:"variant_id,omitempty"`
+	Quantity  int    `json:"quantity,omitempty"`
+	// TotalPrice is nil when the event has none, which is rejected
+	// rather than charged as zero.
+	TotalPrice    *float64 `json:"total_price"`
+	Currency      string   `json:"currency,omitempty"`
+	PaymentMethod string   `json:"payment_method,omitempty"`
+	Timestamp     int64    `json:"timestamp,omitempty"`
+}
+
+// paymentMethod returns the event's payment method. Events from before
+// the field existed are card payments.
+func (e OrderCreatedEvent) paymentMethod() string {
+	if e.PaymentMethod != "" {
+		return e.PaymentMethod
+	}
+	return "card"
+}
+
+// currency returns the event's currency. Events from before the field
+// existed are in USD.
+func (e OrderCreatedEvent) currency() string {
+	if c := strings.ToUpper(strings.TrimSpace(e.Currency)); c != "" {
+		return c
+	}
+	return defaultCurrency
+}
+
+// amount returns the event's total price, or 0 if it has none.
+func (e OrderCreatedEvent) amount() float64 {
+	if e.TotalPrice == nil {
+		return 0
+	}
+	return *e.TotalPrice
+}
+
+// OrderStatusChangedEvent is the order_status_changed message published
+// when an order moves on, such as to "shipped".
+type OrderStatusChangedEvent struct {
+	EventType      string `json:"event_type"`
+	EventID        string `json:"event_id,omitempty"`
+	OrderID        int    `json:"order_id"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status,omitempty"`
+	Timestamp      int64  `json:"timestamp,omitempty"`
+}
+
+// decodeOrderCreated unmarshals and checks an order_created event. A
+// field of the wrong type is reported as invalid_<field>.
+func decodeOrderCreated(data []byte) (OrderCreatedEvent, error) {
+	var event OrderCreatedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return event, &malformedError{"invalid_" + typeErr.Field, err.Error()}
+		}
+		return event, &malformedError{"invalid_json", err.Error()}
+	}
+	if event.OrderID <= 0 {
+		return event, &malformedError{"invalid_order_id", fmt.Sprintf("order_id must be a positive integer, got %d", event.OrderID)}
+	}
+	// Manual payments are only recorded through POST /payments.
+	if event.PaymentMethod != "" && (!paymentMethods[event.PaymentMethod] || event.PaymentMethod == methodManual) {
+		return event, &malformedError{"invalid_payment_method", fmt.Sprintf("payment_method must be one of card, wallet, invoice, got %q", event.PaymentMethod)}
+	}
+	return event, nil
+}
+
+// decodeOrderStatusChanged unmarshals and checks an order_status_changed
+// event, reporting problems as decodeOrderCreated does.
+func decodeOrderStatusChanged(data []byte) (OrderStatusChangedEvent, error) {
+	var event OrderStatusChangedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return event, &malformedError{"invalid_" + typeErr.Field, err.Error()}
+		}
+		return event, &malformedError{"invalid_json", err.Error()}
+	}
+	if event.OrderID <= 0 {
+		return event, &malformedError{"invalid_order_id", fmt.Sprintf("order_id must be a positive integer, got %d", event.OrderID)}
+	}
+	if event.Status == "" {
+		return event, &malformedError{"missing_status", "status must be a non-empty string"}
+	}
+	return event, nil
+}
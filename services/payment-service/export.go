@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const exportFlushEvery = 500
+
+var exportCSVHeader = []string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at"}
+
+// paymentFilter narrows GET /payments and GET /payments/export.
+type paymentFilter struct {
+	// From and To bound created_at to [From, To); zero means unbounded.
+	From, To time.Time
+	Status   string
+	Method   string
+}
+
+// parsePaymentFilter reads ?from= and ?to= (inclusive YYYY-MM-DD dates),
+// ?status= and ?payment_method=.
+func parsePaymentFilter(query url.Values) (paymentFilter, error) {
+	var f paymentFilter
+	if raw := query.Get("from"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return f, errors.New("from must be a YYYY-MM-DD date")
+		}
+		f.From = t
+	}
+	if raw := query.Get("to"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return f, errors.New("to must be a YYYY-MM-DD date")
+		}
+		f.To = t.AddDate(0, 0, 1)
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return f, errors.New("to must not be before from")
+	}
+
+	f.Status = query.Get("status")
+	switch f.Status {
+	case "", statusPending, statusAuthorized, statusCaptured, statusRefunded, statusVoided, statusFailed:
+	default:
+		return f, fmt.Errorf("unknown status %q", f.Status)
+	}
+	f.Method = query.Get("payment_method")
+	if f.Method != "" && !paymentMethods[f.Method] {
+		return f, fmt.Errorf("unknown payment_method %q", f.Method)
+	}
+	return f, nil
+}
+
+// sql returns the payments query for the filter, newest first.
+func (f paymentFilter) sql() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To)
+	}
+	if f.Status != "" {
+		statuses := []string{f.Status}
+		if f.Status == statusCaptured {
+			statuses = append(statuses, statusCompleted)
+		}
+		add("status = ANY($%d)", pq.Array(statuses))
+	}
+	if f.Method != "" {
+		add("payment_method = $%d", f.Method)
+	}
+
+	query := "SELECT id, order_id, amount, currency, status, payment_method, created_at, COALESCE(retry_of, 0) FROM payments"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	return query + " ORDER BY id DESC", args
+}
+
+// exportPayments streams payments as CSV for month-end reconciliation,
+// straight from the database rows and flushing as it goes, so memory use
+// doesn't grow with the range. It takes GET /payments' filters and stops
+// as soon as the client disconnects. Like the rest of payment-service it
+// is only reachable inside the cluster network.
+func exportPayments(w http.ResponseWriter, r *http.Request) {
+	if format := r.URL.Query().Get("format"); format != "" && format != "csv" {
+		http.Error(w, "format must be csv", http.StatusBadRequest)
+		return
+	}
+	filter, err := parsePaymentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	query, args := filter.sql()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payments-%s.csv"`,
+		time.Now().UTC().Format("20060102T150405Z")))
+	cw := csv.NewWriter(w)
+	cw.Write(exportCSVHeader)
+
+	rc := http.NewResponseController(w)
+	count := 0
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Payment export aborted after %d rows: %v", count, err)
+			return
+		}
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.Amount, &p.Currency, &p.Status, &p.PaymentMethod, &p.CreatedAt, &p.RetryOf); err != nil {
+			log.Printf("Payment export aborted after %d rows: %v", count, err)
+			return
+		}
+		cw.Write([]string{
+			strconv.Itoa(p.ID), strconv.Itoa(p.OrderID), strconv.FormatFloat(p.Amount, 'f', 2, 64),
+			p.Currency, normalizeStatus(p.Status), p.PaymentMethod, p.CreatedAt.UTC().Format(time.RFC3339),
+		})
+		count++
+		if count%exportFlushEvery == 0 {
+			if err := flushExport(cw, rc); err != nil {
+				log.Printf("Payment export aborted after %d rows, client write failed: %v", count, err)
+				return
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Payment export aborted after %d rows: %v", count, err)
+		return
+	}
+	if err := flushExport(cw, rc); err != nil {
+		log.Printf("Payment export final flush failed after %d rows: %v", count, err)
+		return
+	}
+	log.Printf("Exported %d payments", count)
+}
+
+func flushExport(cw *csv.Writer, rc *http.ResponseController) error {
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
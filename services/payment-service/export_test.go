@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestExportPayments(t *testing.T) {
+	mock := withMockDB(t)
+
+	created := time.Date(2024, 5, 31, 23, 59, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE created_at >= \\$1 AND created_at < \\$2 AND status = ANY\\(\\$3\\) ORDER BY id DESC").
+		WithArgs(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), pq.Array([]string{"captured", "completed"})).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of"}).
+			AddRow(9, 42, 19.9, "EUR", "captured", "card", created, 0).
+			AddRow(4, 41, 5.0, "USD", "completed", "wallet", created, 0))
+
+	w := httptest.NewRecorder()
+	exportPayments(w, httptest.NewRequest("GET", "/payments/export?from=2024-05-01&to=2024-05-31&status=captured&format=csv", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="payments-`) {
+		t.Errorf("unexpected Content-Disposition %q", cd)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		exportCSVHeader,
+		{"9", "42", "19.90", "EUR", "captured", "card", "2024-05-31T23:59:00Z"},
+		{"4", "41", "5.00", "USD", "captured", "wallet", "2024-05-31T23:59:00Z"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %v", len(want), records)
+	}
+	for i := range want {
+		if strings.Join(records[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("record %d: expected %v, got %v", i, want[i], records[i])
+		}
+	}
+}
+
+func TestExportPaymentsRejectsBadRequests(t *testing.T) {
+	for _, query := range []string{"format=xlsx", "from=May", "from=2024-05-02&to=2024-05-01", "status=settled", "payment_method=crypto"} {
+		withMockDB(t)
+		w := httptest.NewRecorder()
+		exportPayments(w, httptest.NewRequest("GET", "/payments/export?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestPaymentFilterSQL(t *testing.T) {
+	f, err := parsePaymentFilter(url.Values{"payment_method": {"wallet"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args := f.sql()
+	if !strings.HasSuffix(query, "FROM payments WHERE payment_method = $1 ORDER BY id DESC") || len(args) != 1 || args[0] != "wallet" {
+		t.Errorf("unexpected query %q with %v", query, args)
+	}
+
+	query, args = paymentFilter{}.sql()
+	if strings.Contains(query, "WHERE") || len(args) != 0 {
+		t.Errorf("expected an unfiltered query, got %q with %v", query, args)
+	}
+}
+
+func TestExportPaymentsRequiresAdminKey(t *testing.T) {
+	// No DB expectations: the export is refused before any query.
+	withMockDB(t)
+	withAdminKey(t, "secret")
+
+	for _, key := range []string{"", "wrong"} {
+		req := httptest.NewRequest("GET", "/payments/export", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("key %q: expected 401, got %d", key, w.Code)
+		}
+	}
+}
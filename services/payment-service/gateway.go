@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var gatewayDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "payment_gateway_duration_seconds",
+		Help:    "Payment gateway call latency in seconds, by operation and outcome",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"operation", "outcome"},
+)
+
+// PaymentGateway moves money for a payment. Authorize reserves the amount
+// and returns a reference that Capture settles or Void releases; Refund
+// returns money from a captured reference. Authorize's idempotencyKey
+// identifies the charge attempt, so a repeated attempt isn't charged
+// twice but a new one isn't answered with an earlier one's outcome;
+// Refund's identifies the refund the same way.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, orderID int, amount float64, idempotencyKey string) (string, error)
+	Capture(ctx context.Context, ref string, amount float64) error
+	Void(ctx context.Context, ref string) error
+	Refund(ctx context.Context, ref string, amount float64, idempotencyKey string) error
+}
+
+// declinedError is a definitive refusal from the gateway. Any other
+// gateway error leaves the outcome unknown.
+type declinedError struct {
+	reason string
+}
+
+func (e *declinedError) Error() string {
+	return "declined by payment gateway: " + e.reason
+}
+
+func isDeclined(err error) bool {
+	var de *declinedError
+	return errors.As(err, &de)
+}
+
+// gateway is the configured PaymentGateway, selected by PAYMENT_GATEWAY.
+var (
+	gateway        PaymentGateway = mockGateway{delay: 100 * time.Millisecond}
+	gatewayTimeout                = loadDuration("PAYMENT_GATEWAY_TIMEOUT", 10*time.Second)
+)
+
+// newGatewayFromEnv builds the gateway named by PAYMENT_GATEWAY: "mock"
+// (the default) or "http".
+func newGatewayFromEnv() (PaymentGateway, error) {
+	switch name := getEnv("PAYMENT_GATEWAY", "mock"); name {
+	case "mock":
+		return mockGateway{delay: 100 * time.Millisecond}, nil
+	case "http":
+		baseURL := getEnv("PAYMENT_GATEWAY_URL", "")
+		if _, err := url.ParseRequestURI(baseURL); err != nil {
+			return nil, fmt.Errorf("PAYMENT_GATEWAY_URL must be set to a valid URL for the http gateway")
+		}
+		return newHTTPGateway(baseURL, getEnv("PAYMENT_GATEWAY_API_KEY", ""), gatewayTimeout), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_GATEWAY %q", name)
+	}
+}
+
+// observeGateway times a gateway call and records its outcome.
+func observeGateway(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	outcome := "success"
+	if isDeclined(err) {
+		outcome = "declined"
+	} else if err != nil {
+		outcome = "error"
+	}
+	gatewayDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// chargeOrder authorizes and, unless capture is deferred, captures an
+// order's amount, mapping the outcome to a payment status: "captured" or
+// "authorized", "failed" when the gateway declined, or "pending" when it
+// will confirm the authorization later, or couldn't be reached or timed
+// out and the charge may or may not have happened. ref is empty if authorization didn't return one.
+// idempotencyKey identifies the attempt, as chargeKey and retryChargeKey
+// make it.
+func chargeOrder(orderID int, amount float64, idempotencyKey string) (status, ref string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout)
+	defer cancel()
+
+	err = observeGateway("authorize", func() error {
+		var err error
+		ref, err = gateway.Authorize(ctx, orderID, amount, idempotencyKey)
+		return err
+	})
+	if err == nil && deferCapture {
+		return statusAuthorized, ref, nil
+	}
+	if err == nil {
+		err = observeGateway("capture", func() error {
+			return gateway.Capture(ctx, ref, amount)
+		})
+	}
+
+	switch {
+	case err == nil:
+		return statusCaptured, ref, nil
+	case isDeclined(err):
+		return statusFailed, ref, err
+	default:
+		return statusPending, ref, err
+	}
+}
+
+// chargeKey is the idempotency key of an order's first charge, so a
+// redelivered order_created event doesn't reserve the amount twice.
+func chargeKey(orderID int) string {
+	return "order-" + strconv.Itoa(orderID)
+}
+
+// retryChargeKey is the idempotency key of an order's attempt'th charge,
+// counting from 1 for the first.
+func retryChargeKey(orderID, attempt int) string {
+	return chargeKey(orderID) + "-attempt-" + strconv.Itoa(attempt)
+}
+
+// mockGateway approves everything after a short delay.
+type mockGateway struct {
+	delay time.Duration
+}
+
+func (g mockGateway) wait(ctx context.Context) error {
+	select {
+	case <-time.After(g.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g mockGateway) Authorize(ctx context.Context, orderID int, amount float64, idempotencyKey string) (string, error) {
+	if err := g.wait(ctx); err != nil {
+		return "", err
+	}
+	return "mock-auth-" + strconv.Itoa(orderID), nil
+}
+
+func (g mockGateway) Capture(ctx context.Context, ref string, amount float64) error {
+	return nil
+}
+
+func (g mockGateway) Void(ctx context.Context, ref string) error {
+	return nil
+}
+
+func (g mockGateway) Refund(ctx context.Context, ref string, amount float64, idempotencyKey string) error {
+	return g.wait(ctx)
+}
+
+// httpGateway talks to a generic REST payment gateway:
+//
+//	POST {base}/authorizations              {"order_id", "amount"} -> {"id", "status"}
+//	POST {base}/authorizations/{id}/capture {"amount"}
+//	POST {base}/authorizations/{id}/void    {}
+//	POST {base}/authorizations/{id}/refunds {"amount"}
+//
+// 402 and 422 responses are declines; other failures are left pending.
+type httpGateway struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func newHTTPGateway(baseURL, apiKey string, timeout time.Duration) *httpGateway {
+	return &httpGateway{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// post sends a JSON request and decodes a JSON response into out, if
+// given. idempotencyKey lets the gateway drop a retried request.
+func (g *httpGateway) post(ctx context.Context, path, idempotencyKey string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPaymentRequired || resp.StatusCode == http.StatusUnprocessableEntity {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &declinedError{reason: strings.TrimSpace(string(msg))}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("payment gateway returned %s", resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// Authorize sends idempotencyKey with the request, so the gateway drops
+// a repeated attempt. An authorization the gateway reports as "pending" returns errAuthorizationPending with
+// its id; the gateway confirms it through POST /payments/{id}/callback.
+func (g *httpGateway) Authorize(ctx context.Context, orderID int, amount float64, idempotencyKey string) (string, error) {
+	var auth struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	err := g.post(ctx, "/authorizations", idempotencyKey,
+		map[string]interface{}{"order_id": orderID, "amount": amount}, &auth)
+	if err != nil {
+		return "", err
+	}
+	if auth.ID == "" {
+		return "", errors.New("payment gateway returned no authorization id")
+	}
+	if auth.Status == statusPending {
+		return auth.ID, errAuthorizationPending
+	}
+	return auth.ID, nil
+}
+
+func (g *httpGateway) Capture(ctx context.Context, ref string, amount float64) error {
+	return g.post(ctx, "/authorizations/"+url.PathEscape(ref)+"/capture", "capture-"+ref,
+		map[string]interface{}{"amount": amount}, nil)
+}
+
+func (g *httpGateway) Void(ctx context.Context, ref string) error {
+	if ref == "" {
+		return &declinedError{reason: "payment has no gateway reference"}
+	}
+	return g.post(ctx, "/authorizations/"+url.PathEscape(ref)+"/void", "void-"+ref,
+		map[string]interface{}{}, nil)
+}
+
+func (g *httpGateway) Refund(ctx context.Context, ref string, amount float64, idempotencyKey string) error {
+	if ref == "" {
+		return &declinedError{reason: "payment has no gateway reference"}
+	}
+	return g.post(ctx, "/authorizations/"+url.PathEscape(ref)+"/refunds", idempotencyKey,
+		map[string]interface{}{"amount": amount}, nil)
+}
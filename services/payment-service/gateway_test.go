@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// withGateway swaps the payment gateway for the rest of the test.
+func withGateway(t *testing.T, g PaymentGateway) {
+	t.Helper()
+	old := gateway
+	gateway = g
+	t.Cleanup(func() { gateway = old })
+}
+
+// fakeGatewayServer stands in for a REST payment gateway. authorize and
+// capture are the status codes it answers those calls with.
+func fakeGatewayServer(t *testing.T, authorize, capture int, delay time.Duration) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /authorizations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("missing API key, got %q", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("Idempotency-Key") != "order-42" {
+			t.Errorf("expected idempotency key order-42, got %q", r.Header.Get("Idempotency-Key"))
+		}
+		time.Sleep(delay)
+		if authorize != http.StatusOK {
+			http.Error(w, "card declined", authorize)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": "auth_1"})
+	})
+	mux.HandleFunc("POST /authorizations/{id}/capture", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "auth_1" {
+			t.Errorf("expected capture of auth_1, got %s", r.PathValue("id"))
+		}
+		w.WriteHeader(capture)
+	})
+	mux.HandleFunc("POST /authorizations/{id}/refunds", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Idempotency-Key") != "refund-3" {
+			t.Errorf("expected idempotency key refund-3, got %q", r.Header.Get("Idempotency-Key"))
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestChargeOrderHTTPGateway(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorize  int
+		capture    int
+		delay      time.Duration
+		wantStatus string
+		wantRef    string
+	}{
+		{name: "approved", authorize: http.StatusOK, capture: http.StatusOK, wantStatus: "captured", wantRef: "auth_1"},
+		{name: "declined", authorize: http.StatusPaymentRequired, wantStatus: "failed"},
+		{name: "gateway error", authorize: http.StatusServiceUnavailable, wantStatus: "pending"},
+		{name: "capture error", authorize: http.StatusOK, capture: http.StatusInternalServerError, wantStatus: "pending", wantRef: "auth_1"},
+		{name: "timeout", authorize: http.StatusOK, capture: http.StatusOK, delay: 200 * time.Millisecond, wantStatus: "pending"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeGatewayServer(t, tt.authorize, tt.capture, tt.delay)
+			withGateway(t, newHTTPGateway(srv.URL, "secret", 50*time.Millisecond))
+
+			status, ref, err := chargeOrder(42, 19.99, chargeKey(42))
+			if status != tt.wantStatus || ref != tt.wantRef {
+				t.Fatalf("expected %s/%q, got %s/%q (err %v)", tt.wantStatus, tt.wantRef, status, ref, err)
+			}
+			if (err == nil) != (tt.wantStatus == "captured") {
+				t.Errorf("unexpected error %v for status %s", err, status)
+			}
+		})
+	}
+}
+
+func TestHandleOrderCreatedRecordsGatewayOutcome(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+	srv := fakeGatewayServer(t, http.StatusPaymentRequired, 0, 0)
+	withGateway(t, newHTTPGateway(srv.URL, "secret", time.Second))
+
+	expectPaymentSaved(mock, events, 42, 19.99, "failed", "", "card", "USD")
+
+	if err := handleOrderCreated(context.Background(), orderCreated(42, 19.99)); err != nil {
+		t.Fatalf("expected a declined payment to be recorded, got %v", err)
+	}
+	if len(*events) != 1 || (*events)[0]["status"] != "failed" {
+		t.Errorf("expected a failed payment_processed event, got %v", *events)
+	}
+}
+
+// refundingGateway approves charges and answers refunds with err.
+type refundingGateway struct {
+	mockGateway
+	err error
+}
+
+func (g refundingGateway) Refund(ctx context.Context, ref string, amount float64, idempotencyKey string) error {
+	return g.err
+}
+
+func TestRefundPaymentDeclinedByGateway(t *testing.T) {
+	mock := withMockDB(t)
+	events := capturePublishedEvents(t)
+	withGateway(t, refundingGateway{err: &declinedError{reason: "refund window closed"}})
+
+	expectLockedPayment(mock, 30, "completed")
+	expectRefundedAmount(mock, 0)
+	expectReservedRefund(mock, 30)
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE refunds SET status = \\$2 WHERE id = \\$1 AND status = \\$3").
+		WithArgs(3, "failed", "pending").
+		WillReturnRows(sqlmock.NewRows([]string{"payment_id", "amount"}).AddRow(7, 30.0))
+	mock.ExpectExec("UPDATE payments SET refunded_amount = refunded_amount - \\$2 WHERE id = \\$1").
+		WithArgs(7, 30.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := serveRefund("")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events, got %v", *events)
+	}
+}
+
+func TestRefundPaymentUnknownGatewayOutcome(t *testing.T) {
+	mock := withMockDB(t)
+	events := capturePublishedEvents(t)
+	withGateway(t, refundingGateway{err: context.DeadlineExceeded})
+
+	expectLockedPayment(mock, 30, "completed")
+	expectRefundedAmount(mock, 0)
+	expectReservedRefund(mock, 30)
+
+	w := serveRefund("")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var refund Refund
+	json.NewDecoder(w.Body).Decode(&refund)
+	if refund.ID != 3 || refund.Status != "pending" {
+		t.Errorf("expected pending refund 3, got %+v", refund)
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events, got %v", *events)
+	}
+}
+
+func TestRefundPaymentHTTPGatewaySendsRefundKey(t *testing.T) {
+	mock := withMockDB(t)
+	events := capturePublishedEvents(t)
+	srv := fakeGatewayServer(t, http.StatusOK, http.StatusOK, 0)
+	withGateway(t, newHTTPGateway(srv.URL, "secret", time.Second))
+
+	expectLockedPayment(mock, 30, "captured")
+	expectRefundedAmount(mock, 0)
+	expectReservedRefund(mock, 10)
+	expectCompletedRefund(mock, events, 10, 10)
+
+	w := serveRefund(`{"amount": 10}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestResendPendingRefunds(t *testing.T) {
+	mock := withMockDB(t)
+	events := capturePublishedEvents(t)
+	srv := fakeGatewayServer(t, http.StatusOK, http.StatusOK, 0)
+	withGateway(t, newHTTPGateway(srv.URL, "secret", time.Second))
+
+	mock.ExpectQuery("SELECT (.+) FROM refunds r JOIN payments p").
+		WithArgs("pending", sqlmock.AnyArg(), pendingSweepBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payment_id", "amount", "gateway_ref"}).AddRow(3, 7, 30.0, "auth_7"))
+	expectCompletedRefund(mock, events, 30, 30)
+
+	n, err := resendPendingRefunds(context.Background(), time.Minute)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one refund settled, got %d (err %v)", n, err)
+	}
+	if len(*events) != 1 || (*events)[0]["refund_id"] != 3.0 || (*events)[0]["full"] != true {
+		t.Errorf("expected a full payment_refunded event for refund 3, got %v", *events)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var consumerRestarts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "payment_consumer_restarts_total",
+	Help: "Times the order-events consumer was restarted after a panic",
+})
+
+var (
+	// readinessMaxIdle is how long the consumer may go without fetching
+	// while it has lag before /readyz fails.
+	readinessMaxIdle = loadDuration("READINESS_MAX_IDLE", 60*time.Second)
+	consumerHealth   = &consumerHeartbeat{}
+)
+
+// consumerHeartbeat is how the consumer reports liveness to /readyz.
+type consumerHeartbeat struct {
+	mu        sync.Mutex
+	running   bool
+	since     time.Time // when the consumer last started
+	lastFetch time.Time
+	lag       int64
+}
+
+func (h *consumerHeartbeat) setRunning(running bool, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = running
+	h.since = now
+}
+
+// fetched records a successful fetch.
+func (h *consumerHeartbeat) fetched(now time.Time) {
+	h.mu.Lock()
+	h.lastFetch = now
+	h.mu.Unlock()
+}
+
+func (h *consumerHeartbeat) observeLag(lag int64) {
+	h.mu.Lock()
+	h.lag = lag
+	h.mu.Unlock()
+}
+
+// check returns why the consumer isn't ready, or nil. An idle consumer
+// is fine as long as it has nothing to catch up on.
+func (h *consumerHeartbeat) check(now time.Time, maxIdle time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return fmt.Errorf("consumer is not running")
+	}
+	last := h.lastFetch
+	if last.Before(h.since) {
+		last = h.since
+	}
+	if idle := now.Sub(last); idle > maxIdle && h.lag > 0 {
+		return fmt.Errorf("consumer has %d messages of lag but hasn't fetched for %s", h.lag, idle.Round(time.Second))
+	}
+	return nil
+}
+
+// heartbeatStats passes reader stats on to consumerStats, noting the lag
+// for readiness on the way.
+type heartbeatStats struct {
+	statsReader
+	heartbeat *consumerHeartbeat
+}
+
+func (r heartbeatStats) Stats() kafka.ReaderStats {
+	stats := r.statsReader.Stats()
+	r.heartbeat.observeLag(stats.Lag)
+	return stats
+}
+
+// readinessCheck reports whether the service can take traffic: the
+// database answers and the order-events consumer is making progress and
+// not paused by backpressure.
+func readinessCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := db.Ping()
+	if err == nil {
+		err = consumerHealth.check(time.Now(), readinessMaxIdle)
+	}
+	if err == nil {
+		err = dbBackpressure.check()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestConsumerHeartbeatCheck(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		running   bool
+		lastFetch time.Time
+		lag       int64
+		now       time.Time
+		wantErr   bool
+	}{
+		{name: "not running", running: false, now: start, wantErr: true},
+		{name: "just started", running: true, lag: 50, now: start.Add(10 * time.Second)},
+		{name: "fetching", running: true, lastFetch: start.Add(2 * time.Minute), lag: 50, now: start.Add(2*time.Minute + 5*time.Second)},
+		{name: "idle with nothing to do", running: true, lastFetch: start.Add(time.Second), now: start.Add(time.Hour)},
+		{name: "stalled with lag", running: true, lastFetch: start.Add(time.Second), lag: 50, now: start.Add(5 * time.Minute), wantErr: true},
+		{name: "never fetched with lag", running: true, lag: 50, now: start.Add(5 * time.Minute), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &consumerHeartbeat{}
+			h.setRunning(tt.running, start)
+			if !tt.lastFetch.IsZero() {
+				h.fetched(tt.lastFetch)
+			}
+			h.observeLag(tt.lag)
+
+			err := h.check(tt.now, time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	withMockDB(t)
+	old := consumerHealth
+	consumerHealth = &consumerHeartbeat{}
+	t.Cleanup(func() { consumerHealth = old })
+
+	w := httptest.NewRecorder()
+	readinessCheck(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with no consumer running, got %d", w.Code)
+	}
+
+	consumerHealth.setRunning(true, time.Now())
+	w = httptest.NewRecorder()
+	readinessCheck(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 once the consumer runs, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// panickingFetcher panics on its first fetch, then behaves like
+// fakeFetcher.
+type panickingFetcher struct {
+	fakeFetcher
+	panicked bool
+}
+
+func (f *panickingFetcher) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if !f.panicked {
+		f.panicked = true
+		panic("broken reader")
+	}
+	return f.fakeFetcher.FetchMessage(ctx)
+}
+
+func TestStartConsumerRestartsAfterPanic(t *testing.T) {
+	oldDelay := consumerRestartDelay
+	consumerRestartDelay = time.Millisecond
+	t.Cleanup(func() { consumerRestartDelay = oldDelay })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fetcher := &panickingFetcher{fakeFetcher: fakeFetcher{queue: []kafka.Message{{Value: []byte(`{"event_type":"order_cancelled"}`)}}}}
+	startConsumer(ctx, fetcher)
+
+	deadline := time.After(2 * time.Second)
+	for {
+		fetcher.mu.Lock()
+		n := len(fetcher.committed)
+		fetcher.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("consumer did not restart and process the message")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	if !drainInFlight(time.Second) {
+		t.Fatal("consumer did not stop")
+	}
+}
+
+func TestHandleMessageRecoveringTurnsPanicIntoError(t *testing.T) {
+	withGateway(t, mockGateway{})
+	// With no database, saving the payment panics.
+	oldDB := db
+	db = nil
+	t.Cleanup(func() { db = oldDB })
+
+	err := handleMessageRecovering(orderCreatedMessage(42, 19.99))
+	if err == nil || !strings.HasPrefix(err.Error(), "panic: ") {
+		t.Fatalf("expected the panic to be returned as an error, got %v", err)
+	}
+}
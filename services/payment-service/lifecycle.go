@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Payment states. A payment starts pending, authorized, captured or
+// failed depending on how far the gateway got, and moves on from there:
+//
+//	pending → authorized → captured → refunded
+//	   │          ├──→ voided
+//	   └──────────┴──→ failed
+const (
+	statusPending    = "pending"
+	statusAuthorized = "authorized"
+	statusCaptured   = "captured"
+	statusRefunded   = "refunded"
+	statusVoided     = "voided"
+	statusFailed     = "failed"
+	// statusCompleted is how captured payments were stored before
+	// authorization and capture were tracked separately.
+	statusCompleted = "completed"
+)
+
+var paymentTransitions = map[string][]string{
+	statusPending:    {statusAuthorized, statusCaptured, statusFailed},
+	statusAuthorized: {statusCaptured, statusVoided, statusFailed},
+	statusCaptured:   {statusRefunded},
+}
+
+// deferCapture leaves new payments authorized until
+// POST /payments/{id}/capture. Set PAYMENT_CAPTURE_MODE=deferred to
+// capture when the order ships rather than when it is placed.
+var deferCapture = loadCaptureMode()
+
+func loadCaptureMode() bool {
+	switch mode := getEnv("PAYMENT_CAPTURE_MODE", "immediate"); mode {
+	case "immediate":
+		return false
+	case "deferred":
+		return true
+	default:
+		log.Printf("Invalid PAYMENT_CAPTURE_MODE %q, using immediate", mode)
+		return false
+	}
+}
+
+// normalizeStatus maps legacy statuses to their current names.
+func normalizeStatus(status string) string {
+	if status == statusCompleted {
+		return statusCaptured
+	}
+	return status
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range paymentTransitions[normalizeStatus(from)] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// initialTransitions lists the states a new payment passed through to
+// reach status; an immediately captured payment was authorized first.
+func initialTransitions(status string) []string {
+	if status == statusCaptured {
+		return []string{statusAuthorized, statusCaptured}
+	}
+	return []string{status}
+}
+
+// invalidTransitionError is a state change paymentTransitions doesn't
+// allow.
+type invalidTransitionError struct {
+	from, to string
+}
+
+func (e *invalidTransitionError) Error() string {
+	return fmt.Sprintf("payment can't move from %s to %s", e.from, e.to)
+}
+
+// recordTransition writes a state change to the payment_events audit
+// table. from is empty for a new payment.
+func recordTransition(ctx context.Context, tx *sql.Tx, paymentID int, from, to string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO payment_events (payment_id, from_status, to_status) VALUES ($1, NULLIF($2, ''), $3)",
+		paymentID, from, to)
+	return err
+}
+
+// transitionPayment moves a locked payment to status to, recording the
+// change and queueing a payment_status_changed event in tx.
+func transitionPayment(ctx context.Context, tx *sql.Tx, p *Payment, to string) error {
+	from := normalizeStatus(p.Status)
+	if !canTransition(from, to) {
+		return &invalidTransitionError{from, to}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE payments SET status = $2 WHERE id = $1", p.ID, to); err != nil {
+		return err
+	}
+	if err := recordTransition(ctx, tx, p.ID, from, to); err != nil {
+		return err
+	}
+	if err := enqueueEvent(ctx, tx, map[string]interface{}{
+		"event_type":  "payment_status_changed",
+		"payment_id":  p.ID,
+		"order_id":    p.OrderID,
+		"from_status": from,
+		"to_status":   to,
+		"timestamp":   time.Now().Unix(),
+	}); err != nil {
+		return err
+	}
+	p.Status = to
+	return nil
+}
+
+// lockPayment loads a payment for update, with its gateway reference.
+func lockPayment(ctx context.Context, tx *sql.Tx, id string) (Payment, string, error) {
+	return lockPaymentWhere(ctx, tx, "id = $1", id)
+}
+
+// lockPaymentWhere is lockPayment for the first payment matching where.
+func lockPaymentWhere(ctx context.Context, tx *sql.Tx, where string, args ...interface{}) (Payment, string, error) {
+	var p Payment
+	var gatewayRef sql.NullString
+	err := tx.QueryRowContext(ctx,
+		"SELECT id, order_id, amount, currency, status, payment_method, created_at, COALESCE(retry_of, 0), gateway_ref FROM payments WHERE "+where+" FOR UPDATE", args...,
+	).Scan(&p.ID, &p.OrderID, &p.Amount, &p.Currency, &p.Status, &p.PaymentMethod, &p.CreatedAt, &p.RetryOf, &gatewayRef)
+	p.Status = normalizeStatus(p.Status)
+	return p, gatewayRef.String, err
+}
+
+// enqueuePaymentEvent queues a payment_authorized, payment_captured or
+// payment_voided event for p in tx. These sit alongside
+// payment_status_changed for consumers, such as notification-service,
+// that only care about one step.
+func enqueuePaymentEvent(ctx context.Context, tx *sql.Tx, eventType string, p Payment) error {
+	return enqueueEvent(ctx, tx, map[string]interface{}{
+		"event_type":     eventType,
+		"payment_id":     p.ID,
+		"order_id":       p.OrderID,
+		"amount":         p.Amount,
+		"currency":       p.Currency,
+		"payment_method": p.PaymentMethod,
+		"timestamp":      time.Now().Unix(),
+	})
+}
+
+// markCaptured moves a locked, authorized payment to captured in tx. The
+// caller then settles it with captureAtGateway before committing, so a
+// capture the gateway refuses rolls back and leaves the payment
+// authorized.
+func markCaptured(ctx context.Context, tx *sql.Tx, p *Payment) error {
+	if err := transitionPayment(ctx, tx, p, statusCaptured); err != nil {
+		return err
+	}
+	return enqueuePaymentEvent(ctx, tx, "payment_captured", *p)
+}
+
+func captureAtGateway(ctx context.Context, gatewayRef string, amount float64) error {
+	ctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	return observeGateway("capture", func() error {
+		return gateway.Capture(ctx, gatewayRef, amount)
+	})
+}
+
+// capturePayment captures an authorized payment through the gateway, as
+// an order_status_changed event for a shipped order does.
+func capturePayment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	p, gatewayRef, err := lockPayment(r.Context(), tx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = markCaptured(r.Context(), tx, &p)
+	var invalid *invalidTransitionError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = captureAtGateway(r.Context(), gatewayRef, p.Amount)
+	if isDeclined(err) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Payment gateway unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kickOutboxRelay()
+	log.Printf("Captured payment %d (order %d)", p.ID, p.OrderID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// expectTransition expects transitionPayment to move payment id from one
+// status to another, recording its payment_status_changed event in
+// events.
+func expectTransition(mock sqlmock.Sqlmock, events *[]map[string]interface{}, id int, from, to string) {
+	mock.ExpectExec("UPDATE payments SET status = \\$2 WHERE id = \\$1").
+		WithArgs(id, to).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment_events").
+		WithArgs(id, from, to).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs("payment_status_changed", outboxPayload{events}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectPaymentEvent expects a payment_authorized, payment_captured or
+// payment_voided event for payment 7 to be queued, recording it in
+// events.
+func expectPaymentEvent(mock sqlmock.Sqlmock, events *[]map[string]interface{}, eventType string) {
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs(eventType, outboxPayload{events}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func serveCapture() *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}/capture", capturePayment).Methods("POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/payments/7/capture", nil))
+	return w
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{statusPending, statusAuthorized, true},
+		{statusPending, statusFailed, true},
+		{statusAuthorized, statusCaptured, true},
+		{statusAuthorized, statusRefunded, false},
+		{statusAuthorized, statusVoided, true},
+		{statusCaptured, statusVoided, false},
+		{statusCaptured, statusRefunded, true},
+		{statusCompleted, statusRefunded, true},
+		{statusCaptured, statusAuthorized, false},
+		{statusRefunded, statusCaptured, false},
+		{statusFailed, statusCaptured, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %t, want %t", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestCapturePayment(t *testing.T) {
+	mock := withMockDB(t)
+	changes := &[]map[string]interface{}{}
+
+	captured := &[]map[string]interface{}{}
+
+	expectLockedPayment(mock, 30, "authorized")
+	expectTransition(mock, changes, 7, "authorized", "captured")
+	expectPaymentEvent(mock, captured, "payment_captured")
+	mock.ExpectCommit()
+
+	w := serveCapture()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var p Payment
+	json.NewDecoder(w.Body).Decode(&p)
+	if p.Status != "captured" {
+		t.Errorf("expected the payment to be captured, got %+v", p)
+	}
+	if len(*changes) != 1 || (*changes)[0]["from_status"] != "authorized" || (*changes)[0]["to_status"] != "captured" {
+		t.Errorf("expected a payment_status_changed event, got %v", *changes)
+	}
+	if len(*captured) != 1 || (*captured)[0]["payment_id"] != float64(7) || (*captured)[0]["currency"] != "EUR" {
+		t.Errorf("expected a payment_captured event, got %v", *captured)
+	}
+}
+
+func TestCapturePaymentRequiresAdminKey(t *testing.T) {
+	expectAdminOnly(t, "POST", "/payments/7/capture")
+}
+
+func TestCapturePaymentInvalidTransition(t *testing.T) {
+	for _, status := range []string{"captured", "completed", "refunded", "failed"} {
+		t.Run(status, func(t *testing.T) {
+			mock := withMockDB(t)
+			expectLockedPayment(mock, 30, status)
+			mock.ExpectRollback()
+
+			if w := serveCapture(); w.Code != http.StatusConflict {
+				t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// decliningCaptureGateway approves authorizations but declines captures.
+type decliningCaptureGateway struct{ mockGateway }
+
+func (decliningCaptureGateway) Capture(ctx context.Context, ref string, amount float64) error {
+	return &declinedError{reason: "authorization expired"}
+}
+
+func TestCapturePaymentDeclinedByGateway(t *testing.T) {
+	mock := withMockDB(t)
+	withGateway(t, decliningCaptureGateway{})
+
+	expectLockedPayment(mock, 30, "authorized")
+	expectTransition(mock, &[]map[string]interface{}{}, 7, "authorized", "captured")
+	expectPaymentEvent(mock, &[]map[string]interface{}{}, "payment_captured")
+	mock.ExpectRollback()
+
+	if w := serveCapture(); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleOrderCreatedDeferredCapture(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+	deferCapture = true
+	t.Cleanup(func() { deferCapture = false })
+
+	expectPaymentSaved(mock, events, 42, 19.99, "authorized", "mock-auth-42", "card", "USD")
+
+	if err := handleOrderCreated(context.Background(), orderCreated(42, 19.99)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 2 || (*events)[0]["status"] != "authorized" || (*events)[1]["event_type"] != "payment_authorized" {
+		t.Errorf("expected an authorized payment_processed event and a payment_authorized event, got %v", *events)
+	}
+}
+
+func TestGetPaymentMapsCompletedToCaptured(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE id = \\$1").
+		WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of", "refunded_amount"}).
+			AddRow(7, 42, 19.99, "USD", "completed", "card", time.Now(), 0, 0))
+	mock.ExpectQuery("SELECT id, amount, status, created_at FROM refunds").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "amount", "status", "created_at"}))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}", getPayment).Methods("GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/payments/7", nil))
+
+	var p Payment
+	json.NewDecoder(w.Body).Decode(&p)
+	if p.Status != "captured" {
+		t.Errorf("expected a legacy completed payment to read as captured, got %q", p.Status)
+	}
+}
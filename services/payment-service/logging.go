@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type contextKey int
+
+const loggerKey contextKey = iota
+
+// headerCorrelationID is the Kafka header producers may set to tie a
+// message to the request that caused it.
+const headerCorrelationID = "correlation_id"
+
+// initLogger installs a JSON slog handler as the process-wide default.
+// The standard log package is routed through it too, so every line the
+// service writes is structured.
+func initLogger() {
+	var level slog.Level
+	switch strings.ToLower(getEnv("LOG_LEVEL", "info")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler).With("service", "payment-service"))
+}
+
+// withLogger returns ctx carrying logger, for loggerFrom further down the
+// call chain.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// loggerFrom returns the logger ctx carries, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// messageLogger returns the default logger annotated with where msg was
+// consumed from and its correlation id, if it has one.
+func messageLogger(msg kafka.Message) *slog.Logger {
+	logger := slog.Default().With("topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+	if id, ok := header(msg, headerCorrelationID); ok && id != "" {
+		logger = logger.With("correlation_id", id)
+	}
+	return logger
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+// captureLogs sends the default logger's output to a buffer as JSON for
+// the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestHandleMessageLogsCarryOrderAndMessage(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+	logs := captureLogs(t)
+
+	expectEventPaymentSaved(mock, events, "evt-1", 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	event := orderCreated(42, 19.99)
+	event.EventID = "evt-1"
+	data, _ := json.Marshal(event)
+	msg := kafka.Message{
+		Topic:     "order-events",
+		Partition: 2,
+		Offset:    17,
+		Value:     data,
+		Headers:   []kafka.Header{{Key: "correlation_id", Value: []byte("req-9")}},
+	}
+	if err := handleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"order_id":       float64(42),
+		"event_id":       "evt-1",
+		"correlation_id": "req-9",
+		"partition":      float64(2),
+		"offset":         float64(17),
+	}
+	lines := 0
+	dec := json.NewDecoder(logs)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("log line isn't JSON: %v", err)
+		}
+		lines++
+		for key, value := range want {
+			if line[key] != value {
+				t.Errorf("%q line: expected %s=%v, got %v", line["msg"], key, value, line[key])
+			}
+		}
+		if line["msg"] == "payment processed" && line["payment_id"] != float64(1) {
+			t.Errorf("expected payment_id on the processed line, got %v", line)
+		}
+	}
+	if lines < 2 {
+		t.Fatalf("expected the processing and processed lines, got %d lines", lines)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
+	"runtime/debug"
 	"strconv"
 	"syscall"
 	"time"
@@ -23,21 +25,29 @@ import (
 
 // Payment represents a payment record
 type Payment struct {
-	ID        int       `json:"id"`
-	OrderID   int       `json:"order_id"`
-	Amount    float64   `json:"amount"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int       `json:"id"`
+	OrderID       int       `json:"order_id"`
+	Amount        float64   `json:"amount"`
+	Status        string    `json:"status"`
+	Currency      string    `json:"currency"`
+	PaymentMethod string    `json:"payment_method"`
+	CreatedAt     time.Time `json:"created_at"`
+	// RetryOf is the failed payment this one retried, if any.
+	RetryOf int `json:"retry_of,omitempty"`
 }
 
+// paymentMethods are the accepted payment_method values. They double as
+// metric labels, so anything else is rejected rather than recorded.
+var paymentMethods = map[string]bool{"card": true, "wallet": true, "invoice": true, methodManual: true}
+
 // Prometheus metrics
 var (
 	paymentsProcessed = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "payment_processed_total",
-			Help: "Total number of payments processed",
+			Help: "Total number of payments processed, by outcome and payment method",
 		},
-		[]string{"status"},
+		[]string{"status", "method"},
 	)
 	paymentProcessingDuration = promauto.NewHistogram(
 		prometheus.HistogramOpts{
@@ -46,6 +56,24 @@ var (
 			Buckets: prometheus.DefBuckets,
 		},
 	)
+	// paymentAmount and paymentAmountTotal share payment_processed_total's
+	// status labels. Amounts are in the payment's currency, so that is a
+	// label too rather than mixing currencies in one series.
+	paymentAmount = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "payment_amount",
+			Help:    "Amounts of processed payments, by outcome and currency",
+			Buckets: []float64{1, 5, 10, 50, 100, 500, 1000, 5000},
+		},
+		[]string{"status", "currency"},
+	)
+	paymentAmountTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "payment_amount_total",
+			Help: "Sum of processed payment amounts, by outcome and currency",
+		},
+		[]string{"status", "currency"},
+	)
 	httpRequestsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "payment_http_requests_total",
@@ -58,7 +86,14 @@ var (
 var db *sql.DB
 var kafkaWriter *kafka.Writer
 
+var (
+	consumerStats      = newConsumerMetrics("payment")
+	kafkaStatsInterval = loadDuration("KAFKA_STATS_INTERVAL", 15*time.Second)
+)
+
 func main() {
+	initLogger()
+
 	// Database connection
 	dbHost := getEnv("DB_HOST", "localhost")
 	dbPort := getEnv("DB_PORT", "5432") // Default to standard postgres port if not set
@@ -89,8 +124,14 @@ func main() {
 		log.Fatal("Database did not become ready:", err)
 	}
 
-	// Initialize database schema
-	initDB()
+	if err := runMigrations(context.Background(), db, migrationFiles); err != nil {
+		log.Fatal("Failed to apply database migrations: ", err)
+	}
+
+	gateway, err = newGatewayFromEnv()
+	if err != nil {
+		log.Fatal("Invalid payment gateway configuration:", err)
+	}
 
 	// Kafka Producer Setup
 	kafkaBroker := getEnv("KAFKA_BROKER", "localhost:9092")
@@ -100,6 +141,37 @@ func main() {
 		Balancer: &kafka.LeastBytes{},
 	}
 	defer kafkaWriter.Close()
+	eventWriter = kafkaWriter
+
+	dlqKafkaWriter := &kafka.Writer{
+		Addr:     kafka.TCP(kafkaBroker),
+		Topic:    dlqTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	defer dlqKafkaWriter.Close()
+	dlqWriter = dlqKafkaWriter
+	newDLQReader = func() messageFetcher {
+		return kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{kafkaBroker},
+			Topic:   dlqTopic,
+			GroupID: "payment-service-dlq-replay",
+		})
+	}
+
+	orderDLQKafkaWriter := &kafka.Writer{
+		Addr:     kafka.TCP(kafkaBroker),
+		Topic:    orderDLQTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	defer orderDLQKafkaWriter.Close()
+	orderDLQWriter = orderDLQKafkaWriter
+	newOrderDLQReader = func() messageFetcher {
+		return kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{kafkaBroker},
+			Topic:   orderDLQTopic,
+			GroupID: "payment-service-order-dlq-replay",
+		})
+	}
 
 	// Kafka Consumer Setup
 	reader := kafka.NewReader(kafka.ReaderConfig{
@@ -113,27 +185,24 @@ func main() {
 	// Handle graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
-		log.Println("Shutting down gracefully...")
-		cancel()
-	}()
+	cancelOnSignal(cancel, os.Interrupt, syscall.SIGTERM)
 
 	// Start consuming messages
-	go consumeMessages(ctx, reader)
+	startConsumer(ctx, reader)
+	go relayOutboxLoop(ctx, outboxRelayInterval)
+	go dispatchWebhooksLoop(ctx, webhookDispatchInterval)
+	go cleanupProcessedEventsLoop(ctx, processedEventsCleanupInterval)
+	go voidStaleAuthorizationsLoop(ctx, authorizationVoidInterval)
+	go failStalePendingLoop(ctx, pendingSweepInterval)
+	if reconciliationEnabled {
+		go reconcileLoop(ctx, reconciliationInterval)
+	} else {
+		log.Println("Order/payment reconciliation disabled")
+	}
+	go consumerStats.watch(ctx, heartbeatStats{reader, consumerHealth}, kafkaStatsInterval)
 
 	// HTTP Server
-	router := mux.NewRouter()
-	router.Use(metricsMiddleware)
-
-	router.HandleFunc("/payments", getPayments).Methods("GET")
-	router.HandleFunc("/payments/{id}", getPayment).Methods("GET")
-	router.HandleFunc("/health", healthCheck).Methods("GET")
-	router.Handle("/metrics", promhttp.Handler())
+	router := newRouter()
 
 	port := getEnv("PORT", "8084")
 	log.Printf("Payment Service starting on port %s", port)
@@ -157,111 +226,341 @@ func main() {
 	defer shutdownCancel()
 	server.Shutdown(shutdownCtx)
 
+	// Let the payment being processed finish, including its event and
+	// offset commit, before the reader, writers and database close.
+	log.Println("Waiting for in-flight payments...")
+	if !drainInFlight(shutdownDrainTimeout) {
+		log.Printf("In-flight payments still running after %s, stopping anyway", shutdownDrainTimeout)
+	}
+
+	// Publish what the drained payments wrote to the outbox; anything left
+	// goes out on the next start.
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := relayOutbox(flushCtx); err != nil {
+		log.Printf("Final outbox relay failed: %v", err)
+	}
+
 	reader.Close()
 	log.Println("Payment Service stopped")
 }
 
-func initDB() {
-	schema := `
-	CREATE TABLE IF NOT EXISTS payments (
-		id SERIAL PRIMARY KEY,
-		order_id INTEGER NOT NULL,
-		amount DECIMAL(10, 2) NOT NULL,
-		status VARCHAR(50) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	_, err := db.Exec(schema)
-	if err != nil {
-		log.Fatal("Failed to create schema:", err)
+// newRouter routes the service's HTTP API. Endpoints that move money,
+// record payments by hand, read them out in bulk, report on
+// reconciliation, manage webhooks or replay dead letters require the
+// admin key.
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+
+	router.HandleFunc("/payments", getPayments).Methods("GET")
+	router.HandleFunc("/payments", requireAdminKey(createManualPayment)).Methods("POST")
+	router.HandleFunc("/payments/stats", getPaymentStats).Methods("GET")
+	router.HandleFunc("/payments/export", requireAdminKey(exportPayments)).Methods("GET")
+	router.HandleFunc("/payments/replay-dlq", requireAdminKey(replayDLQ)).Methods("POST")
+	router.HandleFunc("/admin/dlq/replay", requireAdminKey(replayDLQ)).Methods("POST")
+	router.HandleFunc("/payments/replay-order-dlq", requireAdminKey(replayOrderDLQ)).Methods("POST")
+	router.HandleFunc("/payments/order/{orderId:[0-9]+}", getPaymentsByOrder).Methods("GET")
+	router.HandleFunc("/payments/{id:[0-9]+}", getPayment).Methods("GET")
+	router.HandleFunc("/payments/{id:[0-9]+}/capture", requireAdminKey(capturePayment)).Methods("POST")
+	router.HandleFunc("/payments/{id:[0-9]+}/retry", requireAdminKey(retryPayment)).Methods("POST")
+	router.HandleFunc("/payments/{id:[0-9]+}/refund", requireAdminKey(refundPayment)).Methods("POST")
+	router.HandleFunc("/payments/{id:[0-9]+}/callback", gatewayCallback).Methods("POST")
+	router.HandleFunc("/webhooks", requireAdminKey(createWebhook)).Methods("POST")
+	router.HandleFunc("/webhooks", requireAdminKey(getWebhooks)).Methods("GET")
+	router.HandleFunc("/webhooks/deliveries/{id:[0-9]+}/redeliver", requireAdminKey(redeliverWebhook)).Methods("POST")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", requireAdminKey(getWebhook)).Methods("GET")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", requireAdminKey(updateWebhook)).Methods("PUT")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", requireAdminKey(deleteWebhook)).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", requireAdminKey(getWebhookDeliveries)).Methods("GET")
+	router.HandleFunc("/reconciliation/report", requireAdminKey(getReconciliationReport)).Methods("GET")
+	router.HandleFunc("/health", healthCheck).Methods("GET")
+	router.HandleFunc("/readyz", readinessCheck).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler())
+	return router
+}
+
+// consumeMessages reads order-events until ctx is cancelled and hands
+// the messages to a pool of paymentWorkers. Messages already fetched are
+// still processed and committed after cancellation.
+func consumeMessages(ctx context.Context, reader messageFetcher) {
+	pool := newWorkerPool(ctx, reader, paymentWorkers, workerQueueSize)
+	defer pool.close()
+
+	log.Printf("Started consuming order-events with %d workers...", paymentWorkers)
+	for {
+		if dbBackpressure.wait(ctx) != nil {
+			return
+		}
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("failed to fetch message", "topic", "order-events", "error", err)
+			continue
+		}
+		consumerStats.messageReceived(msg.Topic)
+		consumerHealth.fetched(time.Now())
+
+		pool.dispatch(msg)
 	}
-	log.Println("Database schema initialized")
 }
 
-func consumeMessages(ctx context.Context, reader *kafka.Reader) {
-	log.Println("Started consuming order-events...")
+// consumeMessage handles msg and reports whether it may be committed:
+// the payment is saved, or the event is in a DLQ. A message that can't
+// be handled is retried rather than skipped, since committing a later
+// offset would also commit it; on shutdown it is left uncommitted for
+// redelivery.
+func consumeMessage(ctx context.Context, msg kafka.Message) bool {
+	backoff := persistRetryBackoff
 	for {
+		err := handleMessageRecovering(msg)
+		if err == nil {
+			return true
+		}
+		messageLogger(msg).Error("failed to handle message, retrying", "backoff", backoff.String(), "error", err)
 		select {
 		case <-ctx.Done():
-			return
-		default:
-			msg, err := reader.ReadMessage(ctx)
-			if err != nil {
-				if err == context.Canceled {
-					return
-				}
-				log.Printf("Error reading message: %v", err)
-				continue
-			}
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
 
-			var event map[string]interface{}
-			if err := json.Unmarshal(msg.Value, &event); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				continue
-			}
+// handleMessageRecovering is handleMessage with a panic turned into an
+// error, so a bad message is retried like any other failure instead of
+// taking the consumer down.
+func handleMessageRecovering(msg kafka.Message) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			messageLogger(msg).Error("panic handling message", "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handleMessage(msg)
+}
 
-			eventType, ok := event["event_type"].(string)
-			if !ok {
-				continue
-			}
+// handleMessage processes one order-events message. Messages that can't
+// be decoded go to order-events-dlq; other event types are ignored.
+func handleMessage(msg kafka.Message) error {
+	event, eventType, err := decodeOrderEvent(msg.Value)
+	if err != nil {
+		return sendMalformedToDLQ(msg, err)
+	}
 
-			if eventType == "order_created" {
-				processPayment(event)
-			}
+	ctx := withLogger(context.Background(), messageLogger(msg))
+	switch eventType {
+	case "order_created":
+		return processPayment(ctx, event)
+	case "order_status_changed":
+		changed, err := decodeOrderStatusChanged(msg.Value)
+		if err != nil {
+			return sendMalformedToDLQ(msg, err)
 		}
+		return handleOrderStatusChanged(ctx, changed)
+	}
+	return nil
+}
+
+// processPayment handles an order_created event. If the payment can't be
+// saved even after retrying, the event goes to the DLQ instead of being
+// dropped. An error means neither happened and the event must not be
+// committed.
+func processPayment(ctx context.Context, event OrderCreatedEvent) error {
+	if err := handleOrderCreated(ctx, event); err != nil {
+		return sendToDLQ(orderContext(ctx, event), deadLetter{Event: &event, Error: err.Error(), Attempts: persistMaxAttempts})
 	}
+	return nil
 }
 
-func processPayment(event map[string]interface{}) {
+// orderContext annotates ctx's logger with the event's order and event
+// ids.
+func orderContext(ctx context.Context, event OrderCreatedEvent) context.Context {
+	logger := loggerFrom(ctx).With("order_id", event.OrderID)
+	if event.EventID != "" {
+		logger = logger.With("event_id", event.EventID)
+	}
+	return withLogger(ctx, logger)
+}
+
+func handleOrderCreated(ctx context.Context, event OrderCreatedEvent) error {
 	start := time.Now()
+	ctx = orderContext(ctx, event)
+	logger := loggerFrom(ctx)
+
+	orderID := event.OrderID
+	amount := event.amount()
+	method := event.paymentMethod()
+	currency := event.currency()
 
-	// Extract details safely
-	orderIDFloat, _ := event["order_id"].(float64)
-	amount, _ := event["total_price"].(float64)
-	orderID := int(orderIDFloat)
+	logger.Info("processing payment", "amount", amount, "currency", currency, "payment_method", method)
 
-	log.Printf("Processing payment for Order ID: %d, Amount: %.2f", orderID, amount)
+	// Checked before charging so a replayed event doesn't reach the
+	// gateway again.
+	seen, err := eventProcessed(ctx, event.EventID)
+	if err != nil {
+		return err
+	}
+	if seen {
+		duplicatesSkipped.WithLabelValues("event_id").Inc()
+		logger.Info("event already processed, skipping")
+		return nil
+	}
 
-	// Simulate processing time
-	time.Sleep(100 * time.Millisecond)
+	if reason := validatePaymentRequest(event, currency); reason != "" {
+		rejectPayment(ctx, orderID, amount, currency, method, reason)
+		return nil
+	}
+
+	reason, err := verifyOrderAmount(ctx, orderID, amount)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		rejectPayment(ctx, orderID, amount, currency, method, reason)
+		return nil
+	}
+
+	// Events without an id, and ones retried after their payment was
+	// saved, are only caught by the order_id check, so it is made before
+	// the gateway is asked as well as on insert.
+	paid, err := orderPaid(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if paid {
+		duplicatesSkipped.WithLabelValues("order_id").Inc()
+		logger.Info("payment already recorded, skipping redelivered event", "check", "order_id")
+		return nil
+	}
+
+	status, gatewayRef, chargeErr := chargeOrder(orderID, amount, chargeKey(orderID))
+	if errors.Is(chargeErr, errAuthorizationPending) {
+		logger.Info("awaiting gateway confirmation", "gateway_ref", gatewayRef)
+	} else if chargeErr != nil {
+		logger.Warn("gateway charge did not complete", "status", status, "gateway_ref", gatewayRef, "error", chargeErr)
+	}
 
 	// Create payment record
 	var paymentID int
 	var createdAt time.Time
-	status := "completed" // Mock success
 
-	err := db.QueryRow(
-		"INSERT INTO payments (order_id, amount, status) VALUES ($1, $2, $3) RETURNING id, created_at",
-		orderID, amount, status,
-	).Scan(&paymentID, &createdAt)
+	// An order_created event redelivered after a crash finds the payment
+	// already saved and inserts nothing. Its event id is recorded with the
+	// payment, so a delivery racing this one is caught either way.
+	duplicate := ""
+	// The payment_processed event is written to the outbox in the same
+	// transaction, so it is published exactly when the payment is saved.
+	err = withRetry(ctx, func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(
+			`INSERT INTO payments (order_id, amount, status, gateway_ref, payment_method, currency)
+			SELECT $1::int, $2::numeric, $3::text, NULLIF($4::text, ''), $5::text, $6::text
+			WHERE NOT EXISTS (SELECT 1 FROM payments WHERE order_id = $1::int)
+			RETURNING id, created_at`,
+			orderID, amount, status, gatewayRef, method, currency,
+		).Scan(&paymentID, &createdAt)
+		if err == sql.ErrNoRows {
+			duplicate = "order_id"
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		first, err := markEventProcessed(context.Background(), tx, event.EventID, paymentID)
+		if err != nil {
+			return err
+		}
+		if !first {
+			duplicate = "event_id"
+			return nil
+		}
 
-	if err != nil {
-		log.Printf("Failed to save payment: %v", err)
-		paymentsProcessed.WithLabelValues("failed").Inc()
-		return
-	}
+		from := ""
+		for _, to := range initialTransitions(status) {
+			if err := recordTransition(context.Background(), tx, paymentID, from, to); err != nil {
+				return err
+			}
+			from = to
+		}
+		if err := enqueueEvent(context.Background(), tx, map[string]interface{}{
+			"event_type":     "payment_processed",
+			"payment_id":     paymentID,
+			"order_id":       orderID,
+			"amount":         amount,
+			"currency":       currency,
+			"status":         status,
+			"payment_method": method,
+			"timestamp":      time.Now().Unix(),
+		}); err != nil {
+			return err
+		}
+		if status == statusAuthorized {
+			authorized := Payment{ID: paymentID, OrderID: orderID, Amount: amount, Currency: currency, PaymentMethod: method}
+			if err := enqueuePaymentEvent(context.Background(), tx, "payment_authorized", authorized); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	dbBackpressure.record(err)
 
-	// Publish Payment Processed Event
-	paymentEvent := map[string]interface{}{
-		"event_type": "payment_processed",
-		"payment_id": paymentID,
-		"order_id":   orderID,
-		"amount":     amount,
-		"status":     status,
-		"timestamp":  time.Now().Unix(),
+	if duplicate != "" {
+		duplicatesSkipped.WithLabelValues(duplicate).Inc()
+		logger.Info("payment already recorded, skipping redelivered event", "check", duplicate)
+		return nil
+	}
+	if err != nil {
+		logger.Error("failed to save payment", "error", err)
+		paymentsProcessed.WithLabelValues("failed", method).Inc()
+		return err
 	}
 
-	publishEvent(paymentEvent)
+	kickOutboxRelay()
 
-	paymentsProcessed.WithLabelValues("success").Inc()
+	paymentsProcessed.WithLabelValues(processedLabel(status), method).Inc()
+	observePaymentAmount(status, currency, amount)
 	paymentProcessingDuration.Observe(time.Since(start).Seconds())
-	log.Printf("Payment processed successfully. Payment ID: %d", paymentID)
+	logger.Info("payment processed", "payment_id", paymentID, "status", status)
+	return nil
+}
+
+// processedLabel maps a saved payment's status to its
+// payment_processed_total label; "failed" there means the payment
+// couldn't be saved at all.
+func processedLabel(status string) string {
+	switch status {
+	case statusCaptured:
+		return "success"
+	case statusFailed:
+		return "declined"
+	default:
+		return status
+	}
 }
 
-func publishEvent(event map[string]interface{}) {
+// observePaymentAmount records a saved payment's amount in the
+// payment_amount metrics.
+func observePaymentAmount(status, currency string, amount float64) {
+	label := processedLabel(status)
+	paymentAmount.WithLabelValues(label, currency).Observe(amount)
+	paymentAmountTotal.WithLabelValues(label, currency).Add(amount)
+}
+
+// publishEvent is a variable so tests can capture events without Kafka.
+var publishEvent = func(event map[string]interface{}) {
 	data, err := json.Marshal(event)
 	if err != nil {
-		log.Printf("Failed to marshal event: %v", err)
+		slog.Error("failed to marshal event", "event_type", event["event_type"], "error", err)
 		return
 	}
 
@@ -269,14 +568,20 @@ func publishEvent(event map[string]interface{}) {
 		Value: data,
 	})
 	if err != nil {
-		log.Printf("Failed to publish event to Kafka: %v", err)
+		slog.Error("failed to publish event to Kafka", "event_type", event["event_type"], "order_id", event["order_id"], "error", err)
 	} else {
-		log.Printf("Published event: %s", string(data))
+		slog.Info("published event", "event_type", event["event_type"], "order_id", event["order_id"])
 	}
 }
 
 func getPayments(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, order_id, amount, status, created_at FROM payments ORDER BY id DESC")
+	filter, err := parsePaymentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, args := filter.sql()
+	rows, err := db.QueryContext(r.Context(), query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -286,11 +591,12 @@ func getPayments(w http.ResponseWriter, r *http.Request) {
 	payments := []Payment{}
 	for rows.Next() {
 		var p Payment
-		err := rows.Scan(&p.ID, &p.OrderID, &p.Amount, &p.Status, &p.CreatedAt)
+		err := rows.Scan(&p.ID, &p.OrderID, &p.Amount, &p.Currency, &p.Status, &p.PaymentMethod, &p.CreatedAt, &p.RetryOf)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		p.Status = normalizeStatus(p.Status)
 		payments = append(payments, p)
 	}
 
@@ -298,13 +604,61 @@ func getPayments(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(payments)
 }
 
+// getPaymentsByOrder returns every payment for an order, newest first.
+// An order can have several once retries and refunds exist.
+func getPaymentsByOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+
+	rows, err := db.Query(
+		"SELECT id, order_id, amount, currency, status, payment_method, created_at, COALESCE(retry_of, 0) FROM payments WHERE order_id = $1 ORDER BY created_at DESC, id DESC",
+		orderID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.Amount, &p.Currency, &p.Status, &p.PaymentMethod, &p.CreatedAt, &p.RetryOf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.Status = normalizeStatus(p.Status)
+		payments = append(payments, p)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(payments) == 0 {
+		http.Error(w, "No payments found for order", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payments)
+}
+
 func getPayment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var p Payment
-	err := db.QueryRow("SELECT id, order_id, amount, status, created_at FROM payments WHERE id = $1", id).
-		Scan(&p.ID, &p.OrderID, &p.Amount, &p.Status, &p.CreatedAt)
+	includeOrder := false
+	if include := r.URL.Query().Get("include"); include != "" {
+		if include != "order" {
+			http.Error(w, "include must be order", http.StatusBadRequest)
+			return
+		}
+		includeOrder = true
+	}
+
+	var p PaymentDetail
+	err := db.QueryRow("SELECT id, order_id, amount, currency, status, payment_method, created_at, COALESCE(retry_of, 0), refunded_amount FROM payments WHERE id = $1", id).
+		Scan(&p.ID, &p.OrderID, &p.Amount, &p.Currency, &p.Status, &p.PaymentMethod, &p.CreatedAt, &p.RetryOf, &p.RefundedAmount)
+	p.Status = normalizeStatus(p.Status)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Payment not found", http.StatusNotFound)
@@ -315,8 +669,30 @@ func getPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	p.Remaining = float64(toCents(p.Amount)-toCents(p.RefundedAmount)) / 100
+	p.Refunds, err = loadRefunds(r.Context(), p.Payment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(p)
+	if !includeOrder {
+		json.NewEncoder(w).Encode(p)
+		return
+	}
+
+	// The order only decorates the payment, so order-service being
+	// unreachable leaves it null with a warning rather than failing.
+	resp := PaymentWithOrder{PaymentDetail: p}
+	order, err := orderSummary(r.Context(), p.OrderID)
+	if err != nil {
+		log.Printf("Failed to fetch order %d for payment %d: %v", p.OrderID, p.ID, err)
+		resp.Warnings = append(resp.Warnings, "order unavailable: "+err.Error())
+	} else {
+		resp.Order = &order
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMain(m *testing.M) {
+	// Tests that exercise verification point it at their own fake
+	// order-service; the rest don't have one.
+	verifyOrderAmounts = false
+	os.Exit(m.Run())
+}
+
+// withMockDB swaps db for a sqlmock connection for the rest of the test.
+func withMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %s", err)
+	}
+	oldDB := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = oldDB
+		mockDB.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+	return mock
+}
+
+func TestGetPaymentsByOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		rows       *sqlmock.Rows
+		wantStatus int
+		wantIDs    []int
+	}{
+		{
+			name: "newest first",
+			rows: sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of"}).
+				AddRow(9, 42, 19.99, "USD", "completed", "card", time.Now(), 0).
+				AddRow(4, 42, 19.99, "USD", "failed", "wallet", time.Now().Add(-time.Hour), 0),
+			wantStatus: http.StatusOK,
+			wantIDs:    []int{9, 4},
+		},
+		{
+			name:       "no payments",
+			rows:       sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of"}),
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			mock.ExpectQuery("SELECT (.+) FROM payments WHERE order_id = \\$1 ORDER BY created_at DESC, id DESC").
+				WithArgs("42").
+				WillReturnRows(tt.rows)
+
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/order/{orderId:[0-9]+}", getPaymentsByOrder).Methods("GET")
+			router.HandleFunc("/payments/{id:[0-9]+}", getPayment).Methods("GET")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/payments/order/42", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var payments []Payment
+			json.NewDecoder(w.Body).Decode(&payments)
+			if len(payments) != len(tt.wantIDs) {
+				t.Fatalf("expected %d payments, got %+v", len(tt.wantIDs), payments)
+			}
+			for i, id := range tt.wantIDs {
+				if payments[i].ID != id {
+					t.Errorf("payment %d: expected id %d, got %d", i, id, payments[i].ID)
+				}
+			}
+		})
+	}
+}
+
+// runConsumer feeds msgs through consumeMessages until the fetcher is
+// drained or timeout passes, and returns what was committed.
+func runConsumer(t *testing.T, timeout time.Duration, msgs ...kafka.Message) []kafka.Message {
+	t.Helper()
+	fetcher := &fakeFetcher{queue: msgs}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	consumeMessages(ctx, fetcher)
+	return fetcher.committed
+}
+
+func orderCreatedMessage(orderID int, total float64) kafka.Message {
+	data, _ := json.Marshal(orderCreated(orderID, total))
+	return kafka.Message{Value: data}
+}
+
+func TestConsumeMessagesCommitsAfterPersisting(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+
+	expectPaymentSaved(mock, events, 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	committed := runConsumer(t, 200*time.Millisecond, orderCreatedMessage(42, 19.99))
+
+	if len(committed) != 1 {
+		t.Fatalf("expected the message to be committed, got %d commits", len(committed))
+	}
+	if len(*events) != 1 {
+		t.Errorf("expected a payment_processed event, got %v", *events)
+	}
+}
+
+func TestConsumeMessagesSkipsRedeliveredOrder(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+
+	// Saved by a delivery racing this one after the check.
+	expectOrderPaid(mock, 42, false)
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments (.+) WHERE NOT EXISTS").
+		WithArgs(42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}))
+	mock.ExpectRollback()
+
+	committed := runConsumer(t, 200*time.Millisecond, orderCreatedMessage(42, 19.99))
+
+	if len(committed) != 1 {
+		t.Fatalf("expected the duplicate to be committed, got %d commits", len(committed))
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events for a duplicate, got %v", *events)
+	}
+}
+
+func TestConsumeMessagesDoesNotCommitUnhandledMessage(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	dlq := withFakeDLQ(t)
+	dlq.err = errors.New("broker unavailable")
+	capturePublishedEvents(t)
+
+	// The consumer keeps retrying the message until the context ends;
+	// retries past the first also fail, on the unexpected query.
+	expectOrderPaid(mock, 42, false)
+	expectPaymentInsertFails(mock, errors.New("connection reset"))
+
+	committed := runConsumer(t, 300*time.Millisecond, orderCreatedMessage(42, 19.99))
+
+	if len(committed) != 0 {
+		t.Fatalf("expected no commit when the insert and DLQ both fail, got %d", len(committed))
+	}
+}
+
+func TestHandleOrderCreatedPaymentMethod(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		want   string
+	}{
+		{name: "from event", method: "wallet", want: "wallet"},
+		{name: "legacy event defaults to card", method: "", want: "card"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			withFastRetries(t, 1)
+			events := capturePublishedEvents(t)
+
+			event := orderCreated(42, 19.99)
+			event.PaymentMethod = tt.method
+			expectPaymentSaved(mock, events, 42, 19.99, "captured", sqlmock.AnyArg(), tt.want, "USD")
+
+			if err := handleOrderCreated(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+			if len(*events) != 1 || (*events)[0]["payment_method"] != tt.want {
+				t.Errorf("expected payment_method %s in payment_processed, got %v", tt.want, *events)
+			}
+		})
+	}
+}
+
+func TestHandleOrderCreatedRejectsInvalidPayments(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      OrderCreatedEvent
+		wantReason string
+	}{
+		{name: "zero amount", event: orderCreated(42, 0), wantReason: "non_positive_amount"},
+		{name: "negative amount", event: orderCreated(42, -5), wantReason: "non_positive_amount"},
+		{name: "rounds to zero", event: orderCreated(42, 0.004), wantReason: "non_positive_amount"},
+		{
+			name:       "missing amount",
+			event:      OrderCreatedEvent{EventType: "order_created", OrderID: 42},
+			wantReason: "missing_amount",
+		},
+		{name: "unsupported currency", event: withCurrency(orderCreated(42, 19.99), "JPY"), wantReason: "unsupported_currency"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No DB expectations: a rejected payment must not be stored.
+			withMockDB(t)
+			events := capturePublishedEvents(t)
+
+			if err := handleOrderCreated(context.Background(), tt.event); err != nil {
+				t.Fatalf("expected the rejection to be handled, got %v", err)
+			}
+			if len(*events) != 1 || (*events)[0]["event_type"] != "payment_rejected" || (*events)[0]["reason"] != tt.wantReason {
+				t.Fatalf("expected payment_rejected with reason %s, got %v", tt.wantReason, *events)
+			}
+		})
+	}
+}
+
+func withCurrency(event OrderCreatedEvent, currency string) OrderCreatedEvent {
+	event.Currency = currency
+	return event
+}
+
+func TestHandleOrderCreatedCurrency(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+
+	event := withCurrency(orderCreated(42, 19.99), "eur")
+	expectPaymentSaved(mock, events, 42, 19.99, "captured", sqlmock.AnyArg(), "card", "EUR")
+
+	if err := handleOrderCreated(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 || (*events)[0]["currency"] != "EUR" {
+		t.Errorf("expected currency EUR in payment_processed, got %v", *events)
+	}
+}
+
+func TestHandleOrderCreatedRecordsAmount(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+
+	before := testutil.ToFloat64(paymentAmountTotal.WithLabelValues("success", "GBP"))
+	expectPaymentSaved(mock, events, 42, 12.5, "captured", sqlmock.AnyArg(), "card", "GBP")
+
+	if err := handleOrderCreated(context.Background(), withCurrency(orderCreated(42, 12.5), "GBP")); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(paymentAmountTotal.WithLabelValues("success", "GBP")) - before; got != 12.5 {
+		t.Errorf("expected payment_amount_total to grow by 12.5, got %v", got)
+	}
+	if n := testutil.CollectAndCount(paymentAmount, "payment_amount"); n == 0 {
+		t.Error("expected a payment_amount observation")
+	}
+}
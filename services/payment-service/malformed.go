@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+const orderDLQTopic = "order-events-dlq"
+
+var malformedEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "payment_malformed_events_total",
+		Help: "order-events messages routed to order-events-dlq, by failure type",
+	},
+	[]string{"reason"},
+)
+
+var (
+	orderDLQWriter messageWriter
+	// newOrderDLQReader opens a consumer on order-events-dlq; set up in main.
+	newOrderDLQReader func() messageFetcher
+)
+
+// Headers recorded on order-events-dlq messages.
+const (
+	headerDLQReason   = "dlq-reason"
+	headerDLQError    = "dlq-error"
+	headerOrigTopic   = "dlq-original-topic"
+	headerOrigPart    = "dlq-original-partition"
+	headerOrigOffset  = "dlq-original-offset"
+	headerDLQFailedAt = "dlq-failed-at"
+)
+
+// malformedError is an order-events message this service can't process
+// however often it is retried. reason is the metric label.
+type malformedError struct {
+	reason string
+	detail string
+}
+
+func (e *malformedError) Error() string {
+	return e.reason + ": " + e.detail
+}
+
+// decodeOrderEvent decodes an order-events message's type and, for
+// order_created, the typed event. Other event types come back with a
+// zero event.
+func decodeOrderEvent(data []byte) (OrderCreatedEvent, string, error) {
+	var envelope orderEventEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return OrderCreatedEvent{}, "", &malformedError{"missing_event_type", "event_type must be a non-empty string"}
+		}
+		return OrderCreatedEvent{}, "", &malformedError{"invalid_json", err.Error()}
+	}
+	if envelope.EventType == "" {
+		return OrderCreatedEvent{}, "", &malformedError{"missing_event_type", "event_type must be a non-empty string"}
+	}
+
+	if envelope.EventType != "order_created" {
+		return OrderCreatedEvent{}, envelope.EventType, nil
+	}
+	event, err := decodeOrderCreated(data)
+	if err != nil {
+		return OrderCreatedEvent{}, "", err
+	}
+	return event, envelope.EventType, nil
+}
+
+func header(msg kafka.Message, key string) (string, bool) {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+// sendMalformedToDLQ copies an undecodable message to order-events-dlq,
+// with headers recording why and where it came from. A message replayed
+// from the DLQ keeps its original topic, partition and offset.
+func sendMalformedToDLQ(msg kafka.Message, cause error) error {
+	reason := "unknown"
+	var me *malformedError
+	if errors.As(cause, &me) {
+		reason = me.reason
+	}
+
+	origin := map[string]string{
+		headerOrigTopic:  msg.Topic,
+		headerOrigPart:   strconv.Itoa(msg.Partition),
+		headerOrigOffset: strconv.FormatInt(msg.Offset, 10),
+	}
+	for key := range origin {
+		if v, ok := header(msg, key); ok {
+			origin[key] = v
+		}
+	}
+
+	dlqMsg := kafka.Message{
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: []kafka.Header{
+			{Key: headerDLQReason, Value: []byte(reason)},
+			{Key: headerDLQError, Value: []byte(cause.Error())},
+			{Key: headerOrigTopic, Value: []byte(origin[headerOrigTopic])},
+			{Key: headerOrigPart, Value: []byte(origin[headerOrigPart])},
+			{Key: headerOrigOffset, Value: []byte(origin[headerOrigOffset])},
+			{Key: headerDLQFailedAt, Value: []byte(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}
+
+	logger := messageLogger(msg).With(
+		"original_topic", origin[headerOrigTopic],
+		"original_partition", origin[headerOrigPart],
+		"original_offset", origin[headerOrigOffset],
+		"reason", reason,
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := orderDLQWriter.WriteMessages(ctx, dlqMsg); err != nil {
+		logger.Error("failed to publish malformed message", "dlq_topic", orderDLQTopic, "error", err)
+		return err
+	}
+	malformedEvents.WithLabelValues(reason).Inc()
+	logger.Warn("routed malformed message", "dlq_topic", orderDLQTopic, "cause", cause.Error())
+	return nil
+}
+
+// replayOrderDLQ re-drives order-events-dlq messages through the normal
+// handling once the producer has been fixed. Messages that are still
+// malformed go back to the DLQ.
+func replayOrderDLQ(w http.ResponseWriter, r *http.Request) {
+	replayFrom(w, r, orderDLQTopic, newOrderDLQReader, func(msg kafka.Message) (bool, error) {
+		if _, _, err := decodeOrderEvent(msg.Value); err != nil {
+			return true, sendMalformedToDLQ(msg, err)
+		}
+		return false, handleMessage(msg)
+	})
+}
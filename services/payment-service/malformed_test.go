@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+func withFakeOrderDLQ(t *testing.T) *fakeWriter {
+	t.Helper()
+	old := orderDLQWriter
+	fw := &fakeWriter{}
+	orderDLQWriter = fw
+	t.Cleanup(func() { orderDLQWriter = old })
+	return fw
+}
+
+func TestDecodeOrderEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantReason string
+	}{
+		{name: "valid order_created", data: `{"event_type":"order_created","order_id":42,"total_price":19.99}`},
+		{name: "other event types need no order_id", data: `{"event_type":"order_cancelled"}`},
+		{name: "not json", data: `{"event_type":`, wantReason: "invalid_json"},
+		{name: "missing event_type", data: `{"order_id":42}`, wantReason: "missing_event_type"},
+		{name: "missing order_id", data: `{"event_type":"order_created","total_price":5}`, wantReason: "invalid_order_id"},
+		{name: "fractional order_id", data: `{"event_type":"order_created","order_id":4.5,"total_price":5}`, wantReason: "invalid_order_id"},
+		{name: "string order_id", data: `{"event_type":"order_created","order_id":"42","total_price":5}`, wantReason: "invalid_order_id"},
+		{name: "numeric event_type", data: `{"event_type":7,"order_id":42}`, wantReason: "missing_event_type"},
+		{name: "unknown fields are ignored", data: `{"event_type":"order_created","order_id":42,"total_price":5,"coupon":"SPRING"}`},
+		{name: "string total", data: `{"event_type":"order_created","order_id":42,"total_price":"5"}`, wantReason: "invalid_total_price"},
+		{name: "zero total is rejected later", data: `{"event_type":"order_created","order_id":42,"total_price":0}`},
+		{name: "numeric currency", data: `{"event_type":"order_created","order_id":42,"total_price":5,"currency":978}`, wantReason: "invalid_currency"},
+		{name: "known payment method", data: `{"event_type":"order_created","order_id":42,"total_price":5,"payment_method":"invoice"}`},
+		{name: "unknown payment method", data: `{"event_type":"order_created","order_id":42,"total_price":5,"payment_method":"crypto"}`, wantReason: "invalid_payment_method"},
+		{name: "manual payment method", data: `{"event_type":"order_created","order_id":42,"total_price":5,"payment_method":"manual"}`, wantReason: "invalid_payment_method"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeOrderEvent([]byte(tt.data))
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			var me *malformedError
+			if !errors.As(err, &me) || me.reason != tt.wantReason {
+				t.Fatalf("expected reason %s, got %v", tt.wantReason, err)
+			}
+		})
+	}
+}
+
+func TestHandleMessageRoutesMalformedToDLQ(t *testing.T) {
+	withMockDB(t)
+	dlq := withFakeOrderDLQ(t)
+
+	msg := kafka.Message{Topic: "order-events", Partition: 2, Offset: 17, Value: []byte("not json")}
+	if err := handleMessage(msg); err != nil {
+		t.Fatalf("expected the message to be handled, got %v", err)
+	}
+
+	if len(dlq.msgs) != 1 {
+		t.Fatalf("expected one dead-lettered message, got %d", len(dlq.msgs))
+	}
+	got := dlq.msgs[0]
+	if string(got.Value) != "not json" {
+		t.Errorf("expected the original payload, got %q", got.Value)
+	}
+	for key, want := range map[string]string{
+		headerDLQReason:  "invalid_json",
+		headerOrigTopic:  "order-events",
+		headerOrigPart:   "2",
+		headerOrigOffset: "17",
+	} {
+		if v, _ := header(got, key); v != want {
+			t.Errorf("header %s: expected %q, got %q", key, want, v)
+		}
+	}
+}
+
+func TestHandleMessageKeepsMalformedWhenDLQUnavailable(t *testing.T) {
+	withMockDB(t)
+	dlq := withFakeOrderDLQ(t)
+	dlq.err = errors.New("broker unavailable")
+
+	if err := handleMessage(kafka.Message{Value: []byte("not json")}); err == nil {
+		t.Fatal("expected an error so the offset isn't committed")
+	}
+}
+
+func TestReplayOrderDLQ(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	dlq := withFakeOrderDLQ(t)
+	events := capturePublishedEvents(t)
+
+	oldWait := dlqReplayWait
+	dlqReplayWait = 10 * time.Millisecond
+	t.Cleanup(func() { dlqReplayWait = oldWait })
+
+	origin := []kafka.Header{
+		{Key: headerOrigTopic, Value: []byte("order-events")},
+		{Key: headerOrigPart, Value: []byte("0")},
+		{Key: headerOrigOffset, Value: []byte("5")},
+	}
+	fixed, _ := json.Marshal(orderCreated(42, 19.99))
+	fetcher := &fakeFetcher{queue: []kafka.Message{
+		{Topic: orderDLQTopic, Offset: 0, Value: fixed, Headers: origin},
+		{Topic: orderDLQTopic, Offset: 1, Value: []byte("still broken"), Headers: origin},
+	}}
+	oldReader := newOrderDLQReader
+	newOrderDLQReader = func() messageFetcher { return fetcher }
+	t.Cleanup(func() { newOrderDLQReader = oldReader })
+
+	expectPaymentSaved(mock, events, 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	w := httptest.NewRecorder()
+	replayOrderDLQ(w, httptest.NewRequest("POST", "/payments/replay-order-dlq", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got replaySummary
+	json.NewDecoder(w.Body).Decode(&got)
+	if got != (replaySummary{Replayed: 2, Succeeded: 1, Failed: 1}) {
+		t.Errorf("expected 2 replayed, 1 succeeded and 1 failed, got %+v", got)
+	}
+	if len(dlq.msgs) != 1 {
+		t.Fatalf("expected the broken message back in the DLQ, got %d", len(dlq.msgs))
+	}
+	if v, _ := header(dlq.msgs[0], headerOrigOffset); v != "5" {
+		t.Errorf("expected the original offset to be kept, got %q", v)
+	}
+}
+
+func TestReplayOrderDLQRequiresAdminKey(t *testing.T) {
+	withAdminKey(t, "secret")
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("POST", "/payments/replay-order-dlq", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a key, got %d", w.Code)
+	}
+}
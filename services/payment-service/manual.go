@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// methodManual is the payment method of payments recorded by hand rather
+// than charged through the gateway.
+const methodManual = "manual"
+
+// paymentAdminKey is the X-API-Key that the admin endpoints, such as
+// POST /payments, require. They are refused while it is unset.
+var paymentAdminKey = getEnv("PAYMENT_ADMIN_KEY", "")
+
+// ManualPaymentRequest is the body of POST /payments.
+type ManualPaymentRequest struct {
+	OrderID  int     `json:"order_id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	Method   string  `json:"method"`
+	// Reference identifies the payment outside the system, for instance
+	// the receipt number of a phone payment.
+	Reference string `json:"reference"`
+}
+
+// ManualPayment is a recorded manual payment.
+type ManualPayment struct {
+	Payment
+	Reference string `json:"reference"`
+}
+
+// requireAdminKey lets a request through to next only with the
+// configured PAYMENT_ADMIN_KEY in X-API-Key.
+func requireAdminKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if paymentAdminKey == "" {
+			http.Error(w, "Admin endpoints are disabled: PAYMENT_ADMIN_KEY is not set", http.StatusForbidden)
+			return
+		}
+		raw := r.Header.Get("X-API-Key")
+		if raw == "" {
+			w.Header().Set("WWW-Authenticate", "ApiKey")
+			http.Error(w, "Missing X-API-Key", http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(raw), []byte(paymentAdminKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", "ApiKey")
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// validate normalizes req and returns what is wrong with it, if anything.
+func (req *ManualPaymentRequest) validate() error {
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if req.Currency == "" {
+		req.Currency = defaultCurrency
+	}
+	if req.Method == "" {
+		req.Method = methodManual
+	}
+	req.Reference = strings.TrimSpace(req.Reference)
+
+	switch {
+	case req.OrderID <= 0:
+		return errors.New("order_id must be a positive integer")
+	case toCents(req.Amount) <= 0:
+		return errors.New("amount must be positive")
+	case !supportedCurrencies[req.Currency]:
+		return fmt.Errorf("unsupported currency %q", req.Currency)
+	case req.Method != methodManual:
+		return errors.New("method must be manual")
+	case req.Reference == "":
+		return errors.New("reference is required")
+	case len(req.Reference) > 255:
+		return errors.New("reference must be at most 255 characters")
+	}
+	return nil
+}
+
+// createManualPayment records a payment taken outside the gateway, such
+// as over the phone, against an existing order. Like one charged for an
+// order_created event it is saved captured, at most once per order, and
+// announced with payment_processed.
+func createManualPayment(w http.ResponseWriter, r *http.Request) {
+	var req ManualPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	order, err := fetchOrder(ctx, req.OrderID)
+	if errors.Is(err, errOrderNotFound) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not verify order: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if verifyOrderAmounts && toCents(order.TotalPrice) != toCents(req.Amount) {
+		http.Error(w, fmt.Sprintf("Amount %.2f does not match the order total %.2f", req.Amount, order.TotalPrice),
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	p := ManualPayment{
+		Payment: Payment{
+			OrderID: req.OrderID, Amount: req.Amount, Status: statusCaptured,
+			Currency: req.Currency, PaymentMethod: req.Method,
+		},
+		Reference: req.Reference,
+	}
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO payments (order_id, amount, status, payment_method, currency, reference)
+		SELECT $1::int, $2::numeric, $3::text, $4::text, $5::text, $6::text
+		WHERE NOT EXISTS (SELECT 1 FROM payments WHERE order_id = $1::int)
+		RETURNING id, created_at`,
+		p.OrderID, p.Amount, p.Status, p.PaymentMethod, p.Currency, p.Reference,
+	).Scan(&p.ID, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order already has a payment", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	from := ""
+	for _, to := range initialTransitions(p.Status) {
+		if err := recordTransition(ctx, tx, p.ID, from, to); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		from = to
+	}
+	if err := enqueueEvent(ctx, tx, map[string]interface{}{
+		"event_type":     "payment_processed",
+		"payment_id":     p.ID,
+		"order_id":       p.OrderID,
+		"amount":         p.Amount,
+		"currency":       p.Currency,
+		"status":         p.Status,
+		"payment_method": p.PaymentMethod,
+		"timestamp":      time.Now().Unix(),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kickOutboxRelay()
+	paymentsProcessed.WithLabelValues(processedLabel(p.Status), p.PaymentMethod).Inc()
+	observePaymentAmount(p.Status, p.Currency, p.Amount)
+	log.Printf("Recorded manual payment %d for order %d, reference %q", p.ID, p.OrderID, p.Reference)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func withAdminKey(t *testing.T, key string) {
+	t.Helper()
+	old := paymentAdminKey
+	paymentAdminKey = key
+	t.Cleanup(func() { paymentAdminKey = old })
+}
+
+// expectAdminOnly checks that newRouter refuses method path with 403
+// while no admin key is configured and with 401 for a wrong key, before
+// touching the database.
+func expectAdminOnly(t *testing.T, method, path string) {
+	t.Helper()
+	withMockDB(t)
+	for key, want := range map[string]int{"": http.StatusForbidden, "secret": http.StatusUnauthorized} {
+		withAdminKey(t, key)
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", "wrong")
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s %s with admin key %q: expected %d, got %d", method, path, key, want, w.Code)
+		}
+	}
+}
+
+func postManualPayment(key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/payments", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	requireAdminKey(createManualPayment)(w, req)
+	return w
+}
+
+const manualPaymentBody = `{"order_id":42,"amount":49.99,"method":"manual","reference":"phone-1234"}`
+
+func TestCreateManualPaymentRequiresKey(t *testing.T) {
+	withAdminKey(t, "")
+	if w := postManualPayment("secret", manualPaymentBody); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with no key configured, got %d", w.Code)
+	}
+
+	withAdminKey(t, "secret")
+	if w := postManualPayment("", manualPaymentBody); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a key, got %d", w.Code)
+	}
+	if w := postManualPayment("wrong", manualPaymentBody); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the wrong key, got %d", w.Code)
+	}
+}
+
+func TestCreateManualPayment(t *testing.T) {
+	mock := withMockDB(t)
+	withAdminKey(t, "secret")
+	withOrderService(t, http.StatusOK, 49.99)
+	var events []map[string]interface{}
+	expectPaymentTx(mock, &events, "", 42, 49.99, statusCaptured, methodManual, "USD", "phone-1234")
+
+	w := postManualPayment("secret", manualPaymentBody)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var p ManualPayment
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != 1 || p.Status != statusCaptured || p.Reference != "phone-1234" {
+		t.Errorf("unexpected payment %+v", p)
+	}
+	if len(events) != 1 || events[0]["event_type"] != "payment_processed" || events[0]["payment_method"] != methodManual {
+		t.Errorf("expected a manual payment_processed event, got %v", events)
+	}
+}
+
+func TestCreateManualPaymentRejects(t *testing.T) {
+	withAdminKey(t, "secret")
+	tests := []struct {
+		name   string
+		status int
+		total  float64
+		body   string
+		want   int
+	}{
+		{"no reference", http.StatusOK, 49.99, `{"order_id":42,"amount":49.99}`, http.StatusBadRequest},
+		{"card method", http.StatusOK, 49.99, `{"order_id":42,"amount":49.99,"method":"card","reference":"r"}`, http.StatusBadRequest},
+		{"unknown order", http.StatusNotFound, 0, manualPaymentBody, http.StatusNotFound},
+		{"order service down", http.StatusServiceUnavailable, 0, manualPaymentBody, http.StatusBadGateway},
+		{"wrong amount", http.StatusOK, 50, manualPaymentBody, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockDB(t)
+			withOrderService(t, tt.status, tt.total)
+			if w := postManualPayment("secret", tt.body); w.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateManualPaymentAlreadyPaid(t *testing.T) {
+	mock := withMockDB(t)
+	withAdminKey(t, "secret")
+	withOrderService(t, http.StatusOK, 49.99)
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments").WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}))
+	mock.ExpectRollback()
+
+	if w := postManualPayment("secret", manualPaymentBody); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,75 @@
+-- Baseline schema. Every statement is idempotent so databases created by
+-- the old initDB adopt the migration history cleanly.
+
+CREATE TABLE IF NOT EXISTS payments (
+	id SERIAL PRIMARY KEY,
+	order_id INTEGER NOT NULL,
+	amount DECIMAL(10, 2) NOT NULL,
+	status VARCHAR(50) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_payments_order_id ON payments(order_id);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS gateway_ref VARCHAR(255);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS payment_method VARCHAR(20) NOT NULL DEFAULT 'card';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS retry_of INTEGER REFERENCES payments(id);
+CREATE TABLE IF NOT EXISTS payment_events (
+	id SERIAL PRIMARY KEY,
+	payment_id INTEGER NOT NULL REFERENCES payments(id),
+	from_status VARCHAR(50),
+	to_status VARCHAR(50) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_payment_events_payment_id ON payment_events(payment_id, id);
+CREATE TABLE IF NOT EXISTS processed_events (
+	event_id TEXT PRIMARY KEY,
+	payment_id INTEGER REFERENCES payments(id),
+	processed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_processed_events_processed_at ON processed_events(processed_at);
+CREATE TABLE IF NOT EXISTS refunds (
+	id SERIAL PRIMARY KEY,
+	payment_id INTEGER NOT NULL REFERENCES payments(id),
+	amount DECIMAL(10, 2) NOT NULL CHECK (amount > 0),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_refunds_payment_id ON refunds(payment_id);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+UPDATE payments p SET refunded_amount = r.total
+FROM (SELECT payment_id, SUM(amount) AS total FROM refunds GROUP BY payment_id) r
+WHERE p.id = r.payment_id AND p.refunded_amount <> r.total;
+CREATE TABLE IF NOT EXISTS event_outbox (
+	id BIGSERIAL PRIMARY KEY,
+	event_type VARCHAR(100) NOT NULL,
+	payload JSONB NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	published_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_event_outbox_pending ON event_outbox(id) WHERE published_at IS NULL;
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+	id SERIAL PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	event_types TEXT[] NOT NULL DEFAULT '{}',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	consecutive_failures INTEGER NOT NULL DEFAULT 0,
+	disabled_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+	event_type VARCHAR(100) NOT NULL,
+	payload JSONB NOT NULL,
+	status VARCHAR(20) NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_status_code INTEGER,
+	last_error TEXT,
+	next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	delivered_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription ON webhook_deliveries(subscription_id, id);
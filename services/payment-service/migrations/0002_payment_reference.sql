@@ -0,0 +1,4 @@
+-- Free-text reference for payments recorded by hand, such as the receipt
+-- number of a payment taken over the phone.
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS reference VARCHAR(255);
@@ -0,0 +1,6 @@
+-- Refunds are reserved as pending before the gateway is asked, and
+-- settled as completed or failed once it answers. Refunds recorded before
+-- this were only written once the gateway had accepted them.
+
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'completed';
+CREATE INDEX IF NOT EXISTS idx_refunds_pending ON refunds (created_at) WHERE status = 'pending';
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var amountMismatches = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "payment_amount_mismatch_total",
+		Help: "order_created events rejected because their amount didn't match order-service, by reason",
+	},
+	[]string{"reason"},
+)
+
+var (
+	orderServiceURL = getEnv("ORDER_SERVICE_URL", "http://order-service:8082")
+	orderClient     = &http.Client{Timeout: 5 * time.Second}
+	// verifyOrderAmounts checks each order_created amount against
+	// order-service before charging. Set VERIFY_ORDER_AMOUNT=false where
+	// order-service isn't reachable.
+	verifyOrderAmounts = loadBool("VERIFY_ORDER_AMOUNT", true)
+	// orderSummaryTimeout bounds the order-service call behind
+	// ?include=order, which only decorates a response.
+	orderSummaryTimeout = loadDuration("ORDER_SUMMARY_TIMEOUT", 2*time.Second)
+	orderSummaryTTL     = loadDuration("ORDER_SUMMARY_CACHE_TTL", 30*time.Second)
+	orderSummaries      = newOrderSummaryCache()
+)
+
+// OrderSummary is the part of an order-service order embedded in
+// GET /payments/{id}?include=order.
+type OrderSummary struct {
+	ID         int     `json:"id"`
+	Status     string  `json:"status"`
+	ProductID  int     `json:"product_id"`
+	Quantity   int     `json:"quantity"`
+	TotalPrice float64 `json:"total_price"`
+}
+
+// PaymentWithOrder is GET /payments/{id}?include=order: the payment with
+// its order from order-service, or a null order and a warning when
+// order-service couldn't be asked.
+type PaymentWithOrder struct {
+	PaymentDetail
+	Order    *OrderSummary `json:"order"`
+	Warnings []string      `json:"warnings,omitempty"`
+}
+
+// errOrderNotFound means order-service has no such order.
+var errOrderNotFound = errors.New("order not found")
+
+func loadBool(key string, def bool) bool {
+	b, err := strconv.ParseBool(getEnv(key, strconv.FormatBool(def)))
+	if err != nil {
+		log.Printf("Invalid %s, using %t", key, def)
+		return def
+	}
+	return b
+}
+
+// fetchOrder asks order-service for an order.
+func fetchOrder(ctx context.Context, orderID int) (OrderSummary, error) {
+	var order OrderSummary
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderServiceURL+"/orders/"+strconv.Itoa(orderID), nil)
+	if err != nil {
+		return order, err
+	}
+
+	resp, err := orderClient.Do(req)
+	if err != nil {
+		return order, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return order, errOrderNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return order, fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&order)
+	return order, err
+}
+
+// fetchOrderTotal asks order-service for an order's total price.
+func fetchOrderTotal(ctx context.Context, orderID int) (float64, error) {
+	order, err := fetchOrder(ctx, orderID)
+	return order.TotalPrice, err
+}
+
+// orderSummary returns an order from order-service, answering from a
+// short-lived cache so list views opening many payments don't call
+// order-service for each.
+func orderSummary(ctx context.Context, orderID int) (OrderSummary, error) {
+	if order, ok := orderSummaries.get(orderID, time.Now()); ok {
+		return order, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, orderSummaryTimeout)
+	defer cancel()
+	order, err := fetchOrder(ctx, orderID)
+	if err != nil {
+		return order, err
+	}
+	orderSummaries.set(orderID, order, time.Now().Add(orderSummaryTTL))
+	return order, nil
+}
+
+// orderSummaryCache is a per-replica cache of order-service orders.
+type orderSummaryCache struct {
+	mu      sync.Mutex
+	entries map[int]orderSummaryEntry
+}
+
+type orderSummaryEntry struct {
+	order     OrderSummary
+	expiresAt time.Time
+}
+
+func newOrderSummaryCache() *orderSummaryCache {
+	return &orderSummaryCache{entries: make(map[int]orderSummaryEntry)}
+}
+
+func (c *orderSummaryCache) get(orderID int, now time.Time) (OrderSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[orderID]
+	if !ok || now.After(e.expiresAt) {
+		return OrderSummary{}, false
+	}
+	return e.order, true
+}
+
+// set stores order until expiresAt, dropping entries that have expired.
+func (c *orderSummaryCache) set(orderID int, order OrderSummary, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[orderID] = orderSummaryEntry{order: order, expiresAt: expiresAt}
+}
+
+// verifyOrderAmount checks an order_created amount against order-service.
+// It returns a rejection reason when they differ by more than a cent or
+// the order doesn't exist, and an error when order-service couldn't be
+// asked even after retrying, so the event is retried later rather than
+// charged unchecked.
+func verifyOrderAmount(ctx context.Context, orderID int, amount float64) (reason string, err error) {
+	if !verifyOrderAmounts {
+		return "", nil
+	}
+
+	var total float64
+	notFound := false
+	err = withRetry(ctx, func() error {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), orderClient.Timeout)
+		defer cancel()
+		var err error
+		total, err = fetchOrderTotal(fetchCtx, orderID)
+		notFound = errors.Is(err, errOrderNotFound)
+		if notFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("verifying order amount: %w", err)
+	}
+	if notFound {
+		reason = "order_not_found"
+	} else if diff := toCents(amount) - toCents(total); diff > 1 || diff < -1 {
+		reason = "amount_mismatch"
+	}
+	if reason != "" {
+		amountMismatches.WithLabelValues(reason).Inc()
+		loggerFrom(ctx).Error("order_created amount doesn't match order-service", "amount", amount, "order_total", total, "reason", reason)
+	}
+	return reason, nil
+}
+
+// rejectPayment records an order_created event that won't be charged.
+func rejectPayment(ctx context.Context, orderID int, amount float64, currency, method, reason string) {
+	loggerFrom(ctx).Warn("rejecting payment", "amount", amount, "currency", currency, "payment_method", method, "reason", reason)
+	paymentsProcessed.WithLabelValues("rejected", method).Inc()
+	publishEvent(map[string]interface{}{
+		"event_type":     "payment_rejected",
+		"order_id":       orderID,
+		"amount":         amount,
+		"currency":       currency,
+		"payment_method": method,
+		"reason":         reason,
+		"timestamp":      time.Now().Unix(),
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// withOrderService points amount verification at a fake order-service
+// answering GET /orders/42 with status and total.
+func withOrderService(t *testing.T, status int, total float64) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/orders/42" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		if status != http.StatusOK {
+			http.Error(w, "error", status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 42, "total_price": total})
+	}))
+	t.Cleanup(srv.Close)
+
+	oldURL, oldVerify := orderServiceURL, verifyOrderAmounts
+	orderServiceURL, verifyOrderAmounts = srv.URL, true
+	t.Cleanup(func() { orderServiceURL, verifyOrderAmounts = oldURL, oldVerify })
+}
+
+func TestVerifyOrderAmount(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		total      float64
+		amount     float64
+		wantReason string
+		wantErr    bool
+	}{
+		{name: "matches", status: http.StatusOK, total: 19.99, amount: 19.99},
+		{name: "within a cent", status: http.StatusOK, total: 19.99, amount: 20.00},
+		{name: "mismatch", status: http.StatusOK, total: 500, amount: 0, wantReason: "amount_mismatch"},
+		{name: "unknown order", status: http.StatusNotFound, amount: 10, wantReason: "order_not_found"},
+		{name: "order-service down", status: http.StatusServiceUnavailable, amount: 10, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFastRetries(t, 2)
+			withOrderService(t, tt.status, tt.total)
+
+			reason, err := verifyOrderAmount(context.Background(), 42, tt.amount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if reason != tt.wantReason {
+				t.Errorf("expected reason %q, got %q", tt.wantReason, reason)
+			}
+		})
+	}
+}
+
+func TestHandleOrderCreatedRejectsMismatchedAmount(t *testing.T) {
+	withMockDB(t)
+	withFastRetries(t, 1)
+	withOrderService(t, http.StatusOK, 500)
+	events := capturePublishedEvents(t)
+
+	if err := handleOrderCreated(context.Background(), orderCreated(42, 10)); err != nil {
+		t.Fatalf("expected the rejection to be handled, got %v", err)
+	}
+	if len(*events) != 1 || (*events)[0]["event_type"] != "payment_rejected" || (*events)[0]["reason"] != "amount_mismatch" {
+		t.Fatalf("expected a payment_rejected event, got %v", *events)
+	}
+}
+
+func TestHandleOrderCreatedChargesVerifiedAmount(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	withOrderService(t, http.StatusOK, 19.99)
+	events := capturePublishedEvents(t)
+
+	expectPaymentSaved(mock, events, 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	if err := handleOrderCreated(context.Background(), orderCreated(42, 19.99)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleOrderCreatedDoesNotFailOpen(t *testing.T) {
+	withMockDB(t)
+	withFastRetries(t, 2)
+	withOrderService(t, http.StatusBadGateway, 0)
+	events := capturePublishedEvents(t)
+
+	err := handleOrderCreated(context.Background(), orderCreated(42, 19.99))
+	if err == nil || errors.Is(err, errOrderNotFound) {
+		t.Fatalf("expected an error so the event is retried, got %v", err)
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected nothing published, got %v", *events)
+	}
+}
+
+// expectPaymentDetail expects getPayment to load payment 7 for order 42,
+// which has no refunds.
+func expectPaymentDetail(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE id = \\$1").
+		WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of", "refunded_amount"}).
+			AddRow(7, 42, 19.99, "USD", "captured", "card", time.Now(), 0, 0))
+	mock.ExpectQuery("SELECT id, amount, status, created_at FROM refunds").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "amount", "status", "created_at"}))
+}
+
+func getPaymentWithOrder(t *testing.T) PaymentWithOrder {
+	t.Helper()
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}", getPayment).Methods("GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/payments/7?include=order", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var p PaymentWithOrder
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func withEmptyOrderSummaryCache(t *testing.T) {
+	t.Helper()
+	old := orderSummaries
+	orderSummaries = newOrderSummaryCache()
+	t.Cleanup(func() { orderSummaries = old })
+}
+
+func TestGetPaymentIncludeOrder(t *testing.T) {
+	mock := withMockDB(t)
+	withEmptyOrderSummaryCache(t)
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": 42, "user_id": 3, "status": "pending", "product_id": 5, "quantity": 2, "total_price": 19.99,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	oldURL := orderServiceURL
+	orderServiceURL = srv.URL
+	t.Cleanup(func() { orderServiceURL = oldURL })
+
+	expectPaymentDetail(mock)
+	expectPaymentDetail(mock)
+
+	p := getPaymentWithOrder(t)
+	want := OrderSummary{ID: 42, Status: "pending", ProductID: 5, Quantity: 2, TotalPrice: 19.99}
+	if p.ID != 7 || p.Order == nil || *p.Order != want || len(p.Warnings) != 0 {
+		t.Errorf("expected payment 7 with order %+v, got %+v", want, p)
+	}
+
+	// The second lookup is answered from the cache.
+	if p := getPaymentWithOrder(t); p.Order == nil || calls != 1 {
+		t.Errorf("expected the cached order and one order-service call, got %+v after %d calls", p.Order, calls)
+	}
+}
+
+func TestGetPaymentIncludeOrderUnavailable(t *testing.T) {
+	mock := withMockDB(t)
+	withEmptyOrderSummaryCache(t)
+	withOrderService(t, http.StatusServiceUnavailable, 0)
+
+	expectPaymentDetail(mock)
+
+	p := getPaymentWithOrder(t)
+	if p.ID != 7 || p.Order != nil || len(p.Warnings) != 1 {
+		t.Errorf("expected the payment with a null order and a warning, got %+v", p)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	outboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_outbox_pending",
+		Help: "Payment events in the outbox not yet published to Kafka",
+	})
+	outboxOldestPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_outbox_oldest_pending_seconds",
+		Help: "Age of the oldest unpublished payment event, 0 when the outbox is empty",
+	})
+	outboxRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_outbox_relayed_total",
+		Help: "Outbox relay attempts, by outcome",
+	}, []string{"outcome"})
+)
+
+var (
+	// eventWriter publishes to payment-events; set up in main.
+	eventWriter         messageWriter
+	outboxRelayInterval = loadDuration("OUTBOX_RELAY_INTERVAL", time.Second)
+	// outboxKick wakes the relay as soon as an event is committed instead
+	// of waiting for the next tick.
+	outboxKick = make(chan struct{}, 1)
+)
+
+const outboxRelayBatch = 100
+
+// enqueueEvent writes a payment event to the outbox inside tx, so it is
+// published if and only if the change it describes commits.
+func enqueueEvent(ctx context.Context, tx *sql.Tx, event map[string]interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO event_outbox (event_type, payload) VALUES ($1, $2)",
+		event["event_type"], data)
+	return err
+}
+
+// kickOutboxRelay asks the relay to run now. It never blocks.
+func kickOutboxRelay() {
+	select {
+	case outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+// relayOutbox publishes pending outbox events in order, stopping at the
+// first failure so ordering is preserved; the rest wait for the next run.
+// Published events are also queued for webhook subscribers.
+// SKIP LOCKED lets replicas relay concurrently without double-publishing.
+func relayOutbox(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, event_type, payload FROM event_outbox WHERE published_at IS NULL
+		ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, outboxRelayBatch)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id        int64
+		eventType string
+		payload   []byte
+	}
+	var events []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.eventType, &p.payload); err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		logger := outboxLogger(e.id, e.eventType, e.payload)
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		werr := eventWriter.WriteMessages(wctx, kafka.Message{Value: e.payload})
+		cancel()
+		if werr != nil {
+			outboxRelayed.WithLabelValues("failed").Inc()
+			logger.Error("failed to relay outbox event, will retry", "error", werr)
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE event_outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2", werr.Error(), e.id,
+			); err != nil {
+				return err
+			}
+			break
+		}
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE event_outbox SET published_at = CURRENT_TIMESTAMP WHERE id = $1", e.id,
+		); err != nil {
+			return err
+		}
+		if err := queueWebhooks(ctx, tx, e.eventType, e.payload); err != nil {
+			return err
+		}
+		outboxRelayed.WithLabelValues("published").Inc()
+		logger.Info("published event")
+	}
+	return tx.Commit()
+}
+
+// updateOutboxBacklog refreshes the backlog gauges.
+func updateOutboxBacklog(ctx context.Context) error {
+	var pending int
+	var oldest float64
+	err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MIN(created_at)), 0)
+		FROM event_outbox WHERE published_at IS NULL`,
+	).Scan(&pending, &oldest)
+	if err != nil {
+		return err
+	}
+	outboxPending.Set(float64(pending))
+	outboxOldestPending.Set(oldest)
+	return nil
+}
+
+// relayOutboxLoop relays the outbox on every tick or kick until ctx is
+// done.
+func relayOutboxLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := relayOutbox(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Outbox relay failed: %v", err)
+		}
+		if err := updateOutboxBacklog(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to measure outbox backlog: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-outboxKick:
+		}
+	}
+}
+
+// outboxLogger returns the default logger annotated with an outbox
+// event's id and the order and payment it is about.
+func outboxLogger(id int64, eventType string, payload []byte) *slog.Logger {
+	var ids struct {
+		OrderID   int `json:"order_id"`
+		PaymentID int `json:"payment_id"`
+	}
+	json.Unmarshal(payload, &ids)
+	return slog.Default().With("event_id", id, "event_type", eventType, "order_id", ids.OrderID, "payment_id", ids.PaymentID)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// outboxPayload matches an event_outbox payload and appends the decoded
+// event to events, so tests can inspect what would be published.
+type outboxPayload struct {
+	events *[]map[string]interface{}
+}
+
+func (o outboxPayload) Match(v driver.Value) bool {
+	data, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return false
+	}
+	*o.events = append(*o.events, event)
+	return true
+}
+
+// expectPaymentSaved expects handleOrderCreated to find no payment for
+// the order and then insert the payment, its initial payment_events and
+// its payment_processed event, recording the event in events. args[0] is
+// the order id and args[2] the status.
+func expectPaymentSaved(mock sqlmock.Sqlmock, events *[]map[string]interface{}, args ...driver.Value) {
+	expectEventPaymentSaved(mock, events, "", args...)
+}
+
+// expectEventPaymentSaved is expectPaymentSaved for an event with an id,
+// which is first checked against and then added to processed_events.
+func expectEventPaymentSaved(mock sqlmock.Sqlmock, events *[]map[string]interface{}, eventID string, args ...driver.Value) {
+	if eventID != "" {
+		expectEventSeen(mock, eventID, false)
+	}
+	expectOrderPaid(mock, args[0], false)
+	expectPaymentTx(mock, events, eventID, args...)
+}
+
+// expectPaymentTx expects just the transaction of expectEventPaymentSaved,
+// as when retrying the insert or saving a manual payment.
+func expectPaymentTx(mock sqlmock.Sqlmock, events *[]map[string]interface{}, eventID string, args ...driver.Value) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments").
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	if eventID != "" {
+		mock.ExpectExec("INSERT INTO processed_events").
+			WithArgs(eventID, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	from := ""
+	for _, to := range initialTransitions(args[2].(string)) {
+		mock.ExpectExec("INSERT INTO payment_events").
+			WithArgs(1, from, to).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		from = to
+	}
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs("payment_processed", outboxPayload{events}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if args[2] == statusAuthorized {
+		mock.ExpectExec("INSERT INTO event_outbox").
+			WithArgs("payment_authorized", outboxPayload{events}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+}
+
+// expectPaymentInsertFails expects handleOrderCreated's transaction to
+// fail on the payment insert and roll back.
+func expectPaymentInsertFails(mock sqlmock.Sqlmock, err error) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments").WillReturnError(err)
+	mock.ExpectRollback()
+}
+
+func withEventWriter(t *testing.T, w messageWriter) {
+	t.Helper()
+	old := eventWriter
+	eventWriter = w
+	t.Cleanup(func() { eventWriter = old })
+}
+
+func TestRelayOutbox(t *testing.T) {
+	mock := withMockDB(t)
+	writer := &fakeWriter{}
+	withEventWriter(t, writer)
+
+	mock.ExpectBegin()
+	processed := []byte(`{"event_type":"payment_processed","payment_id":1,"status":"failed"}`)
+	refunded := []byte(`{"event_type":"payment_refunded","refund_id":1}`)
+	mock.ExpectQuery("SELECT id, event_type, payload FROM event_outbox WHERE published_at IS NULL (.+) FOR UPDATE SKIP LOCKED").
+		WithArgs(outboxRelayBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "payload"}).
+			AddRow(1, "payment_processed", processed).
+			AddRow(2, "payment_refunded", refunded))
+	mock.ExpectExec("UPDATE event_outbox SET published_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").WithArgs("payment_failed", processed).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE event_outbox SET published_at").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").WithArgs("payment_refunded", refunded).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := relayOutbox(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(writer.msgs) != 2 {
+		t.Fatalf("expected 2 events published, got %d", len(writer.msgs))
+	}
+}
+
+func TestRelayOutboxStopsAtFirstFailure(t *testing.T) {
+	mock := withMockDB(t)
+	withEventWriter(t, &fakeWriter{err: errors.New("broker unavailable")})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, event_type, payload FROM event_outbox").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "payload"}).
+			AddRow(1, "payment_processed", []byte(`{}`)).
+			AddRow(2, "payment_processed", []byte(`{}`)))
+	mock.ExpectExec("UPDATE event_outbox SET attempts = attempts \\+ 1, last_error = \\$1 WHERE id = \\$2").
+		WithArgs("broker unavailable", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := relayOutbox(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleOrderCreatedWritesEventToOutbox(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	published := capturePublishedEvents(t)
+
+	var outboxed []map[string]interface{}
+	expectPaymentSaved(mock, &outboxed, 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	if err := handleOrderCreated(context.Background(), orderCreated(42, 19.99)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*published) != 0 {
+		t.Errorf("expected nothing published directly, got %v", *published)
+	}
+	if len(outboxed) != 1 || outboxed[0]["event_type"] != "payment_processed" || outboxed[0]["order_id"] != float64(42) {
+		t.Errorf("expected payment_processed in the outbox, got %v", outboxed)
+	}
+}
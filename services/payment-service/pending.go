@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var pendingResolved = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_pending_resolved_total",
+	Help: "Pending payments settled, by outcome and what settled them (callback or timeout)",
+}, []string{"outcome", "via"})
+
+var (
+	// pendingTimeout is how long a payment may stay pending before the
+	// sweeper fails it. Gateways that confirm asynchronously call back
+	// well within this.
+	pendingTimeout       = loadDuration("PENDING_PAYMENT_TIMEOUT", 30*time.Minute)
+	pendingSweepInterval = loadDuration("PENDING_SWEEP_INTERVAL", time.Minute)
+	// gatewayCallbackSecret signs POST /payments/{id}/callback. Callbacks
+	// are refused while it is unset.
+	gatewayCallbackSecret = getEnv("PAYMENT_GATEWAY_CALLBACK_SECRET", "")
+	// callbackMaxSkew is how far a callback's timestamp may be from now.
+	callbackMaxSkew = 5 * time.Minute
+)
+
+const pendingSweepBatch = 100
+
+// Outcomes a gateway callback can report for a pending payment.
+const (
+	callbackConfirmed = "confirmed"
+	callbackFailed    = "failed"
+)
+
+// errAuthorizationPending means the gateway accepted an authorization
+// but will confirm or fail it later through POST /payments/{id}/callback.
+var errAuthorizationPending = errors.New("payment gateway will confirm the authorization later")
+
+// errNotPending means a pending payment was settled by someone else
+// first: the callback, the sweeper, or an earlier delivery of either.
+var errNotPending = errors.New("payment is no longer pending")
+
+// GatewayCallback is the body of POST /payments/{id}/callback.
+type GatewayCallback struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// settlePending moves pending payment id to authorized when outcome is
+// callbackConfirmed, or to failed, publishing payment_authorized or
+// payment_failed with the status change. A payment that is no longer
+// pending is returned as it is with errNotPending.
+func settlePending(ctx context.Context, id int, outcome, reason string) (Payment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Payment{}, err
+	}
+	defer tx.Rollback()
+
+	p, _, err := lockPayment(ctx, tx, strconv.Itoa(id))
+	if err != nil {
+		return p, err
+	}
+	if p.Status != statusPending {
+		return p, errNotPending
+	}
+
+	if outcome == callbackConfirmed {
+		if err := transitionPayment(ctx, tx, &p, statusAuthorized); err != nil {
+			return p, err
+		}
+		err = enqueuePaymentEvent(ctx, tx, "payment_authorized", p)
+	} else {
+		if err := transitionPayment(ctx, tx, &p, statusFailed); err != nil {
+			return p, err
+		}
+		err = enqueueEvent(ctx, tx, map[string]interface{}{
+			"event_type":     "payment_failed",
+			"payment_id":     p.ID,
+			"order_id":       p.OrderID,
+			"amount":         p.Amount,
+			"currency":       p.Currency,
+			"payment_method": p.PaymentMethod,
+			"reason":         reason,
+			"timestamp":      time.Now().Unix(),
+		})
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := tx.Commit(); err != nil {
+		return p, err
+	}
+	kickOutboxRelay()
+	return p, nil
+}
+
+// captureConfirmed captures a payment the gateway just confirmed, unless
+// capture is deferred. A failed capture leaves it authorized, to be
+// captured through POST /payments/{id}/capture or when the order ships.
+func captureConfirmed(ctx context.Context, id int) (Payment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Payment{}, err
+	}
+	defer tx.Rollback()
+
+	p, gatewayRef, err := lockPayment(ctx, tx, strconv.Itoa(id))
+	if err != nil {
+		return p, err
+	}
+	if p.Status != statusAuthorized {
+		return p, nil
+	}
+	if err := markCaptured(ctx, tx, &p); err != nil {
+		return p, err
+	}
+	if err := captureAtGateway(ctx, gatewayRef, p.Amount); err != nil {
+		return p, err
+	}
+	if err := tx.Commit(); err != nil {
+		return p, err
+	}
+	kickOutboxRelay()
+	return p, nil
+}
+
+// verifyCallback checks a callback's X-Gateway-Timestamp and
+// X-Gateway-Signature, signed like our own webhooks with the callback
+// secret.
+func verifyCallback(r *http.Request, body []byte, now time.Time) bool {
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Gateway-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > callbackMaxSkew || skew < -callbackMaxSkew {
+		return false
+	}
+	want := signWebhook(gatewayCallbackSecret, timestamp, body)
+	return hmac.Equal([]byte(r.Header.Get("X-Gateway-Signature")), []byte(want))
+}
+
+// gatewayCallback lets a gateway that answered an authorization with
+// "pending" confirm or fail it. Deliveries are idempotent: repeating an
+// outcome the payment already reflects returns 200, and one that
+// contradicts it, such as confirming a payment the sweeper already
+// failed, returns 409.
+func gatewayCallback(w http.ResponseWriter, r *http.Request) {
+	if gatewayCallbackSecret == "" {
+		http.Error(w, "Gateway callbacks are disabled", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !verifyCallback(r, body, time.Now()) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var cb GatewayCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if cb.Status != callbackConfirmed && cb.Status != callbackFailed {
+		http.Error(w, "status must be confirmed or failed", http.StatusBadRequest)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	ctx := r.Context()
+	p, err := settlePending(ctx, id, cb.Status, cb.Reason)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errNotPending):
+		failed := p.Status == statusFailed
+		if failed != (cb.Status == callbackFailed) {
+			http.Error(w, "Payment is already "+p.Status, http.StatusConflict)
+			return
+		}
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	default:
+		pendingResolved.WithLabelValues(cb.Status, "callback").Inc()
+		log.Printf("Gateway %s pending payment %d (order %d)", cb.Status, p.ID, p.OrderID)
+		if cb.Status == callbackConfirmed && !deferCapture {
+			captured, err := captureConfirmed(ctx, p.ID)
+			if err != nil {
+				log.Printf("Failed to capture confirmed payment %d, leaving it authorized: %v", p.ID, err)
+			} else {
+				p = captured
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// failStalePending fails up to a batch of payments that have been
+// pending for longer than olderThan, and returns how many it failed.
+// A payment its callback settles in the meantime is left alone.
+func failStalePending(ctx context.Context, olderThan time.Duration) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id FROM payments WHERE status = $1 AND created_at < $2 ORDER BY id LIMIT $3",
+		statusPending, time.Now().Add(-olderThan), pendingSweepBatch)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, id := range ids {
+		_, err := settlePending(ctx, id, callbackFailed, "timed out waiting for gateway confirmation")
+		switch {
+		case errors.Is(err, errNotPending):
+		case err != nil:
+			log.Printf("Failed to time out pending payment %d: %v", id, err)
+		default:
+			pendingResolved.WithLabelValues(callbackFailed, "timeout").Inc()
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// failStalePendingLoop runs failStalePending and resendPendingRefunds on
+// every tick until ctx is done.
+func failStalePendingLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := failStalePending(ctx, pendingTimeout)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Timing out pending payments failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Failed %d payments pending for longer than %s", n, pendingTimeout)
+		}
+		n, err = resendPendingRefunds(ctx, interval)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Resending pending refunds failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Settled %d pending refunds", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func withCallbackSecret(t *testing.T, secret string) {
+	t.Helper()
+	old := gatewayCallbackSecret
+	gatewayCallbackSecret = secret
+	t.Cleanup(func() { gatewayCallbackSecret = old })
+}
+
+// serveCallback posts body as a callback for payment 7, signed with
+// secret at timestamp ts.
+func serveCallback(body, secret string, ts time.Time) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}/callback", gatewayCallback).Methods("POST")
+	req := httptest.NewRequest("POST", "/payments/7/callback", strings.NewReader(body))
+	req.Header.Set("X-Gateway-Timestamp", strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set("X-Gateway-Signature", signWebhook(secret, ts.Unix(), []byte(body)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestGatewayCallbackRejectsUnsigned(t *testing.T) {
+	body := `{"status":"confirmed"}`
+
+	withCallbackSecret(t, "")
+	if w := serveCallback(body, "", time.Now()); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with no secret configured, got %d", w.Code)
+	}
+
+	withCallbackSecret(t, "cb-secret")
+	if w := serveCallback(body, "wrong", time.Now()); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad signature, got %d", w.Code)
+	}
+	if w := serveCallback(body, "cb-secret", time.Now().Add(-time.Hour)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a stale timestamp, got %d", w.Code)
+	}
+	if w := serveCallback(`{"status":"maybe"}`, "cb-secret", time.Now()); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown status, got %d", w.Code)
+	}
+}
+
+func TestGatewayCallbackConfirmsAndCaptures(t *testing.T) {
+	mock := withMockDB(t)
+	withCallbackSecret(t, "cb-secret")
+	var events []map[string]interface{}
+
+	expectLockedPayment(mock, 25, statusPending)
+	expectTransition(mock, &events, 7, statusPending, statusAuthorized)
+	expectPaymentEvent(mock, &events, "payment_authorized")
+	mock.ExpectCommit()
+	expectLockedPayment(mock, 25, statusAuthorized)
+	expectTransition(mock, &events, 7, statusAuthorized, statusCaptured)
+	expectPaymentEvent(mock, &events, "payment_captured")
+	mock.ExpectCommit()
+
+	w := serveCallback(`{"status":"confirmed"}`, "cb-secret", time.Now())
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var p Payment
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != statusCaptured {
+		t.Errorf("expected captured, got %s", p.Status)
+	}
+}
+
+func TestGatewayCallbackFails(t *testing.T) {
+	mock := withMockDB(t)
+	withCallbackSecret(t, "cb-secret")
+	var events []map[string]interface{}
+
+	expectLockedPayment(mock, 25, statusPending)
+	expectTransition(mock, &events, 7, statusPending, statusFailed)
+	expectPaymentEvent(mock, &events, "payment_failed")
+	mock.ExpectCommit()
+
+	w := serveCallback(`{"status":"failed","reason":"insufficient funds"}`, "cb-secret", time.Now())
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if last := events[len(events)-1]; last["reason"] != "insufficient funds" {
+		t.Errorf("expected the reason on payment_failed, got %v", last)
+	}
+}
+
+// The sweeper and a late callback race for the same pending payment;
+// whichever locks it second must leave it as the first one settled it.
+func TestPendingCallbackRacesSweeper(t *testing.T) {
+	withCallbackSecret(t, "cb-secret")
+
+	t.Run("callback after sweeper failed it", func(t *testing.T) {
+		mock := withMockDB(t)
+		expectLockedPayment(mock, 25, statusFailed)
+		mock.ExpectRollback()
+
+		if w := serveCallback(`{"status":"confirmed"}`, "cb-secret", time.Now()); w.Code != http.StatusConflict {
+			t.Errorf("expected 409 confirming a timed out payment, got %d", w.Code)
+		}
+	})
+
+	t.Run("repeated failure callback", func(t *testing.T) {
+		mock := withMockDB(t)
+		expectLockedPayment(mock, 25, statusFailed)
+		mock.ExpectRollback()
+
+		if w := serveCallback(`{"status":"failed"}`, "cb-secret", time.Now()); w.Code != http.StatusOK {
+			t.Errorf("expected 200 for a failure it already reflects, got %d", w.Code)
+		}
+	})
+
+	t.Run("sweeper after callback confirmed it", func(t *testing.T) {
+		mock := withMockDB(t)
+		mock.ExpectQuery("SELECT id FROM payments WHERE status = \\$1 AND created_at < \\$2").
+			WithArgs(statusPending, sqlmock.AnyArg(), pendingSweepBatch).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+		expectLockedPayment(mock, 25, statusAuthorized)
+		mock.ExpectRollback()
+
+		n, err := failStalePending(context.Background(), pendingTimeout)
+		if err != nil || n != 0 {
+			t.Errorf("expected nothing failed, got %d, %v", n, err)
+		}
+	})
+}
+
+func TestFailStalePending(t *testing.T) {
+	mock := withMockDB(t)
+	var events []map[string]interface{}
+
+	mock.ExpectQuery("SELECT id FROM payments WHERE status = \\$1 AND created_at < \\$2").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	expectLockedPayment(mock, 25, statusPending)
+	expectTransition(mock, &events, 7, statusPending, statusFailed)
+	expectPaymentEvent(mock, &events, "payment_failed")
+	mock.ExpectCommit()
+
+	n, err := failStalePending(context.Background(), pendingTimeout)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 payment failed, got %d, %v", n, err)
+	}
+}
+
+func TestHTTPGatewayPendingAuthorization(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"id": "auth_1", "status": "pending"})
+	}))
+	defer srv.Close()
+
+	ref, err := newHTTPGateway(srv.URL, "", time.Second).Authorize(context.Background(), 42, 25, chargeKey(42))
+	if ref != "auth_1" || !errors.Is(err, errAuthorizationPending) {
+		t.Fatalf("expected auth_1 pending, got %q, %v", ref, err)
+	}
+}
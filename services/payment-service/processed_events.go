@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var duplicatesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_duplicate_events_skipped_total",
+	Help: "order_created events skipped as already handled, by which check caught them",
+}, []string{"check"})
+
+var (
+	// processedEventsRetention is how long handled event ids are kept.
+	// A replay of events older than this is only caught by the order_id
+	// check.
+	processedEventsRetention       = loadDuration("PROCESSED_EVENTS_RETENTION", 7*24*time.Hour)
+	processedEventsCleanupInterval = loadDuration("PROCESSED_EVENTS_CLEANUP_INTERVAL", time.Hour)
+)
+
+// eventProcessed reports whether the event with id has already been
+// handled. Events without an id are never considered handled here.
+func eventProcessed(ctx context.Context, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM processed_events WHERE event_id = $1)", id,
+	).Scan(&exists)
+	return exists, err
+}
+
+// orderPaid reports whether a payment has already been recorded for the
+// order.
+func orderPaid(ctx context.Context, orderID int) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM payments WHERE order_id = $1)", orderID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// markEventProcessed records in tx that the event with id has been
+// handled, resulting in paymentID. It returns false if another delivery
+// of the event got there first. Rejected events aren't recorded; a
+// replay only publishes payment_rejected again.
+func markEventProcessed(ctx context.Context, tx *sql.Tx, id string, paymentID int) (bool, error) {
+	if id == "" {
+		return true, nil
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO processed_events (event_id, payment_id) VALUES ($1, $2)
+		ON CONFLICT (event_id) DO NOTHING`,
+		id, paymentID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// cleanupProcessedEvents deletes processed event ids older than the
+// retention period.
+func cleanupProcessedEvents(ctx context.Context, retention time.Duration) (int64, error) {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM processed_events WHERE processed_at < $1",
+		time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// cleanupProcessedEventsLoop runs cleanupProcessedEvents on every tick
+// until ctx is done.
+func cleanupProcessedEventsLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := cleanupProcessedEvents(ctx, processedEventsRetention)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Processed events cleanup failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d processed events older than %s", n, processedEventsRetention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
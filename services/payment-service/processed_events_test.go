@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func expectEventSeen(mock sqlmock.Sqlmock, eventID string, seen bool) {
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM processed_events WHERE event_id = \\$1\\)").
+		WithArgs(eventID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(seen))
+}
+
+func expectOrderPaid(mock sqlmock.Sqlmock, orderID driver.Value, paid bool) {
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM payments WHERE order_id = \\$1\\)").
+		WithArgs(orderID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(paid))
+}
+
+func TestHandleOrderCreatedRecordsEventID(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+
+	event := orderCreated(42, 19.99)
+	event.EventID = "evt-1"
+	expectEventPaymentSaved(mock, events, "evt-1", 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	if err := handleOrderCreated(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 {
+		t.Errorf("expected a payment_processed event, got %v", *events)
+	}
+}
+
+func TestHandleOrderCreatedSkipsProcessedEvent(t *testing.T) {
+	mock := withMockDB(t)
+	events := capturePublishedEvents(t)
+	charged := make(chan struct{})
+	withGateway(t, signallingGateway{started: charged})
+
+	before := testutil.ToFloat64(duplicatesSkipped.WithLabelValues("event_id"))
+	expectEventSeen(mock, "evt-1", true)
+
+	event := orderCreated(42, 19.99)
+	event.EventID = "evt-1"
+	if err := handleOrderCreated(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-charged:
+		t.Error("expected a processed event not to be charged again")
+	default:
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events for a processed event, got %v", *events)
+	}
+	if got := testutil.ToFloat64(duplicatesSkipped.WithLabelValues("event_id")) - before; got != 1 {
+		t.Errorf("expected one event_id duplicate counted, got %v", got)
+	}
+}
+
+func TestHandleOrderCreatedSkipsPaidOrder(t *testing.T) {
+	mock := withMockDB(t)
+	events := capturePublishedEvents(t)
+	charged := make(chan struct{})
+	withGateway(t, signallingGateway{started: charged})
+
+	// A legacy event with no id, redelivered after its payment was saved.
+	before := testutil.ToFloat64(duplicatesSkipped.WithLabelValues("order_id"))
+	expectOrderPaid(mock, 42, true)
+
+	if err := handleOrderCreated(context.Background(), orderCreated(42, 19.99)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-charged:
+		t.Error("expected a paid order not to be charged again")
+	default:
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected no events for a paid order, got %v", *events)
+	}
+	if got := testutil.ToFloat64(duplicatesSkipped.WithLabelValues("order_id")) - before; got != 1 {
+		t.Errorf("expected one order_id duplicate counted, got %v", got)
+	}
+}
+
+func TestHandleOrderCreatedLosesRaceForEventID(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+
+	before := testutil.ToFloat64(duplicatesSkipped.WithLabelValues("event_id"))
+	expectEventSeen(mock, "evt-1", false)
+	expectOrderPaid(mock, 42, false)
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectExec("INSERT INTO processed_events").
+		WithArgs("evt-1", 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	event := orderCreated(42, 19.99)
+	event.EventID = "evt-1"
+	if err := handleOrderCreated(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected nothing published by the losing delivery, got %v", *events)
+	}
+	if got := testutil.ToFloat64(duplicatesSkipped.WithLabelValues("event_id")) - before; got != 1 {
+		t.Errorf("expected one event_id duplicate counted, got %v", got)
+	}
+}
+
+func TestCleanupProcessedEvents(t *testing.T) {
+	mock := withMockDB(t)
+
+	mock.ExpectExec("DELETE FROM processed_events WHERE processed_at < \\$1").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := cleanupProcessedEvents(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 rows deleted, got %d", n)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	reconciliationMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_reconciliation_mismatches_total",
+		Help: "Newly found disagreements between confirmed orders and their payments, by kind",
+	}, []string{"kind"})
+	reconciliationOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_reconciliation_open_mismatches",
+		Help: "Disagreements found by the latest reconciliation run",
+	})
+)
+
+var (
+	// reconciliationEnabled runs the order/payment reconciliation loop.
+	// Set RECONCILIATION_ENABLED=false where order-service isn't
+	// reachable.
+	reconciliationEnabled  = loadBool("RECONCILIATION_ENABLED", true)
+	reconciliationInterval = loadDuration("RECONCILIATION_INTERVAL", 15*time.Minute)
+	// reconciliationLookback is how far back orders are checked, and
+	// reconciliationGrace how old they must be, so payments still in
+	// flight aren't reported.
+	reconciliationLookback = loadDuration("RECONCILIATION_LOOKBACK", 24*time.Hour)
+	reconciliationGrace    = loadDuration("RECONCILIATION_GRACE", 5*time.Minute)
+	// reconciliationRate caps calls to order-service per second.
+	reconciliationRate = loadPositiveInt("RECONCILIATION_RATE_LIMIT", 5)
+)
+
+const reconciliationPageSize = 100
+
+// Kinds of reconciliation mismatch.
+const (
+	mismatchMissingPayment = "missing_payment"
+	mismatchNotCompleted   = "payment_not_completed"
+	mismatchAmount         = "amount_mismatch"
+)
+
+// ReconciliationMismatch is a confirmed order whose payment is missing,
+// didn't go through, or is for a different amount.
+type ReconciliationMismatch struct {
+	OrderID       int     `json:"order_id"`
+	Kind          string  `json:"kind"`
+	OrderTotal    float64 `json:"order_total"`
+	PaymentID     int     `json:"payment_id,omitempty"`
+	PaymentStatus string  `json:"payment_status,omitempty"`
+	PaymentAmount float64 `json:"payment_amount,omitempty"`
+}
+
+// ReconciliationReport is the outcome of one reconciliation run, served
+// by GET /reconciliation/report.
+type ReconciliationReport struct {
+	StartedAt     time.Time                `json:"started_at"`
+	FinishedAt    time.Time                `json:"finished_at"`
+	OrdersChecked int                      `json:"orders_checked"`
+	Mismatches    []ReconciliationMismatch `json:"mismatches"`
+	// Error is why the run stopped early; its findings so far are kept.
+	Error string `json:"error,omitempty"`
+}
+
+// lastReconciliation holds the latest ReconciliationReport.
+var lastReconciliation struct {
+	mu     sync.Mutex
+	report *ReconciliationReport
+}
+
+// listedOrder is an order as order-service lists it.
+type listedOrder struct {
+	ID         int       `json:"id"`
+	Status     string    `json:"status"`
+	TotalPrice float64   `json:"total_price"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// fetchConfirmedOrders asks order-service for a page of confirmed
+// orders, newest first, with ids below beforeID (0 for the first page).
+func fetchConfirmedOrders(ctx context.Context, beforeID int) ([]listedOrder, error) {
+	query := url.Values{"status": {"confirmed"}, "limit": {strconv.Itoa(reconciliationPageSize)}}
+	if beforeID > 0 {
+		query.Set("before_id", strconv.Itoa(beforeID))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderServiceURL+"/orders?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := orderClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+	var orders []listedOrder
+	err = json.NewDecoder(resp.Body).Decode(&orders)
+	return orders, err
+}
+
+// checkOrders compares orders against each one's latest payment.
+func checkOrders(ctx context.Context, orders []listedOrder) ([]ReconciliationMismatch, error) {
+	ids := make([]int64, len(orders))
+	for i, o := range orders {
+		ids[i] = int64(o.ID)
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT DISTINCT ON (order_id) order_id, id, status, amount FROM payments
+		WHERE order_id = ANY($1) ORDER BY order_id, id DESC`,
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := make(map[int]Payment)
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.OrderID, &p.ID, &p.Status, &p.Amount); err != nil {
+			return nil, err
+		}
+		p.Status = normalizeStatus(p.Status)
+		payments[p.OrderID] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var mismatches []ReconciliationMismatch
+	for _, o := range orders {
+		m := ReconciliationMismatch{OrderID: o.ID, OrderTotal: o.TotalPrice}
+		p, ok := payments[o.ID]
+		if ok {
+			m.PaymentID, m.PaymentStatus, m.PaymentAmount = p.ID, p.Status, p.Amount
+		}
+		switch {
+		case !ok:
+			m.Kind = mismatchMissingPayment
+		// Authorized payments are captured when the order ships.
+		case p.Status != statusCaptured && p.Status != statusAuthorized:
+			m.Kind = mismatchNotCompleted
+		case toCents(p.Amount) != toCents(o.TotalPrice):
+			m.Kind = mismatchAmount
+		default:
+			continue
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, nil
+}
+
+// reconcile checks confirmed orders created within the lookback window,
+// paging through order-service no faster than reconciliationRate.
+func reconcile(ctx context.Context, now time.Time) ReconciliationReport {
+	report := ReconciliationReport{StartedAt: now, Mismatches: []ReconciliationMismatch{}}
+	oldest, newest := now.Add(-reconciliationLookback), now.Add(-reconciliationGrace)
+
+	limiter := time.NewTicker(time.Second / time.Duration(reconciliationRate))
+	defer limiter.Stop()
+
+	beforeID := 0
+	for {
+		orders, err := fetchConfirmedOrders(ctx, beforeID)
+		if err != nil {
+			report.Error = err.Error()
+			break
+		}
+
+		var due []listedOrder
+		done := len(orders) < reconciliationPageSize
+		for _, o := range orders {
+			if o.CreatedAt.Before(oldest) {
+				done = true
+				break
+			}
+			if !o.CreatedAt.After(newest) {
+				due = append(due, o)
+			}
+		}
+		if len(due) > 0 {
+			mismatches, err := checkOrders(ctx, due)
+			if err != nil {
+				report.Error = err.Error()
+				break
+			}
+			report.OrdersChecked += len(due)
+			report.Mismatches = append(report.Mismatches, mismatches...)
+		}
+		if done {
+			break
+		}
+		beforeID = orders[len(orders)-1].ID
+
+		select {
+		case <-ctx.Done():
+			report.Error = ctx.Err().Error()
+		case <-limiter.C:
+			continue
+		}
+		break
+	}
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// recordReconciliation makes report the latest and announces mismatches
+// the previous run didn't already report, so a lasting one is counted
+// and published once.
+func recordReconciliation(report ReconciliationReport) {
+	lastReconciliation.mu.Lock()
+	previous := lastReconciliation.report
+	lastReconciliation.report = &report
+	lastReconciliation.mu.Unlock()
+
+	known := make(map[ReconciliationMismatch]bool)
+	if previous != nil {
+		for _, m := range previous.Mismatches {
+			known[m] = true
+		}
+	}
+	for _, m := range report.Mismatches {
+		if known[m] {
+			continue
+		}
+		reconciliationMismatches.WithLabelValues(m.Kind).Inc()
+		publishEvent(map[string]interface{}{
+			"event_type":     "reconciliation_mismatch",
+			"order_id":       m.OrderID,
+			"kind":           m.Kind,
+			"order_total":    m.OrderTotal,
+			"payment_id":     m.PaymentID,
+			"payment_status": m.PaymentStatus,
+			"payment_amount": m.PaymentAmount,
+			"timestamp":      time.Now().Unix(),
+		})
+	}
+	reconciliationOpen.Set(float64(len(report.Mismatches)))
+}
+
+// reconcileLoop reconciles on every tick until ctx is done.
+func reconcileLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report := reconcile(ctx, time.Now())
+		if ctx.Err() != nil {
+			return
+		}
+		recordReconciliation(report)
+		if report.Error != "" {
+			log.Printf("Reconciliation stopped after %d orders: %s", report.OrdersChecked, report.Error)
+		} else {
+			log.Printf("Reconciled %d orders, %d mismatches", report.OrdersChecked, len(report.Mismatches))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getReconciliationReport returns the latest reconciliation findings.
+func getReconciliationReport(w http.ResponseWriter, r *http.Request) {
+	lastReconciliation.mu.Lock()
+	report := lastReconciliation.report
+	lastReconciliation.mu.Unlock()
+
+	if report == nil {
+		http.Error(w, "No reconciliation has run yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withListedOrders points order-service's order listing at orders.
+func withListedOrders(t *testing.T, orders []listedOrder) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/orders" || r.URL.Query().Get("status") != "confirmed" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(orders)
+	}))
+	t.Cleanup(srv.Close)
+
+	old := orderServiceURL
+	orderServiceURL = srv.URL
+	t.Cleanup(func() { orderServiceURL = old })
+}
+
+func withNoReconciliation(t *testing.T) {
+	t.Helper()
+	old := lastReconciliation.report
+	lastReconciliation.report = nil
+	t.Cleanup(func() { lastReconciliation.report = old })
+}
+
+func TestReconcileFindsMismatches(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	withListedOrders(t, []listedOrder{
+		{ID: 6, TotalPrice: 10, CreatedAt: now.Add(-time.Minute)},
+		{ID: 5, TotalPrice: 20, CreatedAt: now.Add(-time.Hour)},
+		{ID: 4, TotalPrice: 30, CreatedAt: now.Add(-time.Hour)},
+		{ID: 3, TotalPrice: 40, CreatedAt: now.Add(-time.Hour)},
+		{ID: 2, TotalPrice: 50, CreatedAt: now.Add(-time.Hour)},
+		{ID: 1, TotalPrice: 60, CreatedAt: now.Add(-48 * time.Hour)},
+	})
+
+	mock.ExpectQuery("SELECT DISTINCT ON \\(order_id\\) order_id, id, status, amount FROM payments").
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "id", "status", "amount"}).
+			AddRow(5, 15, statusCompleted, 20.0).
+			AddRow(4, 14, statusCaptured, 29.99).
+			AddRow(2, 12, statusFailed, 50.0))
+
+	report := reconcile(context.Background(), now)
+	if report.Error != "" {
+		t.Fatalf("unexpected error: %s", report.Error)
+	}
+	if report.OrdersChecked != 4 {
+		t.Errorf("expected 4 orders checked, got %d", report.OrdersChecked)
+	}
+	want := map[int]string{4: mismatchAmount, 3: mismatchMissingPayment, 2: mismatchNotCompleted}
+	if len(report.Mismatches) != len(want) {
+		t.Fatalf("expected %d mismatches, got %+v", len(want), report.Mismatches)
+	}
+	for _, m := range report.Mismatches {
+		if want[m.OrderID] != m.Kind {
+			t.Errorf("order %d: expected %q, got %q", m.OrderID, want[m.OrderID], m.Kind)
+		}
+	}
+}
+
+func TestReconcileKeepsFindingsWhenOrderServiceFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	old := orderServiceURL
+	orderServiceURL = srv.URL
+	defer func() { orderServiceURL = old }()
+
+	report := reconcile(context.Background(), time.Now())
+	if report.Error == "" {
+		t.Error("expected the run to record an error")
+	}
+	if report.Mismatches == nil {
+		t.Error("expected an empty mismatch list, got nil")
+	}
+}
+
+func TestRecordReconciliationPublishesNewMismatchesOnce(t *testing.T) {
+	withNoReconciliation(t)
+	events := capturePublishedEvents(t)
+	counter := reconciliationMismatches.WithLabelValues(mismatchMissingPayment)
+	before := testutil.ToFloat64(counter)
+
+	missing := ReconciliationMismatch{OrderID: 3, Kind: mismatchMissingPayment, OrderTotal: 40}
+	recordReconciliation(ReconciliationReport{Mismatches: []ReconciliationMismatch{missing}})
+	recordReconciliation(ReconciliationReport{Mismatches: []ReconciliationMismatch{missing}})
+
+	if len(*events) != 1 || (*events)[0]["event_type"] != "reconciliation_mismatch" {
+		t.Fatalf("expected one reconciliation_mismatch event, got %v", *events)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("expected the mismatch counted once, got %v", got)
+	}
+	if got := testutil.ToFloat64(reconciliationOpen); got != 1 {
+		t.Errorf("expected 1 open mismatch, got %v", got)
+	}
+}
+
+func TestGetReconciliationReportRequiresAdminKey(t *testing.T) {
+	expectAdminOnly(t, "GET", "/reconciliation/report")
+}
+
+func TestGetReconciliationReport(t *testing.T) {
+	withNoReconciliation(t)
+
+	w := httptest.NewRecorder()
+	getReconciliationReport(w, httptest.NewRequest("GET", "/reconciliation/report", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the first run, got %d", w.Code)
+	}
+
+	capturePublishedEvents(t)
+	recordReconciliation(ReconciliationReport{OrdersChecked: 7, Mismatches: []ReconciliationMismatch{}})
+	w = httptest.NewRecorder()
+	getReconciliationReport(w, httptest.NewRequest("GET", "/reconciliation/report", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var report ReconciliationReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.OrdersChecked != 7 {
+		t.Errorf("expected 7 orders checked, got %d", report.OrdersChecked)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Refund reverses all or part of a captured payment.
+type Refund struct {
+	ID        int       `json:"id"`
+	PaymentID int       `json:"payment_id"`
+	OrderID   int       `json:"order_id"`
+	Amount    float64   `json:"amount"`
+	Currency  string    `json:"currency"`
+	Remaining float64   `json:"remaining"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PaymentDetail is the body of GET /payments/{id}: the payment with the
+// refunds taken from it and what is left.
+type PaymentDetail struct {
+	Payment
+	RefundedAmount float64  `json:"refunded_amount"`
+	Remaining      float64  `json:"remaining"`
+	Refunds        []Refund `json:"refunds"`
+}
+
+// RefundRequest is the body of POST /payments/{id}/refund. A missing
+// amount refunds whatever is left of the payment.
+type RefundRequest struct {
+	Amount *float64 `json:"amount"`
+}
+
+// toCents converts a DECIMAL(10, 2) amount to cents so refund totals are
+// compared without float drift.
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// Refund statuses. A refund is pending from when its amount is reserved
+// until the gateway accepts or declines it.
+const (
+	refundPending   = "pending"
+	refundCompleted = "completed"
+	refundFailed    = "failed"
+)
+
+// errRefundNotPending is returned by completeRefund and failRefund for a
+// refund that has already been settled.
+var errRefundNotPending = errors.New("refund is not pending")
+
+// refundKey is the gateway idempotency key for a refund, so one resent
+// after an unknown outcome isn't paid out twice.
+func refundKey(refundID int) string { return "refund-" + strconv.Itoa(refundID) }
+
+// refundPayment refunds all or part of a captured payment through the
+// gateway. The refund is first written as pending and its amount added to
+// the payment's refunded_amount, with the payment row locked, so
+// concurrent refunds can't together exceed the original amount. The
+// gateway is asked after that commit: a refund it accepts is completed,
+// one it declines is failed and its amount released, and one whose
+// outcome is unknown stays pending, answered with 202, until
+// resendPendingRefunds settles it. Once nothing is left the payment moves
+// to "refunded" and further attempts return 409.
+func refundPayment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Amount != nil && toCents(*req.Amount) <= 0 {
+		http.Error(w, "amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	p, gatewayRef, err := lockPayment(r.Context(), tx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Status == statusRefunded {
+		http.Error(w, "Payment already refunded", http.StatusConflict)
+		return
+	}
+	if p.Status != statusCaptured {
+		http.Error(w, "Only captured payments can be refunded", http.StatusConflict)
+		return
+	}
+
+	var refunded float64
+	if err := tx.QueryRowContext(r.Context(),
+		"SELECT refunded_amount FROM payments WHERE id = $1", p.ID,
+	).Scan(&refunded); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	remaining := toCents(p.Amount) - toCents(refunded)
+	amount := remaining
+	if req.Amount != nil {
+		amount = toCents(*req.Amount)
+	}
+	if amount > remaining {
+		http.Error(w, fmt.Sprintf("Refund exceeds the remaining refundable amount of %.2f %s", float64(remaining)/100, p.Currency), http.StatusConflict)
+		return
+	}
+
+	refund := Refund{PaymentID: p.ID, OrderID: p.OrderID, Amount: float64(amount) / 100, Currency: p.Currency, Status: refundPending}
+	if err := tx.QueryRowContext(r.Context(),
+		"INSERT INTO refunds (payment_id, amount, status) VALUES ($1, $2, $3) RETURNING id, created_at",
+		p.ID, refund.Amount, refundPending,
+	).Scan(&refund.ID, &refund.CreatedAt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(),
+		"UPDATE payments SET refunded_amount = refunded_amount + $2 WHERE id = $1",
+		p.ID, refund.Amount,
+	); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refund.Remaining = float64(remaining-amount) / 100
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = sendRefund(r.Context(), gatewayRef, refund)
+	if isDeclined(err) {
+		if err := failRefund(r.Context(), refund.ID); err != nil {
+			log.Printf("Failed to release declined refund %d of payment %d: %v", refund.ID, refund.PaymentID, err)
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	status := http.StatusCreated
+	if err == nil {
+		var completed Refund
+		if completed, err = completeRefund(r.Context(), refund.ID); err == nil {
+			refund = completed
+			log.Printf("Refunded %.2f of payment %d (order %d)", refund.Amount, refund.PaymentID, refund.OrderID)
+		}
+	}
+	if err != nil {
+		log.Printf("Refund %d of payment %d left pending: %v", refund.ID, refund.PaymentID, err)
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(refund)
+}
+
+// sendRefund asks the gateway to pay refund back from the authorization
+// gatewayRef, under the refund's own idempotency key.
+func sendRefund(ctx context.Context, gatewayRef string, refund Refund) error {
+	ctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	return observeGateway("refund", func() error {
+		return gateway.Refund(ctx, gatewayRef, refund.Amount, refundKey(refund.ID))
+	})
+}
+
+// completeRefund marks a pending refund the gateway accepted as
+// completed and queues payment_refunded for it. The payment moves to
+// "refunded" once its completed refunds add up to the whole amount.
+func completeRefund(ctx context.Context, refundID int) (Refund, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Refund{}, err
+	}
+	defer tx.Rollback()
+
+	refund := Refund{ID: refundID, Status: refundCompleted}
+	err = tx.QueryRowContext(ctx,
+		"UPDATE refunds SET status = $2 WHERE id = $1 AND status = $3 RETURNING payment_id, amount, created_at",
+		refundID, refundCompleted, refundPending,
+	).Scan(&refund.PaymentID, &refund.Amount, &refund.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Refund{}, errRefundNotPending
+	}
+	if err != nil {
+		return Refund{}, err
+	}
+
+	p, _, err := lockPayment(ctx, tx, strconv.Itoa(refund.PaymentID))
+	if err != nil {
+		return Refund{}, err
+	}
+	refund.OrderID, refund.Currency = p.OrderID, p.Currency
+
+	var completed float64
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = $1 AND status = $2", p.ID, refundCompleted,
+	).Scan(&completed); err != nil {
+		return Refund{}, err
+	}
+	remaining := toCents(p.Amount) - toCents(completed)
+	refund.Remaining = float64(remaining) / 100
+
+	if remaining <= 0 && p.Status == statusCaptured {
+		if err := transitionPayment(ctx, tx, &p, statusRefunded); err != nil {
+			return Refund{}, err
+		}
+	}
+	if err := enqueueEvent(ctx, tx, map[string]interface{}{
+		"event_type": "payment_refunded",
+		"refund_id":  refund.ID,
+		"payment_id": refund.PaymentID,
+		"order_id":   refund.OrderID,
+		"amount":     refund.Amount,
+		"currency":   refund.Currency,
+		"remaining":  refund.Remaining,
+		"full":       remaining <= 0,
+		"timestamp":  time.Now().Unix(),
+	}); err != nil {
+		return Refund{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Refund{}, err
+	}
+	kickOutboxRelay()
+	return refund, nil
+}
+
+// failRefund marks a pending refund the gateway declined as failed and
+// takes its amount back off the payment's refunded_amount.
+func failRefund(ctx context.Context, refundID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var paymentID int
+	var amount float64
+	err = tx.QueryRowContext(ctx,
+		"UPDATE refunds SET status = $2 WHERE id = $1 AND status = $3 RETURNING payment_id, amount",
+		refundID, refundFailed, refundPending,
+	).Scan(&paymentID, &amount)
+	if err == sql.ErrNoRows {
+		return errRefundNotPending
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE payments SET refunded_amount = refunded_amount - $2 WHERE id = $1",
+		paymentID, amount,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resendPendingRefunds resends up to a batch of refunds that have been
+// pending for longer than olderThan, under the same idempotency keys, and
+// settles them on the gateway's answer. It returns how many it settled.
+func resendPendingRefunds(ctx context.Context, olderThan time.Duration) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT r.id, r.payment_id, r.amount, COALESCE(p.gateway_ref, '')
+		FROM refunds r JOIN payments p ON p.id = r.payment_id
+		WHERE r.status = $1 AND r.created_at < $2 ORDER BY r.id LIMIT $3`,
+		refundPending, time.Now().Add(-olderThan), pendingSweepBatch)
+	if err != nil {
+		return 0, err
+	}
+	type pendingRefund struct {
+		refund     Refund
+		gatewayRef string
+	}
+	var pending []pendingRefund
+	for rows.Next() {
+		var pr pendingRefund
+		if err := rows.Scan(&pr.refund.ID, &pr.refund.PaymentID, &pr.refund.Amount, &pr.gatewayRef); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, pr)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for _, pr := range pending {
+		err := sendRefund(ctx, pr.gatewayRef, pr.refund)
+		switch {
+		case isDeclined(err):
+			err = failRefund(ctx, pr.refund.ID)
+		case err == nil:
+			_, err = completeRefund(ctx, pr.refund.ID)
+		}
+		switch {
+		case errors.Is(err, errRefundNotPending):
+		case err != nil:
+			log.Printf("Refund %d of payment %d still pending: %v", pr.refund.ID, pr.refund.PaymentID, err)
+		default:
+			settled++
+		}
+	}
+	return settled, nil
+}
+
+// loadRefunds returns p's refunds, oldest first, each with what was left
+// of p after it.
+func loadRefunds(ctx context.Context, p Payment) ([]Refund, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, amount, status, created_at FROM refunds WHERE payment_id = $1 ORDER BY id", p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	remaining := toCents(p.Amount)
+	for rows.Next() {
+		refund := Refund{PaymentID: p.ID, OrderID: p.OrderID, Currency: p.Currency}
+		if err := rows.Scan(&refund.ID, &refund.Amount, &refund.Status, &refund.CreatedAt); err != nil {
+			return nil, err
+		}
+		if refund.Status != refundFailed {
+			remaining -= toCents(refund.Amount)
+		}
+		refund.Remaining = float64(remaining) / 100
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
+}
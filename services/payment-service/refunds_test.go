@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// capturePublishedEvents replaces publishEvent for the duration of a test
+// and returns the events published through it.
+func capturePublishedEvents(t *testing.T) *[]map[string]interface{} {
+	t.Helper()
+	events := &[]map[string]interface{}{}
+	old := publishEvent
+	publishEvent = func(event map[string]interface{}) { *events = append(*events, event) }
+	t.Cleanup(func() { publishEvent = old })
+	return events
+}
+
+func serveRefund(body string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}/refund", refundPayment).Methods("POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/payments/7/refund", strings.NewReader(body)))
+	return w
+}
+
+func expectLockedPayment(mock sqlmock.Sqlmock, amount float64, status string) {
+	mock.ExpectBegin()
+	expectPaymentLock(mock, amount, status)
+}
+
+// expectPaymentLock expects payment 7 to be locked in a transaction
+// already begun.
+func expectPaymentLock(mock sqlmock.Sqlmock, amount float64, status string) {
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE id = \\$1 FOR UPDATE").
+		WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of", "gateway_ref"}).
+			AddRow(7, 42, amount, "EUR", status, "card", time.Now(), 0, "auth_7"))
+}
+
+func expectRefundedAmount(mock sqlmock.Sqlmock, refunded float64) {
+	mock.ExpectQuery("SELECT refunded_amount FROM payments WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"refunded_amount"}).AddRow(refunded))
+}
+
+// expectReservedRefund expects refund 3 of amount to be written as
+// pending against payment 7 and committed.
+func expectReservedRefund(mock sqlmock.Sqlmock, amount float64) {
+	mock.ExpectQuery("INSERT INTO refunds").
+		WithArgs(7, amount, "pending").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+	mock.ExpectExec("UPDATE payments SET refunded_amount = refunded_amount \\+ \\$2 WHERE id = \\$1").
+		WithArgs(7, amount).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// expectCompletedRefund expects refund 3 of amount to be completed, with
+// completed refunds of payment 7 then adding up to completed.
+func expectCompletedRefund(mock sqlmock.Sqlmock, events *[]map[string]interface{}, amount, completed float64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE refunds SET status = \\$2 WHERE id = \\$1 AND status = \\$3").
+		WithArgs(3, "completed", "pending").
+		WillReturnRows(sqlmock.NewRows([]string{"payment_id", "amount", "created_at"}).AddRow(7, amount, time.Now()))
+	expectPaymentLock(mock, 30, "captured")
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(amount\\), 0\\) FROM refunds").
+		WithArgs(7, "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(completed))
+	if completed == 30 {
+		expectTransition(mock, &[]map[string]interface{}{}, 7, "captured", "refunded")
+	}
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs("payment_refunded", outboxPayload{events}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestRefundPayment(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		refunded      float64
+		wantAmount    float64
+		wantRemaining float64
+	}{
+		{name: "full refund by default", body: "", refunded: 0, wantAmount: 30, wantRemaining: 0},
+		{name: "partial refund", body: `{"amount": 10.10}`, refunded: 0, wantAmount: 10.10, wantRemaining: 19.90},
+		{name: "last part of a partially refunded payment", body: `{"amount": 19.90}`, refunded: 10.10, wantAmount: 19.90, wantRemaining: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			events := capturePublishedEvents(t)
+
+			expectLockedPayment(mock, 30, "completed")
+			expectRefundedAmount(mock, tt.refunded)
+			expectReservedRefund(mock, tt.wantAmount)
+			expectCompletedRefund(mock, events, tt.wantAmount, tt.refunded+tt.wantAmount)
+
+			w := serveRefund(tt.body)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+			}
+			var refund Refund
+			json.NewDecoder(w.Body).Decode(&refund)
+			if refund.Amount != tt.wantAmount || refund.Remaining != tt.wantRemaining || refund.Currency != "EUR" || refund.Status != "completed" {
+				t.Errorf("expected amount %.2f remaining %.2f in EUR, got %+v", tt.wantAmount, tt.wantRemaining, refund)
+			}
+			if len(*events) != 1 || (*events)[0]["event_type"] != "payment_refunded" {
+				t.Fatalf("expected one payment_refunded event, got %v", *events)
+			}
+		})
+	}
+}
+
+func TestRefundPaymentRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		status     string
+		refunded   float64
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "already refunded", status: "refunded", wantStatus: http.StatusConflict},
+		{name: "not completed", status: "failed", wantStatus: http.StatusConflict},
+		{name: "exceeds remaining", body: `{"amount": 25}`, status: "captured", refunded: 10, wantStatus: http.StatusConflict, wantBody: "20.00 EUR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			events := capturePublishedEvents(t)
+
+			expectLockedPayment(mock, 30, tt.status)
+			if tt.status == "captured" {
+				expectRefundedAmount(mock, tt.refunded)
+			}
+			mock.ExpectRollback()
+
+			w := serveRefund(tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("expected the response to mention %q, got %q", tt.wantBody, w.Body.String())
+			}
+			if len(*events) != 0 {
+				t.Errorf("expected no events, got %v", *events)
+			}
+		})
+	}
+}
+
+func TestRefundPaymentRequiresAdminKey(t *testing.T) {
+	expectAdminOnly(t, "POST", "/payments/7/refund")
+}
+
+func TestRefundPaymentInvalidAmount(t *testing.T) {
+	withMockDB(t)
+	w := serveRefund(`{"amount": -5}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestGetPaymentIncludesRefunds(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE id = \\$1").
+		WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "amount", "currency", "status", "payment_method", "created_at", "retry_of", "refunded_amount"}).
+			AddRow(7, 42, 30.0, "EUR", "captured", "card", time.Now(), 0, 15.0))
+	mock.ExpectQuery("SELECT id, amount, status, created_at FROM refunds WHERE payment_id = \\$1 ORDER BY id").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "amount", "status", "created_at"}).
+			AddRow(1, 10.0, "completed", time.Now()).
+			AddRow(2, 8.0, "failed", time.Now()).
+			AddRow(3, 5.0, "completed", time.Now()))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}", getPayment).Methods("GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/payments/7", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var p PaymentDetail
+	json.NewDecoder(w.Body).Decode(&p)
+	if p.RefundedAmount != 15 || p.Remaining != 15 {
+		t.Errorf("expected 15 refunded and 15 remaining, got %+v", p)
+	}
+	if len(p.Refunds) != 3 || p.Refunds[0].Remaining != 20 || p.Refunds[1].Remaining != 20 || p.Refunds[2].Remaining != 15 || p.Refunds[2].Currency != "EUR" {
+		t.Errorf("unexpected refunds %+v", p.Refunds)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// retryPayment charges a failed payment's order again without waiting
+// for the order event to be republished. The attempt is saved as a new
+// payment with retry_of pointing at the failed one, so the failure stays
+// on record.
+//
+// Every payment for the order is locked while the gateway is asked, so
+// concurrent retries queue up, and an order that already has a payment
+// that didn't fail returns 409 rather than being charged twice. Each
+// attempt has its own idempotency key, numbered by the payments the
+// order already has, so the gateway doesn't replay an earlier decline.
+func retryPayment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	failed, _, err := lockPayment(r.Context(), tx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if failed.Status != statusFailed {
+		http.Error(w, "Only failed payments can be retried", http.StatusConflict)
+		return
+	}
+
+	rows, err := tx.QueryContext(r.Context(),
+		"SELECT status FROM payments WHERE order_id = $1 ORDER BY id FOR UPDATE", failed.OrderID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settled, attempts := false, 0
+	for rows.Next() {
+		attempts++
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		settled = settled || status != statusFailed
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if settled {
+		http.Error(w, "Order already has a payment that didn't fail", http.StatusConflict)
+		return
+	}
+
+	status, gatewayRef, chargeErr := chargeOrder(failed.OrderID, failed.Amount, retryChargeKey(failed.OrderID, attempts+1))
+	if chargeErr != nil {
+		log.Printf("Retry of payment %d is %s: %v", failed.ID, status, chargeErr)
+	}
+
+	p := Payment{
+		OrderID:       failed.OrderID,
+		Amount:        failed.Amount,
+		Currency:      failed.Currency,
+		Status:        status,
+		PaymentMethod: failed.PaymentMethod,
+		RetryOf:       failed.ID,
+	}
+	if err := tx.QueryRowContext(r.Context(),
+		`INSERT INTO payments (order_id, amount, status, gateway_ref, payment_method, currency, retry_of)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7) RETURNING id, created_at`,
+		p.OrderID, p.Amount, p.Status, gatewayRef, p.PaymentMethod, p.Currency, p.RetryOf,
+	).Scan(&p.ID, &p.CreatedAt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	from := ""
+	for _, to := range initialTransitions(status) {
+		if err := recordTransition(r.Context(), tx, p.ID, from, to); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		from = to
+	}
+	if err := enqueueEvent(r.Context(), tx, map[string]interface{}{
+		"event_type":     "payment_processed",
+		"payment_id":     p.ID,
+		"order_id":       p.OrderID,
+		"amount":         p.Amount,
+		"currency":       p.Currency,
+		"status":         p.Status,
+		"payment_method": p.PaymentMethod,
+		"retry_of":       p.RetryOf,
+		"timestamp":      time.Now().Unix(),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kickOutboxRelay()
+	paymentsProcessed.WithLabelValues(processedLabel(status), p.PaymentMethod).Inc()
+	observePaymentAmount(status, p.Currency, p.Amount)
+	log.Printf("Retried payment %d as payment %d, status: %s", failed.ID, p.ID, p.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func serveRetry() *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id:[0-9]+}/retry", retryPayment).Methods("POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/payments/7/retry", nil))
+	return w
+}
+
+func expectOrderPayments(mock sqlmock.Sqlmock, statuses ...string) {
+	rows := sqlmock.NewRows([]string{"status"})
+	for _, s := range statuses {
+		rows.AddRow(s)
+	}
+	mock.ExpectQuery("SELECT status FROM payments WHERE order_id = \\$1 ORDER BY id FOR UPDATE").
+		WithArgs(42).
+		WillReturnRows(rows)
+}
+
+func TestRetryPayment(t *testing.T) {
+	mock := withMockDB(t)
+	withGateway(t, mockGateway{})
+	events := &[]map[string]interface{}{}
+
+	expectLockedPayment(mock, 30, "failed")
+	expectOrderPayments(mock, "failed")
+	mock.ExpectQuery("INSERT INTO payments").
+		WithArgs(42, 30.0, "captured", "mock-auth-42", "card", "EUR", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, time.Now()))
+	mock.ExpectExec("INSERT INTO payment_events").WithArgs(8, "", "authorized").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO payment_events").WithArgs(8, "authorized", "captured").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs("payment_processed", outboxPayload{events}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	w := serveRetry()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var p Payment
+	json.NewDecoder(w.Body).Decode(&p)
+	if p.ID != 8 || p.RetryOf != 7 || p.Status != "captured" {
+		t.Errorf("expected payment 8 retrying 7 to be captured, got %+v", p)
+	}
+	if len(*events) != 1 || (*events)[0]["retry_of"] != float64(7) {
+		t.Errorf("expected a payment_processed event for the retry, got %v", *events)
+	}
+}
+
+func TestRetryPaymentSendsNewIdempotencyKey(t *testing.T) {
+	mock := withMockDB(t)
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/authorizations" {
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			json.NewEncoder(w).Encode(map[string]string{"id": "auth_2"})
+		}
+	}))
+	defer srv.Close()
+	withGateway(t, newHTTPGateway(srv.URL, "", time.Second))
+	capturePublishedEvents(t)
+
+	expectLockedPayment(mock, 30, "failed")
+	expectOrderPayments(mock, "failed")
+	mock.ExpectQuery("INSERT INTO payments").
+		WithArgs(42, 30.0, "captured", "auth_2", "card", "EUR", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, time.Now()))
+	mock.ExpectExec("INSERT INTO payment_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO payment_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO event_outbox").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if w := serveRetry(); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(keys) != 1 || keys[0] == chargeKey(42) || keys[0] != "order-42-attempt-2" {
+		t.Errorf("expected the retry to send idempotency key order-42-attempt-2, not the original %s; got %v", chargeKey(42), keys)
+	}
+}
+
+func TestRetryPaymentRequiresAdminKey(t *testing.T) {
+	expectAdminOnly(t, "POST", "/payments/7/retry")
+}
+
+func TestRetryPaymentConflicts(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string
+		orderPayments []string
+	}{
+		{name: "not failed", status: "captured"},
+		{name: "already retried", status: "failed", orderPayments: []string{"failed", "captured"}},
+		{name: "retry pending", status: "failed", orderPayments: []string{"failed", "pending"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			// Any charge would fail the test on the unexpected insert.
+			withGateway(t, mockGateway{})
+
+			expectLockedPayment(mock, 30, tt.status)
+			if tt.orderPayments != nil {
+				expectOrderPayments(mock, tt.orderPayments...)
+			}
+			mock.ExpectRollback()
+
+			if w := serveRetry(); w.Code != http.StatusConflict {
+				t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	// inFlight tracks running consumers. A consumer returns only once its
+	// workers have stopped, so once it has nothing is mid-payment.
+	inFlight sync.WaitGroup
+	// shutdownDrainTimeout bounds how long shutdown waits for them.
+	shutdownDrainTimeout = loadDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second)
+	// consumerRestartDelay is how long a panicked consumer waits before
+	// starting again.
+	consumerRestartDelay = time.Second
+)
+
+// startConsumer runs consumeMessages in the background, tracked by
+// inFlight and reported to consumerHealth. A consumer that panics is
+// restarted rather than left dead.
+func startConsumer(ctx context.Context, reader messageFetcher) {
+	inFlight.Add(1)
+	go func() {
+		defer inFlight.Done()
+		for consumeRecovering(ctx, reader) {
+			consumerRestarts.Inc()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(consumerRestartDelay):
+			}
+		}
+	}()
+}
+
+// consumeRecovering runs consumeMessages and reports whether it panicked.
+func consumeRecovering(ctx context.Context, reader messageFetcher) (panicked bool) {
+	consumerHealth.setRunning(true, time.Now())
+	defer consumerHealth.setRunning(false, time.Now())
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Consumer panicked, restarting: %v\n%s", p, debug.Stack())
+			panicked = true
+		}
+	}()
+	consumeMessages(ctx, reader)
+	return false
+}
+
+// cancelOnSignal cancels ctx the first time one of sigs arrives, which
+// stops the consumer fetching new messages.
+func cancelOnSignal(cancel context.CancelFunc, sigs ...os.Signal) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sigs...)
+
+	go func() {
+		<-sigChan
+		signal.Stop(sigChan)
+		log.Println("Shutting down gracefully...")
+		cancel()
+	}()
+}
+
+// drainInFlight waits up to timeout for consumers to finish their
+// current message and stop, and reports whether they did.
+func drainInFlight(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
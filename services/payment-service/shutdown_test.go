@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+// signallingGateway reports when a charge starts, then takes delay.
+type signallingGateway struct {
+	mockGateway
+	started chan struct{}
+}
+
+func (g signallingGateway) Authorize(ctx context.Context, orderID int, amount float64, idempotencyKey string) (string, error) {
+	close(g.started)
+	return g.mockGateway.Authorize(ctx, orderID, amount, idempotencyKey)
+}
+
+func TestShutdownWaitsForInFlightPayment(t *testing.T) {
+	mock := withMockDB(t)
+	withFastRetries(t, 1)
+	events := capturePublishedEvents(t)
+	started := make(chan struct{})
+	withGateway(t, signallingGateway{mockGateway{delay: 200 * time.Millisecond}, started})
+
+	expectPaymentSaved(mock, events, 42, 19.99, "captured", sqlmock.AnyArg(), "card", "USD")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelOnSignal(cancel, syscall.SIGUSR1)
+
+	fetcher := &fakeFetcher{queue: []kafka.Message{orderCreatedMessage(42, 19.99)}}
+	startConsumer(ctx, fetcher)
+
+	<-started
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !drainInFlight(2 * time.Second) {
+		t.Fatal("in-flight payment did not finish")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("expected the signal to cancel the consumer")
+	}
+	if len(*events) != 1 || (*events)[0]["event_type"] != "payment_processed" {
+		t.Errorf("expected the payment_processed event to be written, got %v", *events)
+	}
+	if len(fetcher.committed) != 1 {
+		t.Errorf("expected the message to be committed, got %d commits", len(fetcher.committed))
+	}
+}
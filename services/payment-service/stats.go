@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStatsDays bounds the range GET /payments/stats will aggregate.
+	maxStatsDays     = 90
+	defaultStatsDays = 30
+)
+
+var (
+	statsCacheTTL = loadDuration("STATS_CACHE_TTL", 30*time.Second)
+	statsCache    = newStatsResponseCache()
+)
+
+// PaymentStatsRow is one group of payments: a day's, or the whole
+// range's, payments with one status and currency. Amounts in different
+// currencies are never added together.
+type PaymentStatsRow struct {
+	Date          string  `json:"date,omitempty"`
+	Status        string  `json:"status,omitempty"`
+	PaymentMethod string  `json:"payment_method,omitempty"`
+	Currency      string  `json:"currency"`
+	Count         int     `json:"count"`
+	Amount        float64 `json:"amount"`
+}
+
+// PaymentStats is the body of GET /payments/stats. From and To are the
+// first and last days covered.
+type PaymentStats struct {
+	From     string            `json:"from"`
+	To       string            `json:"to"`
+	GroupBy  string            `json:"group_by,omitempty"`
+	Days     []PaymentStatsRow `json:"days"`
+	ByStatus []PaymentStatsRow `json:"by_status"`
+	Totals   []PaymentStatsRow `json:"totals"`
+}
+
+// statsQuery is a parsed GET /payments/stats request: days [From, To)
+// in UTC, optionally also grouped by payment method.
+type statsQuery struct {
+	From, To time.Time
+	ByMethod bool
+}
+
+func (q statsQuery) key() string {
+	return fmt.Sprintf("%s|%s|%t", q.From.Format("2006-01-02"), q.To.Format("2006-01-02"), q.ByMethod)
+}
+
+// parseStatsQuery reads ?from= and ?to= (inclusive YYYY-MM-DD dates,
+// defaulting to the last 30 days) and ?group_by=payment_method.
+func parseStatsQuery(query url.Values, now time.Time) (statsQuery, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	q := statsQuery{To: today.AddDate(0, 0, 1)}
+
+	if raw := query.Get("to"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return q, errors.New("to must be a YYYY-MM-DD date")
+		}
+		q.To = t.AddDate(0, 0, 1)
+	}
+	q.From = q.To.AddDate(0, 0, -defaultStatsDays)
+	if raw := query.Get("from"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return q, errors.New("from must be a YYYY-MM-DD date")
+		}
+		q.From = t
+	}
+	if !q.From.Before(q.To) {
+		return q, errors.New("to must not be before from")
+	}
+	if q.To.Sub(q.From) > maxStatsDays*24*time.Hour {
+		return q, fmt.Errorf("date range must be at most %d days", maxStatsDays)
+	}
+
+	switch groupBy := query.Get("group_by"); groupBy {
+	case "":
+	case "payment_method":
+		q.ByMethod = true
+	default:
+		return q, errors.New("group_by must be payment_method")
+	}
+	return q, nil
+}
+
+// getPaymentStats returns payment counts and amounts per day and status,
+// with per-status and overall totals, for finance dashboards.
+func getPaymentStats(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStatsQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, ok := statsCache.get(q.key(), time.Now())
+	if !ok {
+		stats, err = loadPaymentStats(r, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statsCache.set(q.key(), stats, time.Now().Add(statsCacheTTL))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func loadPaymentStats(r *http.Request, q statsQuery) (PaymentStats, error) {
+	method := "''"
+	if q.ByMethod {
+		method = "payment_method"
+	}
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT date_trunc('day', created_at) AS day, status, `+method+`, currency, COUNT(*), COALESCE(SUM(amount), 0)
+		FROM payments
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY 1, 2, 3, 4
+		ORDER BY 1, 2, 3, 4`,
+		q.From, q.To)
+	if err != nil {
+		return PaymentStats{}, err
+	}
+	defer rows.Close()
+
+	stats := PaymentStats{
+		From: q.From.Format("2006-01-02"),
+		To:   q.To.AddDate(0, 0, -1).Format("2006-01-02"),
+	}
+	if q.ByMethod {
+		stats.GroupBy = "payment_method"
+	}
+
+	// Legacy "completed" rows are reported as captured, so groups are
+	// merged in cents rather than taken straight from the query.
+	type group struct {
+		row   PaymentStatsRow
+		cents int64
+	}
+	days := map[string]*group{}
+	byStatus := map[string]*group{}
+	totals := map[string]*group{}
+	add := func(groups map[string]*group, row PaymentStatsRow, cents int64) {
+		key := strings.Join([]string{row.Date, row.Status, row.PaymentMethod, row.Currency}, "|")
+		g, ok := groups[key]
+		if !ok {
+			g = &group{row: row}
+			g.row.Count = 0
+			groups[key] = g
+		}
+		g.row.Count += row.Count
+		g.cents += cents
+	}
+
+	for rows.Next() {
+		var day time.Time
+		var row PaymentStatsRow
+		var amount float64
+		if err := rows.Scan(&day, &row.Status, &row.PaymentMethod, &row.Currency, &row.Count, &amount); err != nil {
+			return PaymentStats{}, err
+		}
+		row.Status = normalizeStatus(row.Status)
+		row.Date = day.Format("2006-01-02")
+		cents := toCents(amount)
+
+		add(days, row, cents)
+		add(byStatus, PaymentStatsRow{Status: row.Status, PaymentMethod: row.PaymentMethod, Currency: row.Currency, Count: row.Count}, cents)
+		add(totals, PaymentStatsRow{Currency: row.Currency, Count: row.Count}, cents)
+	}
+	if err := rows.Err(); err != nil {
+		return PaymentStats{}, err
+	}
+
+	flatten := func(groups map[string]*group) []PaymentStatsRow {
+		out := make([]PaymentStatsRow, 0, len(groups))
+		for _, g := range groups {
+			g.row.Amount = float64(g.cents) / 100
+			out = append(out, g.row)
+		}
+		sort.Slice(out, func(i, j int) bool {
+			a, b := out[i], out[j]
+			if a.Date != b.Date {
+				return a.Date < b.Date
+			}
+			if a.Status != b.Status {
+				return a.Status < b.Status
+			}
+			if a.PaymentMethod != b.PaymentMethod {
+				return a.PaymentMethod < b.PaymentMethod
+			}
+			return a.Currency < b.Currency
+		})
+		return out
+	}
+	stats.Days = flatten(days)
+	stats.ByStatus = flatten(byStatus)
+	stats.Totals = flatten(totals)
+	return stats, nil
+}
+
+// statsResponseCache keeps recent GET /payments/stats results briefly,
+// since dashboards poll the same ranges. It is per replica.
+type statsResponseCache struct {
+	mu      sync.Mutex
+	entries map[string]statsCacheEntry
+}
+
+type statsCacheEntry struct {
+	stats     PaymentStats
+	expiresAt time.Time
+}
+
+func newStatsResponseCache() *statsResponseCache {
+	return &statsResponseCache{entries: make(map[string]statsCacheEntry)}
+}
+
+func (c *statsResponseCache) get(key string, now time.Time) (PaymentStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		return PaymentStats{}, false
+	}
+	return e.stats, true
+}
+
+// set stores stats until expiresAt, dropping entries that have expired.
+func (c *statsResponseCache) set(key string, stats PaymentStats, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = statsCacheEntry{stats: stats, expiresAt: expiresAt}
+}
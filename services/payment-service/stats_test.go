@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func withEmptyStatsCache(t *testing.T) {
+	t.Helper()
+	old := statsCache
+	statsCache = newStatsResponseCache()
+	t.Cleanup(func() { statsCache = old })
+}
+
+func statsRows() *sqlmock.Rows {
+	day1 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	return sqlmock.NewRows([]string{"day", "status", "payment_method", "currency", "count", "sum"}).
+		AddRow(day1, "captured", "", "USD", 2, 30.10).
+		AddRow(day1, "completed", "", "USD", 1, 9.90).
+		AddRow(day1, "failed", "", "EUR", 1, 5.00).
+		AddRow(day2, "captured", "", "USD", 1, 20.00)
+}
+
+func TestGetPaymentStats(t *testing.T) {
+	mock := withMockDB(t)
+	withEmptyStatsCache(t)
+
+	mock.ExpectQuery("SELECT date_trunc\\('day', created_at\\) AS day, status, '', currency").
+		WithArgs(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)).
+		WillReturnRows(statsRows())
+
+	get := func() PaymentStats {
+		w := httptest.NewRecorder()
+		getPaymentStats(w, httptest.NewRequest("GET", "/payments/stats?from=2024-05-01&to=2024-05-02", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var stats PaymentStats
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := get()
+	if stats.From != "2024-05-01" || stats.To != "2024-05-02" {
+		t.Errorf("unexpected range %s to %s", stats.From, stats.To)
+	}
+	wantDays := []PaymentStatsRow{
+		{Date: "2024-05-01", Status: "captured", Currency: "USD", Count: 3, Amount: 40},
+		{Date: "2024-05-01", Status: "failed", Currency: "EUR", Count: 1, Amount: 5},
+		{Date: "2024-05-02", Status: "captured", Currency: "USD", Count: 1, Amount: 20},
+	}
+	if len(stats.Days) != len(wantDays) {
+		t.Fatalf("expected %d day rows, got %+v", len(wantDays), stats.Days)
+	}
+	for i, want := range wantDays {
+		if stats.Days[i] != want {
+			t.Errorf("day row %d: expected %+v, got %+v", i, want, stats.Days[i])
+		}
+	}
+	wantTotals := []PaymentStatsRow{
+		{Currency: "EUR", Count: 1, Amount: 5},
+		{Currency: "USD", Count: 4, Amount: 60},
+	}
+	if len(stats.Totals) != 2 || stats.Totals[0] != wantTotals[0] || stats.Totals[1] != wantTotals[1] {
+		t.Errorf("expected totals %+v, got %+v", wantTotals, stats.Totals)
+	}
+	if len(stats.ByStatus) != 2 || stats.ByStatus[0].Status != "captured" || stats.ByStatus[0].Count != 4 {
+		t.Errorf("unexpected by_status %+v", stats.ByStatus)
+	}
+
+	// A second request within the TTL is served from the cache; sqlmock
+	// fails the test if it queries again.
+	if again := get(); len(again.Days) != 3 {
+		t.Errorf("expected the cached stats, got %+v", again)
+	}
+}
+
+func TestGetPaymentStatsByPaymentMethod(t *testing.T) {
+	mock := withMockDB(t)
+	withEmptyStatsCache(t)
+
+	mock.ExpectQuery("SELECT date_trunc\\('day', created_at\\) AS day, status, payment_method, currency").
+		WillReturnRows(sqlmock.NewRows([]string{"day", "status", "payment_method", "currency", "count", "sum"}).
+			AddRow(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), "captured", "card", "USD", 2, 30.0).
+			AddRow(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), "captured", "wallet", "USD", 1, 5.0))
+
+	w := httptest.NewRecorder()
+	getPaymentStats(w, httptest.NewRequest("GET", "/payments/stats?from=2024-05-01&to=2024-05-01&group_by=payment_method", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var stats PaymentStats
+	json.NewDecoder(w.Body).Decode(&stats)
+	if stats.GroupBy != "payment_method" || len(stats.ByStatus) != 2 ||
+		stats.ByStatus[0].PaymentMethod != "card" || stats.ByStatus[1].PaymentMethod != "wallet" {
+		t.Errorf("expected by_status split by payment method, got %+v", stats)
+	}
+	if len(stats.Totals) != 1 || stats.Totals[0].Count != 3 || stats.Totals[0].Amount != 35 {
+		t.Errorf("unexpected totals %+v", stats.Totals)
+	}
+}
+
+func TestParseStatsQuery(t *testing.T) {
+	now := time.Date(2024, 5, 31, 15, 0, 0, 0, time.UTC)
+
+	q, err := parseStatsQuery(url.Values{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.From.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) || !q.To.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the last 30 days by default, got %s to %s", q.From, q.To)
+	}
+
+	for name, raw := range map[string]string{
+		"bad from":      "from=yesterday",
+		"bad to":        "to=2024/05/01",
+		"reversed":      "from=2024-05-02&to=2024-05-01",
+		"too long":      "from=2024-01-01&to=2024-05-01",
+		"unknown group": "group_by=currency",
+	} {
+		query, _ := url.ParseQuery(raw)
+		if _, err := parseStatsQuery(query, now); err == nil {
+			t.Errorf("%s: expected an error for %q", name, raw)
+		}
+	}
+
+	query, _ := url.ParseQuery("from=2024-03-03&to=2024-05-31")
+	if _, err := parseStatsQuery(query, now); err != nil {
+		t.Errorf("expected a 90 day range to be accepted, got %v", err)
+	}
+}
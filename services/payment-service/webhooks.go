@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var webhookDeliveries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "payment_webhook_deliveries_total",
+		Help: "Webhook delivery attempts, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+var (
+	webhookDispatchInterval = loadDuration("WEBHOOK_DISPATCH_INTERVAL", time.Second)
+	webhookTimeout          = loadDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	webhookRetryBackoff     = loadDuration("WEBHOOK_RETRY_BACKOFF", 30*time.Second)
+	webhookMaxAttempts      = loadPositiveInt("WEBHOOK_MAX_ATTEMPTS", 8)
+	// webhookDisableAfter consecutive failed attempts disable a
+	// subscription until it is re-enabled through PUT /webhooks/{id}.
+	webhookDisableAfter = loadPositiveInt("WEBHOOK_DISABLE_AFTER", 20)
+	// webhookAllowPrivate lets subscriptions target loopback and private
+	// addresses, e.g. a receiver on the compose network. Off by default so
+	// a subscription can't be used to reach internal hosts.
+	webhookAllowPrivate = loadBool("WEBHOOK_ALLOW_PRIVATE_TARGETS", false)
+	webhookClient       = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: checkWebhookDial}).DialContext,
+		},
+	}
+)
+
+const (
+	webhookDispatchBatch = 20
+	maxWebhookBackoff    = time.Hour
+)
+
+// webhookEventTypes are the events subscriptions can receive.
+// payment_failed is a payment_processed event for a declined payment.
+var webhookEventTypes = map[string]bool{
+	"payment_processed": true,
+	"payment_failed":    true,
+	"payment_refunded":  true,
+}
+
+// WebhookSubscription is an external endpoint that receives payment
+// events. Secret is only returned when the subscription is created.
+type WebhookSubscription struct {
+	ID                  int        `json:"id"`
+	URL                 string     `json:"url"`
+	Secret              string     `json:"secret,omitempty"`
+	EventTypes          []string   `json:"event_types"`
+	Active              bool       `json:"active"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one subscription.
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int        `json:"subscription_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode *int       `json:"last_status_code"`
+	LastError      *string    `json:"last_error"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+const subscriptionColumns = "id, url, event_types, active, consecutive_failures, disabled_at, created_at"
+
+func scanSubscription(row interface{ Scan(...interface{}) error }, s *WebhookSubscription) error {
+	var eventTypes pq.StringArray
+	err := row.Scan(&s.ID, &s.URL, &eventTypes, &s.Active, &s.ConsecutiveFailures, &s.DisabledAt, &s.CreatedAt)
+	s.EventTypes = []string(eventTypes)
+	if s.EventTypes == nil {
+		s.EventTypes = []string{}
+	}
+	return err
+}
+
+// webhookEventType names a payment event as webhooks see it.
+func webhookEventType(eventType string, payload []byte) string {
+	if eventType != "payment_processed" {
+		return eventType
+	}
+	var event struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(payload, &event) == nil && event.Status == "failed" {
+		return "payment_failed"
+	}
+	return eventType
+}
+
+// queueWebhooks creates a delivery of a relayed outbox event for every
+// active subscription that wants it. It runs in the relay transaction, so
+// an event is queued once however often the relay retries Kafka.
+func queueWebhooks(ctx context.Context, tx *sql.Tx, eventType string, payload []byte) error {
+	hookType := webhookEventType(eventType, payload)
+	if !webhookEventTypes[hookType] {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries (subscription_id, event_type, payload)
+		SELECT id, $1, $2 FROM webhook_subscriptions
+		WHERE active AND (cardinality(event_types) = 0 OR $1 = ANY(event_types))`,
+		hookType, payload)
+	return err
+}
+
+// signWebhook computes the X-Webhook-Signature for a delivery: an
+// HMAC-SHA256 of "<timestamp>.<body>" keyed by the subscription secret.
+// Including the timestamp lets receivers reject replays.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the wait before retrying after the given number of
+// failed attempts.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookRetryBackoff
+	for i := 1; i < attempts && backoff < maxWebhookBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWebhookBackoff {
+		backoff = maxWebhookBackoff
+	}
+	return backoff
+}
+
+// postWebhook sends one delivery and returns the response status code, if
+// there was a response.
+func postWebhook(ctx context.Context, target, secret string, deliveryID int64, eventType string, payload []byte) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":         deliveryID,
+		"event_type": eventType,
+		"data":       json.RawMessage(payload),
+	})
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// dueWebhook is a delivery claimed for sending.
+type dueWebhook struct {
+	id             int64
+	eventType      string
+	payload        []byte
+	attempts       int
+	subscriptionID int
+	url, secret    string
+}
+
+// claimWebhooks takes up to webhookDispatchBatch due deliveries by
+// pushing their next_attempt_at past the send timeout, so other replicas
+// skip them while they are sent without holding any locks. A claim that
+// is never recorded, e.g. because the replica died, comes due again once
+// it lapses.
+func claimWebhooks(ctx context.Context) ([]dueWebhook, error) {
+	rows, err := db.QueryContext(ctx,
+		`UPDATE webhook_deliveries d SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+		FROM webhook_subscriptions s
+		WHERE s.id = d.subscription_id AND d.id IN (
+			SELECT dd.id FROM webhook_deliveries dd JOIN webhook_subscriptions ss ON ss.id = dd.subscription_id
+			WHERE dd.status = 'pending' AND dd.next_attempt_at <= CURRENT_TIMESTAMP AND ss.active
+			ORDER BY dd.id LIMIT $1 FOR UPDATE OF dd SKIP LOCKED)
+		RETURNING d.id, d.event_type, d.payload, d.attempts, s.id, s.url, s.secret`,
+		webhookDispatchBatch, (2 * webhookTimeout).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []dueWebhook
+	for rows.Next() {
+		var d dueWebhook
+		if err := rows.Scan(&d.id, &d.eventType, &d.payload, &d.attempts, &d.subscriptionID, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// dispatchWebhooks claims due deliveries, sends them outside any
+// transaction and records each attempt in a transaction of its own, so a
+// slow subscriber holds neither a connection nor row locks.
+func dispatchWebhooks(ctx context.Context) error {
+	deliveries, err := claimWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		code, sendErr := postWebhook(ctx, d.url, d.secret, d.id, d.eventType, d.payload)
+		if err := recordWebhookAttempt(ctx, d, code, sendErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordWebhookAttempt stores the outcome of sending d and updates its
+// subscription's failure count, disabling it after webhookDisableAfter
+// failures in a row.
+func recordWebhookAttempt(ctx context.Context, d dueWebhook, code int, sendErr error) error {
+	var statusCode *int
+	if code != 0 {
+		statusCode = &code
+	}
+	attempts := d.attempts + 1
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sendErr == nil {
+		webhookDeliveries.WithLabelValues("delivered").Inc()
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE webhook_deliveries SET status = 'delivered', attempts = $1, last_status_code = $2,
+			last_error = NULL, delivered_at = CURRENT_TIMESTAMP WHERE id = $3`,
+			attempts, statusCode, d.id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE webhook_subscriptions SET consecutive_failures = 0 WHERE id = $1", d.subscriptionID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	status := "pending"
+	if attempts >= webhookMaxAttempts {
+		status = "failed"
+	}
+	webhookDeliveries.WithLabelValues(status).Inc()
+	log.Printf("Webhook delivery %d to subscription %d failed (attempt %d): %v", d.id, d.subscriptionID, attempts, sendErr)
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET status = $1, attempts = $2, last_status_code = $3, last_error = $4,
+		next_attempt_at = CURRENT_TIMESTAMP + $5 * INTERVAL '1 second' WHERE id = $6`,
+		status, attempts, statusCode, sendErr.Error(), webhookBackoff(attempts).Seconds(), d.id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE webhook_subscriptions SET consecutive_failures = consecutive_failures + 1,
+		active = consecutive_failures + 1 < $1,
+		disabled_at = CASE WHEN consecutive_failures + 1 >= $1 THEN CURRENT_TIMESTAMP ELSE disabled_at END
+		WHERE id = $2`,
+		webhookDisableAfter, d.subscriptionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func dispatchWebhooksLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := dispatchWebhooks(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Webhook dispatch failed: %v", err)
+		}
+	}
+}
+
+// privateAddress reports whether ip is loopback, private, link-local or
+// unspecified, i.e. somewhere a webhook mustn't be sent.
+func privateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkWebhookDial refuses connections to private addresses. It runs on
+// the resolved address, so a public hostname that resolves to an internal
+// host is refused too.
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	if webhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateAddress(ip) {
+		return fmt.Errorf("webhook target %s is a private address", host)
+	}
+	return nil
+}
+
+// validateSubscription checks the fields a client can set.
+func validateSubscription(s *WebhookSubscription) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if !webhookAllowPrivate {
+		host := u.Hostname()
+		if ip := net.ParseIP(host); strings.EqualFold(host, "localhost") || (ip != nil && privateAddress(ip)) {
+			return fmt.Errorf("url must not target a loopback or private address")
+		}
+	}
+	if s.EventTypes == nil {
+		s.EventTypes = []string{}
+	}
+	for _, t := range s.EventTypes {
+		if !webhookEventTypes[t] {
+			return fmt.Errorf("unknown event type %q: must be payment_processed, payment_failed or payment_refunded", t)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createWebhook registers a subscription. An empty event_types receives
+// every event. The secret is generated unless one is given, and is only
+// returned here.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var s WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateSubscription(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret := s.Secret
+	if secret == "" {
+		var err error
+		if secret, err = newWebhookSecret(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := scanSubscription(db.QueryRowContext(r.Context(),
+		"INSERT INTO webhook_subscriptions (url, secret, event_types) VALUES ($1, $2, $3) RETURNING "+subscriptionColumns,
+		s.URL, secret, pq.Array(s.EventTypes)), &s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Secret = secret
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT "+subscriptionColumns+" FROM webhook_subscriptions ORDER BY id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var s WebhookSubscription
+		if err := scanSubscription(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		subs = append(subs, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	var s WebhookSubscription
+	err := scanSubscription(db.QueryRowContext(r.Context(),
+		"SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE id = $1", mux.Vars(r)["id"]), &s)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// updateWebhook replaces a subscription's url, event types and active
+// flag. Re-activating a subscription clears its failure count.
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	var s WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateSubscription(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := scanSubscription(db.QueryRowContext(r.Context(),
+		`UPDATE webhook_subscriptions SET url = $1, event_types = $2, active = $3,
+		consecutive_failures = CASE WHEN $3 AND NOT active THEN 0 ELSE consecutive_failures END,
+		disabled_at = CASE WHEN $3 THEN NULL ELSE COALESCE(disabled_at, CURRENT_TIMESTAMP) END
+		WHERE id = $4 RETURNING `+subscriptionColumns,
+		s.URL, pq.Array(s.EventTypes), s.Active, mux.Vars(r)["id"]), &s)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM webhook_subscriptions WHERE id = $1", mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const deliveryColumns = "id, subscription_id, event_type, status, attempts, last_status_code, last_error, next_attempt_at, created_at, delivered_at"
+
+func scanDelivery(row interface{ Scan(...interface{}) error }, d *WebhookDelivery) error {
+	return row.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Status, &d.Attempts,
+		&d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt)
+}
+
+// getWebhookDeliveries lists a subscription's most recent deliveries and
+// their attempts.
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var exists bool
+	if err := db.QueryRowContext(r.Context(),
+		"SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1)", id).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY id DESC LIMIT 100", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanDelivery(rows, &d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhook queues a delivery to be sent again on the next
+// dispatch, whatever its state. Its attempt count is kept.
+func redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	var d WebhookDelivery
+	err := scanDelivery(db.QueryRowContext(r.Context(),
+		`UPDATE webhook_deliveries SET status = 'pending', next_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = $1 RETURNING `+deliveryColumns, mux.Vars(r)["id"]), &d)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhook("secret", 1700000000, body); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	old := webhookRetryBackoff
+	webhookRetryBackoff = 30 * time.Second
+	t.Cleanup(func() { webhookRetryBackoff = old })
+
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 20: time.Hour} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("attempt %d: expected %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+// withPrivateWebhooks lets webhooks reach the loopback test servers.
+func withPrivateWebhooks(t *testing.T) {
+	t.Helper()
+	old := webhookAllowPrivate
+	webhookAllowPrivate = true
+	t.Cleanup(func() { webhookAllowPrivate = old })
+}
+
+func TestDispatchWebhooks(t *testing.T) {
+	mock := withMockDB(t)
+	withPrivateWebhooks(t)
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if r.Header.Get("X-Webhook-Signature") != signWebhook("s1", ts, body) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		if r.Header.Get("X-Webhook-Event") != "payment_processed" || r.Header.Get("X-Webhook-Delivery") != "10" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if !strings.Contains(string(body), `"data":{"payment_id":1}`) {
+			t.Errorf("expected the event as data, got %s", body)
+		}
+	}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	// The claim commits on its own; each attempt is then recorded in a
+	// transaction of its own.
+	mock.ExpectQuery("UPDATE webhook_deliveries d SET next_attempt_at (.+) FOR UPDATE OF dd SKIP LOCKED\\) RETURNING").
+		WithArgs(webhookDispatchBatch, (2 * webhookTimeout).Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "payload", "attempts", "sid", "url", "secret"}).
+			AddRow(10, "payment_processed", []byte(`{"payment_id":1}`), 0, 1, ok.URL, "s1").
+			AddRow(11, "payment_refunded", []byte(`{"refund_id":1}`), 2, 2, broken.URL, "s2"))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = 'delivered'").
+		WithArgs(1, 200, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE webhook_subscriptions SET consecutive_failures = 0").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1").
+		WithArgs("pending", 3, 500, sqlmock.AnyArg(), webhookBackoff(3).Seconds(), 11).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE webhook_subscriptions SET consecutive_failures = consecutive_failures \\+ 1").
+		WithArgs(webhookDisableAfter, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := dispatchWebhooks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateWebhookValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "relative url", body: `{"url":"/hook"}`},
+		{name: "unsupported scheme", body: `{"url":"ftp://erp.example.com/hook"}`},
+		{name: "unknown event type", body: `{"url":"https://erp.example.com/hook","event_types":["order_created"]}`},
+		{name: "localhost", body: `{"url":"http://localhost:8084/hook"}`},
+		{name: "loopback", body: `{"url":"http://127.0.0.1/hook"}`},
+		{name: "private", body: `{"url":"https://10.0.0.5/hook"}`},
+		{name: "link-local", body: `{"url":"http://169.254.169.254/latest/meta-data"}`},
+		{name: "ipv6 loopback", body: `{"url":"http://[::1]/hook"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockDB(t)
+			w := httptest.NewRecorder()
+			createWebhook(w, httptest.NewRequest("POST", "/webhooks", strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestPostWebhookRefusesPrivateAddresses(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer srv.Close()
+
+	if _, err := postWebhook(context.Background(), srv.URL, "s", 1, "payment_processed", []byte(`{}`)); err == nil || called {
+		t.Errorf("expected the loopback target to be refused, got err %v, called %v", err, called)
+	}
+}
+
+func TestWebhooksRequireAdminKey(t *testing.T) {
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/webhooks"},
+		{"GET", "/webhooks"},
+		{"GET", "/webhooks/1"},
+		{"PUT", "/webhooks/1"},
+		{"DELETE", "/webhooks/1"},
+		{"GET", "/webhooks/1/deliveries"},
+		{"POST", "/webhooks/deliveries/1/redeliver"},
+	} {
+		expectAdminOnly(t, route.method, route.path)
+	}
+}
+
+func TestCreateWebhookGeneratesSecret(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("INSERT INTO webhook_subscriptions").
+		WithArgs("https://erp.example.com/hook", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "event_types", "active", "consecutive_failures", "disabled_at", "created_at"}).
+			AddRow(1, "https://erp.example.com/hook", "{payment_refunded}", true, 0, nil, time.Now()))
+
+	w := httptest.NewRecorder()
+	createWebhook(w, httptest.NewRequest("POST", "/webhooks",
+		strings.NewReader(`{"url":"https://erp.example.com/hook","event_types":["payment_refunded"]}`)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"secret":"`) || !strings.Contains(w.Body.String(), `"event_types":["payment_refunded"]`) {
+		t.Errorf("expected a generated secret and the event types, got %s", w.Body.String())
+	}
+}
+
+func TestRedeliverWebhookNotFound(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("UPDATE webhook_deliveries SET status = 'pending'").
+		WithArgs("99").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/webhooks/deliveries/{id:[0-9]+}/redeliver", redeliverWebhook).Methods("POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/webhooks/deliveries/99/redeliver", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
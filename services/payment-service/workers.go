@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	workerQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "payment_worker_queue_depth",
+			Help: "order-events messages waiting for a payment worker, by worker",
+		},
+		[]string{"worker"},
+	)
+	workerBusySeconds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "payment_worker_busy_seconds_total",
+			Help: "Time payment workers spent handling messages, by worker; its rate is the worker's utilization",
+		},
+		[]string{"worker"},
+	)
+)
+
+var (
+	// paymentWorkers is how many messages are handled at once.
+	paymentWorkers = loadPositiveInt("PAYMENT_WORKERS", 8)
+	// workerQueueSize is how many fetched messages each worker buffers
+	// before fetching blocks.
+	workerQueueSize = loadPositiveInt("PAYMENT_WORKER_QUEUE", 16)
+)
+
+// workerPool handles order-events messages concurrently. Every message
+// for an order goes to the same worker, so an order's events are still
+// handled in the order they were published.
+type workerPool struct {
+	queues  []chan kafka.Message
+	commits *commitTracker
+	wg      sync.WaitGroup
+}
+
+// newWorkerPool starts n workers. Each message is handled as in
+// consumeMessage and committed through a commitTracker on reader.
+func newWorkerPool(ctx context.Context, reader messageFetcher, n, queueSize int) *workerPool {
+	p := &workerPool{
+		queues:  make([]chan kafka.Message, n),
+		commits: newCommitTracker(reader),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan kafka.Message, queueSize)
+		p.wg.Add(1)
+		go p.work(ctx, i)
+	}
+	return p
+}
+
+// dispatch queues msg for its order's worker, blocking while that
+// worker's queue is full.
+func (p *workerPool) dispatch(msg kafka.Message) {
+	worker := workerFor(msg, len(p.queues))
+	p.commits.track(msg)
+	workerQueueDepth.WithLabelValues(strconv.Itoa(worker)).Inc()
+	p.queues[worker] <- msg
+}
+
+// close stops the workers once they have emptied their queues.
+func (p *workerPool) close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+func (p *workerPool) work(ctx context.Context, worker int) {
+	defer p.wg.Done()
+	label := strconv.Itoa(worker)
+	for msg := range p.queues[worker] {
+		workerQueueDepth.WithLabelValues(label).Dec()
+		start := time.Now()
+		handled := consumeMessage(ctx, msg)
+		workerBusySeconds.WithLabelValues(label).Add(time.Since(start).Seconds())
+		if handled {
+			p.commits.done(msg)
+		}
+	}
+}
+
+// workerFor picks msg's worker from its order_id. Messages without one,
+// which are malformed and only go to the DLQ, are spread by offset.
+func workerFor(msg kafka.Message, n int) int {
+	var event struct {
+		OrderID json.Number `json:"order_id"`
+	}
+	key := strconv.FormatInt(msg.Offset, 10)
+	if json.Unmarshal(msg.Value, &event) == nil && event.OrderID != "" {
+		key = event.OrderID.String()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// commitTracker commits offsets only once every message before them on
+// the partition has been handled. Committing an offset commits all
+// earlier ones, so a later message finishing first mustn't commit one
+// still in progress.
+type commitTracker struct {
+	reader messageFetcher
+
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+// partitionOffsets holds a partition's messages that are fetched but not
+// yet committed, in offset order.
+type partitionOffsets struct {
+	mu      sync.Mutex
+	pending []kafka.Message
+	handled map[int64]bool
+}
+
+func newCommitTracker(reader messageFetcher) *commitTracker {
+	return &commitTracker{reader: reader, partitions: make(map[int]*partitionOffsets)}
+}
+
+func (t *commitTracker) partition(n int) *partitionOffsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	po, ok := t.partitions[n]
+	if !ok {
+		po = &partitionOffsets{handled: make(map[int64]bool)}
+		t.partitions[n] = po
+	}
+	return po
+}
+
+// track records that msg has been fetched. Messages must be tracked in
+// the order they were fetched.
+func (t *commitTracker) track(msg kafka.Message) {
+	po := t.partition(msg.Partition)
+	po.mu.Lock()
+	po.pending = append(po.pending, msg)
+	po.mu.Unlock()
+}
+
+// done records that msg has been handled and commits the partition up to
+// its oldest message still in progress. The partition stays locked while
+// committing so commits can't land out of order.
+func (t *commitTracker) done(msg kafka.Message) {
+	po := t.partition(msg.Partition)
+	po.mu.Lock()
+	defer po.mu.Unlock()
+
+	po.handled[msg.Offset] = true
+	var last *kafka.Message
+	for len(po.pending) > 0 && po.handled[po.pending[0].Offset] {
+		delete(po.handled, po.pending[0].Offset)
+		last = &po.pending[0]
+		po.pending = po.pending[1:]
+	}
+	if last == nil {
+		return
+	}
+
+	// The consumer's ctx may already be cancelled by a shutdown waiting
+	// on this message.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.reader.CommitMessages(ctx, *last); err != nil {
+		messageLogger(*last).Error("failed to commit offset", "error", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestCommitTrackerWaitsForEarlierOffsets(t *testing.T) {
+	fetcher := &fakeFetcher{}
+	tracker := newCommitTracker(fetcher)
+	msgs := []kafka.Message{
+		{Partition: 0, Offset: 1},
+		{Partition: 0, Offset: 2},
+		{Partition: 1, Offset: 7},
+		{Partition: 0, Offset: 3},
+	}
+	for _, msg := range msgs {
+		tracker.track(msg)
+	}
+
+	steps := []struct {
+		done kafka.Message
+		want []int64
+	}{
+		// Offset 2 finishing first mustn't commit offset 1 with it.
+		{done: msgs[1], want: nil},
+		{done: msgs[2], want: []int64{7}},
+		{done: msgs[0], want: []int64{7, 2}},
+		{done: msgs[3], want: []int64{7, 2, 3}},
+	}
+	for _, step := range steps {
+		tracker.done(step.done)
+		var got []int64
+		for _, c := range fetcher.committed {
+			got = append(got, c.Offset)
+		}
+		if len(got) != len(step.want) {
+			t.Fatalf("after offset %d: expected commits %v, got %v", step.done.Offset, step.want, got)
+		}
+		for i := range got {
+			if got[i] != step.want[i] {
+				t.Fatalf("after offset %d: expected commits %v, got %v", step.done.Offset, step.want, got)
+			}
+		}
+	}
+}
+
+func TestWorkerForKeepsAnOrderOnOneWorker(t *testing.T) {
+	first := orderCreatedMessage(42, 19.99)
+	first.Offset = 1
+	second := kafka.Message{Offset: 9, Value: []byte(`{"event_type":"order_status_changed","order_id":42}`)}
+
+	for n := 1; n <= 16; n++ {
+		a, b := workerFor(first, n), workerFor(second, n)
+		if a != b {
+			t.Fatalf("with %d workers, order 42's events went to workers %d and %d", n, a, b)
+		}
+		if a < 0 || a >= n {
+			t.Fatalf("with %d workers, got worker %d", n, a)
+		}
+	}
+}
+
+// barrierGateway holds each authorization until n are in progress at
+// once, so it only succeeds when charges run concurrently.
+type barrierGateway struct {
+	mockGateway
+	mu      sync.Mutex
+	waiting int
+	n       int
+	release chan struct{}
+}
+
+func (g *barrierGateway) Authorize(ctx context.Context, orderID int, amount float64, idempotencyKey string) (string, error) {
+	g.mu.Lock()
+	g.waiting++
+	if g.waiting == g.n {
+		close(g.release)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-g.release:
+		return g.mockGateway.Authorize(ctx, orderID, amount, idempotencyKey)
+	case <-time.After(time.Second):
+		return "", errors.New("charges were not run concurrently")
+	}
+}
+
+func TestConsumeMessagesChargesOrdersConcurrently(t *testing.T) {
+	mock := withMockDB(t)
+	mock.MatchExpectationsInOrder(false)
+	withFastRetries(t, 1)
+	capturePublishedEvents(t)
+	withGateway(t, &barrierGateway{n: 4, release: make(chan struct{})})
+
+	oldWorkers := paymentWorkers
+	paymentWorkers = 4
+	t.Cleanup(func() { paymentWorkers = oldWorkers })
+
+	var msgs []kafka.Message
+	// Order IDs that hash to different workers out of 4.
+	for _, orderID := range []int{1, 2, 3, 4} {
+		msg := orderCreatedMessage(orderID, 10)
+		msg.Offset = int64(orderID)
+		msgs = append(msgs, msg)
+
+		expectOrderPaid(mock, orderID, false)
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO payments").
+			WithArgs(orderID, 10.0, "captured", sqlmock.AnyArg(), "card", "USD").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(orderID, time.Now()))
+		mock.ExpectExec("INSERT INTO payment_events").
+			WithArgs(orderID, "", "authorized").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO payment_events").
+			WithArgs(orderID, "authorized", "captured").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO event_outbox").
+			WithArgs("payment_processed", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+
+	committed := runConsumer(t, 2*time.Second, msgs...)
+
+	if len(committed) == 0 || committed[len(committed)-1].Offset != 4 {
+		t.Fatalf("expected every message to be committed, got %v", committed)
+	}
+}